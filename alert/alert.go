@@ -0,0 +1,394 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/http_requests"
+	"monitoring_system/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 告警类型，对应 config.yaml 中 webhooks[].events
+const (
+	KindBadLineEnter   = "bad_line_enter"  // 城市写入 bad_line
+	KindBadLineLeave   = "bad_line_leave"  // 城市从 bad_line 删除
+	KindGoodLineEnter  = "good_line_enter" // 城市写入 good_line
+	KindGoodLineLeave  = "good_line_leave" // 城市从 good_line 删除
+	KindProbeFailing   = "probe_failing"   // 城市在 failure_window 内的检测全部失败
+	KindProbeRecovered = "probe_recovered" // 持续失败的城市重新检测成功
+)
+
+// Kinds 全部告警类型
+var Kinds = []string{KindBadLineEnter, KindBadLineLeave, KindGoodLineEnter, KindGoodLineLeave, KindProbeFailing, KindProbeRecovered}
+
+// 告警标题
+var titles = map[string]string{
+	KindBadLineEnter:   "城市进入 bad_line",
+	KindBadLineLeave:   "城市移出 bad_line",
+	KindGoodLineEnter:  "城市进入 good_line",
+	KindGoodLineLeave:  "城市移出 good_line",
+	KindProbeFailing:   "城市持续检测失败",
+	KindProbeRecovered: "城市检测恢复",
+}
+
+const (
+	defaultPollInterval    = 10 * time.Second // 未配置 poll_interval 时的默认值
+	defaultDedupWindow     = 30 * time.Minute // 未配置 dedup_window 时的默认值
+	defaultFailureWindow   = 30 * time.Minute // 未配置 failure_window 时的默认值
+	defaultFailureMinTests = 3                // 未配置 failure_min_tests 时的默认值
+	defaultMinSpeed        = 3.0              // 未配置 bad_line_min_speed 时判定失败的下载速率
+	lineEventBatch         = 500              // 每次读取的变更记录条数
+)
+
+// 告警推送结果
+var alertsTotal = metrics.NewCounterVec("monitoring_alerts_total",
+	"告警推送次数。标签 webhook: webhook 名称；kind: 告警类型，如 bad_line_enter、probe_failing；result: sent、failed、deduplicated（去重窗口内已发送）或 quiet（免打扰时段）",
+	"webhook", "kind", "result")
+
+// Event 一条告警
+type Event struct {
+	Kind       string             `json:"kind"`
+	Title      string             `json:"title"`
+	Time       time.Time          `json:"time"`
+	CityID     int                `json:"city_id"`
+	CityName   string             `json:"city_name"`
+	OutboundIP string             `json:"outbound_ip,omitempty"`
+	Reason     string             `json:"reason"`
+	Source     string             `json:"source,omitempty"` // 触发变更的组件，持续失败告警为空
+	TradeID    int                `json:"trade_id,omitempty"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+	Thresholds map[string]float64 `json:"thresholds,omitempty"`
+}
+
+// key 去重使用的键，同一城市的同类告警视为重复
+func (e Event) key() string {
+	return fmt.Sprintf("%s/%d", e.Kind, e.CityID)
+}
+
+// fromLineEvent 将 good_line、bad_line 的变更记录转换为告警，bad_ips 的变更不告警
+func fromLineEvent(e database.LineEvent) []Event {
+	var kinds []string
+	switch e.FromState {
+	case database.LineStateGoodLine:
+		kinds = append(kinds, KindGoodLineLeave)
+	case database.LineStateBadLine:
+		kinds = append(kinds, KindBadLineLeave)
+	}
+	switch e.ToState {
+	case database.LineStateGoodLine:
+		kinds = append(kinds, KindGoodLineEnter)
+	case database.LineStateBadLine:
+		kinds = append(kinds, KindBadLineEnter)
+	}
+
+	events := make([]Event, 0, len(kinds))
+	for _, kind := range kinds {
+		events = append(events, Event{
+			Kind:       kind,
+			Title:      titles[kind],
+			Time:       e.Time,
+			CityID:     e.CityID,
+			CityName:   e.CityName,
+			OutboundIP: e.OutboundIP,
+			Reason:     e.Reason,
+			Source:     e.Source,
+			TradeID:    e.TradeID,
+			Metrics:    e.Metrics,
+			Thresholds: e.Thresholds,
+		})
+	}
+	return events
+}
+
+// Notifier 定期读取新的 line_events 和检测结果，生成告警并推送到配置的 webhook
+type Notifier struct {
+	DB              database.Store
+	Webhooks        []*Webhook
+	PollInterval    time.Duration
+	DedupWindow     time.Duration
+	Quiet           QuietHours
+	FailureWindow   time.Duration
+	FailureMinTests int
+	MinSpeed        float64
+
+	lastEventID int64
+	failing     map[int]bool         // 持续检测失败的城市
+	sent        map[string]time.Time // 去重键到最近一次发送时间
+	started     bool
+}
+
+// NewNotifier 根据配置创建告警推送，未配置 webhook 时返回 nil
+func NewNotifier(db database.Store, config *config.Config) (*Notifier, error) {
+	cfg := config.Alerting
+	if len(cfg.Webhooks) == 0 {
+		return nil, nil
+	}
+	quiet, err := ParseQuietHours(cfg.QuietHours)
+	if err != nil {
+		return nil, err
+	}
+	n := &Notifier{
+		DB:              db,
+		PollInterval:    cfg.PollInterval,
+		DedupWindow:     cfg.DedupWindow,
+		Quiet:           quiet,
+		FailureWindow:   cfg.FailureWindow,
+		FailureMinTests: cfg.FailureMinTests,
+		MinSpeed:        config.Checker.BadLineMinSpeed,
+		failing:         make(map[int]bool),
+		sent:            make(map[string]time.Time),
+	}
+	retry := http_requests.NewRetry(cfg.Retry)
+	for _, webhookCFG := range cfg.Webhooks {
+		webhook, err := NewWebhook(webhookCFG, retry)
+		if err != nil {
+			return nil, err
+		}
+		n.Webhooks = append(n.Webhooks, webhook)
+	}
+	if n.PollInterval <= 0 {
+		n.PollInterval = defaultPollInterval
+	}
+	if n.DedupWindow <= 0 {
+		n.DedupWindow = defaultDedupWindow
+	}
+	if n.FailureWindow <= 0 {
+		n.FailureWindow = defaultFailureWindow
+	}
+	if n.FailureMinTests <= 0 {
+		n.FailureMinTests = defaultFailureMinTests
+	}
+	if n.MinSpeed <= 0 {
+		n.MinSpeed = defaultMinSpeed
+	}
+	return n, nil
+}
+
+// Run 每隔 PollInterval 检查一次，ctx 取消时退出。
+// 第一次检查只记录当前的变更记录位置和持续失败的城市，不为启动前已发生的变化告警
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		if err := n.Poll(ctx, time.Now()); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"Error": err,
+			}).Error("【告警】检查线路变化出错")
+		}
+		select {
+		case <-time.After(n.PollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Poll 读取上次检查之后的变更记录和 now 之前 FailureWindow 内的检测结果，推送产生的告警
+func (n *Notifier) Poll(ctx context.Context, now time.Time) error {
+	if !n.started {
+		latest, err := n.DB.LineEvents(database.LineEventQuery{Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(latest) > 0 {
+			n.lastEventID = latest[0].ID
+		}
+		if _, err := n.failureEvents(now); err != nil {
+			return err
+		}
+		n.started = true
+		return nil
+	}
+
+	var events []Event
+	for {
+		lineEvents, err := n.DB.LineEvents(database.LineEventQuery{AfterID: n.lastEventID, Limit: lineEventBatch})
+		if err != nil {
+			return err
+		}
+		for _, e := range lineEvents {
+			events = append(events, fromLineEvent(e)...)
+			n.lastEventID = e.ID
+		}
+		if len(lineEvents) < lineEventBatch {
+			break
+		}
+	}
+	failureEvents, err := n.failureEvents(now)
+	if err != nil {
+		return err
+	}
+	events = append(events, failureEvents...)
+
+	for _, event := range events {
+		if ctx.Err() != nil {
+			return nil
+		}
+		n.Notify(ctx, event, now)
+	}
+	n.expireSent(now)
+	return nil
+}
+
+// failureEvents 根据 FailureWindow 内的检测结果更新持续失败的城市，返回新增和恢复的告警。
+// 窗口内没有检测结果的城市保持原状态
+func (n *Notifier) failureEvents(now time.Time) ([]Event, error) {
+	stats, err := n.DB.CityFailureStats(now.Add(-n.FailureWindow), n.MinSpeed)
+	if err != nil {
+		return nil, err
+	}
+	thresholds := map[string]float64{
+		"failure_min_tests":  float64(n.FailureMinTests),
+		"failure_window_min": n.FailureWindow.Minutes(),
+		"bad_line_min_speed": n.MinSpeed,
+	}
+	var events []Event
+	for _, stat := range stats {
+		failing := stat.Tests >= n.FailureMinTests && stat.Failures == stat.Tests
+		if failing == n.failing[stat.CityID] {
+			continue
+		}
+		// 恢复需要窗口内至少有一次成功的检测，检测次数不足时保持失败状态
+		if !failing && stat.Failures == stat.Tests {
+			continue
+		}
+		if failing {
+			n.failing[stat.CityID] = true
+		} else {
+			delete(n.failing, stat.CityID)
+		}
+
+		kind, reason := KindProbeFailing, fmt.Sprintf("最近 %s 内 %d 次检测全部失败", n.FailureWindow, stat.Tests)
+		if !failing {
+			kind, reason = KindProbeRecovered, fmt.Sprintf("最近 %s 内 %d 次检测中 %d 次成功", n.FailureWindow, stat.Tests, stat.Tests-stat.Failures)
+		}
+		events = append(events, Event{
+			Kind:       kind,
+			Title:      titles[kind],
+			Time:       stat.LastTest,
+			CityID:     stat.CityID,
+			CityName:   stat.CityName,
+			Reason:     reason,
+			Metrics:    map[string]float64{"tests": float64(stat.Tests), "failures": float64(stat.Failures)},
+			Thresholds: thresholds,
+		})
+	}
+	return events, nil
+}
+
+// Notify 将告警推送到订阅了该类型的 webhook，免打扰时段内和去重窗口内的告警不发送
+func (n *Notifier) Notify(ctx context.Context, event Event, now time.Time) {
+	fields := logrus.Fields{
+		"Kind":     event.Kind,
+		"CityID":   event.CityID,
+		"CityName": event.CityName,
+		"Reason":   event.Reason,
+	}
+	quiet := n.Quiet.Contains(now)
+	last, duplicated := n.sent[event.key()]
+	duplicated = duplicated && now.Sub(last) < n.DedupWindow
+
+	delivered := false
+	for _, webhook := range n.Webhooks {
+		if !webhook.Subscribed(event.Kind) {
+			continue
+		}
+		switch {
+		case quiet:
+			alertsTotal.Inc(webhook.Name, event.Kind, "quiet")
+		case duplicated:
+			alertsTotal.Inc(webhook.Name, event.Kind, "deduplicated")
+		default:
+			if err := webhook.Send(ctx, event); err != nil {
+				alertsTotal.Inc(webhook.Name, event.Kind, "failed")
+				logrus.WithFields(fields).WithFields(logrus.Fields{
+					"Webhook": webhook.Name,
+					"Error":   err,
+				}).Error("【告警】推送失败")
+				continue
+			}
+			alertsTotal.Inc(webhook.Name, event.Kind, "sent")
+			delivered = true
+		}
+	}
+
+	switch {
+	case quiet:
+		logrus.WithFields(fields).Warn("【告警】免打扰时段，不发送告警")
+	case duplicated:
+		logrus.WithFields(fields).Info("【告警】去重窗口内已发送过同类告警，不重复发送")
+	case delivered:
+		n.sent[event.key()] = now
+		logrus.WithFields(fields).Warn("【告警】已推送")
+	}
+}
+
+// expireSent 清理超过去重窗口的发送记录
+func (n *Notifier) expireSent(now time.Time) {
+	for key, last := range n.sent {
+		if now.Sub(last) >= n.DedupWindow {
+			delete(n.sent, key)
+		}
+	}
+}
+
+// QuietHours 每天的免打扰时段，Start 晚于 End 时跨过零点
+type QuietHours struct {
+	Start, End time.Duration // 距零点的时间
+	Enabled    bool
+	Location   *time.Location
+}
+
+// ParseQuietHours 解析 "23:00-08:00" 形式的免打扰时段（东八区），为空时不启用
+func ParseQuietHours(s string) (QuietHours, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return QuietHours{}, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return QuietHours{}, fmt.Errorf("无效的免打扰时段 %q，格式应为 HH:MM-HH:MM", s)
+	}
+	var q QuietHours
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return QuietHours{}, fmt.Errorf("无效的免打扰时段 %q，格式应为 HH:MM-HH:MM", s)
+		}
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			q.Start = d
+		} else {
+			q.End = d
+		}
+	}
+	q.Enabled = q.Start != q.End
+	q.Location = displayLocation()
+	return q, nil
+}
+
+// Contains 判断 t 是否处于免打扰时段
+func (q QuietHours) Contains(t time.Time) bool {
+	if !q.Enabled {
+		return false
+	}
+	t = t.In(q.Location)
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if q.Start < q.End {
+		return d >= q.Start && d < q.End
+	}
+	return d >= q.Start || d < q.End
+}
+
+// displayLocation 免打扰时段和消息中时间使用的时区
+func displayLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
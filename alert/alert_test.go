@@ -0,0 +1,222 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+)
+
+// receiver 记录收到的告警，前 failures 次请求返回 status
+type receiver struct {
+	status   int
+	body     string
+	failures int
+
+	mutex  sync.Mutex
+	calls  int
+	events []Event
+}
+
+// start 启动接收告警的服务器，返回地址
+func (r *receiver) start(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.calls++
+		if r.calls <= r.failures {
+			w.WriteHeader(r.status)
+			w.Write([]byte(r.body))
+			return
+		}
+		var event Event
+		if err := json.NewDecoder(req.Body).Decode(&event); err == nil {
+			r.events = append(r.events, event)
+		}
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// received 返回请求次数和成功收到的告警
+func (r *receiver) received() (int, []Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.calls, append([]Event(nil), r.events...)
+}
+
+// testRetryCFG 测试使用的重试策略，缩短退避时间
+var testRetryCFG = config.RetryPolicy{MaxAttempts: ptr(3), InitialBackoff: ptr(10 * time.Millisecond), MaxBackoff: ptr(50 * time.Millisecond), Multiplier: ptr(2.0)}
+
+var testRetry = http_requests.NewRetry(testRetryCFG)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// newTestNotifier 创建推送到 url 的 json 类型告警
+func newTestNotifier(t *testing.T, url, quietHours string) *Notifier {
+	t.Helper()
+	n, err := NewNotifier(nil, &config.Config{Alerting: config.AlertingCFG{
+		DedupWindow: 10 * time.Minute,
+		QuietHours:  quietHours,
+		Retry:       testRetryCFG,
+		Webhooks:    []config.WebhookCFG{{Name: "test", Type: TypeJSON, URL: url}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func testEvent(cityID int) Event {
+	return Event{Kind: KindBadLineEnter, Title: titles[KindBadLineEnter], CityID: cityID, CityName: "南京市电信", Reason: "速率过低"}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      string
+		status   int
+		body     string
+		failures int
+		calls    int // 期望的请求次数
+		wantErr  bool
+	}{
+		{"5xx_recovers", TypeJSON, http.StatusServiceUnavailable, "", 2, 3, false},
+		{"5xx_exhausted", TypeJSON, http.StatusBadGateway, "", 5, 3, true},
+		{"429_retried", TypeJSON, http.StatusTooManyRequests, "", 1, 2, false},
+		{"4xx_not_retried", TypeJSON, http.StatusBadRequest, "", 5, 1, true},
+		// 机器人接口返回 HTTP 200 但 errcode 不为 0 时同样重试
+		{"errcode_retried", TypeDingTalk, http.StatusOK, `{"errcode":130101,"errmsg":"send too fast"}`, 1, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &receiver{status: tt.status, body: tt.body, failures: tt.failures}
+			webhook, err := NewWebhook(config.WebhookCFG{Type: tt.typ, URL: r.start(t)}, testRetry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = webhook.Send(context.Background(), testEvent(101))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("推送结果为 %v，期望出错: %v", err, tt.wantErr)
+			}
+			if calls, _ := r.received(); calls != tt.calls {
+				t.Fatalf("请求 %d 次，期望 %d 次", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestNotifyDedup(t *testing.T) {
+	r := &receiver{}
+	n := newTestNotifier(t, r.start(t), "")
+	start := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		offset time.Duration
+		cityID int
+		calls  int // 操作后累计的请求次数
+	}{
+		{0, 101, 1},
+		// 去重窗口内同一城市的同类告警不再发送，其他城市不受影响
+		{5 * time.Minute, 101, 1},
+		{5 * time.Minute, 102, 2},
+		{10*time.Minute - time.Second, 101, 2},
+		// 去重窗口结束后再次发送
+		{10 * time.Minute, 101, 3},
+	}
+	for i, step := range steps {
+		n.Notify(context.Background(), testEvent(step.cityID), start.Add(step.offset))
+		if calls, _ := r.received(); calls != step.calls {
+			t.Fatalf("第 %d 步后请求 %d 次，期望 %d 次", i+1, calls, step.calls)
+		}
+	}
+	if _, events := r.received(); events[1].CityID != 102 || events[2].CityID != 101 {
+		t.Fatalf("收到的告警为 %+v", events)
+	}
+
+	// 其他类型的告警单独去重
+	leave := testEvent(101)
+	leave.Kind = KindBadLineLeave
+	n.Notify(context.Background(), leave, start.Add(10*time.Minute))
+	if calls, _ := r.received(); calls != 4 {
+		t.Fatalf("请求 %d 次，期望 bad_line_leave 单独发送", calls)
+	}
+}
+
+func TestNotifyFailureNotDeduplicated(t *testing.T) {
+	r := &receiver{status: http.StatusInternalServerError, failures: testRetry.MaxAttempts}
+	n := newTestNotifier(t, r.start(t), "")
+	now := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)
+
+	// 重试后仍失败的告警不记为已发送，下次检查时再次推送
+	n.Notify(context.Background(), testEvent(101), now)
+	n.Notify(context.Background(), testEvent(101), now.Add(time.Minute))
+	calls, events := r.received()
+	if calls != testRetry.MaxAttempts+1 || len(events) != 1 {
+		t.Fatalf("请求 %d 次，收到 %d 条告警", calls, len(events))
+	}
+}
+
+func TestNotifyQuietHours(t *testing.T) {
+	if _, err := time.LoadLocation("Asia/Shanghai"); err != nil {
+		t.Skipf("没有 Asia/Shanghai 时区数据: %v", err)
+	}
+	// 时间均为 UTC，免打扰时段按东八区计算
+	tests := []struct {
+		name  string
+		quiet string
+		hour  int // UTC 小时
+		min   int
+		sent  bool
+	}{
+		{"before_start", "23:00-08:00", 14, 59, true},    // 22:59
+		{"at_start", "23:00-08:00", 15, 0, false},        // 23:00
+		{"after_midnight", "23:00-08:00", 23, 30, false}, // 次日 07:30
+		{"at_end", "23:00-08:00", 0, 0, true},            // 08:00
+		{"same_day_inside", "12:00-14:00", 5, 0, false},  // 13:00
+		{"same_day_outside", "12:00-14:00", 12, 0, true}, // 20:00
+		// UTC 时间在时段内，东八区不在
+		{"utc_not_used", "12:00-14:00", 13, 0, true}, // 21:00
+		{"disabled", "", 15, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &receiver{}
+			n := newTestNotifier(t, r.start(t), tt.quiet)
+			now := time.Date(2024, 1, 1, tt.hour, tt.min, 0, 0, time.UTC)
+
+			n.Notify(context.Background(), testEvent(101), now)
+			if calls, _ := r.received(); (calls == 1) != tt.sent {
+				t.Fatalf("请求 %d 次，期望发送: %v", calls, tt.sent)
+			}
+		})
+	}
+
+	// 免打扰时段内的告警不记为已发送，时段结束后不被去重
+	r := &receiver{}
+	n := newTestNotifier(t, r.start(t), "23:00-08:00")
+	quiet := time.Date(2024, 1, 1, 23, 55, 0, 0, time.UTC) // 07:55
+	n.Notify(context.Background(), testEvent(101), quiet)
+	n.Notify(context.Background(), testEvent(101), quiet.Add(5*time.Minute))
+	if calls, _ := r.received(); calls != 1 {
+		t.Fatalf("免打扰结束后请求 %d 次，期望 1 次", calls)
+	}
+}
+
+func TestParseQuietHoursInvalid(t *testing.T) {
+	for _, s := range []string{"23:00", "23:00-8", "25:00-08:00", "a-b"} {
+		if _, err := ParseQuietHours(s); err == nil {
+			t.Errorf("%q 应解析失败", s)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+
+	"github.com/sirupsen/logrus"
+)
+
+// webhook 类型，对应 config.yaml 中 webhooks[].type
+const (
+	TypeJSON     = "json"     // 通用 JSON，请求体为 Event
+	TypeDingTalk = "dingtalk" // 钉钉群机器人
+	TypeWeCom    = "wecom"    // 企业微信群机器人
+	TypeFeishu   = "feishu"   // 飞书群机器人
+)
+
+const webhookTimeout = 10 * time.Second
+
+// defaultTemplate 钉钉、企业微信、飞书消息正文的内置模板
+const defaultTemplate = `【{{.Title}}】
+城市: {{.CityName}}（{{.CityID}}）
+{{- if .OutboundIP}}
+出口 IP: {{.OutboundIP}}
+{{- end}}
+原因: {{.Reason}}
+{{- range $name, $value := .Metrics}}
+{{$name}}: {{$value}}
+{{- end}}
+{{- if .Source}}
+来源: {{.Source}}{{if .TradeID}}（TradeID {{.TradeID}}）{{end}}
+{{- end}}
+时间: {{.TimeText}}`
+
+// Webhook 一个告警接收地址
+type Webhook struct {
+	Name     string
+	Type     string
+	URL      string
+	Secret   string
+	Events   map[string]bool // 为空时订阅全部
+	Template *template.Template
+	Retry    http_requests.Retry
+	Client   *http.Client
+}
+
+// NewWebhook 根据配置创建 webhook
+func NewWebhook(cfg config.WebhookCFG, retry http_requests.Retry) (*Webhook, error) {
+	switch cfg.Type {
+	case TypeJSON, TypeDingTalk, TypeWeCom, TypeFeishu:
+	default:
+		return nil, fmt.Errorf("未知的 webhook 类型: %q，可选 json、dingtalk、wecom、feishu", cfg.Type)
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook %s 未配置 url", cfg.Name)
+	}
+	w := &Webhook{
+		Name:   cfg.Name,
+		Type:   cfg.Type,
+		URL:    cfg.URL,
+		Secret: cfg.Secret,
+		Retry:  retry,
+		Client: &http.Client{Timeout: webhookTimeout},
+	}
+	if w.Name == "" {
+		w.Name = cfg.Type
+	}
+	if len(cfg.Events) > 0 {
+		w.Events = make(map[string]bool)
+		for _, kind := range cfg.Events {
+			if _, ok := titles[kind]; !ok {
+				return nil, fmt.Errorf("webhook %s 订阅了未知的告警类型: %s，可选 %s", w.Name, kind, strings.Join(Kinds, "、"))
+			}
+			w.Events[kind] = true
+		}
+	}
+	text := cfg.Template
+	if text == "" {
+		text = defaultTemplate
+	}
+	tmpl, err := template.New(w.Name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("解析 webhook %s 的模板出错: %w", w.Name, err)
+	}
+	w.Template = tmpl
+	return w, nil
+}
+
+// Subscribed 判断是否订阅了该类型的告警
+func (w *Webhook) Subscribed(kind string) bool {
+	return len(w.Events) == 0 || w.Events[kind]
+}
+
+// Send 推送告警，失败时按重试策略重试，4xx（429 除外）不重试
+func (w *Webhook) Send(ctx context.Context, event Event) error {
+	attempts := w.Retry.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var retry bool
+		if retry, err = w.send(ctx, event); err == nil || !retry || attempt == attempts {
+			break
+		}
+
+		wait := w.Retry.Backoff(attempt)
+		logrus.WithFields(logrus.Fields{
+			"Webhook": w.Name,
+			"Attempt": attempt,
+			"Wait":    wait.Round(time.Millisecond),
+			"Error":   err,
+		}).Warn("【告警】推送失败，重试中")
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// send 推送一次，返回错误是否值得重试
+func (w *Webhook) send(ctx context.Context, event Event) (bool, error) {
+	body, reqURL, err := w.payload(event)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return true, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("HTTP 状态码 %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return true, w.checkResponse(respBody)
+}
+
+// checkResponse 机器人接口返回 HTTP 200 时仍可能在响应体中返回错误码
+func (w *Webhook) checkResponse(body []byte) error {
+	var response struct {
+		ErrCode *int   `json:"errcode"` // 钉钉、企业微信
+		ErrMsg  string `json:"errmsg"`
+		Code    *int   `json:"code"` // 飞书
+		Msg     string `json:"msg"`
+	}
+	switch w.Type {
+	case TypeDingTalk, TypeWeCom:
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("解析响应出错: %w", err)
+		}
+		if response.ErrCode != nil && *response.ErrCode != 0 {
+			return fmt.Errorf("接口返回错误: 代码 %d, 消息 %s", *response.ErrCode, response.ErrMsg)
+		}
+	case TypeFeishu:
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("解析响应出错: %w", err)
+		}
+		if response.Code != nil && *response.Code != 0 {
+			return fmt.Errorf("接口返回错误: 代码 %d, 消息 %s", *response.Code, response.Msg)
+		}
+	}
+	return nil
+}
+
+// payload 生成请求体和请求地址，钉钉加签参数在地址中，飞书加签参数在请求体中
+func (w *Webhook) payload(event Event) ([]byte, string, error) {
+	if w.Type == TypeJSON {
+		body, err := json.Marshal(event)
+		return body, w.URL, err
+	}
+
+	text, err := w.render(event)
+	if err != nil {
+		return nil, "", err
+	}
+	reqURL := w.URL
+	var payload map[string]any
+	switch w.Type {
+	case TypeDingTalk:
+		payload = map[string]any{"msgtype": "text", "text": map[string]string{"content": text}}
+		if w.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+			query := url.Values{}
+			query.Set("timestamp", timestamp)
+			query.Set("sign", sign(w.Secret, timestamp+"\n"+w.Secret))
+			separator := "?"
+			if strings.Contains(reqURL, "?") {
+				separator = "&"
+			}
+			reqURL += separator + query.Encode()
+		}
+	case TypeWeCom:
+		payload = map[string]any{"msgtype": "text", "text": map[string]string{"content": text}}
+	case TypeFeishu:
+		payload = map[string]any{"msg_type": "text", "content": map[string]string{"text": text}}
+		if w.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			payload["timestamp"] = timestamp
+			payload["sign"] = sign(timestamp+"\n"+w.Secret, "")
+		}
+	}
+	body, err := json.Marshal(payload)
+	return body, reqURL, err
+}
+
+// render 使用模板生成消息正文
+func (w *Webhook) render(event Event) (string, error) {
+	data := struct {
+		Event
+		TimeText string
+	}{
+		Event:    event,
+		TimeText: event.Time.In(displayLocation()).Format("2006-01-02 15:04:05"),
+	}
+	var buf bytes.Buffer
+	if err := w.Template.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("渲染 webhook %s 的模板出错: %w", w.Name, err)
+	}
+	return buf.String(), nil
+}
+
+// sign 计算 HMAC-SHA256 签名并按 Base64 编码。
+// 钉钉以密钥为 key 对 "timestamp\nsecret" 签名，飞书以 "timestamp\nsecret" 为 key 对空串签名
+func sign(key, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"monitoring_system/config"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 角色，operator 拥有 viewer 的全部权限
+const (
+	RoleViewer   = "viewer"   // 只能查看页面和只读接口
+	RoleOperator = "operator" // 可以调用修改线路表、下载地址等的接口
+)
+
+// 认证方式，写入访问日志
+const (
+	MethodToken   = "token"   // API Token
+	MethodSession = "session" // 网页登录后的会话 Cookie
+	MethodNone    = "none"    // 未配置认证
+)
+
+const (
+	defaultSessionTTL = 12 * time.Hour
+	minTokenLength    = 16
+)
+
+// roleLevels 角色的权限等级，未知角色为 0
+var roleLevels = map[string]int{RoleViewer: 1, RoleOperator: 2}
+
+// ErrInvalidCredentials 请求携带的 Token 或会话无效
+var ErrInvalidCredentials = errors.New("凭据无效或已过期")
+
+// dummyHash 用户不存在时也做一次 bcrypt 比较，避免通过响应时间判断用户名是否存在
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("monitoring_system"), bcrypt.DefaultCost)
+
+// Allows 判断 role 是否拥有 required 角色的权限
+func Allows(role, required string) bool {
+	return roleLevels[role] > 0 && roleLevels[role] >= roleLevels[required]
+}
+
+// Principal 通过认证的调用方
+type Principal struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Method string `json:"method"`
+}
+
+// Authenticator 从请求中识别调用方。请求没有携带该方式的凭据时返回 nil, nil，凭据无效时返回 ErrInvalidCredentials
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Auth 网页服务器的认证：API Token 和用户名密码登录后的会话
+type Auth struct {
+	Authenticators []Authenticator // 按顺序尝试，第一个识别出调用方的生效
+	Sessions       *Sessions
+	CookieSecure   bool
+	users          map[string]user
+}
+
+type user struct {
+	hash []byte
+	role string
+}
+
+// New 根据配置创建认证，未配置用户和 Token 时返回 nil, nil，表示不校验身份
+func New(cfg config.AuthCFG) (*Auth, error) {
+	if len(cfg.Users) == 0 && len(cfg.Tokens) == 0 {
+		return nil, nil
+	}
+
+	tokens := &TokenAuthenticator{}
+	for i, t := range cfg.Tokens {
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("token-%d", i+1)
+		}
+		if len(t.Token) < minTokenLength {
+			return nil, fmt.Errorf("API Token %s 长度不能少于 %d 个字符", t.Name, minTokenLength)
+		}
+		if _, ok := roleLevels[t.Role]; !ok {
+			return nil, fmt.Errorf("API Token %s 的角色 %q 无效，可选 viewer、operator", t.Name, t.Role)
+		}
+		tokens.add(t.Name, t.Token, t.Role)
+	}
+
+	users := make(map[string]user)
+	for _, u := range cfg.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("用户名不能为空")
+		}
+		if _, ok := users[u.Username]; ok {
+			return nil, fmt.Errorf("用户 %s 重复配置", u.Username)
+		}
+		if _, ok := roleLevels[u.Role]; !ok {
+			return nil, fmt.Errorf("用户 %s 的角色 %q 无效，可选 viewer、operator", u.Username, u.Role)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("用户 %s 的 password_hash 不是有效的 bcrypt 哈希: %w", u.Username, err)
+		}
+		users[u.Username] = user{hash: []byte(u.PasswordHash), role: u.Role}
+	}
+
+	ttl := cfg.SessionTTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	sessions := NewSessions(ttl)
+	return &Auth{
+		Authenticators: []Authenticator{tokens, sessions},
+		Sessions:       sessions,
+		CookieSecure:   cfg.CookieSecure,
+		users:          users,
+	}, nil
+}
+
+// Authenticate 依次使用各认证方式识别调用方，都没有识别出时返回 nil, nil
+func (a *Auth) Authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range a.Authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err != nil || principal != nil {
+			return principal, err
+		}
+	}
+	return nil, nil
+}
+
+// HasUsers 是否配置了网页用户
+func (a *Auth) HasUsers() bool {
+	return len(a.users) > 0
+}
+
+// Login 校验用户名和密码，成功时返回调用方
+func (a *Auth) Login(username, password string) (*Principal, error) {
+	u, ok := a.users[username]
+	hash := u.hash
+	if !ok {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: username, Role: u.role, Method: MethodSession}, nil
+}
+
+// TokenAuthenticator 校验 Authorization: Bearer 或 X-API-Token 请求头中的 API Token
+type TokenAuthenticator struct {
+	tokens []token
+}
+
+type token struct {
+	name string
+	sum  [sha256.Size]byte
+	role string
+}
+
+func (t *TokenAuthenticator) add(name, value, role string) {
+	t.tokens = append(t.tokens, token{name: name, sum: sha256.Sum256([]byte(value)), role: role})
+}
+
+// Authenticate 实现 Authenticator，比较 Token 的哈希，耗时与匹配到第几个无关
+func (t *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	value := r.Header.Get("X-API-Token")
+	if header := r.Header.Get("Authorization"); value == "" && header != "" {
+		scheme, rest, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return nil, ErrInvalidCredentials
+		}
+		value = strings.TrimSpace(rest)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(value))
+	var matched *token
+	for i := range t.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t.tokens[i].sum[:]) == 1 {
+			matched = &t.tokens[i]
+		}
+	}
+	if matched == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: matched.name, Role: matched.role, Method: MethodToken}, nil
+}
+
+// NewAccessLog 创建访问日志，path 为空时写入程序日志，否则追加写入该文件。返回的 io.Closer 用于关闭文件
+func NewAccessLog(path string) (*logrus.Logger, io.Closer, error) {
+	if path == "" {
+		return logrus.StandardLogger(), nopCloser{}, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开访问日志 %s 出错: %w", path, err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(file)
+	logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	return logger, file, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// HashPassword 生成密码的 bcrypt 哈希，用于配置 auth.users[].password_hash
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CookieName 会话 Cookie 的名称
+const CookieName = "monitoring_session"
+
+// Sessions 登录后的会话，保存在内存中，服务重启后需要重新登录
+type Sessions struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	sessions map[string]session
+}
+
+type session struct {
+	principal Principal
+	expires   time.Time
+}
+
+// NewSessions 创建会话存储，ttl 为会话的有效期
+func NewSessions(ttl time.Duration) *Sessions {
+	return &Sessions{ttl: ttl, sessions: make(map[string]session)}
+}
+
+// Create 为调用方创建会话，返回会话 ID 和过期时间
+func (s *Sessions) Create(principal Principal) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	id := hex.EncodeToString(buf)
+	now := time.Now()
+	expires := now.Add(s.ttl)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// 顺便清理已过期的会话
+	for key, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[id] = session{principal: principal, expires: expires}
+	return id, expires, nil
+}
+
+// Delete 删除会话
+func (s *Sessions) Delete(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+}
+
+// Authenticate 实现 Authenticator，根据会话 Cookie 识别调用方
+func (s *Sessions) Authenticate(r *http.Request) (*Principal, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess, ok := s.sessions[cookie.Value]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if time.Now().After(sess.expires) {
+		delete(s.sessions, cookie.Value)
+		return nil, ErrInvalidCredentials
+	}
+	principal := sess.principal
+	return &principal, nil
+}
@@ -1,243 +1,141 @@
 package checker
 
 import (
-	"bufio"
-	"database/sql"
-	"errors"
-	"fmt"
+	"context"
+	"monitoring_system/cmd"
+	"monitoring_system/config"
 	"monitoring_system/database"
+	"monitoring_system/events"
 	"monitoring_system/http_requests"
 	"monitoring_system/modules"
-	"os"
-	"os/exec"
+	"monitoring_system/probe"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/proxy"
 )
 
-// DownloadManager 负责下载相关操作
-type DownloadManager struct {
-	DB              *sql.DB
-	TradeID         int
-	Config          *http_requests.Config
-	ExitErrorMap    map[int]map[string]struct{} // 外层为 randomCityID，内层为 outboundIP
-	ExitErrorMutex  *sync.Mutex
-	downloadURL     string
-	downloadURLLock sync.Mutex
-}
-
 // Checker 定义检查器结构体
 type Checker struct {
-	DB                      *sql.DB
-	Config                  *http_requests.Config
-	ExitErrorMap            map[int]map[string]struct{}
-	ExitErrorMutex          *sync.Mutex
+	DB                      database.Store
+	Config                  *config.Config
+	API                     *http_requests.Client
 	ScannedIDs              map[int]time.Time // 存储扫描过的 city_id 及其过期时间
 	ScannedMutex            sync.Mutex        // 保护 ScannedIDs 的互斥锁
 	GoodLineCheckedIDs      map[int]time.Time // 存储已检查的 good_line id 及其过期时间
 	GoodLineCheckedIDsMutex sync.Mutex        // 保护 GoodLineCheckedIDs 的互斥锁
-	IsFromGoodLine          bool
+	InFlight                map[int]int       // 正在检测的 city_id 及负责的 watchTradeID
+	InFlightMutex           sync.Mutex        // 保护 InFlight 的互斥锁
+	RecheckRetryAt          map[int]time.Time // 复查未完成的 city_id 及下次领取的时间
+	RecheckRetryMutex       sync.Mutex        // 保护 RecheckRetryAt 的互斥锁
+	Screen                  *cmd.IPScreen     // 检测前筛查出口 IP
+	Probers                 []probe.Prober    // 复查使用的 SOCKS5 和下载探测器，由 NewProbers 创建
 }
 
-// TestSOCKS5 执行 SOCKS5 测试
-func TestSOCKS5(line *http_requests.Line, TargetAddr string, testCount int) (float64, int64, error) {
-	totalTime := int64(0)
-	successCount := 0
-
-	for i := 0; i < testCount; i++ {
-		start := time.Now()
-		dialer, err := proxy.SOCKS5("tcp", line.EndpointAddr, &proxy.Auth{User: line.SSUser, Password: line.SSPass}, proxy.Direct)
-		if err != nil {
-			continue
+// NewProbers 创建复查使用的 SOCKS5 和下载探测器，超时和下载地址沿用 probes 中的配置。
+// 每轮复查只做一次 SOCKS5 测试和 errTestNum 次下载测试，探测次数不使用 probes 中的 count
+func NewProbers(cfgs []config.ProbeCFG, env probe.Env, errTestNum int) ([]probe.Prober, error) {
+	socks5CFG := config.ProbeCFG{Type: probe.TypeSOCKS5}
+	downloadCFG := config.ProbeCFG{Type: probe.TypeDownload}
+	for i := len(cfgs) - 1; i >= 0; i-- {
+		switch cfgs[i].Type {
+		case probe.TypeSOCKS5:
+			socks5CFG = cfgs[i]
+		case probe.TypeDownload:
+			downloadCFG = cfgs[i]
 		}
+	}
+	socks5CFG.Count = 1
+	downloadCFG.Count = errTestNum
 
-		conn, err := dialer.Dial("tcp", TargetAddr)
+	var probers []probe.Prober
+	for _, cfg := range []config.ProbeCFG{socks5CFG, downloadCFG} {
+		prober, err := probe.New(cfg, env)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		conn.Close()
-
-		elapsed := time.Since(start).Milliseconds()
-		totalTime += elapsed
-		successCount++
-	}
-
-	if successCount == 0 {
-		errMsg := fmt.Sprintf("所有测试请求均失败，连接信息: %s，账号: %s，密码: %s", line.EndpointAddr, line.SSUser, line.SSPass)
-		logrus.WithFields(logrus.Fields{
-			"user":         line.SSUser,
-			"endpointAddr": line.EndpointAddr,
-			"targetAddr":   TargetAddr,
-		}).Error(errMsg)
-		return 0, 0, fmt.Errorf(errMsg)
+		probers = append(probers, prober)
 	}
-
-	successRate := float64(successCount) / float64(testCount) * 100
-	avgResponseTime := totalTime / int64(successCount)
-	logrus.WithFields(logrus.Fields{
-		// "user":            user,
-		// "endpointAddr":    endpointAddr,
-		// "targetAddr":      TargetAddr,
-		// "successRate":     successRate,
-		// "avgResponseTime": avgResponseTime,
-		// "NodeName":        nodeName,
-		// "OutboundIP":      outboundIP,
-	}).Warn("【Checker】SOCKS5测试成功")
-
-	return successRate, avgResponseTime, nil
+	return probers, nil
 }
 
 // NewChecker 创建一个新的检查器实例
-func NewChecker(db *sql.DB, config *http_requests.Config, exitErrorMap map[int]map[string]struct{}, exitErrorMutex *sync.Mutex) *Checker {
+func NewChecker(db database.Store, config *config.Config, api *http_requests.Client, probers []probe.Prober, screen *cmd.IPScreen) *Checker {
 	return &Checker{
 		DB:                 db,
 		Config:             config,
-		ExitErrorMap:       exitErrorMap,
-		ExitErrorMutex:     exitErrorMutex,
+		API:                api,
 		ScannedIDs:         make(map[int]time.Time),
 		GoodLineCheckedIDs: make(map[int]time.Time),
+		InFlight:           make(map[int]int),
+		RecheckRetryAt:     make(map[int]time.Time),
+		Screen:             screen,
+		Probers:            probers,
 	}
 }
 
-// 封装重试逻辑
-func retryOperation(operation func() error, maxRetries int, sleepDuration time.Duration, log *logrus.Entry, tradeID, randomCityID int, action string) error {
-	retryCount := 0
+// Run 为指定的 watchTradeID 启动检测线程，不断从共享队列领取城市 ID 进行检测
+func (c *Checker) Run(ctx context.Context, watchTradeID int) {
+	logrus.WithFields(logrus.Fields{"watchTradeID": watchTradeID}).Warn("\n【Checker】启动成功...")
 	for {
-		err := operation()
-		if err == nil {
-			log.WithFields(logrus.Fields{
-				"TradeID":      tradeID,
-				"RandomCityID": randomCityID,
-				"retryCount":   retryCount,
-			}).Warnf("【Checker】%s 成功", action)
-			return nil
-		} else {
-			log.WithFields(logrus.Fields{
-				"TradeID":      tradeID,
-				"RandomCityID": randomCityID,
-				"retryCount":   retryCount,
-			}).Error("【Checker】获取线路信息失败:", "重试中", retryCount, "次")
-		}
-		retryCount++
-		log.WithFields(logrus.Fields{
-			"TradeID":      tradeID,
-			"RandomCityID": randomCityID,
-			"retryCount":   retryCount,
-		}).Warnf("【Checker】%s 获取线路信息尝试失败，重试", action)
-		if retryCount >= maxRetries {
-			return fmt.Errorf("%s 重试 %d 次后失败", action, retryCount)
+		wait := c.Check(ctx, watchTradeID)
+		if !sleepContext(ctx, wait) {
+			logrus.WithFields(logrus.Fields{"watchTradeID": watchTradeID}).Warn("【Checker】服务退出，停止检测")
+			return
 		}
-		time.Sleep(sleepDuration)
 	}
 }
 
-// MapChecker 检查ExitErrorMap中的CityID
-func (c *Checker) MapChecker() {
-	logrus.Error("【Checker】发现异常开始执行检测流程...")
-	for randomCityID := range c.ExitErrorMap {
-		if randomCityID == 0 {
-			logrus.WithFields(logrus.Fields{"randomCityID": randomCityID}).Warn("【Checker】获取的 randomCityID 为 0，跳过此次检测")
-			delete(c.ExitErrorMap, randomCityID)
-			continue
-		}
-		logrus.WithFields(logrus.Fields{"randomCityID": randomCityID}).Warn("【Checker】从 ExitErrorMap 中移除节点 ID：", randomCityID)
-		delete(c.ExitErrorMap, randomCityID)
-		logrus.WithFields(logrus.Fields{"randomCityID": randomCityID}).Warn("【Checker】开始处理节点 ID：", randomCityID)
-		c.processRandomCityID(randomCityID)
-		break
+// sleepContext 等待 d，ctx 被取消时提前返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
-// Check 执行检测逻辑
-func (c *Checker) Check() {
-	c.ExitErrorMutex.Lock()
-	defer func() {
-		c.ExitErrorMutex.Unlock()
-		// logrus.Warn("【Checker】已释放互斥锁")
-	}()
-	// ExitErrorMap 存在数据则直接进行检测
-	if len(c.ExitErrorMap) > 0 {
-		c.MapChecker()
-		return
+// Check 从共享队列领取一个城市 ID 并使用 watchTradeID 执行检测，返回下一次检测前需要等待的时间
+func (c *Checker) Check(ctx context.Context, watchTradeID int) time.Duration {
+	task, wait, ok := c.nextTask(watchTradeID)
+	if !ok {
+		return wait
 	}
+	defer c.releaseCity(task.CityID)
 
-	consecutiveFailures := 3 // bad_line 允许查询无数据的次数，方便之后修改
-	logrus.Warning("【Checker】检测ExitErrorMap为空")
-	logrus.Warning("【Checker】已分配watchTradeID：", c.Config.WatchTradeID)
-	// 至少进行一次检测，可能查询出已经检测过的ID
-	for {
-		var randomCityID int
-		var err error
-		var badLine modules.BadLine
-		c.IsFromGoodLine = false // 确保每次遍历都从false开始
-		randomCityID, err = badLine.GetRandomCityID(c.DB)
-		// 查询bad_line表
-		if randomCityID == 0 {
-			if errors.Is(err, sql.ErrNoRows) {
-				logrus.Warn("【Checker】数据库中bad_line表没有扫描到需要检测的节点")
-				consecutiveFailures--
-				if consecutiveFailures > 0 {
-					// bad_line 表查询无数据次数未达到允许失败次数
-					continue
-				}
-				// 尝试从good_line表获取数据
-				var goodLineRandomCityID int
-				var goodLine modules.GoodLine
-				goodLineRandomCityID, err = goodLine.GetRandomCityID(c.DB)
-				if err != nil {
-					if errors.Is(err, sql.ErrNoRows) {
-						logrus.Warn("【Checker】数据库中good_line表也没有扫描到需要检测的节点")
-						logrus.Warn("【Checker】 等待 10 分钟后重新查询是否有新的记录")
-						for i := 0; i < 10; i++ {
-							time.Sleep(1 * time.Minute)
-							logrus.Warn("【Checker】等待", 10-i, "分钟后重新查询是否有新的记录")
-						}
-						consecutiveFailures = 3 // 重置允许次数
-						break
-					} else {
-						logrus.WithFields(logrus.Fields{"Error": err}).Error("【Checker】查询 good_line 表时出错")
-						break
-					}
-				}
-				c.GoodLineCheckedIDsMutex.Lock()
-				if expiration, exists := c.GoodLineCheckedIDs[goodLineRandomCityID]; exists && time.Since(expiration) < 30*time.Minute {
-					c.GoodLineCheckedIDsMutex.Unlock()
-					logrus.WithFields(logrus.Fields{"randomCityID": goodLineRandomCityID}).Warn("【Checker】good_line 中的节点 ID 已检查过，跳过检测")
-					continue
-				}
-				c.GoodLineCheckedIDs[goodLineRandomCityID] = time.Now().Add(30 * time.Minute)
-				c.GoodLineCheckedIDsMutex.Unlock()
-				c.IsFromGoodLine = true
-				randomCityID = goodLineRandomCityID
-			} else {
-				logrus.WithFields(logrus.Fields{"Error": err}).Error("【Checker】查询 bad_line 表时出错")
-				break
-			}
-		}
-		c.ScannedMutex.Lock()
-		if expiration, exists := c.ScannedIDs[randomCityID]; exists && time.Since(expiration) < 30*time.Minute {
-			c.ScannedMutex.Unlock()
-			logrus.WithFields(logrus.Fields{"randomCityID": randomCityID}).Warn("【Checker】检测记录已存在,15秒后继续找下一个")
-			time.Sleep(15 * time.Second)
-			continue
-		}
-		c.ScannedIDs[randomCityID] = time.Now().Add(30 * time.Minute)
-		c.ScannedMutex.Unlock()
-		logrus.WithFields(logrus.Fields{"randomCityID": randomCityID}).Warn("【Checker】从表中获取到节点 ID：", randomCityID)
-		c.processRandomCityID(randomCityID)
-		break
+	logrus.WithFields(logrus.Fields{
+		"randomCityID": task.CityID,
+		"watchTradeID": watchTradeID,
+		"Source":       task.Source,
+	}).Warn("【Checker】从队列中获取到节点 ID：", task.CityID)
+	completed := c.processRandomCityID(ctx, task.CityID, watchTradeID, task.Source == SourceGoodLine)
+	if task.Source == SourceRecheckQueue {
+		c.finishRecheck(task, completed)
 	}
+	return checkInterval
 }
 
-// processRandomCityID 处理单个 randomCityID 的检测流程
-func (c *Checker) processRandomCityID(randomCityID int) {
-	// 判断是否从 good_line 表获取的 randomCityID
-	isFromGoodLine := c.IsFromGoodLine
+// saveProbeResult 保存 Checker 的探测结果到 probe_results 表
+func (c *Checker) saveProbeResult(result *probe.Result, line http_requests.Line, randomCityID, tradeID int) {
+	record := result.Record(line, randomCityID, tradeID)
+	if err := c.DB.SaveProbeResult(record); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"TradeID":      tradeID,
+			"RandomCityID": randomCityID,
+			"ProbeType":    result.ProbeType,
+			"Error":        err,
+		}).Error("【Checker】保存探测结果出错")
+	}
+	events.Publish(events.TypeProbeResult, events.SourceChecker, record)
+}
 
+// processRandomCityID 使用 watchTradeID 处理单个 randomCityID 的检测流程，isFromGoodLine 表示 randomCityID 是否来自 good_line 表。
+// 至少一条线路完成检测并处理了线路表时返回 true，中断或未能检测时返回 false
+func (c *Checker) processRandomCityID(ctx context.Context, randomCityID, watchTradeID int, isFromGoodLine bool) bool {
 	var err error
 
 	if randomCityID == 0 {
@@ -245,41 +143,28 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 		c.ScannedMutex.Lock()
 		c.ScannedIDs[randomCityID] = time.Now().Add(30 * time.Minute)
 		c.ScannedMutex.Unlock()
-		return
+		return false
 	}
-	watchTradeID := c.Config.WatchTradeID[0]
 	logrus.WithFields(logrus.Fields{"randomCityID": randomCityID, "watchTradeID": watchTradeID}).
 		Warnf("【Checker】开始处理节点 ID：%d，WorKer：%d", randomCityID, watchTradeID)
 
 	// 更换节点到指定城市
-	err = retryOperation(
-		func() error {
-			return http_requests.ChangeNode(c.Config, randomCityID, watchTradeID)
-		}, 3, 1*time.Second,
-		logrus.WithFields(logrus.Fields{"TradeID": watchTradeID, "RandomCityID": randomCityID}),
-		watchTradeID, randomCityID, "更换节点到指定城市")
+	err = c.API.ChangeNode(ctx, randomCityID, watchTradeID)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"TradeID": watchTradeID, "RandomCityID": randomCityID, "Error": err}).Error("【Checker】更换节点到指定城市失败")
-		return
+		return false
 	}
 
 	// 获取节点信息
-	var lines []http_requests.Line
-	err = retryOperation(
-		func() error {
-			lines, err = http_requests.GetLines(c.Config)
-			return err
-		}, 3, 1*time.Second,
-		logrus.WithFields(logrus.Fields{"TradeID": watchTradeID, "RandomCityID": randomCityID}),
-		watchTradeID, randomCityID, "获取线路信息")
+	lines, err := c.API.GetLines(ctx)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"TradeID": watchTradeID, "RandomCityID": randomCityID, "Error": err}).Error("【Checker】获取线路信息失败")
-		return
+		return false
 	}
 
 	if len(lines) == 0 {
 		logrus.WithFields(logrus.Fields{"TradeID": watchTradeID, "RandomCityID": randomCityID, "Error": err}).Error("【Checker】获取线路信息为空")
-		return
+		return false
 	}
 
 	var matchedLines []http_requests.Line
@@ -291,14 +176,44 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 
 	if len(matchedLines) == 0 {
 		logrus.WithFields(logrus.Fields{"TradeID": watchTradeID, "RandomCityID": randomCityID, "Error": err}).Error("【Checker】无匹配的线路")
-		return
+		return false
+	}
+
+	// 每轮一次 SOCKS5 测试和 ErrTestNum 次下载测试，超时和下载地址以 config.yaml 中的 probes 为准
+	socks5Prober := probe.Find(c.Probers, probe.TypeSOCKS5)
+	downloadProber := probe.Find(c.Probers, probe.TypeDownload)
+	if socks5Prober == nil || downloadProber == nil {
+		logrus.WithFields(logrus.Fields{"TradeID": watchTradeID, "RandomCityID": randomCityID}).Error("【Checker】未配置 SOCKS5 或下载探测器")
+		return false
+	}
+	// Checker 本身就在复查，下载出错时不再写入复查队列
+	downloadManager := &cmd.DownloadManager{
+		DB:          c.DB,
+		TradeID:     watchTradeID,
+		Config:      c.Config,
+		SkipRecheck: true,
 	}
 
 	totalDownloadSpeed := 0.0
 	testCount := 0
 	allBelow10Mbps := true
+	checked := 0
 
 	for _, line := range matchedLines {
+		// 出口 IP 在 bad_ips 或可疑分组中时先更换 IP，不对已知的坏 IP 做完整检测
+		line, err = c.Screen.Screen(ctx, watchTradeID, line)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			logrus.WithFields(logrus.Fields{
+				"TradeID":      watchTradeID,
+				"RandomCityID": randomCityID,
+				"OutboundIP":   line.OutboundIP,
+				"Error":        err,
+			}).Error("【Checker】筛查出口 IP 时出错")
+			continue
+		}
 		logrus.WithFields(logrus.Fields{
 			"randomCityID": randomCityID,
 			"watchTradeID": watchTradeID,
@@ -309,19 +224,22 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 		errorCount := 0
 		badOutboundIPs := make(map[string]struct{})
 
-		targetAddr := strings.TrimPrefix(c.Config.ConnectBaseURL, "http://")
 		logrus.SetLevel(logrus.InfoLevel)
 
 		for i := 0; i < c.Config.ErrTestNum; i++ {
-			successRate, avgResponseTime, err := TestSOCKS5(&line, targetAddr, 1)
-			if err != nil {
+			socks5Result := socks5Prober.Probe(ctx, line)
+			if ctx.Err() != nil {
+				// 服务退出时中断检测，不再写入不完整的结果
+				return false
+			}
+			c.saveProbeResult(socks5Result, line, randomCityID, watchTradeID)
+			if socks5Result.Err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID":      watchTradeID,
 					"RandomCityID": randomCityID,
 					"NodeName":     line.NodeName,
 					"endpointAddr": line.EndpointAddr,
-					"targetAddr":   targetAddr,
-					"Error":        err,
+					"Error":        socks5Result.Err,
 					"outboundIP":   line.OutboundIP,
 				}).Error("【Checker】对节点进行 SOCKS5 测试失败")
 			} else {
@@ -329,52 +247,56 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 					"TradeID":      watchTradeID,
 					"RandomCityID": randomCityID,
 					"NodeName":     line.NodeName,
-					"SuccessRate":  successRate,
-					"ResponseTime": avgResponseTime,
+					"SuccessRate":  socks5Result.SuccessRate,
+					"ResponseTime": socks5Result.ResponseTime,
+					"ConnectMs":    socks5Result.Timing.Connect.Milliseconds(),
+					"HandshakeMs":  socks5Result.Timing.Handshake.Milliseconds(),
+					"ReplyMs":      socks5Result.Timing.ConnectReply.Milliseconds(),
 				}).Warning("【Checker】节点 SOCKS5 测试成功")
 			}
 
-			// 开始进行 curl 下载测试
-			downloadManager := &DownloadManager{
-				DB:             c.DB,
-				TradeID:        watchTradeID,
-				Config:         c.Config,
-				ExitErrorMap:   c.ExitErrorMap,
-				ExitErrorMutex: c.ExitErrorMutex,
+			// 开始进行下载测试
+			downloadResult, err := downloadManager.PerformDownloadTests(ctx, downloadProber, line, randomCityID)
+			if ctx.Err() != nil {
+				return false
 			}
-			speed, err := downloadManager.PerformDownloadTests(&line, randomCityID)
-			if err != nil {
-				var exitErr *exec.ExitError
-				if errors.As(err, &exitErr) {
-					exitCode := exitErr.ExitCode()
-					if exitCode == 18 || exitCode == 28 || exitCode == 97 {
-						errorCount++
-						badOutboundIPs[line.OutboundIP] = struct{}{} // 记录出现错误的 outboundIP
+			speed := 0.0
+			failure, failed := probe.Attempt{Err: err}, err != nil
+			if downloadResult != nil {
+				c.saveProbeResult(downloadResult, line, randomCityID, watchTradeID)
+				speed = downloadResult.DownloadRate
+				if !failed {
+					failure, failed = downloadResult.FirstFailure()
+				}
+				// 退出码为 18、28、97 时判定本轮失败，记录出错的出口 IP，本轮速率不计入平均值
+				if attempt, ok := downloadResult.RecheckFailure(); ok {
+					errorCount++
+					badOutboundIPs[line.OutboundIP] = struct{}{} // 记录出现错误的 outboundIP
+					logrus.WithFields(logrus.Fields{
+						"TradeID":      watchTradeID,
+						"RandomCityID": randomCityID,
+						"NodeName":     line.NodeName,
+						"ExitCode":     attempt.ExitCode,
+						"Error":        attempt.Err,
+					}).Error("【Checker】下载测试遇到特定错误码，判定失败")
+					// 执行 changeLineIpAddr
+					err := c.API.ChangeLineIP(ctx, watchTradeID)
+					if err != nil {
 						logrus.WithFields(logrus.Fields{
 							"TradeID":      watchTradeID,
 							"RandomCityID": randomCityID,
-							"NodeName":     line.NodeName,
-							"ExitCode":     exitCode,
 							"Error":        err,
-						}).Error("【Checker】下载测试遇到特定错误码，判定失败")
-						// 执行 changeLineIpAddr
-						err := http_requests.ChangeLineIP(c.Config, watchTradeID)
-						time.Sleep(5 * time.Second)
-						if err != nil {
-							logrus.WithFields(logrus.Fields{
-								"TradeID":      watchTradeID,
-								"RandomCityID": randomCityID,
-								"Error":        err,
-							}).Error("【Checker】执行更换IP时出错")
-						} else {
-							logrus.WithFields(logrus.Fields{
-								"TradeID":      watchTradeID,
-								"RandomCityID": randomCityID,
-							}).Warning("【Checker】更换节点 IP 成功")
-						}
-						continue
+						}).Error("【Checker】执行更换IP时出错")
+					} else {
+						logrus.WithFields(logrus.Fields{
+							"TradeID":      watchTradeID,
+							"RandomCityID": randomCityID,
+						}).Warning("【Checker】更换节点 IP 成功")
 					}
+					continue
 				}
+			}
+			if failed {
 				errorCount++
 
 				if speed < c.Config.Checker.BadLineMinSpeed {
@@ -382,18 +304,19 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 						"TradeID":      watchTradeID,
 						"RandomCityID": randomCityID,
 						"NodeName":     line.NodeName,
-						"Error":        err,
+						"ExitCode":     failure.ExitCode,
+						"Error":        failure.Err,
 					}).Error("【Checker】下载速率不达标,开始更换节点 IP")
 				} else {
 					logrus.WithFields(logrus.Fields{
 						"TradeID":      watchTradeID,
 						"RandomCityID": randomCityID,
 						"NodeName":     line.NodeName,
-						"Error":        err,
+						"ExitCode":     failure.ExitCode,
+						"Error":        failure.Err,
 					}).Error("【Checker】下载测试失败,开始更换节点 IP")
 				}
-				err = http_requests.ChangeLineIP(c.Config, watchTradeID)
-				time.Sleep(5 * time.Second)
+				err = c.API.ChangeLineIP(ctx, watchTradeID)
 				if err != nil {
 					logrus.WithFields(logrus.Fields{
 						"TradeID":      watchTradeID,
@@ -410,8 +333,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 			} else {
 				// 根据来源判断是否更换 IP
 				if isFromGoodLine && speed < c.Config.Checker.GoodLineMinSpeed {
-					err := http_requests.ChangeLineIP(c.Config, watchTradeID)
-					time.Sleep(5 * time.Second)
+					err := c.API.ChangeLineIP(ctx, watchTradeID)
 					if err != nil {
 						logrus.WithFields(logrus.Fields{
 							"TradeID":      watchTradeID,
@@ -425,8 +347,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 						}).Warning("【Checker】更换节点 IP 成功（good_line 单次速率小于10）")
 					}
 				} else if !isFromGoodLine && speed < c.Config.Checker.BadLineMinSpeed {
-					err := http_requests.ChangeLineIP(c.Config, watchTradeID)
-					time.Sleep(5 * time.Second)
+					err := c.API.ChangeLineIP(ctx, watchTradeID)
 					if err != nil {
 						logrus.WithFields(logrus.Fields{
 							"TradeID":      watchTradeID,
@@ -450,6 +371,10 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 			testCount++
 		}
 
+		if ctx.Err() != nil {
+			return false
+		}
+
 		// 计算平均下载速率
 		avgDownloadSpeed := 0.0
 		if testCount > 0 {
@@ -457,13 +382,6 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 		}
 
 		// 格式化平均下载速率
-		downloadManager := &DownloadManager{
-			DB:             c.DB,
-			TradeID:        watchTradeID,
-			Config:         c.Config,
-			ExitErrorMap:   c.ExitErrorMap,
-			ExitErrorMutex: c.ExitErrorMutex,
-		}
 		formattedSpeed, err := downloadManager.FormatSpeed(avgDownloadSpeed)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
@@ -476,7 +394,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 		// 如果 randomCityID 来自 good_line 且所有下载测试速率都小于 10Mbps，则从 good_line 中删除
 		if isFromGoodLine && allBelow10Mbps {
 			var goodLine modules.GoodLine
-			goodLine.CheckIsNotExistsAndInsert(c.DB, randomCityID)
+			goodLine.CheckIsNotExistsAndInsert(c.DB, randomCityID, c.audit(watchTradeID, "复查下载速率均低于 good_line_min_speed", formattedSpeed, errorCount))
 		}
 
 		// 如果 randomCityID 不是来自 good_line，则执行原有的 bad_line 处理逻辑
@@ -489,7 +407,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 					"NodeName":     line.NodeName,
 				}).Warningf("【Checker】从 bad_line 表中删除 %s: %d", line.NodeName, randomCityID)
 				// 从 bad_line 表中删除记录
-				delErr := database.DeleteFromBadLine_id(c.DB, randomCityID)
+				delErr := c.DB.DeleteFromBadLine_id(randomCityID, c.audit(watchTradeID, "复查下载恢复", formattedSpeed, errorCount))
 				if delErr != nil {
 					logrus.WithFields(logrus.Fields{
 						"TradeID":      watchTradeID,
@@ -507,7 +425,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 				}).Warningf("【Checker】更新 %s: %d 的 good_count 为 0", line.NodeName, randomCityID)
 
 				// 更新 good_count 为 0
-				updateErr := database.UpdateGoodCount(c.DB, randomCityID, false)
+				updateErr := c.DB.UpdateGoodCount(randomCityID, false)
 				if updateErr != nil {
 					logrus.WithFields(logrus.Fields{
 						"TradeID":      watchTradeID,
@@ -519,7 +437,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 
 				// 如果更换 IP 前有错误，且最后一次下载成功，将错误 IP 写入 bad_ips 表
 				if len(badOutboundIPs) > 0 {
-					exists, err := database.CheckNodeIDExistsInBadLine_id(c.DB, randomCityID)
+					exists, err := c.DB.CheckNodeIDExistsInBadLine_id(randomCityID)
 					if err != nil {
 						logrus.WithFields(logrus.Fields{
 							"TradeID":      watchTradeID,
@@ -528,7 +446,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 						}).Error("【Checker】检查 randomCityID 是否存在于 bad_line 表时出错")
 					} else if !exists {
 						for outboundIP := range badOutboundIPs {
-							err := database.InsertIntoBadIPs(c.DB, outboundIP, randomCityID)
+							err := c.DB.InsertIntoBadIPs(outboundIP, randomCityID, c.Config.BadIPExpiry(), c.audit(watchTradeID, "更换 IP 前下载失败", formattedSpeed, errorCount))
 							if err != nil {
 								logrus.WithFields(logrus.Fields{
 									"TradeID":      watchTradeID,
@@ -550,7 +468,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 				badOutboundIPs = make(map[string]struct{})
 			} else {
 				// 检查该 randomCityID 是否在 bad_line 中存在
-				exists, err := database.CheckNodeIDExistsInBadLine_id(c.DB, randomCityID)
+				exists, err := c.DB.CheckNodeIDExistsInBadLine_id(randomCityID)
 				if err != nil {
 					logrus.WithFields(logrus.Fields{
 						"TradeID":      watchTradeID,
@@ -558,7 +476,7 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 						"Error":        err,
 					}).Error("【Checker】检查 randomCityID 是否存在于 bad_line 表时出错")
 				} else if !exists {
-					err := database.InsertIntoBadLine(c.DB, line.OutboundIP, randomCityID)
+					err := c.DB.InsertIntoBadLine(line.OutboundIP, randomCityID, c.audit(watchTradeID, "复查下载失败次数过多", formattedSpeed, errorCount))
 					if err != nil {
 						logrus.WithFields(logrus.Fields{
 							"TradeID":      watchTradeID,
@@ -582,193 +500,25 @@ func (c *Checker) processRandomCityID(randomCityID int) {
 				}
 			}
 		}
+		checked++
 	}
+	return checked > 0
 }
 
-// GetDownloadURL 获取下载 URL
-func (dm *DownloadManager) GetDownloadURL() (string, error) {
-	dm.downloadURLLock.Lock()
-	defer dm.downloadURLLock.Unlock()
-	if dm.downloadURL != "" {
-		return dm.downloadURL, nil
-	}
-	downloadURL, err := database.GetDownloadURL(dm.DB)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"TradeID": dm.TradeID, "Error": err}).Error("获取下载 URL 出错")
-		return dm.Config.DownloadURL, err
-	}
-	if downloadURL == "" {
-		dm.downloadURL = dm.Config.DownloadURL
-	} else {
-		dm.downloadURL = downloadURL
-	}
-	return dm.downloadURL, nil
-}
-
-// PerformDownloadTests 进行多次下载测试以计算平均下载速率
-func (dm *DownloadManager) PerformDownloadTests(line *http_requests.Line, randomCityID int) (float64, error) {
-	downloadURL, err := dm.GetDownloadURL()
-	if err != nil {
-		return 0, err
-	}
-
-	proxyURL := fmt.Sprintf("socks5://%s:%s@%s", line.SSUser, line.SSPass, line.EndpointAddr)
-	downloadTestCount := dm.Config.ErrTestNum
-	var totalSpeed float64
-
-	for i := 0; i < downloadTestCount; i++ {
-		logrus.WithFields(logrus.Fields{
-			"TradeID":      dm.TradeID,
-			"randomCityID": randomCityID,
-			"Test":         i + 1,
-			"outboundIP":   line.OutboundIP,
-			"NodeName":     line.NodeName,
-		}).Warn("【Checker】开始下载测试")
-		speed, err := dm.executeCurlCommand(downloadURL, proxyURL, randomCityID, line.OutboundIP)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"TradeID": dm.TradeID,
-				"Error":   err,
-			}).Error("【Checker】使用 curl 下载文件出错，开始更换 IP")
-			// 更换 IP
-			err := http_requests.ChangeLineIP(dm.Config, dm.TradeID)
-			time.Sleep(5 * time.Second)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"TradeID": dm.TradeID,
-					"Error":   err,
-				}).Error("【Checker】执行更换 IP 时出错")
-			} else {
-				logrus.WithFields(logrus.Fields{
-					"TradeID": dm.TradeID,
-				}).Warn("【Checker】更换 IP 成功")
-			}
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"TradeID":      dm.TradeID,
-				"randomCityID": randomCityID,
-				"Test":         i + 1,
-				"outboundIP":   line.OutboundIP,
-				"NodeName":     line.NodeName,
-				// speed 取两位
-				"Speed": fmt.Sprintf("%.2f", speed),
-			}).Warn("【Checker】", randomCityID, "第", i+1, "次下载测试结果")
-			totalSpeed += speed
-		}
-	}
-
-	if downloadTestCount > 0 {
-		avgDownloadSpeed := totalSpeed / float64(downloadTestCount)
-		formattedSpeed, err := dm.FormatSpeed(avgDownloadSpeed)
-		if err != nil {
-			return 0, err
-		}
-		logrus.WithFields(logrus.Fields{
-			"TradeID":      dm.TradeID,
-			"randomCityID": randomCityID,
-			"outboundIP":   line.OutboundIP,
-			"NodeName":     line.NodeName,
-			"AvgSpeed":     formattedSpeed,
-		}).Warn("【Checker】", downloadTestCount, "次平均下载速率")
-		return formattedSpeed, nil
-	}
-	return 0, nil
-}
-
-// executeCurlCommand 执行 curl 命令
-func (dm *DownloadManager) executeCurlCommand(url, proxy string, randomCityID int, outboundIP string) (float64, error) {
-	timestamp := time.Now().UnixNano()
-	tempFileName := fmt.Sprintf("/tmp/curl_speed_output_tradeid_%d_%d", dm.TradeID, timestamp)
-	outputFile, err := os.Create(tempFileName)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("创建临时文件出错")
-		return 0, fmt.Errorf("创建临时文件出错: %v", err)
-	}
-	outputFilePath := outputFile.Name()
-	defer os.Remove(outputFilePath)
-	defer outputFile.Close()
-
-	cmd := exec.Command("curl", "-x", proxy, "--insecure", "--silent", "-m 120", "--write-out", "%{speed_download}", "--output", "/dev/null", url)
-	cmd.Stdout = outputFile
-
-	if err := cmd.Start(); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("启动 curl 命令出错")
-		return 0, fmt.Errorf("启动 curl 命令出错: %v", err)
-	}
-
-	if err := cmd.Wait(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode := exitErr.ExitCode()
-			logrus.WithFields(logrus.Fields{
-				"TradeID":      dm.TradeID,
-				"ExitCode":     exitCode,
-				"RandomCityID": randomCityID,
-				"OutboundIP":   outboundIP,
-			}).Warn("【Checker】curl 命令执行出错，捕获到退出码")
-			if exitCode == 18 || exitCode == 28 || exitCode == 97 {
-				return 0, fmt.Errorf("curl 命令执行出错，退出码: %d", exitCode)
-			}
-		}
-		logrus.WithFields(logrus.Fields{
-			"TradeID":      dm.TradeID,
-			"Error":        err,
-			"randomCityID": randomCityID,
-		}).Error("【Checker】", randomCityID, "执行 curl 命令出错")
-		return 0, fmt.Errorf("执行 curl 命令出错: %v", err)
-	}
-
-	file, err := os.Open(outputFilePath)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("打开临时文件读取内容出错")
-		return 0, fmt.Errorf("打开临时文件读取内容出错: %v", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	var speedStr string
-	for scanner.Scan() {
-		speedStr = scanner.Text()
-	}
-	if err := scanner.Err(); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("读取临时文件内容出错")
-		return 0, fmt.Errorf("读取临时文件内容出错: %v", err)
-	}
-
-	speed, err := strconv.ParseFloat(strings.TrimSpace(speedStr), 64)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("解析下载速率出错")
-		return 0, fmt.Errorf("解析下载速率出错: %v", err)
-	}
-
-	mbpsSpeed := speed * 8 / (1024 * 1024)
-	return mbpsSpeed, nil
-}
-
-// FormatSpeed 格式化平均下载速率，保留两位小数
-func (dm *DownloadManager) FormatSpeed(speed float64) (float64, error) {
-	formattedSpeedStr := fmt.Sprintf("%.2f", speed)
-	formattedSpeed, err := strconv.ParseFloat(formattedSpeedStr, 64)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("格式化下载速率时出错")
-		return 0, err
+// audit 生成写入 line_events 的变更上下文，记录复查的平均下载速率、失败次数和当时的阈值
+func (c *Checker) audit(watchTradeID int, reason string, avgDownloadSpeed float64, errorCount int) database.LineAudit {
+	return database.LineAudit{
+		Source:  database.SourceChecker,
+		TradeID: watchTradeID,
+		Reason:  reason,
+		Metrics: map[string]float64{
+			"download_rate": avgDownloadSpeed,
+			"error_count":   float64(errorCount),
+		},
+		Thresholds: map[string]float64{
+			"bad_line_min_speed":  c.Config.Checker.BadLineMinSpeed,
+			"good_line_min_speed": c.Config.Checker.GoodLineMinSpeed,
+			"check_err_test_num":  float64(c.Config.ErrTestNum),
+		},
 	}
-	return formattedSpeed, nil
 }
@@ -0,0 +1,171 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"monitoring_system/cmd"
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/fakesocks"
+	"monitoring_system/http_requests"
+	"monitoring_system/mockapi"
+	"monitoring_system/probe"
+)
+
+const (
+	testWatchTradeID = 2001
+	testCityID       = 101
+)
+
+// newTestChecker 创建连接模拟上游、假 SOCKS5 代理、下载服务器和 SQLite 内存库的 Checker。
+// 第一次下载请求到达后调用 onFirstDownload
+func newTestChecker(t *testing.T, proxy *fakesocks.Server, onFirstDownload func()) (*Checker, *mockapi.Server) {
+	t.Helper()
+	var once sync.Once
+	download := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(onFirstDownload)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(make([]byte, 1024*1024)))
+	}))
+	t.Cleanup(download.Close)
+
+	mock := mockapi.NewServer(mockapi.DefaultScenario(proxy.Addr(), testWatchTradeID))
+	upstream := httptest.NewServer(mock)
+	t.Cleanup(upstream.Close)
+	api := http_requests.NewClient(config.APICFG{}, upstream.URL, config.ThrottleCFG{Settle: time.Millisecond})
+
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveProvinces([]http_requests.Province{{ID: 1, Name: "江苏省"}}); err != nil {
+		t.Fatal(err)
+	}
+	project := config.ProjectCFG{Name: "default", ProjectID: config.DefaultProjectID, LineID: config.DefaultLineID}
+	if err := db.SaveNodes([]http_requests.Node{{ID: testCityID, Name: "南京市电信", AreaID: 1}}, project); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		WatchTradeID: []int{testWatchTradeID},
+		ErrTestNum:   3,
+		Checker:      config.Checker{BadLineMinSpeed: 3, GoodLineMinSpeed: 10},
+	}
+	probers, err := NewProbers([]config.ProbeCFG{
+		{Type: probe.TypeSOCKS5, Count: 10},
+		{Type: probe.TypeDownload, Count: 10, URL: download.URL + "/file"},
+	}, probe.Env{TargetAddr: strings.TrimPrefix(download.URL, "http://")}, cfg.ErrTestNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	screen := &cmd.IPScreen{DB: db, API: api, Config: cfg}
+	return NewChecker(db, cfg, api, probers, screen), mock
+}
+
+func TestRecheckWritesBadIPs(t *testing.T) {
+	proxy := fakesocks.NewServer(fakesocks.Config{})
+	if err := proxy.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	user := strconv.Itoa(testWatchTradeID)
+
+	// 第一次下载传输 4KB 后重置连接（退出码 18），之后的连接恢复正常
+	proxy.SetUserImpairments(user, fakesocks.Impairments{ResetAfter: 4096})
+	c, mock := newTestChecker(t, proxy, func() { proxy.ClearUserImpairments(user) })
+	if err := c.DB.EnqueueRecheck(testCityID, "198.51.100.9", 18, 1001); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Check(context.Background(), testWatchTradeID)
+
+	// 变更节点后出口 IP 为 198.51.100.2，下载中断后更换为 198.51.100.1，后两轮下载正常
+	const failedIP = "198.51.100.2"
+	if calls := mock.Calls(http_requests.EndpointChangeLineIPAddr); calls != 1 {
+		t.Fatalf("更换 IP %d 次，期望下载中断后更换 1 次", calls)
+	}
+	entries, err := c.DB.BadIPEntries(database.ProjectFilter{}, c.Config.BadIPExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].OutboundIP != failedIP || entries[0].CityID != testCityID {
+		t.Fatalf("bad_ips 为 %+v，期望城市 %d 的出口 IP %s", entries, testCityID, failedIP)
+	}
+	if bad, err := c.DB.BadLineEntries(database.ProjectFilter{}); err != nil || len(bad) != 0 {
+		t.Fatalf("bad_line 为 %+v, %v，期望为空", bad, err)
+	}
+
+	events, err := c.DB.LineEvents(database.LineEventQuery{CityID: testCityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ToState != database.LineStateBadIPs || events[0].Source != database.SourceChecker ||
+		events[0].Metrics["error_count"] != 1 {
+		t.Fatalf("变更记录为 %+v", events)
+	}
+
+	// 复查完成后移出复查队列
+	if _, err := c.DB.GetRecheckEntry(testCityID); err == nil {
+		t.Fatal("复查完成后城市仍在复查队列中")
+	}
+}
+
+func TestRecheckKeptWhenNodeChangeFails(t *testing.T) {
+	proxy := fakesocks.NewServer(fakesocks.Config{})
+	if err := proxy.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	c, _ := newTestChecker(t, proxy, func() {})
+	// 城市不在模拟上游中，变更节点失败，复查未完成
+	if err := c.DB.SaveNodes([]http_requests.Node{{ID: 999, Name: "不存在的城市", AreaID: 1}}, config.ProjectCFG{}); err != nil {
+		t.Fatal(err)
+	}
+	c.API.Retry.MaxAttempts = 1
+	if err := c.DB.EnqueueRecheck(999, "198.51.100.9", 28, 1001); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Check(context.Background(), testWatchTradeID)
+
+	if _, err := c.DB.GetRecheckEntry(999); err != nil {
+		t.Fatalf("复查未完成时城市应保留在复查队列中: %v", err)
+	}
+	if c.recheckDue(999) {
+		t.Fatal("复查未完成的城市应等待 recheckRetry 后再领取")
+	}
+}
+
+func TestRecheckProbeCounts(t *testing.T) {
+	proxy := fakesocks.NewServer(fakesocks.Config{})
+	if err := proxy.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	c, mock := newTestChecker(t, proxy, func() {})
+	if err := c.DB.EnqueueRecheck(testCityID, "198.51.100.9", 28, 1001); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Check(context.Background(), testWatchTradeID)
+
+	// probes 中的 count 为 10，复查仍然每轮一次 SOCKS5 测试和 check_err_test_num 次下载
+	rounds := c.Config.ErrTestNum
+	if stats := proxy.Stats(); stats.Connections != int64(rounds*(1+c.Config.ErrTestNum)) {
+		t.Fatalf("经代理建立 %d 个连接，期望 %d 轮各 1 次 SOCKS5 测试和 %d 次下载", stats.Connections, rounds, c.Config.ErrTestNum)
+	}
+	if calls := mock.Calls(http_requests.EndpointChangeLineIPAddr); calls != 0 {
+		t.Fatalf("下载正常时更换 IP %d 次", calls)
+	}
+}
@@ -0,0 +1,189 @@
+package checker
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"monitoring_system/database"
+	"monitoring_system/modules"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 城市 ID 的来源，按优先级从高到低排列
+const (
+	SourceRecheckQueue = "recheck_queue"
+	SourceBadLine      = "bad_line"
+	SourceGoodLine     = "good_line"
+)
+
+const (
+	checkInterval   = 5 * time.Second  // 两次检测之间的间隔
+	scannedWait     = 15 * time.Second // 队列中的城市都在冷却期时的等待时间
+	emptyQueueWait  = 10 * time.Minute // 队列为空时的等待时间
+	recheckCooldown = 30 * time.Minute // 同一个城市两次检测的最小间隔
+	recheckRetry    = 5 * time.Minute  // 复查未完成的城市再次领取前的等待时间
+)
+
+// Task 检测任务
+type Task struct {
+	CityID int
+	Source string
+	// 来自复查队列时为领取时城市的最近入队时间，复查完成后只移除此前入队的出口 IP
+	RecheckThrough time.Time
+}
+
+// claimCity 领取城市 ID，已被其他线程领取时返回 false，保证同一时间只有一个 watchTradeID 切换到该城市
+func (c *Checker) claimCity(cityID, watchTradeID int) bool {
+	c.InFlightMutex.Lock()
+	defer c.InFlightMutex.Unlock()
+	if _, exists := c.InFlight[cityID]; exists {
+		return false
+	}
+	c.InFlight[cityID] = watchTradeID
+	return true
+}
+
+// releaseCity 检测完成后释放城市 ID
+func (c *Checker) releaseCity(cityID int) {
+	c.InFlightMutex.Lock()
+	defer c.InFlightMutex.Unlock()
+	delete(c.InFlight, cityID)
+}
+
+// nextTask 按复查队列、bad_line、good_line 的顺序领取下一个城市 ID，没有可领取的任务时返回等待时间
+func (c *Checker) nextTask(watchTradeID int) (Task, time.Duration, bool) {
+	// 只领取 watchTradeID 所属项目的城市
+	filter := database.ProjectFilterFor(c.Config, watchTradeID)
+	if entry, ok := c.claimRecheckCity(watchTradeID, filter); ok {
+		return Task{CityID: entry.CityID, Source: SourceRecheckQueue, RecheckThrough: entry.UpdatedAt}, 0, true
+	}
+
+	var badLine modules.BadLine
+	badIDs, err := badLine.GetRandomCityIDs(c.DB, filter)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"Error": err}).Error("【Checker】查询 bad_line 表时出错")
+		return Task{}, checkInterval, false
+	}
+	for _, cityID := range badIDs {
+		if cityID == 0 || !c.markScanned(cityID) {
+			continue
+		}
+		if c.claimCity(cityID, watchTradeID) {
+			return Task{CityID: cityID, Source: SourceBadLine}, 0, true
+		}
+	}
+	if len(badIDs) == 0 {
+		logrus.Warn("【Checker】数据库中bad_line表没有扫描到需要检测的节点")
+	}
+
+	var goodLine modules.GoodLine
+	goodIDs, err := goodLine.GetRandomCityIDs(c.DB, filter)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"Error": err}).Error("【Checker】查询 good_line 表时出错")
+		return Task{}, checkInterval, false
+	}
+	for _, cityID := range goodIDs {
+		if !c.markGoodLineChecked(cityID) {
+			continue
+		}
+		if c.claimCity(cityID, watchTradeID) {
+			return Task{CityID: cityID, Source: SourceGoodLine}, 0, true
+		}
+	}
+
+	if len(badIDs) == 0 && len(goodIDs) == 0 {
+		logrus.Warn("【Checker】数据库中good_line表也没有扫描到需要检测的节点")
+		logrus.WithFields(logrus.Fields{"watchTradeID": watchTradeID}).Warn("【Checker】 等待 10 分钟后重新查询是否有新的记录")
+		return Task{}, emptyQueueWait, false
+	}
+	logrus.WithFields(logrus.Fields{"watchTradeID": watchTradeID}).Warn("【Checker】检测记录已存在,15秒后继续找下一个")
+	return Task{}, scannedWait, false
+}
+
+// claimRecheckCity 按复查顺序从复查队列中领取一个属于 filter 范围且未被其他线程领取的城市。
+// 领取时不移除记录，复查完成后由 finishRecheck 移除，复查期间重启或中断时城市仍在队列中
+func (c *Checker) claimRecheckCity(watchTradeID int, filter database.ProjectFilter) (database.RecheckEntry, bool) {
+	entries, err := c.DB.RecheckQueue()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"Error": err}).Error("【Checker】查询复查队列时出错")
+		return database.RecheckEntry{}, false
+	}
+	for _, entry := range entries {
+		randomCityID := entry.CityID
+		if randomCityID == 0 {
+			logrus.WithFields(logrus.Fields{"randomCityID": randomCityID}).Warn("【Checker】获取的 randomCityID 为 0，跳过此次检测")
+			if err := c.DB.RemoveRecheck(randomCityID, ""); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				logrus.WithFields(logrus.Fields{"randomCityID": randomCityID, "Error": err}).Error("【Checker】从复查队列中移除城市时出错")
+			}
+			continue
+		}
+		if !c.recheckDue(randomCityID) {
+			continue
+		}
+		if filter != (database.ProjectFilter{}) {
+			projectID, lineID, err := c.DB.GetCityProject(randomCityID)
+			if err != nil || !filter.Match(projectID, lineID) {
+				// 留给所属项目的检测线程处理
+				continue
+			}
+		}
+		if !c.claimCity(randomCityID, watchTradeID) {
+			continue
+		}
+		return entry, true
+	}
+	return database.RecheckEntry{}, false
+}
+
+// finishRecheck 复查完成时从复查队列中移除城市，未完成时保留记录并在 recheckRetry 后重新领取
+func (c *Checker) finishRecheck(task Task, completed bool) {
+	c.RecheckRetryMutex.Lock()
+	if completed {
+		delete(c.RecheckRetryAt, task.CityID)
+	} else {
+		c.RecheckRetryAt[task.CityID] = time.Now().Add(recheckRetry)
+	}
+	c.RecheckRetryMutex.Unlock()
+
+	if !completed {
+		logrus.WithFields(logrus.Fields{"randomCityID": task.CityID}).Warn("【Checker】复查未完成，保留在复查队列中：", task.CityID)
+		return
+	}
+	if err := c.DB.CompleteRecheck(task.CityID, task.RecheckThrough); err != nil {
+		logrus.WithFields(logrus.Fields{"randomCityID": task.CityID, "Error": err}).Error("【Checker】从复查队列中移除城市时出错")
+		return
+	}
+	logrus.WithFields(logrus.Fields{"randomCityID": task.CityID}).Warn("【Checker】复查完成，从复查队列中移除节点 ID：", task.CityID)
+}
+
+// recheckDue 判断复查未完成的城市是否已到重新领取的时间
+func (c *Checker) recheckDue(cityID int) bool {
+	c.RecheckRetryMutex.Lock()
+	defer c.RecheckRetryMutex.Unlock()
+	retryAt, exists := c.RecheckRetryAt[cityID]
+	return !exists || !time.Now().Before(retryAt)
+}
+
+// markScanned 检查 bad_line 中的城市是否在冷却期内，不在则记录本次扫描时间并返回 true
+func (c *Checker) markScanned(cityID int) bool {
+	c.ScannedMutex.Lock()
+	defer c.ScannedMutex.Unlock()
+	if expiration, exists := c.ScannedIDs[cityID]; exists && time.Now().Before(expiration) {
+		return false
+	}
+	c.ScannedIDs[cityID] = time.Now().Add(recheckCooldown)
+	return true
+}
+
+// markGoodLineChecked 检查 good_line 中的城市是否在冷却期内，不在则记录本次检查时间并返回 true
+func (c *Checker) markGoodLineChecked(cityID int) bool {
+	c.GoodLineCheckedIDsMutex.Lock()
+	defer c.GoodLineCheckedIDsMutex.Unlock()
+	if expiration, exists := c.GoodLineCheckedIDs[cityID]; exists && time.Now().Before(expiration) {
+		return false
+	}
+	c.GoodLineCheckedIDs[cityID] = time.Now().Add(recheckCooldown)
+	return true
+}
@@ -1,278 +1,213 @@
 package cmd
 
 import (
-	"bufio"
 	"context"
-	"database/sql"
 	"fmt"
-	"io"
+	"monitoring_system/config"
 	"monitoring_system/database"
 	"monitoring_system/http_requests"
-	"monitoring_system/socks5"
-	"os"
-	"os/exec"
+	"monitoring_system/ipgroup"
+	"monitoring_system/probe"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-// Socks5Tester 负责 SOCKS5 测试
-type Socks5Tester struct{}
+// DownloadManager 负责下载相关操作
+type DownloadManager struct {
+	DB          database.Store
+	TradeID     int
+	Config      *config.Config
+	SkipRecheck bool // 为 true 时下载出错不写入复查队列，Checker 复查时使用
+}
 
-// TestSOCKS5 执行 SOCKS5 测试
-func (s *Socks5Tester) TestSOCKS5(user, pass, endpointAddr, targetAddr, nodeName, outboundIP string, testCount int) (float64, int64, error) {
-	return socks5.TestSOCKS5(user, pass, endpointAddr, targetAddr, nodeName, outboundIP, testCount)
+// DownloadURLSource 返回下载地址的获取函数，优先使用数据库中的地址，没有时使用配置文件中的地址
+func DownloadURLSource(db database.Store, config *config.Config) func() (string, error) {
+	return func() (string, error) {
+		downloadURL, err := db.GetDownloadURL()
+		if err != nil {
+			return config.DownloadURL, err
+		}
+		if downloadURL == "" {
+			return config.DownloadURL, nil
+		}
+		return downloadURL, nil
+	}
 }
 
-// DownloadManager 负责下载相关操作
-type DownloadManager struct {
-	DB             *sql.DB
-	TradeID        int
-	Config         *http_requests.Config
-	ExitErrorMap   map[int]map[string]struct{} // 外层为 randomCityID，内层为 outboundIP
-	ExitErrorMutex *sync.Mutex
+// maxBadIPChanges 出口 IP 命中 bad_ips 或可疑分组时最多连续更换的次数
+const maxBadIPChanges = 3
+
+// IPScreen 检测前筛查线路的出口 IP：在 bad_ips 中且未过期，或落在可疑的网段/ASN 中时立即更换 IP，
+// 不再对其做完整的下载测试
+type IPScreen struct {
+	DB     database.Store
+	API    *http_requests.Client
+	Config *config.Config
+	Groups *ipgroup.Analyzer // 为 nil 时只检查 bad_ips
 }
 
-// GetDownloadURL 获取下载 URL
-func (dm *DownloadManager) GetDownloadURL() (string, error) {
-	downloadURL, err := database.GetDownloadURL(dm.DB)
+// rejectReason 返回出口 IP 需要更换的原因，不需要更换时返回空字符串
+func (s *IPScreen) rejectReason(outboundIP string) (string, error) {
+	bad, err := s.DB.IsBadIP(outboundIP, s.Config.BadIPExpiry())
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("获取下载 URL 出错")
-		return dm.Config.DownloadURL, err
+		return "", err
+	}
+	if bad {
+		return "命中 bad_ips", nil
 	}
-	if downloadURL == "" {
-		return dm.Config.DownloadURL, nil
+	if s.Groups != nil {
+		if group, ok := s.Groups.Suspect(outboundIP); ok {
+			return "位于可疑分组 " + group.Key, nil
+		}
 	}
-	return downloadURL, nil
+	return "", nil
 }
 
-// PerformDownloadTests 进行多次下载测试以计算平均下载速率
-func (dm *DownloadManager) PerformDownloadTests(line http_requests.Line, randomCityID int) (float64, error) {
-	downloadURL, err := dm.GetDownloadURL()
-	if err != nil {
-		return 0, err
-	}
-	proxyURL := fmt.Sprintf("socks5://%s:%s@%s", line.SSUser, line.SSPass, line.EndpointAddr)
-	downloadTestCount := dm.Config.DownloadTestCount
-	var totalSpeed float64
-	for i := 0; i < downloadTestCount; i++ {
-		logrus.WithFields(logrus.Fields{
-			"TradeID":      dm.TradeID,
-			"randomCityID": randomCityID,
-			"Test":         i + 1,
-			"outboundIP":   line.OutboundIP,
-			"NodeName":     line.NodeName,
-		}).Info(dm.TradeID, "【开始第", i+1, "次下载测试】")
-		speed, err := dm.executeCurlCommand(downloadURL, proxyURL, randomCityID, line.OutboundIP)
+// Screen 出口 IP 需要更换时更换 IP，重新获取线路后再次检查，返回用于检测的线路；
+// 连续更换 maxBadIPChanges 次仍被拒绝时返回最后获取的线路
+func (s *IPScreen) Screen(ctx context.Context, tradeID int, line http_requests.Line) (http_requests.Line, error) {
+	for changes := 0; ; changes++ {
+		reason, err := s.rejectReason(line.OutboundIP)
 		if err != nil {
+			return line, err
+		}
+		if reason == "" {
+			return line, nil
+		}
+		if changes == maxBadIPChanges {
 			logrus.WithFields(logrus.Fields{
-				"TradeID": dm.TradeID,
-				"Error":   err,
-			}).Error("使用 curl 下载文件出错")
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"TradeID":      dm.TradeID,
-				"randomCityID": randomCityID,
-				"outboundIP":   line.OutboundIP,
-				"NodeName":     line.NodeName,
-				//speed取两位
-				"Speed": fmt.Sprintf("%.2f", speed),
-			}).Info(dm.TradeID, "【第", i+1, "次下载测试结果】")
-			totalSpeed += speed
+				"TradeID":    tradeID,
+				"OutboundIP": line.OutboundIP,
+				"Reason":     reason,
+				"Changes":    changes,
+			}).Warn("【连续更换 IP 后出口 IP 仍不可用，继续检测当前 IP】")
+			return line, nil
 		}
-	}
-	if downloadTestCount > 0 {
-		avgDownloadSpeed := totalSpeed / float64(downloadTestCount)
-		formattedSpeed, err := dm.FormatSpeed(avgDownloadSpeed)
+
+		logrus.WithFields(logrus.Fields{
+			"TradeID":    tradeID,
+			"NodeName":   line.NodeName,
+			"OutboundIP": line.OutboundIP,
+			"Reason":     reason,
+		}).Warn("【出口 IP 不可用，直接更换 IP】")
+		if err := s.API.ChangeLineIP(ctx, tradeID); err != nil {
+			return line, err
+		}
+		lines, err := s.API.GetLines(ctx)
 		if err != nil {
-			return 0, err
+			return line, err
+		}
+		found := false
+		for _, l := range lines {
+			if l.SSUser == strconv.Itoa(tradeID) {
+				line, found = l, true
+				break
+			}
+		}
+		if !found {
+			return line, fmt.Errorf("更换 IP 后没有 TradeID %d 的线路", tradeID)
 		}
-		logrus.WithFields(logrus.Fields{
-			"TradeID":      dm.TradeID,
-			"randomCityID": randomCityID,
-			"outboundIP":   line.OutboundIP,
-			"NodeName":     line.NodeName,
-			"AvgSpeed":     formattedSpeed,
-		}).Info(dm.TradeID, "【平均下载速率】")
-		return formattedSpeed, nil
 	}
-	return 0, nil
 }
 
-// eCurlCommand 执行 curl 命令
-func (dm *DownloadManager) executeCurlCommand(url, proxy string, randomCityID int, outboundIP string) (float64, error) {
-	timestamp := time.Now().UnixNano()
-	tempFileName := fmt.Sprintf("/tmp/curl_speed_output_tradeid_%d_%d", dm.TradeID, timestamp)
-	outputFile, err := os.Create(tempFileName)
+// GetDownloadURL 获取下载 URL
+func (dm *DownloadManager) GetDownloadURL() (string, error) {
+	downloadURL, err := DownloadURLSource(dm.DB, dm.Config)()
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"TradeID": dm.TradeID,
 			"Error":   err,
-		}).Error("创建临时文件出错")
-		return 0, fmt.Errorf("创建临时文件出错: %v", err)
+		}).Error("获取下载 URL 出错")
 	}
-	outputFilePath := outputFile.Name()
-	defer os.Remove(outputFilePath)
-	defer outputFile.Close()
-
-	cmd := exec.CommandContext(context.Background(), "curl", "-x", proxy, "--insecure", "--silent", "-m 120", "--write-out", "%{speed_download}", "--output", "/dev/null", url)
-	cmd.Stdout = outputFile
+	return downloadURL, err
+}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("获取 curl 标准错误输出管道出错")
-		return 0, fmt.Errorf("获取 curl 标准错误输出管道出错: %v", err)
+// PerformDownloadTests 使用下载探测器进行多次下载测试，并将需要复查的错误写入复查队列
+func (dm *DownloadManager) PerformDownloadTests(ctx context.Context, prober probe.Prober, line http_requests.Line, randomCityID int) (*probe.Result, error) {
+	logrus.WithFields(logrus.Fields{
+		"TradeID":      dm.TradeID,
+		"randomCityID": randomCityID,
+		"outboundIP":   line.OutboundIP,
+		"NodeName":     line.NodeName,
+	}).Info(dm.TradeID, "【开始下载测试】")
+	result := prober.Probe(ctx, line)
+	if ctx.Err() != nil {
+		// 服务退出时中断的下载不代表线路质量，不写入复查队列
+		return nil, ctx.Err()
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		_, err := io.Copy(os.Stderr, stderr)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"TradeID": dm.TradeID,
-				"Error":   err,
-			}).Error("读取 curl 标准错误输出出错")
-		}
-	}()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 130*time.Second) // 比 curl 的 -m 选项多 10 秒
-	defer cancel()
-
-	if err := cmd.Start(); err != nil {
+	if len(result.Attempts) == 0 && result.Err != nil {
 		logrus.WithFields(logrus.Fields{
 			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("启动 curl 命令出错")
-		return 0, fmt.Errorf("启动 curl 命令出错: %v", err)
+			"Error":   result.Err,
+		}).Error("获取下载 URL 出错")
+		return nil, result.Err
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
-
-	select {
-	case err := <-done:
-		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode := exitErr.ExitCode()
-				logrus.WithFields(logrus.Fields{
-					"TradeID":      dm.TradeID,
-					"ExitCode":     exitCode,
-					"RandomCityID": randomCityID,
-					"OutboundIP":   outboundIP,
-				}).Info("curl 命令执行出错，捕获到退出码")
-
-				if exitCode == 18 || exitCode == 28 || exitCode == 97 {
-					dm.ExitErrorMutex.Lock()
-					defer dm.ExitErrorMutex.Unlock()
-
-					if _, exists := dm.ExitErrorMap[randomCityID]; !exists {
-						dm.ExitErrorMap[randomCityID] = make(map[string]struct{})
-					}
-
-					dm.ExitErrorMap[randomCityID][outboundIP] = struct{}{}
-					var outboundIPs []string
-					for ip := range dm.ExitErrorMap[randomCityID] {
-						outboundIPs = append(outboundIPs, ip)
-					}
-					logrus.WithFields(logrus.Fields{
-						"TradeID":      dm.TradeID,
-						"ExitCode":     exitCode,
-						"RandomCityID": randomCityID,
-						"OutboundIPs":  outboundIPs,
-					}).Info("【错误Curl_Erro_Map:】")
-
-					logrus.WithFields(logrus.Fields{
-						"TradeID":      dm.TradeID,
-						"ExitCode":     exitCode,
-						"RandomCityID": randomCityID,
-						"OutboundIP":   outboundIP,
-					}).Info("成功将错误信息存储到 ExitErrorMap")
-				}
-			}
+	for i, attempt := range result.Attempts {
+		if attempt.Err != nil {
+			dm.recordExitError(attempt, line, randomCityID)
 			logrus.WithFields(logrus.Fields{
 				"TradeID": dm.TradeID,
-				"Error":   err,
-			}).Error("执行 curl 命令出错")
-			return 0, fmt.Errorf("执行 curl 命令出错: %v", err)
-		}
-	case <-ctx.Done():
-		if cmd.Process != nil {
-			cmd.Process.Kill()
+				"Error":   attempt.Err,
+			}).Error("下载文件出错")
+			continue
 		}
 		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   ctx.Err(),
-		}).Error("curl 命令执行超时")
-		return 0, fmt.Errorf("curl 命令执行超时: %v", ctx.Err())
-	}
-
-	ctxWg, cancelWg := context.WithTimeout(context.Background(), 10*time.Second) // 等待 10 秒
-	defer cancelWg()
-
-	doneWg := make(chan struct{}, 1)
-	go func() {
-		wg.Wait()
-		doneWg <- struct{}{}
-	}()
-
-	select {
-	case <-doneWg:
-		// 正常完成
-	case <-ctxWg.Done():
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   ctxWg.Err(),
-		}).Error("等待 curl 标准错误输出读取超时")
-		return 0, fmt.Errorf("等待 curl 标准错误输出读取超时: %v", ctxWg.Err())
+			"TradeID":      dm.TradeID,
+			"randomCityID": randomCityID,
+			"outboundIP":   line.OutboundIP,
+			"NodeName":     line.NodeName,
+			//speed取两位
+			"Speed": fmt.Sprintf("%.2f", attempt.Speed),
+		}).Info(dm.TradeID, "【第", i+1, "次下载测试结果】")
 	}
 
-	file, err := os.Open(outputFilePath)
+	formattedSpeed, err := dm.FormatSpeed(result.DownloadRate)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("打开临时文件读取内容出错")
-		return 0, fmt.Errorf("打开临时文件读取内容出错: %v", err)
+		return nil, err
 	}
-	defer file.Close()
+	result.DownloadRate = formattedSpeed
+	logrus.WithFields(logrus.Fields{
+		"TradeID":      dm.TradeID,
+		"randomCityID": randomCityID,
+		"outboundIP":   line.OutboundIP,
+		"NodeName":     line.NodeName,
+		"AvgSpeed":     formattedSpeed,
+		"FirstByteMs":  result.Timing.FirstByte.Milliseconds(),
+	}).Info(dm.TradeID, "【平均下载速率】")
+	return result, nil
+}
 
-	scanner := bufio.NewScanner(file)
-	var speedStr string
-	for scanner.Scan() {
-		speedStr = scanner.Text()
-	}
-	if err := scanner.Err(); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("读取临时文件内容出错")
-		return 0, fmt.Errorf("读取临时文件内容出错: %v", err)
+// recordExitError 下载出现 18、28、97 退出码时，将城市和出口 IP 写入复查队列
+func (dm *DownloadManager) recordExitError(attempt probe.Attempt, line http_requests.Line, randomCityID int) {
+	exitCode := attempt.ExitCode
+	logrus.WithFields(logrus.Fields{
+		"TradeID":      dm.TradeID,
+		"ExitCode":     exitCode,
+		"RandomCityID": randomCityID,
+		"OutboundIP":   line.OutboundIP,
+	}).Info("下载测试出错，捕获到退出码")
+	if dm.SkipRecheck || !attempt.NeedsRecheck() || randomCityID == 0 {
+		return
 	}
 
-	speed, err := strconv.ParseFloat(strings.TrimSpace(speedStr), 64)
-	if err != nil {
+	if err := dm.DB.EnqueueRecheck(randomCityID, line.OutboundIP, exitCode, dm.TradeID); err != nil {
 		logrus.WithFields(logrus.Fields{
-			"TradeID": dm.TradeID,
-			"Error":   err,
-		}).Error("解析下载速率出错")
-		return 0, fmt.Errorf("解析下载速率出错: %v", err)
+			"TradeID":      dm.TradeID,
+			"RandomCityID": randomCityID,
+			"OutboundIP":   line.OutboundIP,
+			"Error":        err,
+		}).Error("【复查队列】写入复查队列出错")
+		return
 	}
-
-	mbpsSpeed := speed * 8 / (1024 * 1024)
-	return mbpsSpeed, nil
+	logrus.WithFields(logrus.Fields{
+		"TradeID":      dm.TradeID,
+		"ExitCode":     exitCode,
+		"RandomCityID": randomCityID,
+		"OutboundIP":   line.OutboundIP,
+	}).Info("【复查队列】成功将错误信息存储到复查队列")
 }
 
 // FormatSpeed 格式化平均下载速率，保留两位小数
@@ -289,18 +224,47 @@ func (dm *DownloadManager) FormatSpeed(speed float64) (float64, error) {
 	return formattedSpeed, nil
 }
 
+// good_line 和 bad_line 的判定阈值
+const (
+	goodLineResponseTime = 500   // 响应时间高于该值（毫秒）或下载速率高于 goodLineDownloadRate 时计为一次良好
+	goodLineDownloadRate = 10    // Mbps
+	badLineResponseTime  = 20000 // 响应时间高于该值（毫秒）或下载速率低于 badLineDownloadRate 时计为一次较差
+	badLineDownloadRate  = 3     // Mbps
+	lineCountThreshold   = 3     // good_count 或 bad_count 达到该值后写入 good_line 或 bad_line
+)
+
 // LineProcessor 负责处理 good_line 和 bad_line 表相关操作
 type LineProcessor struct {
-	DB      *sql.DB
+	DB      database.Store
 	TradeID int
 }
 
+// audit 生成写入 line_events 的变更上下文
+func (lp *LineProcessor) audit(reason string, avgResponseTime int64, avgDownloadSpeed float64, count int, thresholds map[string]float64) database.LineAudit {
+	return database.LineAudit{
+		Source:  database.SourceLineProcessor,
+		TradeID: lp.TradeID,
+		Reason:  reason,
+		Metrics: map[string]float64{
+			"avg_response_time": float64(avgResponseTime),
+			"download_rate":     avgDownloadSpeed,
+			"count":             float64(count),
+		},
+		Thresholds: thresholds,
+	}
+}
+
 // ProcessGoodLine 处理 good_line 表记录
 func (lp *LineProcessor) ProcessGoodLine(randomCityID int, avgResponseTime int64, avgDownloadSpeed float64) {
 	done := make(chan struct{})
 	go func() {
-		if avgResponseTime > 500 || avgDownloadSpeed > 10 {
-			err := database.UpdateGoodCount(lp.DB, randomCityID, true)
+		thresholds := map[string]float64{
+			"avg_response_time": goodLineResponseTime,
+			"download_rate":     goodLineDownloadRate,
+			"count":             lineCountThreshold,
+		}
+		if avgResponseTime > goodLineResponseTime || avgDownloadSpeed > goodLineDownloadRate {
+			err := lp.DB.UpdateGoodCount(randomCityID, true)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID": lp.TradeID,
@@ -309,7 +273,7 @@ func (lp *LineProcessor) ProcessGoodLine(randomCityID int, avgResponseTime int64
 				}).Error("更新城市的 good_count 时出错")
 				return
 			}
-			goodCount, err := database.GetGoodCount(lp.DB, randomCityID)
+			goodCount, err := lp.DB.GetGoodCount(randomCityID)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID": lp.TradeID,
@@ -318,8 +282,8 @@ func (lp *LineProcessor) ProcessGoodLine(randomCityID int, avgResponseTime int64
 				}).Error("获取城市的 good_count 时出错")
 				return
 			}
-			if goodCount >= 3 {
-				err = database.InsertIntoGoodLine(lp.DB, randomCityID)
+			if goodCount >= lineCountThreshold {
+				err = lp.DB.InsertIntoGoodLine(randomCityID, lp.audit("连续检测良好", avgResponseTime, avgDownloadSpeed, goodCount, thresholds))
 				if err != nil {
 					logrus.WithFields(logrus.Fields{
 						"TradeID": lp.TradeID,
@@ -329,7 +293,7 @@ func (lp *LineProcessor) ProcessGoodLine(randomCityID int, avgResponseTime int64
 				}
 			}
 		} else {
-			err := database.UpdateGoodCount(lp.DB, randomCityID, false)
+			err := lp.DB.UpdateGoodCount(randomCityID, false)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID": lp.TradeID,
@@ -338,7 +302,7 @@ func (lp *LineProcessor) ProcessGoodLine(randomCityID int, avgResponseTime int64
 				}).Error("重置城市的 good_count 时出错")
 				return
 			}
-			err = database.DeleteFromGoodLine(lp.DB, randomCityID)
+			err = lp.DB.DeleteFromGoodLine(randomCityID, lp.audit("检测未达到良好标准", avgResponseTime, avgDownloadSpeed, 0, thresholds))
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID": lp.TradeID,
@@ -366,8 +330,13 @@ func (lp *LineProcessor) ProcessGoodLine(randomCityID int, avgResponseTime int64
 func (lp *LineProcessor) ProcessBadLine(randomCityID int, avgResponseTime int64, avgDownloadSpeed float64, outboundIP string) {
 	done := make(chan struct{})
 	go func() {
-		isBadLine := avgResponseTime > 20000 || avgDownloadSpeed < 3
-		existsInBadLine, err := database.CheckNodeIDExistsInBadLine(lp.DB, outboundIP)
+		isBadLine := avgResponseTime > badLineResponseTime || avgDownloadSpeed < badLineDownloadRate
+		thresholds := map[string]float64{
+			"avg_response_time": badLineResponseTime,
+			"download_rate":     badLineDownloadRate,
+			"count":             lineCountThreshold,
+		}
+		existsInBadLine, err := lp.DB.CheckNodeIDExistsInBadLine(outboundIP)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"TradeID":    lp.TradeID,
@@ -378,7 +347,7 @@ func (lp *LineProcessor) ProcessBadLine(randomCityID int, avgResponseTime int64,
 		}
 
 		if isBadLine {
-			err := database.UpdateBadCount(lp.DB, randomCityID, true)
+			err := lp.DB.UpdateBadCount(randomCityID, true)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID": lp.TradeID,
@@ -387,7 +356,7 @@ func (lp *LineProcessor) ProcessBadLine(randomCityID int, avgResponseTime int64,
 				}).Error("更新城市的 bad_count 时出错")
 				return
 			}
-			badCount, err := database.GetBadCount(lp.DB, randomCityID)
+			badCount, err := lp.DB.GetBadCount(randomCityID)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID": lp.TradeID,
@@ -396,8 +365,8 @@ func (lp *LineProcessor) ProcessBadLine(randomCityID int, avgResponseTime int64,
 				}).Error("获取城市的 bad_count 时出错")
 				return
 			}
-			if badCount >= 3 && !existsInBadLine {
-				err = database.InsertIntoBadLine(lp.DB, outboundIP, randomCityID)
+			if badCount >= lineCountThreshold && !existsInBadLine {
+				err = lp.DB.InsertIntoBadLine(outboundIP, randomCityID, lp.audit("连续检测较差", avgResponseTime, avgDownloadSpeed, badCount, thresholds))
 				if err != nil {
 					logrus.WithFields(logrus.Fields{
 						"TradeID":    lp.TradeID,
@@ -408,7 +377,7 @@ func (lp *LineProcessor) ProcessBadLine(randomCityID int, avgResponseTime int64,
 				}
 			}
 		} else {
-			err := database.UpdateBadCount(lp.DB, randomCityID, false)
+			err := lp.DB.UpdateBadCount(randomCityID, false)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"TradeID": lp.TradeID,
@@ -418,7 +387,7 @@ func (lp *LineProcessor) ProcessBadLine(randomCityID int, avgResponseTime int64,
 				return
 			}
 			if existsInBadLine {
-				err = database.DeleteFromBadLine(lp.DB, outboundIP)
+				err = lp.DB.DeleteFromBadLine(outboundIP, lp.audit("检测恢复正常", avgResponseTime, avgDownloadSpeed, 0, thresholds))
 				if err != nil {
 					logrus.WithFields(logrus.Fields{
 						"TradeID":    lp.TradeID,
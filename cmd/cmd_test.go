@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/http_requests"
+	"monitoring_system/ipgroup"
+	"monitoring_system/mockapi"
+)
+
+const (
+	testTradeID = 1001
+	testCityID  = 101
+)
+
+// newTestScreen 创建连接模拟上游的 IPScreen，testTradeID 的线路在 198.51.100.1 和 198.51.100.2 之间轮换
+func newTestScreen(t *testing.T) (*IPScreen, *mockapi.Server) {
+	t.Helper()
+	mock := mockapi.NewServer(mockapi.DefaultScenario("127.0.0.1:1080", testTradeID))
+	upstream := httptest.NewServer(mock)
+	t.Cleanup(upstream.Close)
+	api := http_requests.NewClient(config.APICFG{}, upstream.URL, config.ThrottleCFG{Settle: time.Millisecond})
+
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	return &IPScreen{DB: db, API: api, Config: &config.Config{TradeIDs: []int{testTradeID}}}, mock
+}
+
+// addBadIP 将出口 IP 写入 bad_ips
+func addBadIP(t *testing.T, s *IPScreen, ip string) {
+	t.Helper()
+	if err := s.DB.InsertIntoBadIPs(ip, testCityID, s.Config.BadIPExpiry(), database.LineAudit{Source: database.SourceAPI}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPScreen(t *testing.T) {
+	tests := []struct {
+		name    string
+		badIPs  []string
+		changes int    // 期望更换 IP 的次数
+		want    string // 期望返回线路的出口 IP
+	}{
+		{"clean", nil, 0, "198.51.100.1"},
+		{"bad_ip_changed", []string{"198.51.100.1"}, 1, "198.51.100.2"},
+		// 两个出口 IP 都在 bad_ips 中，连续更换 maxBadIPChanges 次后继续检测当前 IP
+		{"stops_after_max_changes", []string{"198.51.100.1", "198.51.100.2"}, maxBadIPChanges, "198.51.100.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			screen, mock := newTestScreen(t)
+			for _, ip := range tt.badIPs {
+				addBadIP(t, screen, ip)
+			}
+			line, _ := mock.Line(testTradeID)
+
+			got, err := screen.Screen(context.Background(), testTradeID, line)
+			if err != nil {
+				t.Fatalf("筛查出错: %v", err)
+			}
+			if calls := mock.Calls(http_requests.EndpointChangeLineIPAddr); calls != tt.changes {
+				t.Fatalf("更换 IP %d 次，期望 %d 次", calls, tt.changes)
+			}
+			if got.OutboundIP != tt.want {
+				t.Fatalf("返回线路的出口 IP 为 %s，期望 %s", got.OutboundIP, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPScreenSuspectGroup(t *testing.T) {
+	screen, mock := newTestScreen(t)
+	// 198.51.100.0/24 的检测全部失败，整个网段可疑
+	for i := 0; i < 5; i++ {
+		err := screen.DB.SaveNodeTestResult(database.NodeTestResult{NodeName: "南京市电信", NodeID: testCityID, OutboundIP: "198.51.100.9", TradeID: testTradeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err := ipgroup.NewAnalyzer(screen.DB, &config.Config{IPGroups: config.IPGroupsCFG{MinTests: 5, FailureRate: 0.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := groups.Analyze(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := groups.Suspect("198.51.100.1"); !ok {
+		t.Fatal("198.51.100.0/24 未被判定为可疑")
+	}
+
+	// 未启用分组分析时只检查 bad_ips
+	line, _ := mock.Line(testTradeID)
+	if _, err := screen.Screen(context.Background(), testTradeID, line); err != nil {
+		t.Fatal(err)
+	}
+	if calls := mock.Calls(http_requests.EndpointChangeLineIPAddr); calls != 0 {
+		t.Fatalf("未启用分组分析时更换 IP %d 次", calls)
+	}
+
+	// 轮换的出口 IP 都在可疑网段中，更换 maxBadIPChanges 次后停止
+	screen.Groups = groups
+	got, err := screen.Screen(context.Background(), testTradeID, line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := mock.Calls(http_requests.EndpointChangeLineIPAddr); calls != maxBadIPChanges {
+		t.Fatalf("更换 IP %d 次，期望 %d 次", calls, maxBadIPChanges)
+	}
+	if current, _ := mock.Line(testTradeID); got != current {
+		t.Fatalf("返回线路为 %+v，期望最后获取的线路 %+v", got, current)
+	}
+}
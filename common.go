@@ -1,27 +1,35 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"fmt"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/exp/rand"
 	"monitoring_system/cmd"
+	"monitoring_system/config"
 	"monitoring_system/database"
+	"monitoring_system/events"
 	"monitoring_system/http_requests"
+	"monitoring_system/jobs"
+	"monitoring_system/probe"
+	"monitoring_system/scheduler"
 	"strconv"
-	"time"
 )
 
 // 检测逻辑封装到一个单独的函数中
-func performChecks(db *sql.DB, tradeID int, config *http_requests.Config, sem chan struct{}, targetAddr string) {
-	// 获取信号量
-	sem <- struct{}{}
+func performChecks(ctx context.Context, db database.Store, api *http_requests.Client, tradeID int, config *config.Config, sem chan struct{}, probers []probe.Prober, sched *scheduler.Scheduler, screen *cmd.IPScreen) {
+	// 获取信号量，服务退出时不再开始新的检测
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
 	defer func() {
 		// 释放信号量
 		<-sem
 	}()
 
-	// 获取所有城市 ID
-	cityIDs, err := database.GetAllCityIDs(db)
+	// 按覆盖情况选择下一个检测的城市 ID
+	randomCityID, err := sched.Next(database.ProjectFilterFor(config, tradeID))
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"TradeID": tradeID,
@@ -30,63 +38,59 @@ func performChecks(db *sql.DB, tradeID int, config *http_requests.Config, sem ch
 		return
 	}
 
-	// 随机选择一个城市 ID
-	rand.Seed(uint64(time.Now().UnixNano()))
-	randomCityID := cityIDs[rand.Intn(len(cityIDs))]
+	// 按需检测可能正在使用该 TradeID，等待其结束
+	unlock, err := tradeLocks.lock(ctx, tradeID)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	// 错误已在检测过程中记录日志
+	_, _ = checkCity(ctx, db, api, tradeID, randomCityID, config, probers, screen, events.SourceChecks, nil)
 
-	// 发送 POST 请求，添加重试机制
-	maxRetries := 3
-	var changeNodeErr error
-	for i := 0; i < maxRetries; i++ {
-		changeNodeErr = http_requests.ChangeNode(config, randomCityID, tradeID)
-		if changeNodeErr == nil {
-			break
-		}
-		if i == maxRetries-1 {
-			logrus.WithFields(logrus.Fields{
-				"TradeID": tradeID,
-				"Retries": maxRetries,
-				"Error":   changeNodeErr,
-			}).Error("变更节点时出错，重试多次后仍失败")
-			return
+	logrus.WithFields(logrus.Fields{
+		// "TradeID": tradeID,
+	}).Info("=【", tradeID, "完成处理检测流程】 =")
+}
+
+// checkCity 将 tradeID 切换到城市 randomCityID，对命中的线路依次执行探测器并保存结果，周期检测和按需检测共用。
+// probers 同时包含 socks5 和 download 时保存节点检测结果并更新 good_line、bad_line；
+// progress 不为 nil 时用于报告进度
+func checkCity(ctx context.Context, db database.Store, api *http_requests.Client, tradeID, randomCityID int, config *config.Config, probers []probe.Prober, screen *cmd.IPScreen, source string, progress func(message string)) (jobs.Outcome, error) {
+	var outcome jobs.Outcome
+	report := func(format string, args ...interface{}) {
+		if progress != nil {
+			progress(fmt.Sprintf(format, args...))
 		}
-		logrus.WithFields(logrus.Fields{
-			"TradeID": tradeID,
-			"Retry":   i + 1,
-		}).Error("变更节点失败，重试中...")
-		time.Sleep(2 * time.Second) // 重试间隔 2 秒
 	}
 
-	// 获取线路信息，添加重试机制
-	var lines []http_requests.Line
-	var getLinesErr error
-	for i := 0; i < maxRetries; i++ {
+	// 变更节点，重试由 api 客户端按配置处理
+	report("TradeID %d 变更节点到城市 %d", tradeID, randomCityID)
+	err := api.ChangeNode(ctx, randomCityID, tradeID)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"TradeID": tradeID,
-			// "Retry":   i + 1,
-		}).Info(tradeID, "【尝试获取线路信息...】") // 添加调试信息
-		lines, getLinesErr = http_requests.GetLines(config)
-		if getLinesErr == nil {
-			logrus.WithFields(logrus.Fields{
-				"TradeID": tradeID,
-				// "Retry":   i + 1,
-			}).Info(tradeID, "【成功获取线路信息】") // 添加调试信息
-			break
-		}
-		if i == maxRetries-1 {
-			logrus.WithFields(logrus.Fields{
-				"TradeID": tradeID,
-				"Retries": maxRetries,
-				"Error":   getLinesErr,
-			}).Error("【获取线路信息出错，重试多次后仍失败】")
-			return
-		}
+			"Error":   err,
+		}).Error("变更节点时出错，重试多次后仍失败")
+		return outcome, fmt.Errorf("变更节点出错: %w", err)
+	}
+
+	// 获取线路信息
+	logrus.WithFields(logrus.Fields{
+		"TradeID": tradeID,
+	}).Info(tradeID, "【尝试获取线路信息...】")
+	report("获取线路信息")
+	lines, err := api.GetLines(ctx)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"TradeID": tradeID,
-			"Retry":   i + 1,
-		}).Error(i, "次", "获取线路信息失败，重试中...")
-		time.Sleep(2 * time.Second) // 重试间隔 2 秒
+			"Error":   err,
+		}).Error("【获取线路信息出错，重试多次后仍失败】")
+		return outcome, fmt.Errorf("获取线路信息出错: %w", err)
 	}
+	logrus.WithFields(logrus.Fields{
+		"TradeID": tradeID,
+	}).Info(tradeID, "【成功获取线路信息】")
 
 	// 查找命中的线路
 	var matchedLines []http_requests.Line
@@ -96,14 +100,14 @@ func performChecks(db *sql.DB, tradeID int, config *http_requests.Config, sem ch
 			matchedLines = append(matchedLines, line)
 		}
 	}
+	if len(matchedLines) == 0 {
+		return outcome, fmt.Errorf("没有找到 TradeID %d 的线路", tradeID)
+	}
 
-	socks5Tester := &cmd.Socks5Tester{}
 	downloadManager := &cmd.DownloadManager{
-		DB:             db,
-		TradeID:        tradeID,
-		Config:         config,
-		ExitErrorMap:   curlExitErrorMap,
-		ExitErrorMutex: &curlExitErrorMutex,
+		DB:      db,
+		TradeID: tradeID,
+		Config:  config,
 	}
 	lineProcessor := &cmd.LineProcessor{
 		DB:      db,
@@ -112,63 +116,172 @@ func performChecks(db *sql.DB, tradeID int, config *http_requests.Config, sem ch
 
 	// 对命中的线路进行处理
 	for _, line := range matchedLines {
-		// 进行 SOCKS5 测试
-		successRate, avgResponseTime, err := socks5Tester.TestSOCKS5(line.SSUser, line.SSPass, line.EndpointAddr, targetAddr, line.NodeName, line.OutboundIP, 10)
-		nodeName := removeLeadingChar(line.NodeName)
+		// 出口 IP 在 bad_ips 或可疑分组中时先更换 IP，不对已知的坏 IP 做完整检测
+		line, err = screen.Screen(ctx, tradeID, line)
 		if err != nil {
+			if ctx.Err() != nil {
+				return outcome, ctx.Err()
+			}
+			logrus.WithFields(logrus.Fields{
+				"TradeID":    tradeID,
+				"NodeName":   line.NodeName,
+				"OutboundIP": line.OutboundIP,
+				"Error":      err,
+			}).Error("筛查出口 IP 时出错")
+			report("筛查线路 %s 的出口 IP 出错: %v", line.NodeName, err)
+			continue
+		}
+		nodeName := removeLeadingChar(line.NodeName)
+		report("检测线路 %s，出口 IP %s", nodeName, line.OutboundIP)
+
+		// 依次执行配置的探测器，SOCKS5 和下载测试的结果用于判定线路好坏
+		var socks5Result, downloadResult *probe.Result
+		var results []*probe.Result
+		skipped := false
+		for _, prober := range probers {
+			var result *probe.Result
+			if prober.Name() == probe.TypeDownload {
+				// 进行多次下载测试以计算平均下载速率
+				result, err = downloadManager.PerformDownloadTests(ctx, prober, line, randomCityID)
+				if err != nil {
+					report("下载测试出错: %v", err)
+					skipped = true
+					break
+				}
+				downloadResult = result
+			} else {
+				result = prober.Probe(ctx, line)
+			}
+			if prober.Name() == probe.TypeSOCKS5 {
+				socks5Result = result
+			}
+			results = append(results, result)
+			if result.Err != nil {
+				report("%s 探测失败: %v", result.ProbeType, result.Err)
+			} else {
+				report("%s 探测完成，成功率 %.2f%%", result.ProbeType, result.SuccessRate)
+			}
+		}
+		if ctx.Err() != nil {
+			// 服务退出时被中断的检测结果不完整，不写入数据库
 			logrus.WithFields(logrus.Fields{
 				"TradeID":  tradeID,
 				"NodeName": line.NodeName,
-				"Error":    err,
-			}).Error("【对节点进行 SOCKS5 测试出错】")
-			successRate = 0
-			avgResponseTime = -1
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"TradeID":      tradeID,
-				"NodeName":     line.NodeName,
-				"SuccessRate":  successRate,
-				"ResponseTime": avgResponseTime,
-				"randomCityID": randomCityID,
-			}).Info("【节点SOCKS5测试结果】")
+			}).Warn("【检测被中断，丢弃本次结果】")
+			return outcome, ctx.Err()
 		}
-
-		// 进行多次下载测试以计算平均下载速率
-		avgDownloadSpeed, err := downloadManager.PerformDownloadTests(line, randomCityID)
-		if err != nil {
+		if skipped {
 			continue
 		}
 
 		// 加锁保护数据库操作
 		dbMutex.Lock()
-		// 保存节点检测结果到数据库，包括下载速率和节点 ID
-		err = database.SaveNodeTestResult(db, nodeName, successRate, int64(avgResponseTime), avgDownloadSpeed, randomCityID)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"TradeID":  tradeID,
-				"NodeName": nodeName,
-				"Error":    err,
-			}).Error("保存节点检测结果到数据库时出错")
+		if socks5Result != nil && downloadResult != nil {
+			// 进行 SOCKS5 测试
+			successRate, avgResponseTime := socks5Result.SuccessRate, socks5Result.ResponseTime
+			if socks5Result.Err != nil {
+				logrus.WithFields(logrus.Fields{
+					"TradeID":  tradeID,
+					"NodeName": line.NodeName,
+					"Error":    socks5Result.Err,
+				}).Error("【对节点进行 SOCKS5 测试出错】")
+				successRate = 0
+				avgResponseTime = -1
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"TradeID":      tradeID,
+					"NodeName":     line.NodeName,
+					"SuccessRate":  successRate,
+					"ResponseTime": avgResponseTime,
+					"randomCityID": randomCityID,
+				}).Info("【节点SOCKS5测试结果】")
+			}
+			avgDownloadSpeed := downloadResult.DownloadRate
+
+			// 保存节点检测结果到数据库，包括下载速率、城市 ID、出口 IP 和 TradeID
+			record := database.NodeTestResult{
+				NodeName:        nodeName,
+				NodeID:          randomCityID,
+				OutboundIP:      line.OutboundIP,
+				TradeID:         tradeID,
+				SuccessRate:     successRate,
+				AvgResponseTime: avgResponseTime,
+				DownloadRate:    avgDownloadSpeed,
+				PhaseTimes: database.PhaseTimes{
+					Connect:      socks5Result.Timing.Connect.Milliseconds(),
+					Handshake:    socks5Result.Timing.Handshake.Milliseconds(),
+					ConnectReply: socks5Result.Timing.ConnectReply.Milliseconds(),
+					FirstByte:    downloadResult.Timing.FirstByte.Milliseconds(),
+				},
+			}
+			err = db.SaveNodeTestResult(record)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"TradeID":  tradeID,
+					"NodeName": nodeName,
+					"Error":    err,
+				}).Error("保存节点检测结果到数据库时出错")
+			}
+			events.Publish(events.TypeNodeResult, source, record)
+			outcome.NodeResults = append(outcome.NodeResults, record)
 		}
 
-		// 处理 good_line 表记录
-		lineProcessor.ProcessGoodLine(randomCityID, avgResponseTime, avgDownloadSpeed)
+		// 按探测类型保存每个探测器的结果
+		for _, result := range results {
+			probeRecord := result.Record(line, randomCityID, tradeID)
+			err = db.SaveProbeResult(probeRecord)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"TradeID":   tradeID,
+					"ProbeType": result.ProbeType,
+					"Error":     err,
+				}).Error("保存探测结果到数据库时出错")
+			}
+			events.Publish(events.TypeProbeResult, source, probeRecord)
+			outcome.ProbeResults = append(outcome.ProbeResults, probeRecord)
+		}
+
+		// 只执行部分探测器时没有完整的检测结果，不判定线路好坏
+		if socks5Result != nil && downloadResult != nil {
+			record := outcome.NodeResults[len(outcome.NodeResults)-1]
 
-		// 处理 bad_line 表记录
-		lineProcessor.ProcessBadLine(randomCityID, avgResponseTime, avgDownloadSpeed, line.OutboundIP)
+			// 处理 good_line 表记录
+			lineProcessor.ProcessGoodLine(randomCityID, record.AvgResponseTime, record.DownloadRate)
+
+			// 处理 bad_line 表记录
+			lineProcessor.ProcessBadLine(randomCityID, record.AvgResponseTime, record.DownloadRate, line.OutboundIP)
+		}
 
 		// 解锁
 		dbMutex.Unlock()
 	}
+	if len(outcome.ProbeResults) == 0 {
+		return outcome, fmt.Errorf("TradeID %d 的 %d 条线路均未完成检测", tradeID, len(matchedLines))
+	}
+	return outcome, nil
+}
 
-	logrus.WithFields(logrus.Fields{
-		// "TradeID": tradeID,
-	}).Info("=【", tradeID, "完成处理检测流程】 =")
+// projectsWithoutCities 返回数据库中还没有城市数据的项目
+func projectsWithoutCities(db database.Store, projects []config.ProjectCFG) []config.ProjectCFG {
+	var missing []config.ProjectCFG
+	for _, project := range projects {
+		count, err := db.CountCities(database.ProjectFilterOf(project))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"Project": project.Name,
+				"Error":   err,
+			}).Fatal("查询项目城市数量时出错")
+		}
+		if count == 0 {
+			missing = append(missing, project)
+		}
+	}
+	return missing
 }
 
-func updateDatabase(db *sql.DB, config *http_requests.Config) {
+func updateDatabase(ctx context.Context, db database.Store, api *http_requests.Client, projects []config.ProjectCFG) {
 	// 获取省份列表
-	provinces, err := http_requests.GetProvinces(config)
+	provinces, err := api.GetProvinces(ctx)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"Error": err,
@@ -176,29 +289,33 @@ func updateDatabase(db *sql.DB, config *http_requests.Config) {
 	}
 
 	// 存储省份列表到数据库
-	err = database.SaveProvinces(db, provinces)
+	err = db.SaveProvinces(provinces)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"Error": err,
 		}).Fatal("存储省份列表到数据库出错")
 	}
 
-	// 获取并存储城市列表
-	for _, province := range provinces {
-		nodes, err := http_requests.GetNodes(config, province.ID)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"Province": province.Name,
-				"Error":    err,
-			}).Error("获取省份节点信息出错")
-			continue
-		}
-		err = database.SaveNodes(db, nodes)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"Province": province.Name,
-				"Error":    err,
-			}).Error("保存省份节点信息到数据库出错")
+	// 按项目获取并存储城市列表
+	for _, project := range projects {
+		for _, province := range provinces {
+			nodes, err := api.GetNodes(ctx, project.ProjectID, project.LineID, province.ID)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"Project":  project.Name,
+					"Province": province.Name,
+					"Error":    err,
+				}).Error("获取省份节点信息出错")
+				continue
+			}
+			err = db.SaveNodes(nodes, project)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"Project":  project.Name,
+					"Province": province.Name,
+					"Error":    err,
+				}).Error("保存省份节点信息到数据库出错")
+			}
 		}
 	}
 }
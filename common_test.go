@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"monitoring_system/cmd"
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/events"
+	"monitoring_system/fakesocks"
+	"monitoring_system/http_requests"
+	"monitoring_system/mockapi"
+	"monitoring_system/probe"
+)
+
+const (
+	testTradeID = 1001
+	testCityID  = 101
+)
+
+// checkEnv 端到端检测环境：模拟上游、假 SOCKS5 代理、下载服务器和 SQLite 内存库
+type checkEnv struct {
+	db      database.Store
+	api     *http_requests.Client
+	mock    *mockapi.Server
+	proxy   *fakesocks.Server
+	config  *config.Config
+	probers []probe.Prober
+	screen  *cmd.IPScreen
+	size    *atomic.Int64 // 下载文件的大小
+}
+
+func newCheckEnv(t *testing.T) *checkEnv {
+	t.Helper()
+	size := &atomic.Int64{}
+	size.Store(1024 * 1024)
+	download := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(make([]byte, size.Load())))
+	}))
+	t.Cleanup(download.Close)
+
+	proxy := fakesocks.NewServer(fakesocks.Config{})
+	if err := proxy.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+
+	mock := mockapi.NewServer(mockapi.DefaultScenario(proxy.Addr(), testTradeID))
+	upstream := httptest.NewServer(mock)
+	t.Cleanup(upstream.Close)
+	api := http_requests.NewClient(config.APICFG{}, upstream.URL, config.ThrottleCFG{Settle: time.Millisecond})
+
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{TradeIDs: []int{testTradeID}}
+	updateDatabase(context.Background(), db, api, cfg.ProjectList())
+
+	probers, err := probe.FromConfig([]config.ProbeCFG{
+		{Type: probe.TypeSOCKS5, Count: 1},
+		{Type: probe.TypeDownload, Count: 1, URL: download.URL + "/file"},
+	}, probe.Env{TargetAddr: strings.TrimPrefix(download.URL, "http://")}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &checkEnv{
+		db:      db,
+		api:     api,
+		mock:    mock,
+		proxy:   proxy,
+		config:  cfg,
+		probers: probers,
+		screen:  &cmd.IPScreen{DB: db, API: api, Config: cfg},
+		size:    size,
+	}
+}
+
+// check 使用 testTradeID 检测 testCityID
+func (e *checkEnv) check(t *testing.T) {
+	t.Helper()
+	outcome, err := checkCity(context.Background(), e.db, e.api, testTradeID, testCityID, e.config, e.probers, e.screen, events.SourceChecks, nil)
+	if err != nil {
+		t.Fatalf("检测出错: %v", err)
+	}
+	if len(outcome.NodeResults) != 1 {
+		t.Fatalf("检测结果 %d 条，期望 1 条", len(outcome.NodeResults))
+	}
+}
+
+func TestCheckCityLineTables(t *testing.T) {
+	env := newCheckEnv(t)
+
+	// 本地下载速率远高于 good_line 的阈值，连续三次后写入 good_line
+	for i := 0; i < 3; i++ {
+		env.check(t)
+	}
+	good, err := env.db.GoodLineEntries(database.ProjectFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(good) != 1 || good[0].CityID != testCityID {
+		t.Fatalf("good_line 为 %+v，期望只有城市 %d", good, testCityID)
+	}
+
+	// 限速到约 0.25Mbps，低于 bad_line 的阈值，第一次即移出 good_line，连续三次后写入 bad_line。
+	// 缩小下载文件，每次检测约 0.5 秒
+	env.size.Store(16 * 1024)
+	env.proxy.SetUserImpairments("1001", fakesocks.Impairments{Bandwidth: 32 * 1024})
+	for i := 0; i < 3; i++ {
+		env.check(t)
+	}
+	good, err = env.db.GoodLineEntries(database.ProjectFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(good) != 0 {
+		t.Fatalf("限速后 good_line 仍有 %+v", good)
+	}
+	line, _ := env.mock.Line(testTradeID)
+	bad, err := env.db.BadLineEntries(database.ProjectFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 1 || bad[0].CityID != testCityID || bad[0].OutboundIP != line.OutboundIP {
+		t.Fatalf("bad_line 为 %+v，期望城市 %d 的出口 IP %s", bad, testCityID, line.OutboundIP)
+	}
+
+	lineEvents, err := env.db.LineEvents(database.LineEventQuery{CityID: testCityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transitions []string
+	for i := len(lineEvents) - 1; i >= 0; i-- {
+		if lineEvents[i].Source != database.SourceLineProcessor {
+			t.Errorf("变更记录的来源为 %s", lineEvents[i].Source)
+		}
+		transitions = append(transitions, lineEvents[i].FromState+"->"+lineEvents[i].ToState)
+	}
+	want := []string{"none->good_line", "good_line->none", "none->bad_line"}
+	if strings.Join(transitions, ",") != strings.Join(want, ",") {
+		t.Fatalf("变更记录为 %v，期望 %v", transitions, want)
+	}
+
+	// bad_line 按出口 IP 记录，速率恢复且变更节点轮换回同一出口 IP 时移出 bad_line
+	env.proxy.ClearUserImpairments("1001")
+	env.size.Store(1024 * 1024)
+	for i := 0; i < 2; i++ {
+		env.check(t)
+	}
+	if bad, err = env.db.BadLineEntries(database.ProjectFilter{}); err != nil || len(bad) != 0 {
+		t.Fatalf("速率恢复后 bad_line 为 %+v, %v", bad, err)
+	}
+}
+
+func TestCheckCityScreensBadIP(t *testing.T) {
+	env := newCheckEnv(t)
+
+	// 变更节点后线路的出口 IP 为 198.51.100.2，预先写入 bad_ips
+	const badIP = "198.51.100.2"
+	if err := env.db.InsertIntoBadIPs(badIP, testCityID, env.config.BadIPExpiry(), database.LineAudit{Source: database.SourceAPI}); err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := checkCity(context.Background(), env.db, env.api, testTradeID, testCityID, env.config, env.probers, env.screen, events.SourceChecks, nil)
+	if err != nil {
+		t.Fatalf("检测出错: %v", err)
+	}
+	if calls := env.mock.Calls(http_requests.EndpointChangeLineIPAddr); calls != 1 {
+		t.Fatalf("更换 IP %d 次，期望命中 bad_ips 后更换 1 次", calls)
+	}
+	if len(outcome.NodeResults) != 1 || outcome.NodeResults[0].OutboundIP == badIP {
+		t.Fatalf("检测结果为 %+v，不应检测 bad_ips 中的出口 IP", outcome.NodeResults)
+	}
+
+	// 筛查只更换 IP，不修改 bad_ips
+	entries, err := env.db.BadIPEntries(database.ProjectFilter{}, env.config.BadIPExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].OutboundIP != badIP || entries[0].HitCount != 1 {
+		t.Fatalf("bad_ips 为 %+v", entries)
+	}
+}
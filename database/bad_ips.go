@@ -0,0 +1,147 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SourceRetention 过期清理，对应 line_events 的 source
+const SourceRetention = "retention"
+
+// BadIPEntry bad_ips 表中的一条记录
+type BadIPEntry struct {
+	OutboundIP string    `json:"outbound_ip"`
+	CityID     int       `json:"city_id"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	HitCount   int       `json:"hit_count"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Expired    bool      `json:"expired"` // 已过期但尚未被清理
+	Note       string    `json:"note"`
+}
+
+// InsertIntoBadIPs 插入 outboundIP 和 randomCityID 到 bad_ips 表。
+// 未过期的记录再次命中时累加 hit_count 并更新 last_seen，新记录和过期后重新命中的记录写入变更记录
+func (s *sqlStore) InsertIntoBadIPs(outboundIP string, randomCityID int, ttl time.Duration, audit LineAudit) error {
+	now := time.Now()
+	return s.withLineTx(func(tx *lineTx) error {
+		var lastSeen sql.NullInt64
+		err := tx.QueryRow(s.rebind("SELECT last_seen FROM bad_ips WHERE outboundIP = ? AND randomCityID = ?"),
+			outboundIP, randomCityID).Scan(&lastSeen)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && lastSeen.Int64 >= now.Add(-ttl).Unix() {
+			_, err := tx.Exec(s.rebind("UPDATE bad_ips SET hit_count = hit_count + 1, last_seen = ? WHERE outboundIP = ? AND randomCityID = ?"),
+				now.Unix(), outboundIP, randomCityID)
+			return err
+		}
+
+		if _, err := tx.Exec(s.rebind(`
+            INSERT INTO bad_ips (outboundIP, randomCityID, first_seen, last_seen, hit_count) VALUES (?,?,?,?,1)
+            ON CONFLICT (outboundIP, randomCityID) DO UPDATE SET
+                first_seen = excluded.first_seen, last_seen = excluded.last_seen, hit_count = 1
+        `), outboundIP, randomCityID, now.Unix(), now.Unix()); err != nil {
+			return err
+		}
+		return s.recordLineEvent(tx, randomCityID, outboundIP, LineStateNone, LineStateBadIPs, audit)
+	})
+}
+
+// IsBadIP 判断出口 IP 是否在 bad_ips 中且 ttl 内仍有命中
+func (s *sqlStore) IsBadIP(outboundIP string, ttl time.Duration) (bool, error) {
+	var count int
+	err := s.queryRow("SELECT COUNT(*) FROM bad_ips WHERE outboundIP = ? AND last_seen >= ?",
+		outboundIP, time.Now().Add(-ttl).Unix()).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// BadIPEntries 获取 filter 范围内的 bad_ips 记录，包括已过期但尚未清理的记录，按最近命中时间倒序
+func (s *sqlStore) BadIPEntries(filter ProjectFilter, ttl time.Duration) ([]BadIPEntry, error) {
+	where, args := filter.Where("c")
+	rows, err := s.query(`
+        SELECT b.outboundIP, b.randomCityID, b.first_seen, b.last_seen, b.hit_count, b.note
+        FROM bad_ips b
+        LEFT JOIN cities c ON c.id = b.randomCityID
+        WHERE `+where+`
+        ORDER BY b.last_seen DESC
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var entries []BadIPEntry
+	for rows.Next() {
+		var entry BadIPEntry
+		var cityID, firstSeen, lastSeen, hitCount sql.NullInt64
+		var note sql.NullString
+		if err := rows.Scan(&entry.OutboundIP, &cityID, &firstSeen, &lastSeen, &hitCount, &note); err != nil {
+			return nil, err
+		}
+		entry.Note = note.String
+		entry.CityID = int(cityID.Int64)
+		entry.FirstSeen = time.Unix(firstSeen.Int64, 0)
+		entry.LastSeen = time.Unix(lastSeen.Int64, 0)
+		entry.HitCount = int(hitCount.Int64)
+		entry.ExpiresAt = entry.LastSeen.Add(ttl)
+		entry.Expired = !entry.ExpiresAt.After(now)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// PurgeExpiredBadIPs 删除超过 ttl 未再命中的 bad_ips 记录并写入变更记录，返回删除的条数
+func (s *sqlStore) PurgeExpiredBadIPs(ttl time.Duration) (int, error) {
+	expireBefore := time.Now().Add(-ttl).Unix()
+	purged := 0
+	err := s.withLineTx(func(tx *lineTx) error {
+		rows, err := tx.Query(s.rebind("SELECT outboundIP, randomCityID, hit_count, last_seen FROM bad_ips WHERE last_seen < ?"), expireBefore)
+		if err != nil {
+			return err
+		}
+		type expiredIP struct {
+			outboundIP string
+			cityID     int
+			hitCount   int64
+			lastSeen   int64
+		}
+		var expired []expiredIP
+		for rows.Next() {
+			var e expiredIP
+			var cityID, hitCount, lastSeen sql.NullInt64
+			if err := rows.Scan(&e.outboundIP, &cityID, &hitCount, &lastSeen); err != nil {
+				rows.Close()
+				return err
+			}
+			e.cityID, e.hitCount, e.lastSeen = int(cityID.Int64), hitCount.Int64, lastSeen.Int64
+			expired = append(expired, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, e := range expired {
+			if _, err := tx.Exec(s.rebind("DELETE FROM bad_ips WHERE outboundIP = ? AND randomCityID = ?"), e.outboundIP, e.cityID); err != nil {
+				return err
+			}
+			audit := LineAudit{
+				Source:     SourceRetention,
+				Reason:     "超过 TTL 未再命中",
+				Metrics:    map[string]float64{"hit_count": float64(e.hitCount), "idle_hours": time.Since(time.Unix(e.lastSeen, 0)).Hours()},
+				Thresholds: map[string]float64{"ttl_hours": ttl.Hours()},
+			}
+			if err := s.recordLineEvent(tx, e.cityID, e.outboundIP, LineStateBadIPs, LineStateNone, audit); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	return purged, err
+}
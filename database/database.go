@@ -2,233 +2,239 @@ package database
 
 import (
 	"database/sql"
-	"fmt"
-	"github.com/sirupsen/logrus"
 	"log"
+	"monitoring_system/config"
 	"monitoring_system/http_requests"
+	"strings"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
-// InitDatabase 初始化数据库
-func InitDatabase() *sql.DB {
-	db, err := OpenDatabase()
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"Error": err,
-		}).Fatal("打开数据库出错")
+// SaveProvinces 存储省份列表到数据库
+func (s *sqlStore) SaveProvinces(provinces []http_requests.Province) error {
+	for _, province := range provinces {
+		_, err := s.exec("INSERT INTO provinces (id, name) VALUES (?,?) ON CONFLICT DO NOTHING", province.ID, province.Name)
+		if err != nil {
+			return err
+		}
 	}
-	// 设置最大打开连接数
-	db.SetMaxOpenConns(10)
-	// 设置最大空闲连接数
-	db.SetMaxIdleConns(5)
+	return nil
+}
 
-	// 创建表
-	if err = CreateTables(db); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"Error": err,
-		}).Fatal("创建表出错")
+// SaveNodes 存储项目的城市列表到数据库，已存在的城市只更新项目和线路标记
+func (s *sqlStore) SaveNodes(nodes []http_requests.Node, project config.ProjectCFG) error {
+	for _, node := range nodes {
+		_, err := s.exec(`
+            INSERT INTO cities (id, name, line_type, max, area_id, project_id, line_id) VALUES (?,?,?,?,?,?,?)
+            ON CONFLICT(id) DO UPDATE SET project_id = excluded.project_id, line_id = excluded.line_id
+        `, node.ID, node.Name, node.LineType, node.Max, node.AreaID, project.ProjectID, project.LineID)
+		if err != nil {
+			return err
+		}
 	}
-	return db
+	return nil
 }
 
-// OpenDatabase 打开 SQLite 数据库
-func OpenDatabase() (*sql.DB, error) {
-	return sql.Open("sqlite3", "./monitor.db")
+// TagUntaggedCities 将没有项目标记的城市归入 project，旧库中的城市都是按默认项目拉取的
+func (s *sqlStore) TagUntaggedCities(project config.ProjectCFG) error {
+	_, err := s.exec("UPDATE cities SET project_id = ?, line_id = ? WHERE project_id = 0 OR project_id IS NULL", project.ProjectID, project.LineID)
+	return err
 }
 
-// ResetGoodCount 将 cities 表中指定 id 的 good_count 置为 0
-func ResetGoodCount(db *sql.DB, randomCityID int) error {
-	return UpdateGoodCount(db, randomCityID, false)
+// ProjectFilter 按项目和线路类型筛选城市，字段为 0 时不限制
+type ProjectFilter struct {
+	ProjectID int
+	LineID    int
 }
 
-// CreateTables 创建省份表、城市表、节点检测结果表、下载 URL 表、good_line 表和 bad_line 表
-func CreateTables(db *sql.DB) error {
-	// 创建省份表
-	_, err := db.Exec(`
-        CREATE TABLE IF NOT EXISTS provinces (
-            id INTEGER PRIMARY KEY,
-            name TEXT
-        );
-    `)
-	if err != nil {
-		return err
-	}
+// ProjectFilterOf 返回只包含 project 的筛选条件
+func ProjectFilterOf(project config.ProjectCFG) ProjectFilter {
+	return ProjectFilter{ProjectID: project.ProjectID, LineID: project.LineID}
+}
 
-	// 创建城市表，添加 good_count 和 bad_count 字段
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS cities (
-            id INTEGER PRIMARY KEY,
-            name TEXT,
-            line_type TEXT,
-            max INTEGER,
-            area_id INTEGER,
-            good_count INTEGER DEFAULT 0,
-            bad_count INTEGER DEFAULT 0,
-            FOREIGN KEY (area_id) REFERENCES provinces(id)
-        );
-    `)
-	if err != nil {
-		return err
+// ProjectFilterFor 返回 tradeID 所属项目的筛选条件，未归属任何项目时不限制
+func ProjectFilterFor(config *config.Config, tradeID int) ProjectFilter {
+	if project, ok := config.ProjectOf(tradeID); ok {
+		return ProjectFilterOf(project)
 	}
+	return ProjectFilter{}
+}
 
-	// 创建 node_test_results 表，添加 outbound_ip 列、download_rate 列和 node_id 列
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS node_test_results (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            node_name TEXT NOT NULL,
-            success_rate REAL,
-            avg_response_time INTEGER,
-            test_time TEXT,
-            outbound_ip TEXT,  -- 添加 outbound_ip 列
-            download_rate REAL,  -- 添加 download_rate 列，用于存储下载速率
-            node_id INTEGER  -- 新增 node_id 列
-        );
-    `)
-	if err != nil {
-		return err
-	}
+// Match 判断城市的项目标记是否满足筛选条件
+func (f ProjectFilter) Match(projectID, lineID int) bool {
+	return (f.ProjectID == 0 || f.ProjectID == projectID) && (f.LineID == 0 || f.LineID == lineID)
+}
 
-	// 创建下载 URL 表
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS download_url (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            url TEXT
-        );
-    `)
-	if err != nil {
-		return err
+// Where 返回以 alias 为 cities 表别名的 SQL 条件及参数
+func (f ProjectFilter) Where(alias string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if f.ProjectID != 0 {
+		conditions = append(conditions, alias+".project_id = ?")
+		args = append(args, f.ProjectID)
 	}
-
-	// 创建 good_line 表
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS good_line (
-            node_id INTEGER PRIMARY KEY
-        );
-    `)
-	if err != nil {
-		return err
+	if f.LineID != 0 {
+		conditions = append(conditions, alias+".line_id = ?")
+		args = append(args, f.LineID)
 	}
-
-	// 创建 bad_line 表，将主键改为 TEXT 类型以存储 IP 地址，并添加 randomCityID 字段
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS bad_line (
-            outbound_ip TEXT PRIMARY KEY,
-            randomCityID INT
-        );
-    `)
-	if err != nil {
-		return err
+	if len(conditions) == 0 {
+		return "1=1", nil
 	}
+	return strings.Join(conditions, " AND "), args
+}
 
-	// 创建 bad_ips 表，包含 outboundIP 和 randomCityID 字段
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS bad_ips (
-            outboundIP TEXT,
-            randomCityID INTEGER,
-            PRIMARY KEY (outboundIP, randomCityID)
-        );
-    `)
-	if err != nil {
-		return err
-	}
+// CountCities 统计满足筛选条件的城市数量
+func (s *sqlStore) CountCities(filter ProjectFilter) (int, error) {
+	where, args := filter.Where("c")
+	var count int
+	err := s.queryRow("SELECT COUNT(*) FROM cities c WHERE "+where, args...).Scan(&count)
+	return count, err
+}
 
-	return nil
+// GetCityProject 获取城市所属的项目 ID 和线路 ID
+func (s *sqlStore) GetCityProject(cityID int) (int, int, error) {
+	var projectID, lineID sql.NullInt64
+	err := s.queryRow("SELECT project_id, line_id FROM cities WHERE id = ?", cityID).Scan(&projectID, &lineID)
+	return int(projectID.Int64), int(lineID.Int64), err
 }
 
-// SaveProvinces 存储省份列表到数据库
-func SaveProvinces(db *sql.DB, provinces []http_requests.Province) error {
-	for _, province := range provinces {
-		_, err := db.Exec("INSERT OR IGNORE INTO provinces (id, name) VALUES (?,?)", province.ID, province.Name)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+// CityLastTest 城市及其最后一次检测时间
+type CityLastTest struct {
+	CityID       int
+	Name         string
+	ProjectID    int
+	LineID       int
+	LastTestTime time.Time // 从未检测过时为零值
 }
 
-// SaveNodes 存储城市列表到数据库
-func SaveNodes(db *sql.DB, nodes []http_requests.Node) error {
-	for _, node := range nodes {
-		_, err := db.Exec("INSERT OR IGNORE INTO cities (id, name, line_type, max, area_id) VALUES (?,?,?,?,?)", node.ID, node.Name, node.LineType, node.Max, node.AreaID)
-		if err != nil {
-			return err
+// GetCityLastTestTimes 获取所有城市的最后一次检测时间
+func (s *sqlStore) GetCityLastTestTimes() ([]CityLastTest, error) {
+	// 子查询按 (node_id, test_time) 索引取每个城市的最大值，不扫描整张结果表
+	rows, err := s.query(`
+        SELECT c.id, c.name, c.project_id, c.line_id,
+            (SELECT MAX(n.test_time) FROM node_test_results n WHERE n.node_id = c.id)
+        FROM cities c
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cities []CityLastTest
+	for rows.Next() {
+		var city CityLastTest
+		var name sql.NullString
+		var projectID, lineID, testTime sql.NullInt64
+		if err := rows.Scan(&city.CityID, &name, &projectID, &lineID, &testTime); err != nil {
+			return nil, err
+		}
+		city.Name = name.String
+		city.ProjectID = int(projectID.Int64)
+		city.LineID = int(lineID.Int64)
+		if testTime.Valid {
+			city.LastTestTime = time.Unix(testTime.Int64, 0)
 		}
+		cities = append(cities, city)
 	}
-	return nil
+	return cities, rows.Err()
 }
 
-// PrintAssociations 打印省份和城市的关联关系
-func PrintAssociations(db *sql.DB) {
-	rows, err := db.Query(`
-        SELECT provinces.id, provinces.name, cities.id, cities.name
-        FROM provinces
-        JOIN cities ON provinces.id = cities.area_id
-        ORDER BY provinces.id, cities.id
-    `)
+// GetRecentFailureTimes 获取 since 之后检测失败（SOCKS5 全部失败或下载速率低于 minSpeed）的城市及最近一次失败时间
+func (s *sqlStore) GetRecentFailureTimes(since time.Time, minSpeed float64) (map[int]time.Time, error) {
+	rows, err := s.query(`
+        SELECT node_id, MAX(test_time) FROM node_test_results
+        WHERE test_time >= ? AND node_id IS NOT NULL AND (success_rate = 0 OR download_rate < ?)
+        GROUP BY node_id
+    `, since.Unix(), minSpeed)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 
-	var currentProvinceID int
-	var firstProvince = true
-
+	failures := make(map[int]time.Time)
 	for rows.Next() {
-		var provinceID int
-		var provinceName string
 		var cityID int
-		var cityName string
-		err := rows.Scan(&provinceID, &provinceName, &cityID, &cityName)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if firstProvince || provinceID != currentProvinceID {
-			if !firstProvince {
-				fmt.Println()
-			}
-			//fmt.Printf("Province ID: %d, Province Name: %s\n", provinceID, provinceName)
-			currentProvinceID = provinceID
-			firstProvince = false
+		var testTime int64
+		if err := rows.Scan(&cityID, &testTime); err != nil {
+			return nil, err
 		}
-		//fmt.Printf("  City ID: %d, City Name: %s\n", cityID, cityName)
+		failures[cityID] = time.Unix(testTime, 0)
 	}
+	return failures, rows.Err()
+}
 
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
-	}
+// OutboundIPStat 出口 IP 在一段时间内的检测次数和失败次数
+type OutboundIPStat struct {
+	OutboundIP string
+	Tests      int
+	Failures   int
 }
 
-// GetAllCityIDs 获取所有城市 ID
-func GetAllCityIDs(db *sql.DB) ([]int, error) {
-	rows, err := db.Query("SELECT id FROM cities")
+// OutboundIPStats 统计 since 之后每个出口 IP 的检测次数和失败（SOCKS5 全部失败或下载速率低于 minSpeed）次数
+func (s *sqlStore) OutboundIPStats(since time.Time, minSpeed float64) ([]OutboundIPStat, error) {
+	rows, err := s.query(`
+        SELECT outbound_ip, COUNT(*), SUM(CASE WHEN success_rate = 0 OR download_rate < ? THEN 1 ELSE 0 END)
+        FROM node_test_results
+        WHERE test_time >= ? AND outbound_ip IS NOT NULL AND outbound_ip <> ''
+        GROUP BY outbound_ip
+    `, minSpeed, since.Unix())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var cityIDs []int
+	var stats []OutboundIPStat
 	for rows.Next() {
-		var cityID int
-		err := rows.Scan(&cityID)
-		if err != nil {
+		var stat OutboundIPStat
+		if err := rows.Scan(&stat.OutboundIP, &stat.Tests, &stat.Failures); err != nil {
 			return nil, err
 		}
-		cityIDs = append(cityIDs, cityID)
+		stats = append(stats, stat)
 	}
+	return stats, rows.Err()
+}
 
-	if err := rows.Err(); err != nil {
+// CityFailureStat 城市在一段时间内的检测次数和失败次数
+type CityFailureStat struct {
+	CityID   int
+	CityName string
+	Tests    int
+	Failures int
+	LastTest time.Time
+}
+
+// CityFailureStats 统计 since 之后每个城市的检测次数和失败（SOCKS5 全部失败或下载速率低于 minSpeed）次数
+func (s *sqlStore) CityFailureStats(since time.Time, minSpeed float64) ([]CityFailureStat, error) {
+	rows, err := s.query(`
+        SELECT n.node_id, c.name, COUNT(*), SUM(CASE WHEN n.success_rate = 0 OR n.download_rate < ? THEN 1 ELSE 0 END), MAX(n.test_time)
+        FROM node_test_results n
+        LEFT JOIN cities c ON c.id = n.node_id
+        WHERE n.test_time >= ?
+        GROUP BY n.node_id, c.name
+    `, minSpeed, since.Unix())
+	if err != nil {
 		return nil, err
 	}
-	return cityIDs, nil
+	defer rows.Close()
+
+	var stats []CityFailureStat
+	for rows.Next() {
+		var stat CityFailureStat
+		var cityName sql.NullString
+		var lastTest int64
+		if err := rows.Scan(&stat.CityID, &cityName, &stat.Tests, &stat.Failures, &lastTest); err != nil {
+			return nil, err
+		}
+		stat.CityName = cityName.String
+		stat.LastTest = time.Unix(lastTest, 0)
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
 }
 
 // CheckDataExists 检查数据库中是否已经存在省份和城市信息
-func CheckDataExists(db *sql.DB) (bool, error) {
+func (s *sqlStore) CheckDataExists() (bool, error) {
 	var provinceCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM provinces").Scan(&provinceCount)
+	err := s.queryRow("SELECT COUNT(*) FROM provinces").Scan(&provinceCount)
 	if err != nil {
 		return false, err
 	}
@@ -237,37 +243,88 @@ func CheckDataExists(db *sql.DB) (bool, error) {
 	}
 
 	var cityCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM cities").Scan(&cityCount)
+	err = s.queryRow("SELECT COUNT(*) FROM cities").Scan(&cityCount)
 	if err != nil {
 		return false, err
 	}
 	return cityCount > 0, nil
 }
 
-// SaveNodeTestResult 保存节点检测结果到数据库
-func SaveNodeTestResult(db *sql.DB, nodeName string, successRate float64, avgResponseTime int64, downloadRate float64, nodeID int) error {
-	now := time.Now().Format("2006-01-02 15:04:05")
-	_, err := db.Exec(`
-        INSERT INTO node_test_results (node_name, success_rate, avg_response_time, test_time, outbound_ip, download_rate, node_id)
-        VALUES (?,?,?,?,?,?,?)
-    `, nodeName, successRate, avgResponseTime, now, "", downloadRate, nodeID)
+// PhaseTimes 探测各阶段耗时，单位毫秒
+type PhaseTimes struct {
+	Connect      int64 `json:"connect_time"`
+	Handshake    int64 `json:"handshake_time"`
+	ConnectReply int64 `json:"connect_reply_time"`
+	FirstByte    int64 `json:"first_byte_time"`
+}
+
+// NodeTestResult 一次节点检测的汇总结果
+type NodeTestResult struct {
+	NodeName        string  `json:"node_name"`
+	NodeID          int     `json:"node_id"`     // 检测的城市 ID
+	OutboundIP      string  `json:"outbound_ip"` // 检测时线路的出口 IP
+	TradeID         int     `json:"trade_id"`
+	SuccessRate     float64 `json:"success_rate"`
+	AvgResponseTime int64   `json:"avg_response_time"`
+	DownloadRate    float64 `json:"download_rate"`
+	PhaseTimes
+}
+
+// SaveNodeTestResult 保存节点检测结果到数据库，test_time 为当前 UTC Unix 秒
+func (s *sqlStore) SaveNodeTestResult(r NodeTestResult) error {
+	_, err := s.exec(`
+        INSERT INTO node_test_results (node_name, success_rate, avg_response_time, test_time, outbound_ip, trade_id, download_rate, node_id,
+            connect_time, handshake_time, connect_reply_time, first_byte_time)
+        VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+    `, r.NodeName, r.SuccessRate, r.AvgResponseTime, time.Now().Unix(), r.OutboundIP, r.TradeID, r.DownloadRate, r.NodeID,
+		r.Connect, r.Handshake, r.ConnectReply, r.FirstByte)
+	if err != nil {
+		log.Printf("保存节点 %s 检测结果到数据库时出错: %v", r.NodeName, err)
+		return err
+	}
+	return nil
+}
+
+// ProbeResult 单个探测器的检测结果
+type ProbeResult struct {
+	ProbeType    string  `json:"probe_type"`
+	NodeID       int     `json:"node_id"`
+	NodeName     string  `json:"node_name"`
+	OutboundIP   string  `json:"outbound_ip"`
+	TradeID      int     `json:"trade_id"`
+	SuccessRate  float64 `json:"success_rate"`
+	ResponseTime int64   `json:"response_time"`
+	DownloadRate float64 `json:"download_rate"`
+	PhaseTimes
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error"`
+}
+
+// SaveProbeResult 保存探测器结果到 probe_results 表
+func (s *sqlStore) SaveProbeResult(r ProbeResult) error {
+	_, err := s.exec(`
+        INSERT INTO probe_results (probe_type, node_id, node_name, outbound_ip, trade_id, success_rate, response_time, download_rate,
+            connect_time, handshake_time, connect_reply_time, first_byte_time, exit_code, error, test_time)
+        VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+    `, r.ProbeType, r.NodeID, r.NodeName, r.OutboundIP, r.TradeID, r.SuccessRate, r.ResponseTime, r.DownloadRate,
+		r.Connect, r.Handshake, r.ConnectReply, r.FirstByte, r.ExitCode, r.Error, time.Now().Unix())
 	if err != nil {
-		log.Printf("保存节点 %s 检测结果到数据库时出错: %v", nodeName, err)
+		log.Printf("保存 %s 探测结果到数据库时出错: %v", r.ProbeType, err)
 		return err
 	}
 	return nil
 }
 
-// SaveDownloadURL 保存下载 URL 到数据库
-func SaveDownloadURL(db *sql.DB, url string) error {
+// SaveDownloadURL 将下载 URL 设置为唯一的下载地址，替换已有的全部地址
+func (s *sqlStore) SaveDownloadURL(url string) error {
 	// 先删除表中的所有记录
-	_, err := db.Exec("DELETE FROM download_url")
+	_, err := s.exec("DELETE FROM download_url")
 	if err != nil {
 		return err
 	}
 
 	// 插入新的 URL
-	_, err = db.Exec("INSERT INTO download_url (url) VALUES (?)", url)
+	_, err = s.exec("INSERT INTO download_url (url, enabled, note, created_at) VALUES (?,1,'',?)", url, time.Now().Unix())
 	if err != nil {
 		return err
 	}
@@ -276,19 +333,19 @@ func SaveDownloadURL(db *sql.DB, url string) error {
 }
 
 // 查询 randomCityID 是否存在 bad_line 表中
-func CheckNodeIDExistsInBadLine_id(db *sql.DB, randomCityID int) (bool, error) {
+func (s *sqlStore) CheckNodeIDExistsInBadLine_id(randomCityID int) (bool, error) {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM bad_line WHERE randomCityID =?", randomCityID).Scan(&count)
+	err := s.queryRow("SELECT COUNT(*) FROM bad_line WHERE randomCityID =?", randomCityID).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-// GetDownloadURL 从数据库中获取下载 URL
-func GetDownloadURL(db *sql.DB) (string, error) {
+// GetDownloadURL 从启用的下载地址中随机取一个，没有时返回空字符串
+func (s *sqlStore) GetDownloadURL() (string, error) {
 	var url string
-	err := db.QueryRow("SELECT url FROM download_url").Scan(&url)
+	err := s.queryRow("SELECT url FROM download_url WHERE enabled = 1 ORDER BY RANDOM() LIMIT 1").Scan(&url)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return "", nil
@@ -299,54 +356,99 @@ func GetDownloadURL(db *sql.DB) (string, error) {
 }
 
 // InsertIntoGoodLine 插入 node_id 到 good_line 表
-func InsertIntoGoodLine(db *sql.DB, nodeID int) error {
-	_, err := db.Exec("INSERT OR IGNORE INTO good_line (node_id) VALUES (?)", nodeID)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *sqlStore) InsertIntoGoodLine(nodeID int, audit LineAudit) error {
+	return s.withLineTx(func(tx *lineTx) error {
+		result, err := tx.Exec(s.rebind("INSERT INTO good_line (node_id) VALUES (?) ON CONFLICT DO NOTHING"), nodeID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil
+		}
+		return s.recordLineEvent(tx, nodeID, "", LineStateNone, LineStateGoodLine, audit)
+	})
 }
 
 // DeleteFromGoodLine 从 good_line 表中删除 node_id
-func DeleteFromGoodLine(db *sql.DB, nodeID int) error {
-	_, err := db.Exec("DELETE FROM good_line WHERE node_id = ?", nodeID)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *sqlStore) DeleteFromGoodLine(nodeID int, audit LineAudit) error {
+	return s.withLineTx(func(tx *lineTx) error {
+		result, err := tx.Exec(s.rebind("DELETE FROM good_line WHERE node_id = ?"), nodeID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil
+		}
+		return s.recordLineEvent(tx, nodeID, "", LineStateGoodLine, LineStateNone, audit)
+	})
 }
 
 // InsertIntoBadLine 插入 outbound_ip 到 bad_line 表，并传入 randomCityID
-func InsertIntoBadLine(db *sql.DB, outboundIP string, randomCityID int) error {
-	_, err := db.Exec("INSERT OR IGNORE INTO bad_line (outbound_ip, randomCityID) VALUES (?,?)", outboundIP, randomCityID)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *sqlStore) InsertIntoBadLine(outboundIP string, randomCityID int, audit LineAudit) error {
+	return s.withLineTx(func(tx *lineTx) error {
+		result, err := tx.Exec(s.rebind("INSERT INTO bad_line (outbound_ip, randomCityID) VALUES (?,?) ON CONFLICT DO NOTHING"), outboundIP, randomCityID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil
+		}
+		return s.recordLineEvent(tx, randomCityID, outboundIP, LineStateNone, LineStateBadLine, audit)
+	})
 }
 
 // DeleteFromBadLine 从 bad_line 表中删除 outbound_ip
-func DeleteFromBadLine(db *sql.DB, outboundIP string) error {
-	_, err := db.Exec("DELETE FROM bad_line WHERE outbound_ip = ?", outboundIP)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *sqlStore) DeleteFromBadLine(outboundIP string, audit LineAudit) error {
+	return s.deleteFromBadLine("outbound_ip = ?", outboundIP, audit)
 }
 
 // DeleteFromBadLine_id 从 bad_line 表中删除指定 randomCityID 的记录
-func DeleteFromBadLine_id(db *sql.DB, randomCityID int) error {
-	_, err := db.Exec("DELETE FROM bad_line WHERE randomCityID = ?", randomCityID)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *sqlStore) DeleteFromBadLine_id(randomCityID int, audit LineAudit) error {
+	return s.deleteFromBadLine("randomCityID = ?", randomCityID, audit)
+}
+
+// deleteFromBadLine 删除满足 condition 的 bad_line 记录，每删除一条写入一条变更记录
+func (s *sqlStore) deleteFromBadLine(condition string, arg interface{}, audit LineAudit) error {
+	return s.withLineTx(func(tx *lineTx) error {
+		rows, err := tx.Query(s.rebind("SELECT outbound_ip, randomCityID FROM bad_line WHERE "+condition), arg)
+		if err != nil {
+			return err
+		}
+		var entries []BadLineEntry
+		for rows.Next() {
+			var entry BadLineEntry
+			var cityID sql.NullInt64
+			if err := rows.Scan(&entry.OutboundIP, &cityID); err != nil {
+				rows.Close()
+				return err
+			}
+			entry.CityID = int(cityID.Int64)
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec(s.rebind("DELETE FROM bad_line WHERE "+condition), arg); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := s.recordLineEvent(tx, entry.CityID, entry.OutboundIP, LineStateBadLine, LineStateNone, audit); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // CheckNodeIDExistsInBadLine 检查 outbound_ip 是否存在于 bad_line 表
-func CheckNodeIDExistsInBadLine(db *sql.DB, outboundIP string) (bool, error) {
+func (s *sqlStore) CheckNodeIDExistsInBadLine(outboundIP string) (bool, error) {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM bad_line WHERE outbound_ip = ?", outboundIP).Scan(&count)
+	err := s.queryRow("SELECT COUNT(*) FROM bad_line WHERE outbound_ip = ?", outboundIP).Scan(&count)
 	if err != nil {
 		return false, err
 	}
@@ -354,14 +456,14 @@ func CheckNodeIDExistsInBadLine(db *sql.DB, outboundIP string) (bool, error) {
 }
 
 // UpdateGoodCount 更新城市的 good_count
-func UpdateGoodCount(db *sql.DB, randomCityID int, increment bool) error {
+func (s *sqlStore) UpdateGoodCount(randomCityID int, increment bool) error {
 	var query string
 	if increment {
 		query = "UPDATE cities SET good_count = good_count + 1 WHERE id = ?"
 	} else {
 		query = "UPDATE cities SET good_count = 0 WHERE id = ?"
 	}
-	_, err := db.Exec(query, randomCityID)
+	_, err := s.exec(query, randomCityID)
 	if err != nil {
 		return err
 	}
@@ -369,14 +471,14 @@ func UpdateGoodCount(db *sql.DB, randomCityID int, increment bool) error {
 }
 
 // UpdateBadCount 更新城市的 bad_count
-func UpdateBadCount(db *sql.DB, randomCityID int, increment bool) error {
+func (s *sqlStore) UpdateBadCount(randomCityID int, increment bool) error {
 	var query string
 	if increment {
 		query = "UPDATE cities SET bad_count = bad_count + 1 WHERE id = ?"
 	} else {
 		query = "UPDATE cities SET bad_count = 0 WHERE id = ?"
 	}
-	_, err := db.Exec(query, randomCityID)
+	_, err := s.exec(query, randomCityID)
 	if err != nil {
 		return err
 	}
@@ -384,9 +486,9 @@ func UpdateBadCount(db *sql.DB, randomCityID int, increment bool) error {
 }
 
 // GetGoodCount 获取城市的 good_count
-func GetGoodCount(db *sql.DB, randomCityID int) (int, error) {
+func (s *sqlStore) GetGoodCount(randomCityID int) (int, error) {
 	var count int
-	err := db.QueryRow("SELECT good_count FROM cities WHERE id = ?", randomCityID).Scan(&count)
+	err := s.queryRow("SELECT good_count FROM cities WHERE id = ?", randomCityID).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -394,20 +496,167 @@ func GetGoodCount(db *sql.DB, randomCityID int) (int, error) {
 }
 
 // GetBadCount 获取城市的 bad_count
-func GetBadCount(db *sql.DB, randomCityID int) (int, error) {
+func (s *sqlStore) GetBadCount(randomCityID int) (int, error) {
 	var count int
-	err := db.QueryRow("SELECT bad_count FROM cities WHERE id = ?", randomCityID).Scan(&count)
+	err := s.queryRow("SELECT bad_count FROM cities WHERE id = ?", randomCityID).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-// InsertIntoBadIPs 插入 outboundIP 和 randomCityID 到 bad_ips 表
-func InsertIntoBadIPs(db *sql.DB, outboundIP string, randomCityID int) error {
-	_, err := db.Exec("INSERT OR IGNORE INTO bad_ips (outboundIP, randomCityID) VALUES (?,?)", outboundIP, randomCityID)
+// GoodLineCityIDs 获取 filter 范围内 good_line 表中的城市 ID，random 为 true 时按随机顺序返回
+func (s *sqlStore) GoodLineCityIDs(filter ProjectFilter, random bool) ([]int, error) {
+	where, args := filter.Where("c")
+	query := "SELECT g.node_id FROM good_line g LEFT JOIN cities c ON c.id = g.node_id WHERE " + where
+	if random {
+		query += " ORDER BY RANDOM()"
+	}
+	return s.queryIDs(query, args...)
+}
+
+// BadLineCityIDs 按随机顺序获取 filter 范围内 bad_line 表中的城市 ID，同一城市只返回一次
+func (s *sqlStore) BadLineCityIDs(filter ProjectFilter) ([]int, error) {
+	where, args := filter.Where("c")
+	return s.queryIDs(`
+        SELECT b.randomCityID FROM bad_line b
+        LEFT JOIN cities c ON c.id = b.randomCityID
+        WHERE b.randomCityID IS NOT NULL AND `+where+`
+        GROUP BY b.randomCityID
+        ORDER BY RANDOM()`, args...)
+}
+
+// BadLineEntry bad_line 表中的一条记录
+type BadLineEntry struct {
+	OutboundIP string `json:"outbound_ip"`
+	CityID     int    `json:"city_id"`
+	Note       string `json:"note"`
+}
+
+// BadLineEntries 获取 filter 范围内 bad_line 表中的记录
+func (s *sqlStore) BadLineEntries(filter ProjectFilter) ([]BadLineEntry, error) {
+	where, args := filter.Where("c")
+	rows, err := s.query("SELECT t.outbound_ip, t.randomCityID, t.note FROM bad_line t LEFT JOIN cities c ON c.id = t.randomCityID WHERE "+where, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+
+	var entries []BadLineEntry
+	for rows.Next() {
+		var entry BadLineEntry
+		var nullCityID sql.NullInt64
+		var note sql.NullString
+		if err := rows.Scan(&entry.OutboundIP, &nullCityID, &note); err != nil {
+			return nil, err
+		}
+		entry.Note = note.String
+		if nullCityID.Valid {
+			entry.CityID = int(nullCityID.Int64)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CityResult 城市最近一次检测结果
+type CityResult struct {
+	CityID          int
+	ProvinceName    string
+	CityName        string
+	SuccessRate     float64
+	AvgResponseTime int64
+	TestTime        time.Time
+	DownloadRate    float64
+	PhaseTimes
+}
+
+// LatestCityResults 获取 filter 范围内每个城市最近一次的检测结果。
+// start、end 不为零值时只统计该时间段内的结果，sortBy 为 download_rate 或 response_time
+func (s *sqlStore) LatestCityResults(start, end time.Time, sortBy string, filter ProjectFilter) ([]CityResult, error) {
+	var args []interface{}
+	timeCondition := ""
+	if !start.IsZero() && !end.IsZero() {
+		timeCondition = "AND latest.test_time BETWEEN ? AND ?"
+		args = append(args, start.Unix(), end.Unix())
+	}
+
+	orderBy := "p.name"
+	if sortBy == "download_rate" {
+		orderBy += ", n.download_rate DESC"
+	} else if sortBy == "response_time" {
+		orderBy += ", n.avg_response_time ASC"
+	}
+
+	// 子查询按 (node_id, test_time) 索引取每个城市最新的一条结果
+	projectWhere, projectArgs := filter.Where("c")
+	args = append(args, projectArgs...)
+	rows, err := s.query(`
+        SELECT c.id, p.name, c.name, n.success_rate, n.avg_response_time, n.test_time, n.download_rate,
+            n.connect_time, n.handshake_time, n.connect_reply_time, n.first_byte_time
+        FROM provinces p
+        JOIN cities c ON p.id = c.area_id
+        JOIN node_test_results n ON n.id = (
+            SELECT latest.id FROM node_test_results latest
+            WHERE latest.node_id = c.id `+timeCondition+`
+            ORDER BY latest.test_time DESC, latest.id DESC
+            LIMIT 1
+        )
+        WHERE `+projectWhere+`
+        ORDER BY `+orderBy, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []CityResult
+	for rows.Next() {
+		var r CityResult
+		var cityName sql.NullString
+		var successRate, downloadRate sql.NullFloat64
+		var avgResponseTime, testTime, connect, handshake, connectReply, firstByte sql.NullInt64
+		if err := rows.Scan(&r.CityID, &r.ProvinceName, &cityName, &successRate, &avgResponseTime, &testTime, &downloadRate,
+			&connect, &handshake, &connectReply, &firstByte); err != nil {
+			return nil, err
+		}
+		r.CityName = cityName.String
+		r.SuccessRate = successRate.Float64
+		r.DownloadRate = downloadRate.Float64
+		r.AvgResponseTime = avgResponseTime.Int64
+		r.TestTime = time.Unix(testTime.Int64, 0)
+		r.PhaseTimes = PhaseTimes{Connect: connect.Int64, Handshake: handshake.Int64, ConnectReply: connectReply.Int64, FirstByte: firstByte.Int64}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// NodeResult 最近一次检测的节点信息
+type NodeResult struct {
+	NodeName   string
+	OutboundIP string
+	TestTime   time.Time // 没有检测结果时为零值
+}
+
+// LatestNodeResult 获取 filter 范围内最近一次检测的节点，没有检测结果时返回零值
+func (s *sqlStore) LatestNodeResult(filter ProjectFilter) (NodeResult, error) {
+	var result NodeResult
+	var outboundIP sql.NullString
+	var testTime sql.NullInt64
+	where, args := filter.Where("c")
+	err := s.queryRow(`
+        SELECT n.node_name, n.outbound_ip, n.test_time
+        FROM node_test_results n
+        LEFT JOIN cities c ON c.id = n.node_id
+        WHERE `+where+`
+        ORDER BY n.test_time DESC
+        LIMIT 1
+    `, args...).Scan(&result.NodeName, &outboundIP, &testTime)
+	if err != nil && err != sql.ErrNoRows {
+		return result, err
+	}
+	result.OutboundIP = outboundIP.String
+	if testTime.Valid {
+		result.TestTime = time.Unix(testTime.Int64, 0)
+	}
+	return result, nil
 }
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DownloadURL download_url 表中的一个下载地址
+type DownloadURL struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Enabled   bool      `json:"enabled"` // 停用的地址不参与检测
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DownloadURLs 获取全部下载地址，按 ID 排序
+func (s *sqlStore) DownloadURLs() ([]DownloadURL, error) {
+	rows, err := s.query("SELECT id, url, enabled, note, created_at FROM download_url ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []DownloadURL
+	for rows.Next() {
+		u, err := scanDownloadURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, rows.Err()
+}
+
+// GetDownloadURLByID 获取指定 ID 的下载地址，不存在时返回 sql.ErrNoRows
+func (s *sqlStore) GetDownloadURLByID(id int64) (DownloadURL, error) {
+	return scanDownloadURL(s.queryRow("SELECT id, url, enabled, note, created_at FROM download_url WHERE id = ?", id))
+}
+
+// AddDownloadURL 新增下载地址
+func (s *sqlStore) AddDownloadURL(url, note string, enabled bool) (DownloadURL, error) {
+	u := DownloadURL{URL: url, Enabled: enabled, Note: note, CreatedAt: time.Unix(time.Now().Unix(), 0)}
+	err := s.queryRow("INSERT INTO download_url (url, enabled, note, created_at) VALUES (?,?,?,?) RETURNING id",
+		url, boolToInt(enabled), note, u.CreatedAt.Unix()).Scan(&u.ID)
+	return u, err
+}
+
+// UpdateDownloadURL 修改下载地址的启用状态和备注，不存在时返回 sql.ErrNoRows
+func (s *sqlStore) UpdateDownloadURL(id int64, enabled bool, note string) error {
+	return s.execOne("UPDATE download_url SET enabled = ?, note = ? WHERE id = ?", boolToInt(enabled), note, id)
+}
+
+// DeleteDownloadURL 删除下载地址，不存在时返回 sql.ErrNoRows
+func (s *sqlStore) DeleteDownloadURL(id int64) error {
+	return s.execOne("DELETE FROM download_url WHERE id = ?", id)
+}
+
+// scanDownloadURL 读取一行 id, url, enabled, note, created_at
+func scanDownloadURL(row interface{ Scan(...any) error }) (DownloadURL, error) {
+	var u DownloadURL
+	var url, note sql.NullString
+	var enabled, createdAt sql.NullInt64
+	if err := row.Scan(&u.ID, &url, &enabled, &note, &createdAt); err != nil {
+		return u, err
+	}
+	u.URL, u.Note = url.String, note.String
+	u.Enabled = !enabled.Valid || enabled.Int64 != 0
+	u.CreatedAt = time.Unix(createdAt.Int64, 0)
+	return u, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
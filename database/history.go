@@ -0,0 +1,241 @@
+package database
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"time"
+)
+
+// CityInfo 城市及所属省份
+type CityInfo struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	ProvinceName string `json:"province_name"`
+}
+
+// HistoryStats 一个区间内某项指标的统计，没有样本时各项为 nil。
+// 汇总数据只保存总和、最小值和最大值，区间内包含汇总数据时 P95 为 nil，成功率的 Min、Max 同样为 nil
+type HistoryStats struct {
+	Min *float64 `json:"min"`
+	Avg *float64 `json:"avg"`
+	Max *float64 `json:"max"`
+	P95 *float64 `json:"p95"`
+}
+
+// HistoryBucket 城市检测结果在一个时间区间内的统计
+type HistoryBucket struct {
+	Start        time.Time    `json:"start"`
+	Samples      int64        `json:"samples"`
+	Failures     int64        `json:"failures"`      // SOCKS5 全部失败（成功率为 0）的次数
+	Aggregated   bool         `json:"aggregated"`    // 区间内包含 node_test_aggregates 中的汇总数据
+	DownloadRate HistoryStats `json:"download_rate"` // Mbps
+	ResponseTime HistoryStats `json:"response_time"` // 毫秒，不含失败的检测
+	SuccessRate  HistoryStats `json:"success_rate"`  // 百分比
+}
+
+// GetCity 获取城市及所属省份，城市不存在时返回 sql.ErrNoRows
+func (s *sqlStore) GetCity(cityID int) (CityInfo, error) {
+	city := CityInfo{ID: cityID}
+	var name, provinceName sql.NullString
+	err := s.queryRow(`
+        SELECT c.name, p.name
+        FROM cities c
+        LEFT JOIN provinces p ON p.id = c.area_id
+        WHERE c.id = ?
+    `, cityID).Scan(&name, &provinceName)
+	city.Name, city.ProvinceName = name.String, provinceName.String
+	return city, err
+}
+
+// CityHistory 按 step 将城市在 [from, to) 内的检测结果分区间统计，区间起点按 UTC Unix 秒对齐 step，
+// 没有检测结果的区间也会返回。超过保留期的结果取自 node_test_aggregates，按天汇总的数据计入当天 0 点（UTC）所在的区间
+func (s *sqlStore) CityHistory(cityID int, from, to time.Time, step time.Duration) ([]HistoryBucket, error) {
+	stepSeconds := int64(step / time.Second)
+	if stepSeconds <= 0 {
+		stepSeconds = 1
+	}
+	start := from.Unix() - from.Unix()%stepSeconds
+	end := to.Unix()
+
+	accs := make([]historyAcc, 0, (end-start)/stepSeconds+1)
+	for t := start; t < end; t += stepSeconds {
+		accs = append(accs, historyAcc{start: t})
+	}
+	if len(accs) == 0 {
+		return nil, nil
+	}
+	bucket := func(t int64) *historyAcc {
+		if t < start || t >= end {
+			return nil
+		}
+		return &accs[(t-start)/stepSeconds]
+	}
+
+	rows, err := s.query(`
+        SELECT test_time, success_rate, avg_response_time, download_rate
+        FROM node_test_results
+        WHERE node_id = ? AND test_time >= ? AND test_time < ?
+    `, cityID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var testTime int64
+		var successRate, downloadRate sql.NullFloat64
+		var responseTime sql.NullInt64
+		if err := rows.Scan(&testTime, &successRate, &responseTime, &downloadRate); err != nil {
+			return nil, err
+		}
+		acc := bucket(testTime)
+		if acc == nil {
+			continue
+		}
+		acc.samples++
+		if successRate.Valid {
+			if successRate.Float64 == 0 {
+				acc.failures++
+			}
+			acc.successRate.add(successRate.Float64)
+		}
+		// 失败的检测 avg_response_time 为 -1，与汇总一致不计入响应时间
+		if responseTime.Valid && responseTime.Int64 >= 0 {
+			acc.responseTime.add(float64(responseTime.Int64))
+		}
+		if downloadRate.Valid {
+			acc.downloadRate.add(downloadRate.Float64)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	aggRows, err := s.query(`
+        SELECT bucket_start, samples, failures, success_rate_sum, response_samples, response_time_sum,
+            response_time_min, response_time_max, download_rate_sum, download_rate_min, download_rate_max
+        FROM node_test_aggregates
+        WHERE node_id = ? AND bucket_start >= ? AND bucket_start < ?
+    `, cityID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer aggRows.Close()
+	for aggRows.Next() {
+		var bucketStart, samples, failures int64
+		var successRateSum, downloadRateSum sql.NullFloat64
+		var responseSamples, responseTimeSum, responseTimeMin, responseTimeMax sql.NullInt64
+		var downloadRateMin, downloadRateMax sql.NullFloat64
+		if err := aggRows.Scan(&bucketStart, &samples, &failures, &successRateSum, &responseSamples, &responseTimeSum,
+			&responseTimeMin, &responseTimeMax, &downloadRateSum, &downloadRateMin, &downloadRateMax); err != nil {
+			return nil, err
+		}
+		acc := bucket(bucketStart)
+		if acc == nil {
+			continue
+		}
+		acc.samples += samples
+		acc.failures += failures
+		acc.aggregated = true
+		acc.successRate.merge(samples, successRateSum.Float64, sql.NullFloat64{}, sql.NullFloat64{})
+		acc.responseTime.merge(responseSamples.Int64, float64(responseTimeSum.Int64), nullIntToFloat(responseTimeMin), nullIntToFloat(responseTimeMax))
+		acc.downloadRate.merge(samples, downloadRateSum.Float64, downloadRateMin, downloadRateMax)
+	}
+	if err := aggRows.Err(); err != nil {
+		return nil, err
+	}
+
+	buckets := make([]HistoryBucket, len(accs))
+	for i, acc := range accs {
+		buckets[i] = HistoryBucket{
+			Start:        time.Unix(acc.start, 0),
+			Samples:      acc.samples,
+			Failures:     acc.failures,
+			Aggregated:   acc.aggregated,
+			DownloadRate: acc.downloadRate.stats(),
+			ResponseTime: acc.responseTime.stats(),
+			SuccessRate:  acc.successRate.stats(),
+		}
+	}
+	return buckets, nil
+}
+
+// historyAcc 一个区间的累计值
+type historyAcc struct {
+	start        int64
+	samples      int64
+	failures     int64
+	aggregated   bool
+	downloadRate metricAcc
+	responseTime metricAcc
+	successRate  metricAcc
+}
+
+// metricAcc 一项指标的累计值，原始结果保留取值用于计算 P95
+type metricAcc struct {
+	count      int64
+	sum        float64
+	min, max   float64
+	values     []float64
+	noMinMax   bool // 合并了没有最小值、最大值的汇总数据
+	aggregated bool // 合并了汇总数据，无法计算 P95
+}
+
+// add 累计一个原始取值
+func (a *metricAcc) add(v float64) {
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.count++
+	a.sum += v
+	a.values = append(a.values, v)
+}
+
+// merge 累计一条汇总数据
+func (a *metricAcc) merge(count int64, sum float64, min, max sql.NullFloat64) {
+	if count <= 0 {
+		return
+	}
+	if !min.Valid || !max.Valid {
+		a.noMinMax = true
+	} else {
+		if a.count == 0 || min.Float64 < a.min {
+			a.min = min.Float64
+		}
+		if a.count == 0 || max.Float64 > a.max {
+			a.max = max.Float64
+		}
+	}
+	a.count += count
+	a.sum += sum
+	a.aggregated = true
+}
+
+// stats 计算统计结果
+func (a *metricAcc) stats() HistoryStats {
+	var stats HistoryStats
+	if a.count == 0 {
+		return stats
+	}
+	avg := a.sum / float64(a.count)
+	stats.Avg = &avg
+	if !a.noMinMax {
+		min, max := a.min, a.max
+		stats.Min, stats.Max = &min, &max
+	}
+	if !a.aggregated {
+		sort.Float64s(a.values)
+		// 最近秩法：取第 ceil(0.95n) 个值
+		p95 := a.values[int(math.Ceil(0.95*float64(len(a.values))))-1]
+		stats.P95 = &p95
+	}
+	return stats
+}
+
+// nullIntToFloat 将可能为 NULL 的整数转为浮点数
+func nullIntToFloat(v sql.NullInt64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: float64(v.Int64), Valid: v.Valid}
+}
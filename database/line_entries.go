@@ -0,0 +1,128 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// GoodLineEntry good_line 表中的一条记录
+type GoodLineEntry struct {
+	CityID   int    `json:"city_id"`
+	CityName string `json:"city_name"`
+	Note     string `json:"note"`
+}
+
+// GoodLineEntries 获取 filter 范围内 good_line 表中的记录，按城市 ID 排序
+func (s *sqlStore) GoodLineEntries(filter ProjectFilter) ([]GoodLineEntry, error) {
+	where, args := filter.Where("c")
+	rows, err := s.query(`
+        SELECT g.node_id, c.name, g.note
+        FROM good_line g
+        LEFT JOIN cities c ON c.id = g.node_id
+        WHERE `+where+`
+        ORDER BY g.node_id
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []GoodLineEntry
+	for rows.Next() {
+		var entry GoodLineEntry
+		var cityName, note sql.NullString
+		if err := rows.Scan(&entry.CityID, &cityName, &note); err != nil {
+			return nil, err
+		}
+		entry.CityName, entry.Note = cityName.String, note.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CheckNodeIDExistsInGoodLine 检查 node_id 是否存在于 good_line 表
+func (s *sqlStore) CheckNodeIDExistsInGoodLine(nodeID int) (bool, error) {
+	var count int
+	err := s.queryRow("SELECT COUNT(*) FROM good_line WHERE node_id = ?", nodeID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// SetGoodLineNote 修改 good_line 记录的备注，记录不存在时返回 sql.ErrNoRows
+func (s *sqlStore) SetGoodLineNote(nodeID int, note string) error {
+	return s.execOne("UPDATE good_line SET note = ? WHERE node_id = ?", note, nodeID)
+}
+
+// SetBadLineNote 修改 bad_line 记录的备注，记录不存在时返回 sql.ErrNoRows
+func (s *sqlStore) SetBadLineNote(outboundIP, note string) error {
+	return s.execOne("UPDATE bad_line SET note = ? WHERE outbound_ip = ?", note, outboundIP)
+}
+
+// SetBadIPNote 修改 bad_ips 记录的备注，cityID 为 0 时修改该出口 IP 的全部记录，没有记录时返回 sql.ErrNoRows
+func (s *sqlStore) SetBadIPNote(outboundIP string, cityID int, note string) error {
+	if cityID == 0 {
+		return s.execOne("UPDATE bad_ips SET note = ? WHERE outboundIP = ?", note, outboundIP)
+	}
+	return s.execOne("UPDATE bad_ips SET note = ? WHERE outboundIP = ? AND randomCityID = ?", note, outboundIP, cityID)
+}
+
+// DeleteFromBadIPs 删除 bad_ips 记录并写入变更记录，cityID 为 0 时删除该出口 IP 的全部记录，返回删除的条数
+func (s *sqlStore) DeleteFromBadIPs(outboundIP string, cityID int, audit LineAudit) (int, error) {
+	condition, args := "outboundIP = ?", []interface{}{outboundIP}
+	if cityID != 0 {
+		condition += " AND randomCityID = ?"
+		args = append(args, cityID)
+	}
+	deleted := 0
+	err := s.withLineTx(func(tx *lineTx) error {
+		rows, err := tx.Query(s.rebind("SELECT randomCityID FROM bad_ips WHERE "+condition), args...)
+		if err != nil {
+			return err
+		}
+		var cityIDs []int
+		for rows.Next() {
+			var id sql.NullInt64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			cityIDs = append(cityIDs, int(id.Int64))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(cityIDs) == 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec(s.rebind("DELETE FROM bad_ips WHERE "+condition), args...); err != nil {
+			return err
+		}
+		for _, id := range cityIDs {
+			if err := s.recordLineEvent(tx, id, outboundIP, LineStateBadIPs, LineStateNone, audit); err != nil {
+				return err
+			}
+		}
+		deleted = len(cityIDs)
+		return nil
+	})
+	return deleted, err
+}
+
+// execOne 执行修改语句，没有影响任何行时返回 sql.ErrNoRows
+func (s *sqlStore) execOne(query string, args ...interface{}) error {
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
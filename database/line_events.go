@@ -0,0 +1,197 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"monitoring_system/events"
+)
+
+// 线路状态，对应 line_events 的 from_state 和 to_state
+const (
+	LineStateNone     = "none"
+	LineStateGoodLine = "good_line"
+	LineStateBadLine  = "bad_line"
+	LineStateBadIPs   = "bad_ips"
+)
+
+// 变更来源组件，对应 line_events 的 source
+const (
+	SourceLineProcessor = "line_processor" // cmd.LineProcessor，按每轮检测结果累计 good_count/bad_count
+	SourceChecker       = "checker"        // checker 复查 good_line/bad_line 中的城市
+	SourceAPI           = "api"            // 通过 /api/v1 手动修改
+)
+
+const defaultLineEventLimit = 100
+
+// LineAudit 触发 good_line、bad_line、bad_ips 变更的上下文，随变更一起写入 line_events
+type LineAudit struct {
+	Source     string             `json:"source"`
+	TradeID    int                `json:"trade_id"`
+	Reason     string             `json:"reason"`
+	Metrics    map[string]float64 `json:"metrics"`    // 触发变更的指标，如 download_rate、avg_response_time
+	Thresholds map[string]float64 `json:"thresholds"` // 判定时使用的阈值
+}
+
+// LineEvent line_events 表中的一条变更记录
+type LineEvent struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	CityID     int       `json:"city_id"`
+	CityName   string    `json:"city_name"`
+	OutboundIP string    `json:"outbound_ip"`
+	FromState  string    `json:"from_state"`
+	ToState    string    `json:"to_state"`
+	LineAudit
+}
+
+// LineEventQuery line_events 查询条件
+type LineEventQuery struct {
+	CityID   int   // 为 0 时查询全部城市
+	BeforeID int64 // 大于 0 时只返回 id 小于该值的记录，用于翻页
+	AfterID  int64 // 大于 0 时只返回 id 大于该值的记录并按 id 升序排列，用于增量读取新记录
+	Limit    int   // 为 0 时返回 100 条
+}
+
+// withTx 在一个事务中执行 fn，fn 返回错误时回滚
+func (s *sqlStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lineTx 修改线路表的事务，记录事务中写入的变更
+type lineTx struct {
+	*sql.Tx
+	events []LineEvent
+}
+
+// withLineTx 在一个事务中修改线路表，提交成功后将写入的变更发布到事件总线
+func (s *sqlStore) withLineTx(fn func(tx *lineTx) error) error {
+	var ltx *lineTx
+	err := s.withTx(func(tx *sql.Tx) error {
+		ltx = &lineTx{Tx: tx}
+		return fn(ltx)
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range ltx.events {
+		events.Publish(events.TypeLineTransition, event.Source, event)
+	}
+	return nil
+}
+
+// recordLineEvent 在事务中写入一条变更记录
+func (s *sqlStore) recordLineEvent(tx *lineTx, cityID int, outboundIP, fromState, toState string, audit LineAudit) error {
+	metrics, err := json.Marshal(audit.Metrics)
+	if err != nil {
+		return err
+	}
+	thresholds, err := json.Marshal(audit.Thresholds)
+	if err != nil {
+		return err
+	}
+	event := LineEvent{
+		Time:       time.Unix(time.Now().Unix(), 0),
+		CityID:     cityID,
+		OutboundIP: outboundIP,
+		FromState:  fromState,
+		ToState:    toState,
+		LineAudit:  audit,
+	}
+	err = tx.QueryRow(s.rebind(`
+        INSERT INTO line_events (event_time, city_id, outbound_ip, from_state, to_state, metrics, thresholds, reason, trade_id, source)
+        VALUES (?,?,?,?,?,?,?,?,?,?)
+        RETURNING id
+    `), event.Time.Unix(), cityID, outboundIP, fromState, toState, string(metrics), string(thresholds), audit.Reason, audit.TradeID, audit.Source).Scan(&event.ID)
+	if err != nil {
+		return err
+	}
+
+	var cityName sql.NullString
+	err = tx.QueryRow(s.rebind("SELECT name FROM cities WHERE id = ?"), cityID).Scan(&cityName)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	event.CityName = cityName.String
+	tx.events = append(tx.events, event)
+	return nil
+}
+
+// LineEvents 按时间倒序返回变更记录，指定 AfterID 时按时间正序
+func (s *sqlStore) LineEvents(q LineEventQuery) ([]LineEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if q.CityID != 0 {
+		conditions = append(conditions, "e.city_id = ?")
+		args = append(args, q.CityID)
+	}
+	if q.BeforeID > 0 {
+		conditions = append(conditions, "e.id < ?")
+		args = append(args, q.BeforeID)
+	}
+	order := "DESC"
+	if q.AfterID > 0 {
+		conditions = append(conditions, "e.id > ?")
+		args = append(args, q.AfterID)
+		order = "ASC"
+	}
+	where := "1=1"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLineEventLimit
+	}
+	args = append(args, limit)
+
+	rows, err := s.query(`
+        SELECT e.id, e.event_time, e.city_id, c.name, e.outbound_ip, e.from_state, e.to_state,
+            e.metrics, e.thresholds, e.reason, e.trade_id, e.source
+        FROM line_events e
+        LEFT JOIN cities c ON c.id = e.city_id
+        WHERE `+where+`
+        ORDER BY e.id `+order+`
+        LIMIT ?
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []LineEvent
+	for rows.Next() {
+		var e LineEvent
+		var eventTime int64
+		var cityID, tradeID sql.NullInt64
+		var cityName, outboundIP, metrics, thresholds, reason sql.NullString
+		if err := rows.Scan(&e.ID, &eventTime, &cityID, &cityName, &outboundIP, &e.FromState, &e.ToState,
+			&metrics, &thresholds, &reason, &tradeID, &e.Source); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(eventTime, 0)
+		e.CityID = int(cityID.Int64)
+		e.CityName = cityName.String
+		e.OutboundIP = outboundIP.String
+		e.Reason = reason.String
+		e.TradeID = int(tradeID.Int64)
+		if metrics.Valid {
+			_ = json.Unmarshal([]byte(metrics.String), &e.Metrics)
+		}
+		if thresholds.Valid {
+			_ = json.Unmarshal([]byte(thresholds.String), &e.Thresholds)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// migrationFS 内嵌的迁移脚本，每种数据库一个目录，文件名格式为 <版本号>_<名称>.sql，按版本号顺序执行。
+// 新增表、列或索引时在每个目录中添加相同版本号的迁移文件，不要修改已发布的迁移
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFS embed.FS
+
+// legacyMigrationVersion 引入迁移之前的 SQLite 旧库已经通过手工补列加过 0001 到 0003 中的列
+const legacyMigrationVersion = 3
+
+// Migration 一个数据库迁移
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus 迁移的执行状态
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt string
+}
+
+// SchemaTooNewError 数据库版本高于程序内置的最新迁移，通常是用旧版本程序打开了新版本的数据库
+type SchemaTooNewError struct {
+	Current int
+	Latest  int
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("数据库版本 %d 高于程序支持的版本 %d，请升级程序", e.Current, e.Latest)
+}
+
+// Migrations 返回 dbType 对应的内嵌迁移列表，按版本号升序
+func Migrations(dbType string) ([]Migration, error) {
+	migrationDir := path.Join("migrations", dbType)
+	entries, err := fs.ReadDir(migrationFS, migrationDir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(entries))
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("迁移文件名格式错误: %s", entry.Name())
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("迁移文件版本号错误: %s", entry.Name())
+		}
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("迁移版本号 %d 重复: %s 和 %s", version, other, entry.Name())
+		}
+		seen[version] = entry.Name()
+
+		content, err := migrationFS.ReadFile(path.Join(migrationDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(content)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// ensureSchemaVersionTable 创建 schema_version 表
+func (s *sqlStore) ensureSchemaVersionTable() error {
+	_, err := s.exec(`
+        CREATE TABLE IF NOT EXISTS schema_version (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at TEXT NOT NULL
+        );
+    `)
+	return err
+}
+
+// SchemaVersion 返回数据库当前的版本，未执行过任何迁移时为 0
+func (s *sqlStore) SchemaVersion() (int, error) {
+	if err := s.ensureSchemaVersionTable(); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := s.queryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// MigrationStatuses 返回所有内嵌迁移及其执行状态
+func (s *sqlStore) MigrationStatuses() ([]MigrationStatus, error) {
+	migrations, err := Migrations(s.dbType)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureSchemaVersionTable(); err != nil {
+		return nil, err
+	}
+	rows, err := s.query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{Migration: m, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+// CheckSchema 数据库版本高于内置的最新迁移时返回 SchemaTooNewError，否则返回当前版本和最新版本
+func (s *sqlStore) CheckSchema() (current, latest int, err error) {
+	migrations, err := Migrations(s.dbType)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	current, err = s.SchemaVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	if current > latest {
+		return current, latest, &SchemaTooNewError{Current: current, Latest: latest}
+	}
+	return current, latest, nil
+}
+
+// Migrate 按顺序执行版本号大于当前版本、且不超过 target 的迁移，target <= 0 时执行全部。
+// 返回执行过的迁移
+func (s *sqlStore) Migrate(target int) ([]Migration, error) {
+	current, _, err := s.CheckSchema()
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Migrations(s.dbType)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if target > 0 && m.Version > target {
+			break
+		}
+		if err := s.applyMigration(m); err != nil {
+			return applied, fmt.Errorf("执行迁移 %04d_%s 出错: %w", m.Version, m.Name, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"Version": m.Version,
+			"Name":    m.Name,
+		}).Info("数据库迁移完成")
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// applyMigration 在一个事务中执行迁移并记录版本
+func (s *sqlStore) applyMigration(m Migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitStatements(m.SQL) {
+		if _, err := tx.Exec(stmt); err != nil {
+			// SQLite 旧库执行 0001 到 0003 时重复加列视为已执行，之后的迁移重复加列说明库结构异常，直接报错
+			if s.dbType == DBTypeSQLite && m.Version <= legacyMigrationVersion && strings.Contains(err.Error(), "duplicate column name") {
+				continue
+			}
+			return err
+		}
+	}
+	if _, err := tx.Exec(s.rebind("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)"),
+		m.Version, m.Name, time.Now().Format("2006-01-02 15:04:05")); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitStatements 按分号拆分迁移脚本中的语句，去掉 -- 注释和空语句
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+	var stmts []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
@@ -0,0 +1,46 @@
+-- 初始表结构：省份、城市、节点检测结果、下载 URL、good_line、bad_line、bad_ips
+CREATE TABLE IF NOT EXISTS provinces (
+    id INTEGER PRIMARY KEY,
+    name TEXT
+);
+
+CREATE TABLE IF NOT EXISTS cities (
+    id INTEGER PRIMARY KEY,
+    name TEXT,
+    line_type TEXT,
+    max INTEGER,
+    area_id INTEGER REFERENCES provinces(id),
+    good_count INTEGER DEFAULT 0,
+    bad_count INTEGER DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS node_test_results (
+    id BIGSERIAL PRIMARY KEY,
+    node_name TEXT NOT NULL,
+    success_rate DOUBLE PRECISION,
+    avg_response_time BIGINT,
+    test_time TEXT,
+    outbound_ip TEXT,
+    download_rate DOUBLE PRECISION,
+    node_id INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS download_url (
+    id SERIAL PRIMARY KEY,
+    url TEXT
+);
+
+CREATE TABLE IF NOT EXISTS good_line (
+    node_id INTEGER PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS bad_line (
+    outbound_ip TEXT PRIMARY KEY,
+    randomCityID INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS bad_ips (
+    outboundIP TEXT,
+    randomCityID INTEGER,
+    PRIMARY KEY (outboundIP, randomCityID)
+);
@@ -0,0 +1,24 @@
+-- 节点检测结果的分阶段耗时（毫秒），以及按探测类型存储结果的 probe_results 表
+ALTER TABLE node_test_results ADD COLUMN IF NOT EXISTS connect_time BIGINT DEFAULT 0;
+ALTER TABLE node_test_results ADD COLUMN IF NOT EXISTS handshake_time BIGINT DEFAULT 0;
+ALTER TABLE node_test_results ADD COLUMN IF NOT EXISTS connect_reply_time BIGINT DEFAULT 0;
+ALTER TABLE node_test_results ADD COLUMN IF NOT EXISTS first_byte_time BIGINT DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS probe_results (
+    id BIGSERIAL PRIMARY KEY,
+    probe_type TEXT NOT NULL,
+    node_id INTEGER,
+    node_name TEXT,
+    outbound_ip TEXT,
+    trade_id INTEGER,
+    success_rate DOUBLE PRECISION,
+    response_time BIGINT,
+    download_rate DOUBLE PRECISION,
+    connect_time BIGINT DEFAULT 0,
+    handshake_time BIGINT DEFAULT 0,
+    connect_reply_time BIGINT DEFAULT 0,
+    first_byte_time BIGINT DEFAULT 0,
+    exit_code INTEGER DEFAULT 0,
+    error TEXT,
+    test_time TEXT
+);
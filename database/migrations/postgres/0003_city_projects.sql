@@ -0,0 +1,3 @@
+-- 城市按项目和线路类型标记
+ALTER TABLE cities ADD COLUMN IF NOT EXISTS project_id INTEGER DEFAULT 0;
+ALTER TABLE cities ADD COLUMN IF NOT EXISTS line_id INTEGER DEFAULT 0;
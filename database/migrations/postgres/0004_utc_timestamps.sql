@@ -0,0 +1,12 @@
+-- test_time 改为 UTC Unix 秒（整数），node_test_results 增加 trade_id，并为按城市和时间的查询建立索引。
+-- 旧的 "2006-01-02 15:04:05" 字符串按会话时区解析
+ALTER TABLE node_test_results ALTER COLUMN test_time TYPE BIGINT
+    USING CAST(EXTRACT(EPOCH FROM CAST(test_time AS TIMESTAMPTZ)) AS BIGINT);
+ALTER TABLE node_test_results ADD COLUMN IF NOT EXISTS trade_id INTEGER DEFAULT 0;
+
+ALTER TABLE probe_results ALTER COLUMN test_time TYPE BIGINT
+    USING CAST(EXTRACT(EPOCH FROM CAST(test_time AS TIMESTAMPTZ)) AS BIGINT);
+
+CREATE INDEX IF NOT EXISTS idx_node_test_results_node_time ON node_test_results (node_id, test_time);
+CREATE INDEX IF NOT EXISTS idx_node_test_results_test_time ON node_test_results (test_time);
+CREATE INDEX IF NOT EXISTS idx_probe_results_test_time ON probe_results (test_time);
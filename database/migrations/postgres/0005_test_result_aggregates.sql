@@ -0,0 +1,18 @@
+-- 超过保留期的检测结果按小时和按天汇总，period 为 hour 或 day，bucket_start 为区间开始的 UTC Unix 秒。
+-- 保存总和而不是平均值，同一区间分多次汇总时可以直接累加
+CREATE TABLE IF NOT EXISTS node_test_aggregates (
+    node_id INTEGER NOT NULL,
+    period TEXT NOT NULL,
+    bucket_start BIGINT NOT NULL,
+    samples BIGINT NOT NULL DEFAULT 0,
+    failures BIGINT NOT NULL DEFAULT 0,
+    success_rate_sum DOUBLE PRECISION DEFAULT 0,
+    response_samples BIGINT DEFAULT 0,
+    response_time_sum BIGINT DEFAULT 0,
+    response_time_min BIGINT,
+    response_time_max BIGINT,
+    download_rate_sum DOUBLE PRECISION DEFAULT 0,
+    download_rate_min DOUBLE PRECISION,
+    download_rate_max DOUBLE PRECISION,
+    PRIMARY KEY (node_id, period, bucket_start)
+);
@@ -0,0 +1,10 @@
+-- bad_ips 记录首次和最近一次命中时间（UTC Unix 秒）及命中次数，超过 TTL 未再命中的记录过期。
+-- 旧记录没有命中时间，从迁移时开始计算 TTL
+ALTER TABLE bad_ips ADD COLUMN IF NOT EXISTS first_seen BIGINT DEFAULT 0;
+ALTER TABLE bad_ips ADD COLUMN IF NOT EXISTS last_seen BIGINT DEFAULT 0;
+ALTER TABLE bad_ips ADD COLUMN IF NOT EXISTS hit_count INTEGER DEFAULT 1;
+
+UPDATE bad_ips SET first_seen = CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT), last_seen = CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT)
+WHERE first_seen = 0 OR first_seen IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_bad_ips_last_seen ON bad_ips (last_seen);
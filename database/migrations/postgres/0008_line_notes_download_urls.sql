@@ -0,0 +1,12 @@
+-- good_line、bad_line、bad_ips 增加备注，由 /api/v1 写入。
+-- download_url 改为可保存多个下载地址，enabled 为 0 的地址不参与检测，created_at 为 UTC Unix 秒
+ALTER TABLE good_line ADD COLUMN IF NOT EXISTS note TEXT DEFAULT '';
+ALTER TABLE bad_line ADD COLUMN IF NOT EXISTS note TEXT DEFAULT '';
+ALTER TABLE bad_ips ADD COLUMN IF NOT EXISTS note TEXT DEFAULT '';
+
+ALTER TABLE download_url ADD COLUMN IF NOT EXISTS enabled INTEGER DEFAULT 1;
+ALTER TABLE download_url ADD COLUMN IF NOT EXISTS note TEXT DEFAULT '';
+ALTER TABLE download_url ADD COLUMN IF NOT EXISTS created_at BIGINT DEFAULT 0;
+
+UPDATE download_url SET created_at = CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT)
+WHERE created_at = 0 OR created_at IS NULL;
@@ -0,0 +1,15 @@
+-- recheck_queue 替代内存中的 ExitErrorMap，保存下载出现退出码 18、28、97 后等待复查的城市和出口 IP，重启后恢复。
+-- exit_code 为最近一次的退出码，trade_id 为出错时检测的 TradeID，priority 越大越先复查，
+-- enqueued_at 为首次入队时间，updated_at 为最近一次入队时间（UTC Unix 秒）
+CREATE TABLE IF NOT EXISTS recheck_queue (
+    city_id INTEGER NOT NULL,
+    outbound_ip TEXT NOT NULL,
+    exit_code INTEGER DEFAULT 0,
+    trade_id INTEGER DEFAULT 0,
+    priority INTEGER DEFAULT 0,
+    enqueued_at BIGINT DEFAULT 0,
+    updated_at BIGINT DEFAULT 0,
+    PRIMARY KEY (city_id, outbound_ip)
+);
+
+CREATE INDEX IF NOT EXISTS idx_recheck_queue_priority ON recheck_queue (priority, enqueued_at);
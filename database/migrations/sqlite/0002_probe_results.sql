@@ -0,0 +1,24 @@
+-- 节点检测结果的分阶段耗时（毫秒），以及按探测类型存储结果的 probe_results 表
+ALTER TABLE node_test_results ADD COLUMN connect_time INTEGER DEFAULT 0;
+ALTER TABLE node_test_results ADD COLUMN handshake_time INTEGER DEFAULT 0;
+ALTER TABLE node_test_results ADD COLUMN connect_reply_time INTEGER DEFAULT 0;
+ALTER TABLE node_test_results ADD COLUMN first_byte_time INTEGER DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS probe_results (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    probe_type TEXT NOT NULL,
+    node_id INTEGER,
+    node_name TEXT,
+    outbound_ip TEXT,
+    trade_id INTEGER,
+    success_rate REAL,
+    response_time INTEGER,
+    download_rate REAL,
+    connect_time INTEGER DEFAULT 0,
+    handshake_time INTEGER DEFAULT 0,
+    connect_reply_time INTEGER DEFAULT 0,
+    first_byte_time INTEGER DEFAULT 0,
+    exit_code INTEGER DEFAULT 0,
+    error TEXT,
+    test_time TEXT
+);
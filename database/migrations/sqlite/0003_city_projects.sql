@@ -0,0 +1,3 @@
+-- 城市按项目和线路类型标记
+ALTER TABLE cities ADD COLUMN project_id INTEGER DEFAULT 0;
+ALTER TABLE cities ADD COLUMN line_id INTEGER DEFAULT 0;
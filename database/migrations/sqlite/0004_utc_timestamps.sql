@@ -0,0 +1,59 @@
+-- test_time 改为 UTC Unix 秒（整数），node_test_results 增加 trade_id，并为按城市和时间的查询建立索引。
+-- SQLite 不能修改列类型，重建表后按本地时间解析旧的 "2006-01-02 15:04:05" 字符串
+CREATE TABLE node_test_results_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    node_name TEXT NOT NULL,
+    success_rate REAL,
+    avg_response_time INTEGER,
+    test_time INTEGER,
+    outbound_ip TEXT,
+    trade_id INTEGER DEFAULT 0,
+    download_rate REAL,
+    node_id INTEGER,
+    connect_time INTEGER DEFAULT 0,
+    handshake_time INTEGER DEFAULT 0,
+    connect_reply_time INTEGER DEFAULT 0,
+    first_byte_time INTEGER DEFAULT 0
+);
+
+INSERT INTO node_test_results_new (id, node_name, success_rate, avg_response_time, test_time, outbound_ip, trade_id,
+    download_rate, node_id, connect_time, handshake_time, connect_reply_time, first_byte_time)
+SELECT id, node_name, success_rate, avg_response_time, CAST(strftime('%s', test_time, 'utc') AS INTEGER), outbound_ip, 0,
+    download_rate, node_id, connect_time, handshake_time, connect_reply_time, first_byte_time
+FROM node_test_results;
+
+DROP TABLE node_test_results;
+ALTER TABLE node_test_results_new RENAME TO node_test_results;
+
+CREATE TABLE probe_results_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    probe_type TEXT NOT NULL,
+    node_id INTEGER,
+    node_name TEXT,
+    outbound_ip TEXT,
+    trade_id INTEGER,
+    success_rate REAL,
+    response_time INTEGER,
+    download_rate REAL,
+    connect_time INTEGER DEFAULT 0,
+    handshake_time INTEGER DEFAULT 0,
+    connect_reply_time INTEGER DEFAULT 0,
+    first_byte_time INTEGER DEFAULT 0,
+    exit_code INTEGER DEFAULT 0,
+    error TEXT,
+    test_time INTEGER
+);
+
+INSERT INTO probe_results_new (id, probe_type, node_id, node_name, outbound_ip, trade_id, success_rate, response_time,
+    download_rate, connect_time, handshake_time, connect_reply_time, first_byte_time, exit_code, error, test_time)
+SELECT id, probe_type, node_id, node_name, outbound_ip, trade_id, success_rate, response_time,
+    download_rate, connect_time, handshake_time, connect_reply_time, first_byte_time, exit_code, error,
+    CAST(strftime('%s', test_time, 'utc') AS INTEGER)
+FROM probe_results;
+
+DROP TABLE probe_results;
+ALTER TABLE probe_results_new RENAME TO probe_results;
+
+CREATE INDEX IF NOT EXISTS idx_node_test_results_node_time ON node_test_results (node_id, test_time);
+CREATE INDEX IF NOT EXISTS idx_node_test_results_test_time ON node_test_results (test_time);
+CREATE INDEX IF NOT EXISTS idx_probe_results_test_time ON probe_results (test_time);
@@ -0,0 +1,18 @@
+-- good_line、bad_line、bad_ips 的变更记录：状态变化、触发的指标、当时的阈值、trade ID 和来源组件。
+-- event_time 为 UTC Unix 秒，metrics 和 thresholds 为 JSON 对象
+CREATE TABLE IF NOT EXISTS line_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_time INTEGER NOT NULL,
+    city_id INTEGER,
+    outbound_ip TEXT,
+    from_state TEXT NOT NULL,
+    to_state TEXT NOT NULL,
+    metrics TEXT,
+    thresholds TEXT,
+    reason TEXT,
+    trade_id INTEGER DEFAULT 0,
+    source TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_line_events_city_time ON line_events (city_id, event_time);
+CREATE INDEX IF NOT EXISTS idx_line_events_time ON line_events (event_time);
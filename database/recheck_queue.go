@@ -0,0 +1,132 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RecheckEntry 复查队列中的一个城市，同一城市的出口 IP 共用一个优先级
+type RecheckEntry struct {
+	CityID     int         `json:"city_id"`
+	CityName   string      `json:"city_name"`
+	Priority   int         `json:"priority"`    // 越大越先复查
+	EnqueuedAt time.Time   `json:"enqueued_at"` // 最早入队的出口 IP 的入队时间
+	UpdatedAt  time.Time   `json:"updated_at"`  // 最近一次入队时间
+	IPs        []RecheckIP `json:"ips"`
+}
+
+// RecheckIP 复查队列中城市的一个出口 IP
+type RecheckIP struct {
+	OutboundIP string    `json:"outbound_ip"`
+	ExitCode   int       `json:"exit_code"` // 最近一次下载出错的退出码
+	TradeID    int       `json:"trade_id"`  // 出错时检测的 TradeID
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// EnqueueRecheck 将下载出错的城市和出口 IP 加入复查队列。已在队列中时只更新退出码、TradeID 和更新时间，
+// 保留首次入队时间；城市已有其他出口 IP 时沿用城市的优先级
+func (s *sqlStore) EnqueueRecheck(cityID int, outboundIP string, exitCode, tradeID int) error {
+	now := time.Now().Unix()
+	_, err := s.exec(`
+        INSERT INTO recheck_queue (city_id, outbound_ip, exit_code, trade_id, priority, enqueued_at, updated_at)
+        VALUES (?, ?, ?, ?, COALESCE((SELECT MAX(priority) FROM recheck_queue WHERE city_id = ?), 0), ?, ?)
+        ON CONFLICT (city_id, outbound_ip) DO UPDATE SET
+            exit_code = excluded.exit_code, trade_id = excluded.trade_id, updated_at = excluded.updated_at
+    `, cityID, outboundIP, exitCode, tradeID, cityID, now, now)
+	return err
+}
+
+// RecheckQueue 获取复查队列中的全部城市，按优先级降序、入队时间升序排列，即复查的顺序
+func (s *sqlStore) RecheckQueue() ([]RecheckEntry, error) {
+	return s.recheckEntries("")
+}
+
+// GetRecheckEntry 获取复查队列中的一个城市，不在队列中时返回 sql.ErrNoRows
+func (s *sqlStore) GetRecheckEntry(cityID int) (RecheckEntry, error) {
+	entries, err := s.recheckEntries("WHERE r.city_id = ?", cityID)
+	if err != nil {
+		return RecheckEntry{}, err
+	}
+	if len(entries) == 0 {
+		return RecheckEntry{}, sql.ErrNoRows
+	}
+	return entries[0], nil
+}
+
+// RemoveRecheck 从复查队列中移除城市的出口 IP，outboundIP 为空时移除城市的全部出口 IP，
+// 没有可移除的记录时返回 sql.ErrNoRows
+func (s *sqlStore) RemoveRecheck(cityID int, outboundIP string) error {
+	if outboundIP == "" {
+		return s.execOne("DELETE FROM recheck_queue WHERE city_id = ?", cityID)
+	}
+	return s.execOne("DELETE FROM recheck_queue WHERE city_id = ? AND outbound_ip = ?", cityID, outboundIP)
+}
+
+// CompleteRecheck 复查完成后移除城市在 through 及之前入队的出口 IP，复查期间再次入队的出口 IP 保留，等待下一次复查
+func (s *sqlStore) CompleteRecheck(cityID int, through time.Time) error {
+	_, err := s.exec("DELETE FROM recheck_queue WHERE city_id = ? AND updated_at <= ?", cityID, through.Unix())
+	return err
+}
+
+// SetRecheckPriority 修改城市在复查队列中的优先级，不在队列中时返回 sql.ErrNoRows
+func (s *sqlStore) SetRecheckPriority(cityID, priority int) error {
+	return s.execOne("UPDATE recheck_queue SET priority = ? WHERE city_id = ?", priority, cityID)
+}
+
+// RecheckQueueSize 返回复查队列中的城市数和出口 IP 数
+func (s *sqlStore) RecheckQueueSize() (cities, ips int, err error) {
+	err = s.queryRow("SELECT COUNT(DISTINCT city_id), COUNT(*) FROM recheck_queue").Scan(&cities, &ips)
+	return cities, ips, err
+}
+
+// recheckEntries 查询复查队列并按城市汇总，城市的顺序与复查顺序一致
+func (s *sqlStore) recheckEntries(where string, args ...interface{}) ([]RecheckEntry, error) {
+	rows, err := s.query(`
+        SELECT r.city_id, c.name, r.outbound_ip, r.exit_code, r.trade_id, r.priority, r.enqueued_at, r.updated_at
+        FROM recheck_queue r
+        LEFT JOIN cities c ON c.id = r.city_id
+        `+where+`
+        ORDER BY r.priority DESC, r.enqueued_at, r.city_id, r.outbound_ip
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []RecheckEntry
+	index := make(map[int]int) // 城市 ID 到 entries 中的下标
+	for rows.Next() {
+		var cityID, priority int
+		var cityName sql.NullString
+		var ip RecheckIP
+		var exitCode, tradeID, enqueuedAt, updatedAt sql.NullInt64
+		if err := rows.Scan(&cityID, &cityName, &ip.OutboundIP, &exitCode, &tradeID, &priority, &enqueuedAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		ip.ExitCode, ip.TradeID = int(exitCode.Int64), int(tradeID.Int64)
+		ip.EnqueuedAt, ip.UpdatedAt = time.Unix(enqueuedAt.Int64, 0), time.Unix(updatedAt.Int64, 0)
+
+		i, ok := index[cityID]
+		if !ok {
+			i = len(entries)
+			index[cityID] = i
+			entries = append(entries, RecheckEntry{
+				CityID:     cityID,
+				CityName:   cityName.String,
+				Priority:   priority,
+				EnqueuedAt: ip.EnqueuedAt,
+				UpdatedAt:  ip.UpdatedAt,
+			})
+		}
+		entry := &entries[i]
+		if ip.EnqueuedAt.Before(entry.EnqueuedAt) {
+			entry.EnqueuedAt = ip.EnqueuedAt
+		}
+		if ip.UpdatedAt.After(entry.UpdatedAt) {
+			entry.UpdatedAt = ip.UpdatedAt
+		}
+		entry.IPs = append(entry.IPs, ip)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// 汇总区间，对应 node_test_aggregates.period
+const (
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+)
+
+// RollupStats 一次汇总处理的行数
+type RollupStats struct {
+	RawRows    int64 // 汇总并删除的 node_test_results 行数
+	ProbeRows  int64 // 删除的 probe_results 行数
+	HourlyRows int64 // 汇总为按天并删除的按小时汇总行数
+}
+
+// aggregateUpsert 同一区间已有汇总时累加总和并合并最小值、最大值
+const aggregateUpsert = `
+        ON CONFLICT (node_id, period, bucket_start) DO UPDATE SET
+            samples = node_test_aggregates.samples + excluded.samples,
+            failures = node_test_aggregates.failures + excluded.failures,
+            success_rate_sum = node_test_aggregates.success_rate_sum + excluded.success_rate_sum,
+            response_samples = node_test_aggregates.response_samples + excluded.response_samples,
+            response_time_sum = node_test_aggregates.response_time_sum + excluded.response_time_sum,
+            response_time_min = %s,
+            response_time_max = %s,
+            download_rate_sum = node_test_aggregates.download_rate_sum + excluded.download_rate_sum,
+            download_rate_min = %s,
+            download_rate_max = %s
+    `
+
+// RollupTestResults 将 rawBefore 之前的检测结果按小时汇总后删除（probe_results 直接删除），
+// 再将 hourlyBefore 之前的按小时汇总合并为按天汇总。两个时间应分别按小时和按天对齐，
+// 避免同一区间被拆成多次汇总；即使拆开，汇总保存的是总和，结果也不会出错
+func (s *sqlStore) RollupTestResults(rawBefore, hourlyBefore time.Time) (RollupStats, error) {
+	var stats RollupStats
+	tx, err := s.db.Begin()
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	upsert := s.aggregateUpsertSQL()
+
+	// 失败的检测 avg_response_time 为 -1，不计入响应时间
+	if _, err := tx.Exec(s.rebind(`
+        INSERT INTO node_test_aggregates (node_id, period, bucket_start, samples, failures, success_rate_sum,
+            response_samples, response_time_sum, response_time_min, response_time_max,
+            download_rate_sum, download_rate_min, download_rate_max)
+        SELECT node_id, ?, test_time - test_time % 3600, COUNT(*),
+            SUM(CASE WHEN success_rate = 0 THEN 1 ELSE 0 END),
+            SUM(COALESCE(success_rate, 0)),
+            SUM(CASE WHEN avg_response_time >= 0 THEN 1 ELSE 0 END),
+            SUM(CASE WHEN avg_response_time >= 0 THEN avg_response_time ELSE 0 END),
+            MIN(CASE WHEN avg_response_time >= 0 THEN avg_response_time END),
+            MAX(CASE WHEN avg_response_time >= 0 THEN avg_response_time END),
+            SUM(COALESCE(download_rate, 0)), MIN(download_rate), MAX(download_rate)
+        FROM node_test_results
+        WHERE test_time < ? AND node_id IS NOT NULL
+        GROUP BY node_id, test_time - test_time % 3600
+    `+upsert), PeriodHour, rawBefore.Unix()); err != nil {
+		return stats, err
+	}
+	if stats.RawRows, err = execRows(tx, s.rebind("DELETE FROM node_test_results WHERE test_time < ?"), rawBefore.Unix()); err != nil {
+		return stats, err
+	}
+	if stats.ProbeRows, err = execRows(tx, s.rebind("DELETE FROM probe_results WHERE test_time < ?"), rawBefore.Unix()); err != nil {
+		return stats, err
+	}
+
+	if _, err := tx.Exec(s.rebind(`
+        INSERT INTO node_test_aggregates (node_id, period, bucket_start, samples, failures, success_rate_sum,
+            response_samples, response_time_sum, response_time_min, response_time_max,
+            download_rate_sum, download_rate_min, download_rate_max)
+        SELECT node_id, ?, bucket_start - bucket_start % 86400, SUM(samples), SUM(failures), SUM(success_rate_sum),
+            SUM(response_samples), SUM(response_time_sum), MIN(response_time_min), MAX(response_time_max),
+            SUM(download_rate_sum), MIN(download_rate_min), MAX(download_rate_max)
+        FROM node_test_aggregates
+        WHERE period = ? AND bucket_start < ?
+        GROUP BY node_id, bucket_start - bucket_start % 86400
+    `+upsert), PeriodDay, PeriodHour, hourlyBefore.Unix()); err != nil {
+		return stats, err
+	}
+	if stats.HourlyRows, err = execRows(tx, s.rebind("DELETE FROM node_test_aggregates WHERE period = ? AND bucket_start < ?"),
+		PeriodHour, hourlyBefore.Unix()); err != nil {
+		return stats, err
+	}
+
+	return stats, tx.Commit()
+}
+
+// aggregateUpsertSQL 按数据库方言生成 aggregateUpsert，SQLite 的两参数 MIN/MAX 遇到 NULL 返回 NULL，先用 COALESCE 补齐
+func (s *sqlStore) aggregateUpsertSQL() string {
+	least := func(column string) string {
+		a, b := "node_test_aggregates."+column, "excluded."+column
+		if s.dbType == DBTypePostgres {
+			return "LEAST(" + a + ", " + b + ")"
+		}
+		return "MIN(COALESCE(" + a + ", " + b + "), COALESCE(" + b + ", " + a + "))"
+	}
+	greatest := func(column string) string {
+		a, b := "node_test_aggregates."+column, "excluded."+column
+		if s.dbType == DBTypePostgres {
+			return "GREATEST(" + a + ", " + b + ")"
+		}
+		return "MAX(COALESCE(" + a + ", " + b + "), COALESCE(" + b + ", " + a + "))"
+	}
+	return fmt.Sprintf(aggregateUpsert,
+		least("response_time_min"), greatest("response_time_max"),
+		least("download_rate_min"), greatest("download_rate_max"))
+}
+
+// execRows 执行语句并返回影响的行数
+func execRows(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,246 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+
+	"github.com/sirupsen/logrus"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// 支持的数据库类型，对应 config.yaml 中的 database.db_type
+const (
+	DBTypeSQLite   = "sqlite"
+	DBTypePostgres = "postgres"
+)
+
+const (
+	defaultSQLitePath = "./monitor.db"
+	sqliteMemoryPath  = ":memory:"
+	sqliteBusyTimeout = 5000 // 毫秒，共用一个连接池时写入冲突等待锁释放
+	maxOpenConns      = 10
+	maxIdleConns      = 5
+)
+
+// Store 存储接口，覆盖省份、城市、检测结果、good_line、bad_line、bad_ips、复查队列和 download_url。
+// 检测线程、主循环和网页服务器共用同一个实例
+type Store interface {
+	// 省份和城市
+	SaveProvinces(provinces []http_requests.Province) error
+	SaveNodes(nodes []http_requests.Node, project config.ProjectCFG) error
+	TagUntaggedCities(project config.ProjectCFG) error
+	CheckDataExists() (bool, error)
+	CountCities(filter ProjectFilter) (int, error)
+	GetCityProject(cityID int) (int, int, error)
+	GetCity(cityID int) (CityInfo, error)
+	GetCityLastTestTimes() ([]CityLastTest, error)
+	UpdateGoodCount(randomCityID int, increment bool) error
+	UpdateBadCount(randomCityID int, increment bool) error
+	GetGoodCount(randomCityID int) (int, error)
+	GetBadCount(randomCityID int) (int, error)
+
+	// 检测结果
+	SaveNodeTestResult(r NodeTestResult) error
+	SaveProbeResult(r ProbeResult) error
+	GetRecentFailureTimes(since time.Time, minSpeed float64) (map[int]time.Time, error)
+	OutboundIPStats(since time.Time, minSpeed float64) ([]OutboundIPStat, error)
+	CityFailureStats(since time.Time, minSpeed float64) ([]CityFailureStat, error)
+	LatestCityResults(start, end time.Time, sortBy string, filter ProjectFilter) ([]CityResult, error)
+	LatestNodeResult(filter ProjectFilter) (NodeResult, error)
+	CityHistory(cityID int, from, to time.Time, step time.Duration) ([]HistoryBucket, error)
+	RollupTestResults(rawBefore, hourlyBefore time.Time) (RollupStats, error)
+
+	// good_line、bad_line 和 bad_ips，写入和删除时在同一事务中记录 line_events
+	InsertIntoGoodLine(nodeID int, audit LineAudit) error
+	DeleteFromGoodLine(nodeID int, audit LineAudit) error
+	GoodLineCityIDs(filter ProjectFilter, random bool) ([]int, error)
+	GoodLineEntries(filter ProjectFilter) ([]GoodLineEntry, error)
+	CheckNodeIDExistsInGoodLine(nodeID int) (bool, error)
+	SetGoodLineNote(nodeID int, note string) error
+	InsertIntoBadLine(outboundIP string, randomCityID int, audit LineAudit) error
+	DeleteFromBadLine(outboundIP string, audit LineAudit) error
+	DeleteFromBadLine_id(randomCityID int, audit LineAudit) error
+	CheckNodeIDExistsInBadLine(outboundIP string) (bool, error)
+	CheckNodeIDExistsInBadLine_id(randomCityID int) (bool, error)
+	BadLineEntries(filter ProjectFilter) ([]BadLineEntry, error)
+	BadLineCityIDs(filter ProjectFilter) ([]int, error)
+	SetBadLineNote(outboundIP, note string) error
+	InsertIntoBadIPs(outboundIP string, randomCityID int, ttl time.Duration, audit LineAudit) error
+	IsBadIP(outboundIP string, ttl time.Duration) (bool, error)
+	BadIPEntries(filter ProjectFilter, ttl time.Duration) ([]BadIPEntry, error)
+	DeleteFromBadIPs(outboundIP string, cityID int, audit LineAudit) (int, error)
+	SetBadIPNote(outboundIP string, cityID int, note string) error
+	PurgeExpiredBadIPs(ttl time.Duration) (int, error)
+	LineEvents(q LineEventQuery) ([]LineEvent, error)
+
+	// 复查队列，保存下载出现退出码 18、28、97 后等待复查的城市和出口 IP
+	EnqueueRecheck(cityID int, outboundIP string, exitCode, tradeID int) error
+	RecheckQueue() ([]RecheckEntry, error)
+	GetRecheckEntry(cityID int) (RecheckEntry, error)
+	RemoveRecheck(cityID int, outboundIP string) error
+	CompleteRecheck(cityID int, through time.Time) error
+	SetRecheckPriority(cityID, priority int) error
+	RecheckQueueSize() (cities, ips int, err error)
+
+	// 下载地址
+	SaveDownloadURL(url string) error
+	GetDownloadURL() (string, error)
+	DownloadURLs() ([]DownloadURL, error)
+	GetDownloadURLByID(id int64) (DownloadURL, error)
+	AddDownloadURL(url, note string, enabled bool) (DownloadURL, error)
+	UpdateDownloadURL(id int64, enabled bool, note string) error
+	DeleteDownloadURL(id int64) error
+
+	// 迁移
+	Migrate(target int) ([]Migration, error)
+	MigrationStatuses() ([]MigrationStatus, error)
+	CheckSchema() (current, latest int, err error)
+
+	DBType() string
+	Close() error
+}
+
+// sqlStore 基于 database/sql 的 Store 实现，SQLite 和 PostgreSQL 共用，方言差异由 dbType 区分
+type sqlStore struct {
+	db     *sql.DB
+	dbType string
+}
+
+// InitDatabase 按配置打开数据库并执行未应用的迁移，失败时退出程序
+func InitDatabase(cfg config.DatabaseCFG) Store {
+	store, err := Open(cfg)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("打开数据库出错")
+	}
+
+	// 执行未应用的迁移，数据库版本高于程序支持的版本时拒绝启动
+	if _, err = store.Migrate(0); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("数据库迁移出错")
+	}
+	return store
+}
+
+// Open 按 db_type 打开数据库，不执行迁移
+func Open(cfg config.DatabaseCFG) (Store, error) {
+	switch strings.ToLower(cfg.DBType) {
+	case "", DBTypeSQLite, "sqlite3":
+		return OpenSQLite(cfg.Path)
+	case DBTypePostgres, "postgresql":
+		return OpenPostgres(cfg.DSN)
+	default:
+		return nil, fmt.Errorf("不支持的数据库类型: %s", cfg.DBType)
+	}
+}
+
+// OpenSQLite 打开 SQLite 数据库，path 为空时使用 ./monitor.db，为 :memory: 时打开内存数据库
+func OpenSQLite(path string) (Store, error) {
+	if path == "" {
+		path = defaultSQLitePath
+	}
+	// SQLite 默认不检查外键，开启后与 PostgreSQL 一致，cities.area_id 必须是已存在的省份
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=%d&_foreign_keys=on", path, sqliteBusyTimeout))
+	if err != nil {
+		return nil, err
+	}
+	store := newSQLStore(db, DBTypeSQLite)
+	if path == sqliteMemoryPath {
+		// 内存数据库的每个连接是各自独立的库，只保留一个连接
+		db.SetMaxOpenConns(1)
+	}
+	return store, nil
+}
+
+// OpenPostgres 打开 PostgreSQL 数据库并检查连接
+func OpenPostgres(dsn string) (Store, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("db_type 为 postgres 时必须配置 database.dsn")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("连接 PostgreSQL 出错: %w", err)
+	}
+	return newSQLStore(db, DBTypePostgres), nil
+}
+
+func newSQLStore(db *sql.DB, dbType string) *sqlStore {
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	return &sqlStore{db: db, dbType: dbType}
+}
+
+// DBType 返回数据库类型
+func (s *sqlStore) DBType() string {
+	return s.dbType
+}
+
+// Close 关闭连接池
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind 将 ? 占位符转换为当前数据库的格式，PostgreSQL 使用 $1、$2
+func (s *sqlStore) rebind(query string) string {
+	if s.dbType != DBTypePostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+// queryIDs 执行查询并返回第一列的 id 列表，忽略 NULL
+func (s *sqlStore) queryIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id sql.NullInt64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if id.Valid {
+			ids = append(ids, int(id.Int64))
+		}
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,689 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+)
+
+// 设置后同样的用例也在 PostgreSQL 上执行，每个用例使用一个临时 schema，结束后删除
+const testPostgresDSNEnv = "MONITOR_TEST_PG_DSN"
+
+var testProject = config.ProjectCFG{Name: "test", ProjectID: 592, LineID: 22}
+
+// forEachStore 分别在 SQLite 内存库和 PostgreSQL 上执行 fn，migrate 为 true 时先执行全部迁移
+func forEachStore(t *testing.T, migrate bool, fn func(t *testing.T, s *sqlStore)) {
+	t.Helper()
+	t.Run(DBTypeSQLite, func(t *testing.T) {
+		store, err := OpenSQLite(sqliteMemoryPath)
+		if err != nil {
+			t.Fatalf("打开 SQLite 内存库出错: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		fn(t, prepareStore(t, store, migrate))
+	})
+	t.Run(DBTypePostgres, func(t *testing.T) {
+		dsn := os.Getenv(testPostgresDSNEnv)
+		if dsn == "" {
+			t.Skipf("未设置 %s", testPostgresDSNEnv)
+		}
+		fn(t, prepareStore(t, openTestPostgres(t, dsn), migrate))
+	})
+}
+
+// openTestPostgres 创建临时 schema 并打开以它为 search_path 的连接
+func openTestPostgres(t *testing.T, dsn string) Store {
+	t.Helper()
+	admin, err := OpenPostgres(dsn)
+	if err != nil {
+		t.Fatalf("连接 PostgreSQL 出错: %v", err)
+	}
+	schema := fmt.Sprintf("monitor_test_%d", time.Now().UnixNano())
+	if _, err := admin.(*sqlStore).exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatalf("创建 schema 出错: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.(*sqlStore).exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	// lib/pq 将未识别的连接参数作为会话参数发送给服务器
+	switch {
+	case !strings.Contains(dsn, "://"):
+		dsn += " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		dsn += "&search_path=" + schema
+	default:
+		dsn += "?search_path=" + schema
+	}
+	store, err := OpenPostgres(dsn)
+	if err != nil {
+		t.Fatalf("连接 PostgreSQL 出错: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func prepareStore(t *testing.T, store Store, migrate bool) *sqlStore {
+	t.Helper()
+	if migrate {
+		if _, err := store.Migrate(0); err != nil {
+			t.Fatalf("执行迁移出错: %v", err)
+		}
+	}
+	return store.(*sqlStore)
+}
+
+// seedCity 写入一个省份和一个城市
+func seedCity(t *testing.T, s *sqlStore, cityID int) {
+	t.Helper()
+	if err := s.SaveProvinces([]http_requests.Province{{ID: 1, Name: "江苏省"}}); err != nil {
+		t.Fatalf("写入省份出错: %v", err)
+	}
+	node := http_requests.Node{ID: cityID, Name: fmt.Sprintf("城市%d", cityID), LineType: "电信", Max: 100, AreaID: 1}
+	if err := s.SaveNodes([]http_requests.Node{node}, testProject); err != nil {
+		t.Fatalf("写入城市出错: %v", err)
+	}
+}
+
+// lineEvents 按写入顺序返回城市的变更记录，LineEvents 默认按时间倒序
+func lineEvents(t *testing.T, s *sqlStore, cityID int) []LineEvent {
+	t.Helper()
+	events, err := s.LineEvents(LineEventQuery{CityID: cityID})
+	if err != nil {
+		t.Fatalf("查询变更记录出错: %v", err)
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dbType string
+		query  string
+		want   string
+	}{
+		{DBTypeSQLite, "SELECT * FROM bad_ips WHERE outboundIP = ? AND randomCityID = ?", "SELECT * FROM bad_ips WHERE outboundIP = ? AND randomCityID = ?"},
+		{DBTypePostgres, "SELECT * FROM bad_ips WHERE outboundIP = ? AND randomCityID = ?", "SELECT * FROM bad_ips WHERE outboundIP = $1 AND randomCityID = $2"},
+		{DBTypePostgres, "INSERT INTO good_line (node_id) VALUES (?)", "INSERT INTO good_line (node_id) VALUES ($1)"},
+		{DBTypePostgres, "SELECT COUNT(*) FROM provinces", "SELECT COUNT(*) FROM provinces"},
+		{DBTypePostgres, "UPDATE cities SET name = '南京' WHERE id = ?", "UPDATE cities SET name = '南京' WHERE id = $1"},
+	}
+	for _, tt := range tests {
+		s := &sqlStore{dbType: tt.dbType}
+		if got := s.rebind(tt.query); got != tt.want {
+			t.Errorf("%s rebind(%q) = %q，期望 %q", tt.dbType, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	forEachStore(t, false, func(t *testing.T, s *sqlStore) {
+		migrations, err := Migrations(s.dbType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(migrations) != 9 {
+			t.Fatalf("内置迁移 %d 个，期望 0001 到 0009 共 9 个", len(migrations))
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Fatalf("第 %d 个迁移的版本号为 %d", i+1, m.Version)
+			}
+		}
+
+		// 先迁移到 0003，再执行剩余的迁移
+		applied, err := s.Migrate(3)
+		if err != nil {
+			t.Fatalf("迁移到 0003 出错: %v", err)
+		}
+		if len(applied) != 3 {
+			t.Fatalf("迁移到 0003 执行了 %d 个迁移", len(applied))
+		}
+		applied, err = s.Migrate(0)
+		if err != nil {
+			t.Fatalf("执行剩余迁移出错: %v", err)
+		}
+		if len(applied) != 6 || applied[0].Version != 4 {
+			t.Fatalf("剩余迁移执行了 %d 个", len(applied))
+		}
+
+		current, latest, err := s.CheckSchema()
+		if err != nil || current != 9 || latest != 9 {
+			t.Fatalf("CheckSchema() = %d, %d, %v，期望 9, 9", current, latest, err)
+		}
+		statuses, err := s.MigrationStatuses()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range statuses {
+			if !status.Applied {
+				t.Errorf("迁移 %04d_%s 未标记为已执行", status.Version, status.Name)
+			}
+		}
+
+		// 再次执行不应重复迁移
+		applied, err = s.Migrate(0)
+		if err != nil || len(applied) != 0 {
+			t.Fatalf("重复执行迁移: %d 个, %v", len(applied), err)
+		}
+
+		// 各迁移创建的表和列都可以访问
+		for _, query := range []string{
+			"SELECT id, name, line_type, max, area_id, good_count, bad_count, project_id, line_id FROM cities",
+			"SELECT node_id, note FROM good_line",
+			"SELECT outbound_ip, randomCityID, note FROM bad_line",
+			"SELECT outboundIP, randomCityID, first_seen, last_seen, hit_count, note FROM bad_ips",
+			"SELECT id, event_time, city_id, outbound_ip, from_state, to_state, metrics, thresholds, reason, trade_id, source FROM line_events",
+			"SELECT city_id, outbound_ip, exit_code, trade_id, priority, enqueued_at, updated_at FROM recheck_queue",
+			"SELECT id, url, enabled, note FROM download_url",
+		} {
+			rows, err := s.query(query)
+			if err != nil {
+				t.Errorf("%s: %v", query, err)
+				continue
+			}
+			rows.Close()
+		}
+	})
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		if _, err := s.exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", 100, "future", "2030-01-01 00:00:00"); err != nil {
+			t.Fatal(err)
+		}
+		var tooNew *SchemaTooNewError
+		if _, err := s.Migrate(0); !errors.As(err, &tooNew) || tooNew.Current != 100 {
+			t.Fatalf("Migrate() 错误为 %v，期望 SchemaTooNewError", err)
+		}
+	})
+}
+
+func TestMigrateDuplicateColumn(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		wantErr bool
+	}{
+		// 引入迁移之前的旧库已有 0001 到 0003 中的列
+		{"legacy", 2, false},
+		{"legacy_last", legacyMigrationVersion, false},
+		{"after_legacy", legacyMigrationVersion + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := OpenSQLite(sqliteMemoryPath)
+			if err != nil {
+				t.Fatalf("打开 SQLite 内存库出错: %v", err)
+			}
+			t.Cleanup(func() { store.Close() })
+			s := prepareStore(t, store, true)
+
+			// project_id 已由 0003 添加，删除版本记录后以 tt.version 重新执行同样的加列语句
+			m := Migration{Version: tt.version, Name: "duplicate", SQL: "ALTER TABLE cities ADD COLUMN project_id INTEGER DEFAULT 0;"}
+			if _, err := s.exec("DELETE FROM schema_version WHERE version = ?", m.Version); err != nil {
+				t.Fatal(err)
+			}
+			err = s.applyMigration(m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyMigration() 错误为 %v，期望出错: %v", err, tt.wantErr)
+			}
+			// 只有执行成功时才记录版本
+			var count int
+			if err := s.queryRow("SELECT COUNT(*) FROM schema_version WHERE version = ?", m.Version).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if recorded := count == 1; recorded == tt.wantErr {
+				t.Fatalf("schema_version 中版本 %d 的记录为 %d 条", m.Version, count)
+			}
+		})
+	}
+}
+
+func TestCityAreaForeignKey(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		orphan := http_requests.Node{ID: 999, Name: "不存在的省份", AreaID: 99}
+		if err := s.SaveNodes([]http_requests.Node{orphan}, testProject); err == nil {
+			t.Fatal("area_id 不存在时写入城市应失败")
+		}
+		count, err := s.CountCities(ProjectFilter{})
+		if err != nil || count != 1 {
+			t.Fatalf("CountCities() = %d, %v，期望 1", count, err)
+		}
+	})
+}
+
+func TestGoodLineEvents(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		audit := LineAudit{Source: SourceLineProcessor, TradeID: 7, Reason: "连续检测成功", Metrics: map[string]float64{"download_rate": 12.5}}
+		if err := s.InsertIntoGoodLine(101, audit); err != nil {
+			t.Fatal(err)
+		}
+		// 重复写入不产生新的变更记录
+		if err := s.InsertIntoGoodLine(101, audit); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.CheckNodeIDExistsInGoodLine(101); err != nil || !ok {
+			t.Fatalf("good_line 中没有 101: %v", err)
+		}
+		if err := s.DeleteFromGoodLine(101, LineAudit{Source: SourceAPI}); err != nil {
+			t.Fatal(err)
+		}
+
+		events := lineEvents(t, s, 101)
+		if len(events) != 2 {
+			t.Fatalf("变更记录 %d 条，期望 2 条", len(events))
+		}
+		if e := events[0]; e.FromState != LineStateNone || e.ToState != LineStateGoodLine || e.Source != SourceLineProcessor ||
+			e.TradeID != 7 || e.CityName != "城市101" || e.Metrics["download_rate"] != 12.5 {
+			t.Errorf("写入 good_line 的变更记录为 %+v", e)
+		}
+		if e := events[1]; e.FromState != LineStateGoodLine || e.ToState != LineStateNone || e.Source != SourceAPI {
+			t.Errorf("删除 good_line 的变更记录为 %+v", e)
+		}
+	})
+}
+
+func TestBadLineEvents(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		audit := LineAudit{Source: SourceChecker, Reason: "下载速度过低"}
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			if err := s.InsertIntoBadLine(ip, 101, audit); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.DeleteFromBadLine_id(101, LineAudit{Source: SourceAPI}); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.CheckNodeIDExistsInBadLine_id(101); err != nil || ok {
+			t.Fatalf("bad_line 中仍有 101: %v", err)
+		}
+
+		events := lineEvents(t, s, 101)
+		if len(events) != 4 {
+			t.Fatalf("变更记录 %d 条，期望 4 条", len(events))
+		}
+		for _, e := range events[:2] {
+			if e.ToState != LineStateBadLine || e.Source != SourceChecker {
+				t.Errorf("写入 bad_line 的变更记录为 %+v", e)
+			}
+		}
+		for _, e := range events[2:] {
+			if e.FromState != LineStateBadLine || e.ToState != LineStateNone || e.OutboundIP == "" {
+				t.Errorf("删除 bad_line 的变更记录为 %+v", e)
+			}
+		}
+	})
+}
+
+func TestBadIPsEvents(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		audit := LineAudit{Source: SourceChecker, Reason: "下载出错"}
+		for i := 0; i < 3; i++ {
+			if err := s.InsertIntoBadIPs("10.0.0.1", 101, time.Hour, audit); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := s.BadIPEntries(ProjectFilter{}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].HitCount != 3 || entries[0].Expired {
+			t.Fatalf("bad_ips 记录为 %+v，期望命中 3 次且未过期", entries)
+		}
+		if ok, err := s.IsBadIP("10.0.0.1", time.Hour); err != nil || !ok {
+			t.Fatalf("IsBadIP() = %v, %v", ok, err)
+		}
+		// 未过期时再次命中只累加次数，只有首次写入产生变更记录
+		events := lineEvents(t, s, 101)
+		if len(events) != 1 || events[0].ToState != LineStateBadIPs || events[0].OutboundIP != "10.0.0.1" {
+			t.Fatalf("变更记录为 %+v", events)
+		}
+	})
+}
+
+func TestLineWriteRollsBackWithEvent(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		// 变更记录写入失败时，同一事务中对线路表的修改也要回滚
+		if _, err := s.exec("DROP TABLE line_events"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertIntoGoodLine(101, LineAudit{Source: SourceAPI}); err == nil {
+			t.Fatal("line_events 不存在时写入 good_line 应失败")
+		}
+		if err := s.InsertIntoBadLine("10.0.0.1", 101, LineAudit{Source: SourceAPI}); err == nil {
+			t.Fatal("line_events 不存在时写入 bad_line 应失败")
+		}
+		if err := s.InsertIntoBadIPs("10.0.0.1", 101, time.Hour, LineAudit{Source: SourceAPI}); err == nil {
+			t.Fatal("line_events 不存在时写入 bad_ips 应失败")
+		}
+		for _, table := range []string{"good_line", "bad_line", "bad_ips"} {
+			var count int
+			if err := s.queryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Errorf("%s 中有 %d 条未回滚的记录", table, count)
+			}
+		}
+	})
+}
+
+func TestPurgeExpiredBadIPs(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			if err := s.InsertIntoBadIPs(ip, 101, time.Hour, LineAudit{Source: SourceChecker}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stale := time.Now().Add(-2 * time.Hour).Unix()
+		if _, err := s.exec("UPDATE bad_ips SET last_seen = ? WHERE outboundIP = ?", stale, "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.IsBadIP("10.0.0.1", time.Hour); err != nil || ok {
+			t.Fatalf("过期的出口 IP IsBadIP() = %v, %v", ok, err)
+		}
+
+		purged, err := s.PurgeExpiredBadIPs(time.Hour)
+		if err != nil || purged != 1 {
+			t.Fatalf("PurgeExpiredBadIPs() = %d, %v，期望 1", purged, err)
+		}
+		entries, err := s.BadIPEntries(ProjectFilter{}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].OutboundIP != "10.0.0.2" {
+			t.Fatalf("清理后 bad_ips 为 %+v", entries)
+		}
+		events := lineEvents(t, s, 101)
+		last := events[len(events)-1]
+		if last.OutboundIP != "10.0.0.1" || last.FromState != LineStateBadIPs || last.ToState != LineStateNone || last.Source != SourceRetention {
+			t.Fatalf("清理的变更记录为 %+v", last)
+		}
+		if purged, err := s.PurgeExpiredBadIPs(time.Hour); err != nil || purged != 0 {
+			t.Fatalf("重复清理 PurgeExpiredBadIPs() = %d, %v", purged, err)
+		}
+	})
+}
+
+func TestEnqueueRecheck(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		seedCity(t, s, 102)
+		if err := s.EnqueueRecheck(102, "10.0.1.1", 18, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.EnqueueRecheck(101, "10.0.0.1", 18, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetRecheckPriority(101, 5); err != nil {
+			t.Fatal(err)
+		}
+		// 城市已在队列中时，新的出口 IP 沿用城市的优先级
+		if err := s.EnqueueRecheck(101, "10.0.0.2", 97, 2); err != nil {
+			t.Fatal(err)
+		}
+		// 重复入队只更新退出码、TradeID 和更新时间，保留首次入队时间
+		old := time.Now().Add(-time.Hour).Unix()
+		if _, err := s.exec("UPDATE recheck_queue SET enqueued_at = ?, updated_at = ? WHERE outbound_ip = ?", old, old, "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.EnqueueRecheck(101, "10.0.0.1", 28, 3); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := s.RecheckQueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].CityID != 101 || entries[1].CityID != 102 {
+			t.Fatalf("复查顺序为 %+v，期望 101 在 102 之前", entries)
+		}
+		entry := entries[0]
+		if entry.Priority != 5 || len(entry.IPs) != 2 || entry.CityName != "城市101" || entry.EnqueuedAt.Unix() != old {
+			t.Fatalf("城市 101 为 %+v", entry)
+		}
+		for _, ip := range entry.IPs {
+			switch ip.OutboundIP {
+			case "10.0.0.1":
+				if ip.ExitCode != 28 || ip.TradeID != 3 || ip.EnqueuedAt.Unix() != old || ip.UpdatedAt.Unix() == old {
+					t.Errorf("重复入队后 10.0.0.1 为 %+v", ip)
+				}
+			case "10.0.0.2":
+				if ip.ExitCode != 97 || ip.TradeID != 2 {
+					t.Errorf("10.0.0.2 为 %+v", ip)
+				}
+			}
+		}
+
+		cities, ips, err := s.RecheckQueueSize()
+		if err != nil || cities != 2 || ips != 3 {
+			t.Fatalf("RecheckQueueSize() = %d, %d, %v，期望 2, 3", cities, ips, err)
+		}
+		if err := s.SetRecheckPriority(999, 1); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("不在队列中的城市 SetRecheckPriority() = %v，期望 sql.ErrNoRows", err)
+		}
+	})
+}
+
+func TestCompleteRecheck(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		if err := s.EnqueueRecheck(101, "10.0.0.1", 18, 1); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := s.GetRecheckEntry(101)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 复查期间再次入队的出口 IP 保留到下一次复查
+		later := entry.UpdatedAt.Add(time.Minute).Unix()
+		if _, err := s.exec(`
+            INSERT INTO recheck_queue (city_id, outbound_ip, exit_code, trade_id, priority, enqueued_at, updated_at)
+            VALUES (?, ?, ?, ?, 0, ?, ?)
+        `, 101, "10.0.0.2", 28, 1, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CompleteRecheck(101, entry.UpdatedAt); err != nil {
+			t.Fatal(err)
+		}
+		entry, err = s.GetRecheckEntry(101)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entry.IPs) != 1 || entry.IPs[0].OutboundIP != "10.0.0.2" {
+			t.Fatalf("复查完成后队列为 %+v", entry.IPs)
+		}
+
+		if err := s.RemoveRecheck(101, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetRecheckEntry(101); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("移除后 GetRecheckEntry() = %v，期望 sql.ErrNoRows", err)
+		}
+		if err := s.RemoveRecheck(101, ""); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("重复移除 RemoveRecheck() = %v，期望 sql.ErrNoRows", err)
+		}
+	})
+}
+
+// insertTestResult 写入一条指定检测时间的 node_test_results，SaveNodeTestResult 固定使用当前时间
+func insertTestResult(t *testing.T, s *sqlStore, cityID int, testTime time.Time, successRate float64, responseTime int64, downloadRate float64) {
+	t.Helper()
+	if _, err := s.exec(`
+        INSERT INTO node_test_results (node_name, success_rate, avg_response_time, test_time, outbound_ip, trade_id, download_rate, node_id)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, fmt.Sprintf("城市%d", cityID), successRate, responseTime, testTime.Unix(), "10.0.0.1", 1, downloadRate, cityID); err != nil {
+		t.Fatalf("写入检测结果出错: %v", err)
+	}
+}
+
+// countRows 返回表中满足条件的行数
+func countRows(t *testing.T, s *sqlStore, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := s.queryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("统计行数出错: %v", err)
+	}
+	return n
+}
+
+// checkStats 比较一项指标的最小值、平均值和最大值，min、max 为 nil 时期望没有最小值、最大值
+func checkStats(t *testing.T, name string, got HistoryStats, min *float64, avg float64, max *float64) {
+	t.Helper()
+	equal := func(a, b *float64) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return math.Abs(*a-*b) < 1e-9
+	}
+	if !equal(got.Min, min) || !equal(got.Avg, &avg) || !equal(got.Max, max) {
+		t.Errorf("%s 为 min=%v avg=%v max=%v，期望 min=%v avg=%v max=%v", name,
+			formatStat(got.Min), formatStat(got.Avg), formatStat(got.Max), formatStat(min), avg, formatStat(max))
+	}
+}
+
+// formatStat 格式化可能为 nil 的统计值
+func formatStat(v *float64) string {
+	if v == nil {
+		return "nil"
+	}
+	return fmt.Sprint(*v)
+}
+
+// floatPtr 返回指向 v 的指针
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestRollupTestResults(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		day0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		hour0 := day0.Add(10 * time.Hour)
+		hour1 := hour0.Add(time.Hour)
+		rawBefore := day0.Add(2 * 24 * time.Hour)
+
+		insertTestResult(t, s, 101, hour0.Add(time.Minute), 100, 100, 10)
+		insertTestResult(t, s, 101, hour0.Add(2*time.Minute), 50, 300, 30)
+		// 失败的检测响应时间为 -1，不计入响应时间
+		insertTestResult(t, s, 101, hour0.Add(3*time.Minute), 0, -1, 0)
+		insertTestResult(t, s, 101, hour1.Add(time.Minute), 100, 200, 20)
+		// 恰好在截止时间的结果保留原始数据
+		insertTestResult(t, s, 101, rawBefore, 100, 50, 5)
+		if err := s.SaveProbeResult(ProbeResult{ProbeType: "dns", NodeID: 101}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveProbeResult(ProbeResult{ProbeType: "dns", NodeID: 101}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.exec("UPDATE probe_results SET test_time = ? WHERE id = (SELECT MIN(id) FROM probe_results)", hour0.Unix()); err != nil {
+			t.Fatal(err)
+		}
+
+		// 按小时汇总，保留期内的按小时汇总不合并
+		stats, err := s.RollupTestResults(rawBefore, day0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats != (RollupStats{RawRows: 4, ProbeRows: 1}) {
+			t.Fatalf("按小时汇总处理了 %+v", stats)
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM node_test_results"); n != 1 {
+			t.Fatalf("汇总后剩余 %d 条原始结果，期望 1 条", n)
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM probe_results"); n != 1 {
+			t.Fatalf("汇总后剩余 %d 条探测结果，期望 1 条", n)
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM node_test_aggregates WHERE period = ?", PeriodHour); n != 2 {
+			t.Fatalf("按小时汇总为 %d 条，期望 2 条", n)
+		}
+
+		buckets, err := s.CityHistory(101, hour0, hour1.Add(time.Hour), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != 2 {
+			t.Fatalf("区间为 %+v，期望 2 个", buckets)
+		}
+		b := buckets[0]
+		if b.Samples != 3 || b.Failures != 1 || !b.Aggregated {
+			t.Fatalf("第一个小时为 %+v，期望 3 次检测、1 次失败", b)
+		}
+		checkStats(t, "第一个小时的响应时间", b.ResponseTime, floatPtr(100), 200, floatPtr(300))
+		checkStats(t, "第一个小时的下载速率", b.DownloadRate, floatPtr(0), 40.0/3, floatPtr(30))
+		checkStats(t, "第一个小时的成功率", b.SuccessRate, nil, 50, nil)
+		if b.ResponseTime.P95 != nil {
+			t.Errorf("汇总数据的 P95 为 %v，期望 nil", *b.ResponseTime.P95)
+		}
+		b = buckets[1]
+		if b.Samples != 1 || b.Failures != 0 {
+			t.Fatalf("第二个小时为 %+v，期望 1 次检测", b)
+		}
+		checkStats(t, "第二个小时的响应时间", b.ResponseTime, floatPtr(200), 200, floatPtr(200))
+
+		// 重复执行不会再次汇总
+		if stats, err := s.RollupTestResults(rawBefore, day0); err != nil || stats != (RollupStats{}) {
+			t.Fatalf("重复汇总 RollupTestResults() = %+v, %v", stats, err)
+		}
+
+		// 按小时汇总合并为按天汇总
+		stats, err = s.RollupTestResults(rawBefore, day0.Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats != (RollupStats{HourlyRows: 2}) {
+			t.Fatalf("按天汇总处理了 %+v", stats)
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM node_test_aggregates WHERE period = ?", PeriodHour); n != 0 {
+			t.Fatalf("按天汇总后剩余 %d 条按小时汇总", n)
+		}
+		buckets, err = s.CityHistory(101, day0, day0.Add(24*time.Hour), 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != 1 || buckets[0].Samples != 4 || buckets[0].Failures != 1 || !buckets[0].Aggregated {
+			t.Fatalf("按天汇总为 %+v，期望 4 次检测、1 次失败", buckets)
+		}
+		b = buckets[0]
+		checkStats(t, "当天的响应时间", b.ResponseTime, floatPtr(100), 200, floatPtr(300))
+		checkStats(t, "当天的下载速率", b.DownloadRate, floatPtr(0), 15, floatPtr(30))
+		checkStats(t, "当天的成功率", b.SuccessRate, nil, 62.5, nil)
+	})
+}
+
+func TestRollupKeepsRawRowsOnError(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, s *sqlStore) {
+		seedCity(t, s, 101)
+		testTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+		insertTestResult(t, s, 101, testTime, 100, 100, 10)
+		// 汇总写入失败时整个事务回滚，原始结果不能被删除
+		if _, err := s.exec("DROP TABLE node_test_aggregates"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RollupTestResults(testTime.Add(time.Hour), testTime); err == nil {
+			t.Fatal("汇总表不存在时应返回错误")
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM node_test_results"); n != 1 {
+			t.Fatalf("汇总失败后剩余 %d 条原始结果，期望 1 条", n)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"monitoring_system/metrics"
+)
+
+// 事件类型，对应 /events 推送的 event 字段
+const (
+	TypeNodeResult     = "node_result"     // performChecks 的一次节点检测汇总结果，data 为 database.NodeTestResult
+	TypeProbeResult    = "probe_result"    // 单个探测器的结果，data 为 database.ProbeResult
+	TypeAPIAction      = "api_action"      // 调用 changeNode、changeLineIpAddr，data 为 http_requests.APIAction
+	TypeLineTransition = "line_transition" // good_line、bad_line、bad_ips 的变更，data 为 database.LineEvent
+	TypeProbeJob       = "probe_job"       // 按需检测任务的状态变化，data 为 jobs.Job
+)
+
+// 事件来源，line_transition 的来源沿用 line_events 的 source
+const (
+	SourceChecks   = "checks"    // performChecks 的周期检测
+	SourceChecker  = "checker"   // checker 复查
+	SourceProbeJob = "probe_job" // 通过 /api/v1/probes 发起的按需检测
+)
+
+const (
+	defaultHistorySize = 200 // 保留的最近事件数，用于断线重连和新页面回放
+	subscriberBuffer   = 256 // 每个订阅者的缓冲区大小
+)
+
+// 订阅者处理不过来时丢弃的事件数
+var dropped = metrics.NewCounterVec("monitoring_events_dropped_total", "事件总线因订阅者缓冲区已满而丢弃的事件数。标签 type: 事件类型", "type")
+
+// Event 事件总线上的一条事件
+type Event struct {
+	ID     int64     `json:"id"` // 进程内递增的序号，重启后从 1 开始
+	Type   string    `json:"type"`
+	Source string    `json:"source,omitempty"`
+	Time   time.Time `json:"time"`
+	Data   any       `json:"data"`
+}
+
+// Bus 进程内事件总线。发布不阻塞，订阅者的缓冲区已满时丢弃该订阅者的事件
+type Bus struct {
+	mutex       sync.Mutex
+	seq         int64
+	history     []Event // 环形缓冲区，保存最近的事件
+	next        int     // history 中下一条事件的写入位置
+	subscribers map[chan Event]struct{}
+}
+
+// Default 默认事件总线，检测流程、Checker、线路表变更和上游接口调用都发布到这里，由网页服务器的 /events 推送
+var Default = NewBus(defaultHistorySize)
+
+// NewBus 创建事件总线，historySize 为保留的最近事件数
+func NewBus(historySize int) *Bus {
+	if historySize <= 0 {
+		historySize = defaultHistorySize
+	}
+	return &Bus{
+		history:     make([]Event, 0, historySize),
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish 发布事件到 Default
+func Publish(eventType, source string, data any) {
+	Default.Publish(eventType, source, data)
+}
+
+// Publish 发布事件，返回分配了序号的事件
+func (b *Bus) Publish(eventType, source string, data any) Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.seq++
+	event := Event{ID: b.seq, Type: eventType, Source: source, Time: time.Now().UTC(), Data: data}
+	if len(b.history) < cap(b.history) {
+		b.history = append(b.history, event)
+	} else {
+		b.history[b.next] = event
+	}
+	b.next = (b.next + 1) % cap(b.history)
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			dropped.Inc(eventType)
+		}
+	}
+	return event
+}
+
+// Subscribe 订阅事件。lastID 大于 0 时回放序号大于 lastID 的历史事件（断线重连），
+// 否则回放最近 recent 条。返回的 cancel 用于取消订阅，取消后 channel 被关闭
+func (b *Bus) Subscribe(lastID int64, recent int) (replay []Event, ch <-chan Event, cancel func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	history := b.recentLocked()
+	switch {
+	case lastID > 0:
+		for _, event := range history {
+			if event.ID > lastID {
+				replay = append(replay, event)
+			}
+		}
+	case recent > 0:
+		if recent < len(history) {
+			history = history[len(history)-recent:]
+		}
+		replay = history
+	}
+
+	sub := make(chan Event, subscriberBuffer)
+	b.subscribers[sub] = struct{}{}
+	var once sync.Once
+	cancel = func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			delete(b.subscribers, sub)
+			close(sub)
+		})
+	}
+	return replay, sub, cancel
+}
+
+// recentLocked 按序号升序返回历史事件的副本，调用方需持有锁
+func (b *Bus) recentLocked() []Event {
+	events := make([]Event, 0, len(b.history))
+	if len(b.history) < cap(b.history) {
+		return append(events, b.history...)
+	}
+	events = append(events, b.history[b.next:]...)
+	return append(events, b.history[:b.next]...)
+}
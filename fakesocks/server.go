@@ -0,0 +1,486 @@
+package fakesocks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// SOCKS5 协议常量
+const (
+	socksVersion        = 0x05
+	authNone            = 0x00
+	authUsernamePass    = 0x02
+	authNoAcceptable    = 0xff
+	authUsernamePassVer = 0x01
+	cmdConnect          = 0x01
+	atypIPv4            = 0x01
+	atypDomain          = 0x03
+	atypIPv6            = 0x04
+)
+
+// CONNECT 响应码
+const (
+	replySucceeded          = 0x00
+	replyHostUnreachable    = 0x04
+	replyConnectionRefused  = 0x05
+	replyCommandUnsupported = 0x07
+	replyAddrUnsupported    = 0x08
+)
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	relayChunkSize     = 16 * 1024
+)
+
+// Impairments 注入到连接上的异常
+type Impairments struct {
+	Latency       time.Duration `yaml:"latency"`        // 每次握手响应前的延迟
+	Bandwidth     int64         `yaml:"bandwidth"`      // 下行带宽上限，字节/秒，0 表示不限
+	ResetAfter    int64         `yaml:"reset_after"`    // 下行传输该字节数后重置连接，0 表示不重置
+	AuthFail      bool          `yaml:"auth_fail"`      // 用户名密码认证总是失败
+	RefuseConnect bool          `yaml:"refuse_connect"` // CONNECT 总是返回连接被拒绝
+}
+
+// Config 假 SOCKS5 代理配置
+type Config struct {
+	Users       map[string]string      `yaml:"users"`    // 用户名到密码，为空时接受任意用户名密码
+	Redirect    string                 `yaml:"redirect"` // 所有 CONNECT 改为连接该地址，为空时连接请求的目标
+	DialTimeout time.Duration          `yaml:"dial_timeout"`
+	Impairments Impairments            `yaml:"impairments"` // 默认异常
+	PerUser     map[string]Impairments `yaml:"per_user"`    // 按用户名覆盖异常，用于让不同 trade ID 表现不同
+}
+
+// Stats 代理的连接统计
+type Stats struct {
+	Connections   int64 `json:"connections"`
+	AuthFailures  int64 `json:"auth_failures"`
+	Refused       int64 `json:"refused"`
+	Resets        int64 `json:"resets"`
+	BytesRelayed  int64 `json:"bytes_relayed"`
+	ConnectErrors int64 `json:"connect_errors"`
+}
+
+// Server 假 SOCKS5 代理，只支持 CONNECT，可注入延迟、限速、中途重置、认证失败和拒绝 CONNECT
+type Server struct {
+	config Config
+
+	mutex       sync.RWMutex
+	impairments Impairments
+	perUser     map[string]Impairments
+	listener    net.Listener
+	conns       map[net.Conn]struct{}
+	wg          sync.WaitGroup
+
+	connections   atomic.Int64
+	authFailures  atomic.Int64
+	refused       atomic.Int64
+	resets        atomic.Int64
+	bytesRelayed  atomic.Int64
+	connectErrors atomic.Int64
+}
+
+// NewServer 创建假 SOCKS5 代理
+func NewServer(config Config) *Server {
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	perUser := make(map[string]Impairments, len(config.PerUser))
+	for user, imp := range config.PerUser {
+		perUser[user] = imp
+	}
+	return &Server{
+		config:      config,
+		impairments: config.Impairments,
+		perUser:     perUser,
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen 监听 addr 并在后台处理连接，addr 为 "127.0.0.1:0" 时可通过 Addr 获取实际端口
+func (s *Server) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.listener = listener
+	s.mutex.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serve(listener)
+	}()
+	return nil
+}
+
+// Addr 返回监听地址，可直接作为 Line.EndpointAddr
+func (s *Server) Addr() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Close 停止监听并断开所有连接
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Run 监听 addr 直到 ctx 取消
+func (s *Server) Run(ctx context.Context, addr string) error {
+	if err := s.Listen(addr); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return s.Close()
+}
+
+// SetImpairments 修改默认异常，对之后的新连接生效
+func (s *Server) SetImpairments(imp Impairments) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.impairments = imp
+}
+
+// SetUserImpairments 修改某个用户名的异常，对之后的新连接生效
+func (s *Server) SetUserImpairments(user string, imp Impairments) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.perUser[user] = imp
+}
+
+// ClearUserImpairments 删除某个用户名的异常，恢复使用默认异常
+func (s *Server) ClearUserImpairments(user string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.perUser, user)
+}
+
+// Stats 返回连接统计
+func (s *Server) Stats() Stats {
+	return Stats{
+		Connections:   s.connections.Load(),
+		AuthFailures:  s.authFailures.Load(),
+		Refused:       s.refused.Load(),
+		Resets:        s.resets.Load(),
+		BytesRelayed:  s.bytesRelayed.Load(),
+		ConnectErrors: s.connectErrors.Load(),
+	}
+}
+
+// impairmentsFor 返回用户名对应的异常
+func (s *Server) impairmentsFor(user string) Impairments {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if imp, ok := s.perUser[user]; ok {
+		return imp
+	}
+	return s.impairments
+}
+
+// track 记录或移除活动连接，Close 时统一断开
+func (s *Server) track(conn net.Conn, add bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+func (s *Server) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.WithFields(logrus.Fields{"Error": err}).Error("【FakeSOCKS5】接受连接出错")
+			}
+			return
+		}
+		s.connections.Add(1)
+		s.track(conn, true)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.track(conn, false)
+			defer conn.Close()
+			if err := s.handle(conn); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"Remote": conn.RemoteAddr().String(),
+					"Error":  err,
+				}).Debug("【FakeSOCKS5】连接结束")
+			}
+		}()
+	}
+}
+
+// handle 完成握手后转发数据
+func (s *Server) handle(conn net.Conn) error {
+	user, err := s.negotiate(conn)
+	if err != nil {
+		return err
+	}
+	imp := s.impairmentsFor(user)
+
+	target, err := s.readRequest(conn, imp)
+	if err != nil {
+		return err
+	}
+	if imp.RefuseConnect {
+		s.refused.Add(1)
+		return s.reply(conn, imp, replyConnectionRefused, nil)
+	}
+
+	dialAddr := target
+	if s.config.Redirect != "" {
+		dialAddr = s.config.Redirect
+	}
+	upstream, err := net.DialTimeout("tcp", dialAddr, s.config.DialTimeout)
+	if err != nil {
+		s.connectErrors.Add(1)
+		s.reply(conn, imp, replyHostUnreachable, nil)
+		return fmt.Errorf("连接目标 %s 出错: %w", dialAddr, err)
+	}
+	defer upstream.Close()
+	if err := s.reply(conn, imp, replySucceeded, upstream.LocalAddr()); err != nil {
+		return err
+	}
+	return s.relay(conn, upstream, imp)
+}
+
+// negotiate 完成方法协商和用户名密码认证，返回用户名
+func (s *Server) negotiate(conn net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("不支持的 SOCKS 版本: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(authNoAcceptable)
+	for _, m := range methods {
+		if m == authUsernamePass {
+			method = authUsernamePass
+			break
+		}
+		if m == authNone && len(s.config.Users) == 0 {
+			method = authNone
+		}
+	}
+	// 认证前还不知道用户名，按默认异常注入延迟
+	delay(s.impairmentsFor(""))
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	switch method {
+	case authNone:
+		return "", nil
+	case authNoAcceptable:
+		return "", errors.New("客户端没有可用的认证方式")
+	}
+
+	// 用户名密码认证：VER ULEN UNAME PLEN PASSWD
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return "", err
+	}
+	uname := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return "", err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return "", err
+	}
+	passwd := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return "", err
+	}
+
+	user := string(uname)
+	imp := s.impairmentsFor(user)
+	ok := !imp.AuthFail
+	if want, exists := s.config.Users[user]; len(s.config.Users) > 0 && (!exists || want != string(passwd)) {
+		ok = false
+	}
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+		s.authFailures.Add(1)
+	}
+	delay(imp)
+	if _, err := conn.Write([]byte{authUsernamePassVer, status}); err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("用户 %s 认证失败", user)
+	}
+	return user, nil
+}
+
+// readRequest 读取 CONNECT 请求，返回目标地址
+func (s *Server) readRequest(conn net.Conn, imp Impairments) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[1] != cmdConnect {
+		s.reply(conn, imp, replyCommandUnsupported, nil)
+		return "", fmt.Errorf("不支持的命令: %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if header[3] == atypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		s.reply(conn, imp, replyAddrUnsupported, nil)
+		return "", fmt.Errorf("不支持的地址类型: %d", header[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// reply 发送 CONNECT 响应，bound 为空时返回 0.0.0.0:0
+func (s *Server) reply(conn net.Conn, imp Impairments, code byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			ip = ip4
+		}
+		port = addr.Port
+	}
+	msg := []byte{socksVersion, code, 0x00, atypIPv4}
+	msg = append(msg, ip...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+	delay(imp)
+	_, err := conn.Write(msg)
+	return err
+}
+
+// relay 双向转发数据，下行方向按 imp 限速和重置
+func (s *Server) relay(client, upstream net.Conn, imp Impairments) error {
+	go func() {
+		io.Copy(upstream, client)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+
+	buf := make([]byte, relayChunkSize)
+	start := time.Now()
+	var sent int64
+	for {
+		chunk := buf
+		if imp.ResetAfter > 0 && imp.ResetAfter-sent < int64(len(chunk)) {
+			chunk = buf[:imp.ResetAfter-sent]
+		}
+		n, readErr := upstream.Read(chunk)
+		if n > 0 {
+			if _, err := client.Write(chunk[:n]); err != nil {
+				return err
+			}
+			sent += int64(n)
+			s.bytesRelayed.Add(int64(n))
+			if imp.Bandwidth > 0 {
+				// 按已发送字节数计算应耗时间，超前时等待
+				expected := time.Duration(float64(sent) / float64(imp.Bandwidth) * float64(time.Second))
+				if wait := expected - time.Since(start); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+		if imp.ResetAfter > 0 && sent >= imp.ResetAfter {
+			s.resets.Add(1)
+			reset(client)
+			return fmt.Errorf("已传输 %d 字节，重置连接", sent)
+		}
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				return nil
+			}
+			return readErr
+		}
+	}
+}
+
+// reset 以 RST 方式关闭连接
+func reset(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// delay 按异常配置等待
+func delay(imp Impairments) {
+	if imp.Latency > 0 {
+		time.Sleep(imp.Latency)
+	}
+}
+
+// LoadConfig 读取配置文件
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("读取配置文件出错: %w", err)
+	}
+	if err := yaml.Unmarshal(file, &config); err != nil {
+		return config, fmt.Errorf("解析配置文件出错: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,260 @@
+package fakesocks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// startUpstream 启动目标服务器，每个连接先发送 payload，payload 为空时回显收到的数据
+func startUpstream(t *testing.T, payload []byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if len(payload) > 0 {
+					conn.Write(payload)
+					return
+				}
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startServer 启动假 SOCKS5 代理，测试结束时关闭
+func startServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	server := NewServer(config)
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// dial 通过代理连接 target
+func dial(t *testing.T, server *Server, user, pass, target string) (net.Conn, error) {
+	t.Helper()
+	var auth *proxy.Auth
+	if user != "" {
+		auth = &proxy.Auth{User: user, Password: pass}
+	}
+	dialer, err := proxy.SOCKS5("tcp", server.Addr(), auth, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialer.Dial("tcp", target)
+}
+
+// waitStats 等待代理处理完连接后返回统计，连接在后台协程中结束
+func waitStats(t *testing.T, server *Server, done func(Stats) bool) Stats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := server.Stats()
+		if done(stats) || time.Now().After(deadline) {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	upstream := startUpstream(t, nil)
+	server := startServer(t, Config{Users: map[string]string{"1001": "secret"}})
+
+	conn, err := dial(t, server, "1001", "secret", upstream)
+	if err != nil {
+		t.Fatalf("CONNECT 出错: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("收到 %q，期望 ping", reply)
+	}
+
+	stats := waitStats(t, server, func(s Stats) bool { return s.BytesRelayed == 4 })
+	if stats.Connections != 1 || stats.BytesRelayed != 4 || stats.AuthFailures != 0 {
+		t.Fatalf("统计为 %+v", stats)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	upstream := startUpstream(t, []byte("hello"))
+	server := startServer(t, Config{Redirect: upstream})
+
+	// 请求的目标不存在，代理改为连接 Redirect
+	conn, err := dial(t, server, "1001", "any", "example.invalid:80")
+	if err != nil {
+		t.Fatalf("CONNECT 出错: %v", err)
+	}
+	defer conn.Close()
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("收到 %q, %v，期望 hello", data, err)
+	}
+}
+
+func TestAuthFail(t *testing.T) {
+	upstream := startUpstream(t, nil)
+	tests := []struct {
+		name   string
+		config Config
+		user   string
+		pass   string
+	}{
+		{"impairment", Config{Impairments: Impairments{AuthFail: true}}, "1001", "secret"},
+		{"per_user", Config{PerUser: map[string]Impairments{"1001": {AuthFail: true}}}, "1001", "secret"},
+		{"wrong_password", Config{Users: map[string]string{"1001": "secret"}}, "1001", "wrong"},
+		{"unknown_user", Config{Users: map[string]string{"1001": "secret"}}, "1002", "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startServer(t, tt.config)
+			if conn, err := dial(t, server, tt.user, tt.pass, upstream); err == nil {
+				conn.Close()
+				t.Fatal("认证失败时 CONNECT 应出错")
+			}
+			stats := waitStats(t, server, func(s Stats) bool { return s.AuthFailures == 1 })
+			if stats.AuthFailures != 1 || stats.BytesRelayed != 0 {
+				t.Fatalf("统计为 %+v", stats)
+			}
+		})
+	}
+
+	// 其他用户不受 per_user 中的异常影响
+	server := startServer(t, Config{PerUser: map[string]Impairments{"1001": {AuthFail: true}}})
+	conn, err := dial(t, server, "1002", "secret", upstream)
+	if err != nil {
+		t.Fatalf("未配置异常的用户 CONNECT 出错: %v", err)
+	}
+	conn.Close()
+}
+
+func TestRefuseConnect(t *testing.T) {
+	upstream := startUpstream(t, nil)
+	server := startServer(t, Config{Impairments: Impairments{RefuseConnect: true}})
+
+	if conn, err := dial(t, server, "1001", "secret", upstream); err == nil {
+		conn.Close()
+		t.Fatal("RefuseConnect 时 CONNECT 应出错")
+	}
+	stats := waitStats(t, server, func(s Stats) bool { return s.Refused == 1 })
+	if stats.Refused != 1 || stats.AuthFailures != 0 || stats.BytesRelayed != 0 {
+		t.Fatalf("统计为 %+v", stats)
+	}
+
+	// 修改异常后新的连接恢复正常
+	server.SetImpairments(Impairments{})
+	conn, err := dial(t, server, "1001", "secret", upstream)
+	if err != nil {
+		t.Fatalf("清除异常后 CONNECT 出错: %v", err)
+	}
+	conn.Close()
+}
+
+func TestConnectError(t *testing.T) {
+	// 监听后立即关闭，得到一个拒绝连接的地址
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	server := startServer(t, Config{})
+	if conn, err := dial(t, server, "1001", "secret", closed); err == nil {
+		conn.Close()
+		t.Fatal("目标拒绝连接时 CONNECT 应出错")
+	}
+	if stats := waitStats(t, server, func(s Stats) bool { return s.ConnectErrors == 1 }); stats.ConnectErrors != 1 {
+		t.Fatalf("统计为 %+v", stats)
+	}
+}
+
+func TestResetAfter(t *testing.T) {
+	const resetAfter = 1000
+	upstream := startUpstream(t, bytes.Repeat([]byte("x"), 64*1024))
+	server := startServer(t, Config{})
+	server.SetUserImpairments("1001", Impairments{ResetAfter: resetAfter})
+
+	conn, err := dial(t, server, "1001", "secret", upstream)
+	if err != nil {
+		t.Fatalf("CONNECT 出错: %v", err)
+	}
+	defer conn.Close()
+	data, err := io.ReadAll(conn)
+	if err == nil {
+		t.Fatalf("收到 %d 字节后正常结束，期望连接被重置", len(data))
+	}
+	if len(data) > resetAfter {
+		t.Fatalf("收到 %d 字节，超过 reset_after %d", len(data), resetAfter)
+	}
+
+	stats := waitStats(t, server, func(s Stats) bool { return s.Resets == 1 })
+	if stats.Resets != 1 || stats.BytesRelayed != resetAfter {
+		t.Fatalf("统计为 %+v", stats)
+	}
+
+	// 清除用户的异常后恢复使用默认异常
+	server.ClearUserImpairments("1001")
+	conn, err = dial(t, server, "1001", "secret", upstream)
+	if err != nil {
+		t.Fatalf("CONNECT 出错: %v", err)
+	}
+	defer conn.Close()
+	if data, err := io.ReadAll(conn); err != nil || len(data) != 64*1024 {
+		t.Fatalf("收到 %d 字节, %v，期望完整的 64KB", len(data), err)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	const (
+		size      = 32 * 1024
+		bandwidth = 64 * 1024 // 字节/秒，传输 size 约需 500ms
+	)
+	upstream := startUpstream(t, bytes.Repeat([]byte("x"), size))
+	server := startServer(t, Config{Impairments: Impairments{Bandwidth: bandwidth}})
+
+	start := time.Now()
+	conn, err := dial(t, server, "1001", "secret", upstream)
+	if err != nil {
+		t.Fatalf("CONNECT 出错: %v", err)
+	}
+	defer conn.Close()
+	data, err := io.ReadAll(conn)
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if len(data) != size {
+		t.Fatalf("收到 %d 字节，期望 %d", len(data), size)
+	}
+	// 限速按已发送字节数计算，最后一块发送后等待到应耗时间
+	if want := time.Duration(float64(size) / bandwidth * float64(time.Second)); elapsed < want*8/10 {
+		t.Fatalf("传输耗时 %s，限速 %d 字节/秒时应不少于 %s", elapsed, bandwidth, want)
+	}
+}
@@ -0,0 +1,411 @@
+package http_requests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/events"
+	"monitoring_system/metrics"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/rand"
+)
+
+// 上游接口名称，同时作为 config.yaml 中 api.endpoints 的键
+const (
+	EndpointGetProvinces     = "getProvinces"
+	EndpointGetNodes         = "getNodes"
+	EndpointChangeNode       = "changeNode"
+	EndpointChangeLineIPAddr = "changeLineIpAddr"
+	EndpointGetLine          = "getLine"
+)
+
+// 上游接口调用次数，一次调用包含全部重试
+var (
+	apiCalls        = metrics.NewCounterVec("monitoring_api_calls_total", "上游接口调用次数，重试不重复计数。标签 endpoint: 接口名称，如 changeNode、changeLineIpAddr", "endpoint")
+	apiCallFailures = metrics.NewCounterVec("monitoring_api_call_failures_total", "上游接口调用失败次数，包括重试后仍失败和被限流或熔断。标签 endpoint: 接口名称", "endpoint")
+)
+
+// CodeSuccess 上游接口成功时返回的 code
+const CodeSuccess = 1000
+
+const (
+	defaultAPITimeout     = 10 * time.Second
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 10 * time.Second
+	defaultMultiplier     = 2.0
+	defaultJitter         = 0.2
+)
+
+// Retry 生效的重试策略，两次重试之间按指数退避等待并加入随机抖动
+type Retry struct {
+	MaxAttempts    int           // 最多请求次数，包含第一次
+	InitialBackoff time.Duration // 第一次重试前的等待时间
+	MaxBackoff     time.Duration // 等待时间上限
+	Multiplier     float64       // 每次重试等待时间的倍数
+	Jitter         float64       // 随机抖动比例，0.2 表示上下浮动 20%
+}
+
+// NewRetry 从默认重试策略开始，依次用 policies 中已配置的字段覆盖，配置为 0 的字段同样生效
+func NewRetry(policies ...config.RetryPolicy) Retry {
+	r := defaultRetry
+	for _, policy := range policies {
+		r = r.merge(policy)
+	}
+	return r
+}
+
+// merge 用 policy 中已配置的字段覆盖 r
+func (r Retry) merge(policy config.RetryPolicy) Retry {
+	if policy.MaxAttempts != nil {
+		r.MaxAttempts = *policy.MaxAttempts
+	}
+	if policy.InitialBackoff != nil {
+		r.InitialBackoff = *policy.InitialBackoff
+	}
+	if policy.MaxBackoff != nil {
+		r.MaxBackoff = *policy.MaxBackoff
+	}
+	if policy.Multiplier != nil {
+		r.Multiplier = *policy.Multiplier
+	}
+	if policy.Jitter != nil {
+		r.Jitter = *policy.Jitter
+	}
+	return r
+}
+
+// Backoff 返回第 attempt 次重试前的等待时间，attempt 从 1 开始
+func (r Retry) Backoff(attempt int) time.Duration {
+	d := float64(r.InitialBackoff) * math.Pow(r.Multiplier, float64(attempt-1))
+	if max := float64(r.MaxBackoff); d > max {
+		d = max
+	}
+	if r.Jitter > 0 {
+		d += d * r.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+// defaultRetry 未配置时的默认重试策略
+var defaultRetry = Retry{
+	MaxAttempts:    defaultMaxAttempts,
+	InitialBackoff: defaultInitialBackoff,
+	MaxBackoff:     defaultMaxBackoff,
+	Multiplier:     defaultMultiplier,
+	Jitter:         defaultJitter,
+}
+
+// defaultEndpointPolicies 各接口的默认重试策略，更换 IP 每次调用都会换一个出口，默认不重试
+var defaultEndpointPolicies = map[string]config.RetryPolicy{
+	EndpointChangeLineIPAddr: {MaxAttempts: ptr(1)},
+}
+
+// ptr 返回 v 的指针，用于填写 config.RetryPolicy
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// APIError 上游接口返回的 code 不是 CodeSuccess
+type APIError struct {
+	Endpoint string
+	Code     int
+	Msg      string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s 接口返回失败: 代码 %d, 消息 %s", e.Endpoint, e.Code, e.Msg)
+}
+
+// StatusError 上游接口返回了非 2xx 的 HTTP 状态码
+type StatusError struct {
+	Endpoint   string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s 接口 HTTP 状态码 %d", e.Endpoint, e.StatusCode)
+}
+
+// apiResponse 上游接口的通用响应格式
+type apiResponse struct {
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Client 上游接口客户端，统一处理超时、重试和响应码校验
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Retry      Retry            // 默认重试策略
+	Endpoints  map[string]Retry // 单独配置了重试策略的接口
+	Throttle   *Throttle        // 变更节点和更换 IP 接口的限流与熔断
+	Settle     time.Duration    // 更换 IP 成功后等待新出口生效的时间
+}
+
+// NewClient 根据配置创建上游接口客户端，cfg.BaseURL 为空时使用 baseAPIAddr
+func NewClient(cfg config.APICFG, baseAPIAddr string, throttle config.ThrottleCFG) *Client {
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = baseAPIAddr
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultAPITimeout
+	}
+
+	// 接口的重试策略依次由默认值、api.retry、接口默认值和 api.endpoints 覆盖
+	endpoints := make(map[string]Retry)
+	for name := range defaultEndpointPolicies {
+		endpoints[name] = NewRetry(cfg.Retry, defaultEndpointPolicies[name], cfg.Endpoints[name])
+	}
+	for name := range cfg.Endpoints {
+		endpoints[name] = NewRetry(cfg.Retry, defaultEndpointPolicies[name], cfg.Endpoints[name])
+	}
+
+	settle := throttle.Settle
+	if settle <= 0 {
+		settle = defaultChangeLineIPSettle
+	}
+
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Timeout: timeout},
+		Retry:      NewRetry(cfg.Retry),
+		Endpoints:  endpoints,
+		Throttle:   NewThrottle(throttle),
+		Settle:     settle,
+	}
+}
+
+// policy 返回接口的重试策略
+func (c *Client) policy(endpoint string) Retry {
+	if r, ok := c.Endpoints[endpoint]; ok {
+		return r
+	}
+	return c.Retry
+}
+
+// GetProvinces 获取省份列表
+func (c *Client) GetProvinces(ctx context.Context) ([]Province, error) {
+	var provinces []Province
+	err := c.call(ctx, EndpointGetProvinces, 0, http.MethodGet, "/api/outApi/getProvinces", nil, nil, func(data json.RawMessage) error {
+		return json.Unmarshal(data, &provinces)
+	})
+	return provinces, err
+}
+
+// GetNodes 获取项目中指定省份的城市列表
+func (c *Client) GetNodes(ctx context.Context, projectID, lineID, provinceID int) ([]Node, error) {
+	query := url.Values{}
+	query.Set("line_id", fmt.Sprint(lineID))
+	query.Set("project_id", fmt.Sprint(projectID))
+	query.Set("province_id", fmt.Sprint(provinceID))
+
+	var nodes []Node
+	err := c.call(ctx, EndpointGetNodes, 0, http.MethodGet, "/api/outApi/getNodes", query, nil, func(data json.RawMessage) error {
+		return json.Unmarshal(data, &nodes)
+	})
+	return nodes, err
+}
+
+// APIAction 一次修改线路的接口调用（changeNode、changeLineIpAddr），发布到事件总线
+type APIAction struct {
+	Endpoint  string `json:"endpoint"`
+	TradeID   int    `json:"trade_id"`
+	NodeID    int    `json:"node_id,omitempty"` // 只有 changeNode 有
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	ElapsedMs int64  `json:"elapsed_ms"` // 包括重试在内的耗时
+}
+
+// publishAction 将修改线路的接口调用结果发布到事件总线
+func publishAction(endpoint string, tradeID, nodeID int, start time.Time, err error) {
+	action := APIAction{
+		Endpoint:  endpoint,
+		TradeID:   tradeID,
+		NodeID:    nodeID,
+		OK:        err == nil,
+		ElapsedMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		action.Error = err.Error()
+	}
+	events.Publish(events.TypeAPIAction, "", action)
+}
+
+// ChangeNode 修改 tradeID 对应线路的节点
+func (c *Client) ChangeNode(ctx context.Context, nodeID, tradeID int) error {
+	payload := map[string]int{
+		"node_id":  nodeID,
+		"trade_id": tradeID,
+	}
+	start := time.Now()
+	err := c.call(ctx, EndpointChangeNode, tradeID, http.MethodPost, "/api/outApi/changeNode", nil, payload, nil)
+	publishAction(EndpointChangeNode, tradeID, nodeID, start, err)
+	return err
+}
+
+// ChangeLineIP 更换线路 IP，成功后等待 Settle 使新出口生效，lineID 即 trade ID
+func (c *Client) ChangeLineIP(ctx context.Context, lineID int) error {
+	query := url.Values{}
+	query.Set("line_id", fmt.Sprint(lineID))
+	start := time.Now()
+	err := c.call(ctx, EndpointChangeLineIPAddr, lineID, http.MethodGet, "/api/outApi/changeLineIpAddr", query, nil, nil)
+	publishAction(EndpointChangeLineIPAddr, lineID, 0, start, err)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"LineID": lineID}).Info("更换 IP 成功")
+
+	timer := time.NewTimer(c.Settle)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetLines 获取线路信息
+func (c *Client) GetLines(ctx context.Context) ([]Line, error) {
+	var lines []Line
+	err := c.call(ctx, EndpointGetLine, 0, http.MethodGet, "/api/outApi/getLine", nil, nil, func(data json.RawMessage) error {
+		if err := json.Unmarshal(data, &lines); err != nil {
+			return err
+		}
+		if len(lines) == 0 {
+			return fmt.Errorf("获取失败，data为空")
+		}
+		return nil
+	})
+	return lines, err
+}
+
+// call 按接口的重试策略发送请求，校验 code 后将 data 交给 decode 解析，decode 返回错误时同样重试。
+// 每次请求都计入 tradeID 的限流预算，被限流或熔断时直接返回，不再重试
+func (c *Client) call(ctx context.Context, endpoint string, tradeID int, method, path string, query url.Values, payload any, decode func(json.RawMessage) error) (err error) {
+	apiCalls.Inc(endpoint)
+	defer func() {
+		if err != nil {
+			apiCallFailures.Inc(endpoint)
+		}
+	}()
+
+	policy := c.policy(endpoint)
+	attempts := policy.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if c.Throttle != nil {
+			if err = c.Throttle.Allow(endpoint, tradeID); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"Endpoint": endpoint,
+					"TradeID":  tradeID,
+					"Error":    err,
+				}).Warn("【API】请求被限流或熔断")
+				return err
+			}
+		}
+		err = c.do(ctx, endpoint, method, path, query, payload, decode)
+		if c.Throttle != nil {
+			c.Throttle.Done(endpoint, tradeID, err)
+		}
+		if err == nil || !retryable(ctx, err) || attempt == attempts {
+			break
+		}
+
+		wait := policy.Backoff(attempt)
+		logrus.WithFields(logrus.Fields{
+			"Endpoint": endpoint,
+			"Attempt":  attempt,
+			"Wait":     wait.Round(time.Millisecond),
+			"Error":    err,
+		}).Warn("【API】请求失败，重试中")
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// do 发送一次请求并校验响应
+func (c *Client) do(ctx context.Context, endpoint, method, path string, query url.Values, payload any, decode func(json.RawMessage) error) error {
+	reqURL := c.BaseURL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &StatusError{Endpoint: endpoint, StatusCode: resp.StatusCode}
+	}
+
+	var response apiResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return fmt.Errorf("解析响应出错: %w", err)
+	}
+	if response.Code != CodeSuccess {
+		return &APIError{Endpoint: endpoint, Code: response.Code, Msg: response.Msg}
+	}
+	if decode == nil {
+		return nil
+	}
+	return decode(response.Data)
+}
+
+// retryable 判断错误是否值得重试：ctx 已取消和 4xx（429 除外）不重试
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
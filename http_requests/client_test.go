@@ -0,0 +1,75 @@
+package http_requests
+
+import (
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestClientRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		endpoints map[string]Retry // 期望的各接口重试策略
+	}{
+		{"defaults", "", map[string]Retry{
+			EndpointGetLine:          defaultRetry,
+			EndpointChangeLineIPAddr: {1, time.Second, 10 * time.Second, 2, 0.2},
+		}},
+		// 配置为 0 的字段按 0 生效，未配置的字段沿用默认值
+		{"zero_honored", `
+retry:
+  initial_backoff: 0s
+  jitter: 0
+endpoints:
+  getLine:
+    max_attempts: 0
+    multiplier: 0
+`, map[string]Retry{
+			EndpointGetNodes:         {3, 0, 10 * time.Second, 2, 0},
+			EndpointGetLine:          {0, 0, 10 * time.Second, 0, 0},
+			EndpointChangeLineIPAddr: {1, 0, 10 * time.Second, 2, 0},
+		}},
+		// api.retry 不覆盖接口默认值，api.endpoints 可以覆盖
+		{"endpoint_override", `
+retry:
+  max_attempts: 5
+  max_backoff: 3s
+endpoints:
+  changeLineIpAddr:
+    jitter: 0.5
+  getProvinces:
+    max_attempts: 2
+`, map[string]Retry{
+			EndpointGetNodes:         {5, time.Second, 3 * time.Second, 2, 0.2},
+			EndpointGetProvinces:     {2, time.Second, 3 * time.Second, 2, 0.2},
+			EndpointChangeLineIPAddr: {1, time.Second, 3 * time.Second, 2, 0.5},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.APICFG
+			if err := yaml.Unmarshal([]byte(tt.yaml), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			c := NewClient(cfg, "http://127.0.0.1", config.ThrottleCFG{})
+			for endpoint, want := range tt.endpoints {
+				if got := c.policy(endpoint); got != want {
+					t.Errorf("%s 的重试策略为 %+v，期望 %+v", endpoint, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := NewRetry(config.RetryPolicy{Jitter: ptr(0.0)})
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if got := r.Backoff(attempt + 1); got != want {
+			t.Errorf("第 %d 次重试前等待 %s，期望 %s", attempt+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package http_requests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"monitoring_system/config"
+)
+
+const (
+	defaultChangeNodeBudget   = 20
+	defaultChangeLineIPBudget = 6
+	defaultBudgetWindow       = time.Minute
+	defaultFailureThreshold   = 5
+	defaultBreakerCooldown    = 2 * time.Minute
+	defaultChangeLineIPSettle = 5 * time.Second
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"    // 正常放行
+	BreakerOpen     = "open"      // 连续失败过多，拒绝请求直到冷却结束
+	BreakerHalfOpen = "half_open" // 冷却结束，放行一次试探请求
+)
+
+// RateLimitError 调用次数超出预算
+type RateLimitError struct {
+	Endpoint   string
+	TradeID    int
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s 调用过于频繁(trade ID %d)，%s 后可再次调用", e.Endpoint, e.TradeID, e.RetryAfter.Round(time.Second))
+}
+
+// CircuitOpenError 熔断器处于打开状态
+type CircuitOpenError struct {
+	Endpoint   string
+	TradeID    int
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s 已熔断(trade ID %d)，%s 后恢复", e.Endpoint, e.TradeID, e.RetryAfter.Round(time.Second))
+}
+
+// ThrottleStatus 单个 trade ID 在某个接口上的限流和熔断状态，用于页面展示
+type ThrottleStatus struct {
+	Endpoint            string    `json:"endpoint"`
+	TradeID             int       `json:"trade_id"`
+	Used                int       `json:"used"`
+	Budget              int       `json:"budget"`
+	Window              string    `json:"window"`
+	BreakerState        string    `json:"breaker_state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenUntil           time.Time `json:"open_until"`
+	Cooldown            string    `json:"cooldown"`
+}
+
+// throttleKey 限流和熔断按接口和 trade ID 区分
+type throttleKey struct {
+	endpoint string
+	tradeID  int
+}
+
+// throttleState 单个 key 的调用记录和熔断状态
+type throttleState struct {
+	calls     []time.Time // 窗口内的调用时间
+	failures  int         // 连续失败次数
+	openUntil time.Time   // 熔断结束时间
+	probing   bool        // 半开状态下是否已有试探请求在进行
+}
+
+// Throttle 限流器与熔断器，保护变更节点和更换 IP 接口不被频繁调用
+type Throttle struct {
+	budgets          map[string]config.BudgetCFG
+	failureThreshold int
+	cooldown         time.Duration
+	now              func() time.Time // 当前时间，测试时可替换
+
+	mutex  sync.Mutex
+	states map[throttleKey]*throttleState
+}
+
+// NewThrottle 根据配置创建限流器，未配置的字段使用默认值
+func NewThrottle(cfg config.ThrottleCFG) *Throttle {
+	budget := func(b config.BudgetCFG, def int) config.BudgetCFG {
+		if b.Budget <= 0 {
+			b.Budget = def
+		}
+		if b.Window <= 0 {
+			b.Window = defaultBudgetWindow
+		}
+		return b
+	}
+	t := &Throttle{
+		budgets: map[string]config.BudgetCFG{
+			EndpointChangeNode:       budget(cfg.ChangeNode, defaultChangeNodeBudget),
+			EndpointChangeLineIPAddr: budget(cfg.ChangeLineIP, defaultChangeLineIPBudget),
+		},
+		failureThreshold: cfg.Breaker.FailureThreshold,
+		cooldown:         cfg.Breaker.Cooldown,
+		now:              time.Now,
+		states:           make(map[throttleKey]*throttleState),
+	}
+	if t.failureThreshold <= 0 {
+		t.failureThreshold = defaultFailureThreshold
+	}
+	if t.cooldown <= 0 {
+		t.cooldown = defaultBreakerCooldown
+	}
+	return t
+}
+
+// state 返回 key 对应的状态，调用方需持有锁
+func (t *Throttle) state(key throttleKey) *throttleState {
+	s, ok := t.states[key]
+	if !ok {
+		s = &throttleState{}
+		t.states[key] = s
+	}
+	return s
+}
+
+// prune 清理窗口外的调用记录
+func (s *throttleState) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(s.calls) && now.Sub(s.calls[i]) >= window {
+		i++
+	}
+	s.calls = s.calls[i:]
+}
+
+// breakerState 返回当前熔断状态
+func (s *throttleState) breakerState(now time.Time) string {
+	if s.openUntil.IsZero() {
+		return BreakerClosed
+	}
+	if now.Before(s.openUntil) {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// Allow 判断是否允许调用接口，允许时计入预算，调用结束后必须调用 Done
+func (t *Throttle) Allow(endpoint string, tradeID int) error {
+	budget, limited := t.budgets[endpoint]
+	if !limited {
+		return nil
+	}
+	now := t.now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := t.state(throttleKey{endpoint, tradeID})
+
+	switch s.breakerState(now) {
+	case BreakerOpen:
+		return &CircuitOpenError{Endpoint: endpoint, TradeID: tradeID, RetryAfter: s.openUntil.Sub(now)}
+	case BreakerHalfOpen:
+		if s.probing {
+			return &CircuitOpenError{Endpoint: endpoint, TradeID: tradeID}
+		}
+	}
+
+	s.prune(now, budget.Window)
+	if len(s.calls) >= budget.Budget {
+		return &RateLimitError{Endpoint: endpoint, TradeID: tradeID, RetryAfter: budget.Window - now.Sub(s.calls[0])}
+	}
+	s.calls = append(s.calls, now)
+	if s.breakerState(now) == BreakerHalfOpen {
+		s.probing = true
+	}
+	return nil
+}
+
+// Done 记录调用结果，连续失败达到阈值或半开状态下试探失败时打开熔断器
+func (t *Throttle) Done(endpoint string, tradeID int, err error) {
+	if _, limited := t.budgets[endpoint]; !limited {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := t.state(throttleKey{endpoint, tradeID})
+	halfOpen := s.probing
+	s.probing = false
+	if errors.Is(err, context.Canceled) {
+		// 服务退出导致的取消不代表上游异常
+		return
+	}
+	if err == nil {
+		s.failures = 0
+		s.openUntil = time.Time{}
+		return
+	}
+	s.failures++
+	if halfOpen || s.failures >= t.failureThreshold {
+		s.openUntil = t.now().Add(t.cooldown)
+	}
+}
+
+// Status 返回所有已调用过的接口和 trade ID 的限流与熔断状态
+func (t *Throttle) Status() []ThrottleStatus {
+	now := t.now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	statuses := make([]ThrottleStatus, 0, len(t.states))
+	for key, s := range t.states {
+		budget := t.budgets[key.endpoint]
+		s.prune(now, budget.Window)
+		status := ThrottleStatus{
+			Endpoint:            key.endpoint,
+			TradeID:             key.tradeID,
+			Used:                len(s.calls),
+			Budget:              budget.Budget,
+			Window:              budget.Window.String(),
+			BreakerState:        s.breakerState(now),
+			ConsecutiveFailures: s.failures,
+			Cooldown:            t.cooldown.String(),
+		}
+		if status.BreakerState == BreakerOpen {
+			status.OpenUntil = s.openUntil
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].TradeID != statuses[j].TradeID {
+			return statuses[i].TradeID < statuses[j].TradeID
+		}
+		return statuses[i].Endpoint < statuses[j].Endpoint
+	})
+	return statuses
+}
@@ -0,0 +1,210 @@
+package http_requests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+)
+
+const testTradeID = 1001
+
+var errUpstream = errors.New("上游异常")
+
+// fakeClock 手动推进的时钟
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// throttleStep 一步操作：推进时钟后调用 Allow，或调用 Done 记录结果
+type throttleStep struct {
+	advance time.Duration
+	done    bool  // true 时调用 Done，否则调用 Allow
+	err     error // Done 的调用结果
+	want    string
+	state   string // 操作后期望的熔断状态
+}
+
+// Allow 期望的结果
+const (
+	wantAllowed   = ""
+	wantOpen      = "open"
+	wantRateLimit = "rate_limit"
+)
+
+// call 一次允许的调用：Allow 后以 err 调用 Done
+func call(err error, state string) []throttleStep {
+	return []throttleStep{
+		{want: wantAllowed},
+		{done: true, err: err, state: state},
+	}
+}
+
+// steps 拼接多段操作
+func steps(parts ...[]throttleStep) []throttleStep {
+	var all []throttleStep
+	for _, part := range parts {
+		all = append(all, part...)
+	}
+	return all
+}
+
+func TestThrottleBreaker(t *testing.T) {
+	const cooldown = time.Minute
+	// 连续失败 3 次后熔断
+	open := steps(call(errUpstream, BreakerClosed), call(errUpstream, BreakerClosed), call(errUpstream, BreakerOpen))
+	// 冷却结束后进入半开
+	halfOpen := steps(open, []throttleStep{
+		{advance: cooldown - time.Second, want: wantOpen, state: BreakerOpen},
+		{advance: time.Second, want: wantAllowed, state: BreakerHalfOpen},
+	})
+
+	tests := []struct {
+		name  string
+		steps []throttleStep
+	}{
+		{"closed_to_open", steps(open, []throttleStep{{want: wantOpen, state: BreakerOpen}})},
+		{"success_resets_failures", steps(
+			call(errUpstream, BreakerClosed), call(errUpstream, BreakerClosed), call(nil, BreakerClosed),
+			call(errUpstream, BreakerClosed), call(errUpstream, BreakerClosed),
+		)},
+		{"canceled_not_counted", steps(
+			call(errUpstream, BreakerClosed), call(errUpstream, BreakerClosed),
+			call(context.Canceled, BreakerClosed), call(context.Canceled, BreakerClosed),
+		)},
+		{"open_to_half_open", halfOpen},
+		{"single_probe", steps(halfOpen, []throttleStep{
+			{want: wantOpen, state: BreakerHalfOpen},
+			{advance: cooldown, want: wantOpen, state: BreakerHalfOpen},
+		})},
+		{"probe_success_closes", steps(halfOpen, []throttleStep{
+			{done: true, state: BreakerClosed},
+		}, call(errUpstream, BreakerClosed))},
+		{"probe_failure_reopens", steps(halfOpen, []throttleStep{
+			{done: true, err: errUpstream, state: BreakerOpen},
+			{advance: cooldown - time.Second, want: wantOpen, state: BreakerOpen},
+			{advance: time.Second, want: wantAllowed, state: BreakerHalfOpen},
+		})},
+		{"probe_canceled_allows_next_probe", steps(halfOpen, []throttleStep{
+			{done: true, err: context.Canceled, state: BreakerHalfOpen},
+			{want: wantAllowed, state: BreakerHalfOpen},
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			throttle := NewThrottle(config.ThrottleCFG{
+				ChangeNode: config.BudgetCFG{Budget: 100},
+				Breaker:    config.BreakerCFG{FailureThreshold: 3, Cooldown: cooldown},
+			})
+			throttle.now = clock.Now
+			for i, step := range tt.steps {
+				clock.now = clock.now.Add(step.advance)
+				if step.done {
+					throttle.Done(EndpointChangeNode, testTradeID, step.err)
+				} else {
+					checkAllow(t, i, throttle.Allow(EndpointChangeNode, testTradeID), step.want)
+				}
+				if step.state != "" {
+					if state := breakerState(t, throttle); state != step.state {
+						t.Fatalf("第 %d 步后熔断状态为 %s，期望 %s", i+1, state, step.state)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleOpenRetryAfter(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	throttle := NewThrottle(config.ThrottleCFG{Breaker: config.BreakerCFG{FailureThreshold: 1, Cooldown: time.Minute}})
+	throttle.now = clock.Now
+
+	if err := throttle.Allow(EndpointChangeLineIPAddr, testTradeID); err != nil {
+		t.Fatal(err)
+	}
+	throttle.Done(EndpointChangeLineIPAddr, testTradeID, errUpstream)
+	clock.now = clock.now.Add(20 * time.Second)
+
+	var openErr *CircuitOpenError
+	if err := throttle.Allow(EndpointChangeLineIPAddr, testTradeID); !errors.As(err, &openErr) || openErr.RetryAfter != 40*time.Second {
+		t.Fatalf("错误为 %v，期望 40s 后恢复", err)
+	}
+	// 熔断按 trade ID 和接口分别计算
+	if err := throttle.Allow(EndpointChangeLineIPAddr, testTradeID+1); err != nil {
+		t.Fatalf("其他 trade ID 被熔断: %v", err)
+	}
+	if err := throttle.Allow(EndpointChangeNode, testTradeID); err != nil {
+		t.Fatalf("其他接口被熔断: %v", err)
+	}
+	// 不限流的接口始终放行
+	if err := throttle.Allow(EndpointGetLine, testTradeID); err != nil {
+		t.Fatalf("getLine 被限流: %v", err)
+	}
+}
+
+func TestThrottleBudget(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	throttle := NewThrottle(config.ThrottleCFG{ChangeLineIP: config.BudgetCFG{Budget: 2, Window: time.Minute}})
+	throttle.now = clock.Now
+
+	tests := []struct {
+		advance time.Duration
+		want    string
+	}{
+		{0, wantAllowed},
+		{10 * time.Second, wantAllowed},
+		{10 * time.Second, wantRateLimit},
+		// 第一次调用移出窗口
+		{40 * time.Second, wantAllowed},
+		{time.Second, wantRateLimit},
+		{10 * time.Second, wantAllowed},
+	}
+	for i, tt := range tests {
+		clock.now = clock.now.Add(tt.advance)
+		err := throttle.Allow(EndpointChangeLineIPAddr, testTradeID)
+		checkAllow(t, i, err, tt.want)
+		if err == nil {
+			throttle.Done(EndpointChangeLineIPAddr, testTradeID, nil)
+		}
+	}
+}
+
+// checkAllow 检查第 i 步 Allow 的结果
+func checkAllow(t *testing.T, i int, err error, want string) {
+	t.Helper()
+	var openErr *CircuitOpenError
+	var limitErr *RateLimitError
+	switch want {
+	case wantAllowed:
+		if err != nil {
+			t.Fatalf("第 %d 步被拒绝: %v", i+1, err)
+		}
+	case wantOpen:
+		if !errors.As(err, &openErr) {
+			t.Fatalf("第 %d 步的错误为 %v，期望熔断", i+1, err)
+		}
+	case wantRateLimit:
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("第 %d 步的错误为 %v，期望限流", i+1, err)
+		}
+	}
+}
+
+// breakerState 返回 changeNode 在 testTradeID 上的熔断状态
+func breakerState(t *testing.T, throttle *Throttle) string {
+	t.Helper()
+	for _, status := range throttle.Status() {
+		if status.Endpoint == EndpointChangeNode && status.TradeID == testTradeID {
+			return status.BreakerState
+		}
+	}
+	t.Fatal("没有 changeNode 的熔断状态")
+	return ""
+}
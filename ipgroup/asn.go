@@ -0,0 +1,46 @@
+package ipgroup
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ASN 出口 IP 所属的自治系统
+type ASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// ASNDB 离线的 MaxMind 格式 ASN 数据库，如 GeoLite2-ASN.mmdb
+type ASNDB struct {
+	reader *maxminddb.Reader
+}
+
+// OpenASNDB 打开 ASN 数据库文件
+func OpenASNDB(path string) (*ASNDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开 ASN 数据库 %s 出错: %w", path, err)
+	}
+	return &ASNDB{reader: reader}, nil
+}
+
+// Lookup 查询 IP 所属的 ASN，数据库中没有该 IP 时返回 false
+func (d *ASNDB) Lookup(ip string) (ASN, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ASN{}, false
+	}
+	var asn ASN
+	if err := d.reader.Lookup(parsed, &asn); err != nil || asn.Number == 0 {
+		return ASN{}, false
+	}
+	return asn, true
+}
+
+// Close 关闭数据库文件
+func (d *ASNDB) Close() error {
+	return d.reader.Close()
+}
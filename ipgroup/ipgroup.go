@@ -0,0 +1,292 @@
+package ipgroup
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 分组类型
+const (
+	KindPrefix = "prefix" // IPv4 /24 或 IPv6 /48
+	KindASN    = "asn"
+)
+
+const (
+	defaultWindow      = 24 * time.Hour  // 未配置 window 时的默认值
+	defaultInterval    = 5 * time.Minute // 未配置 interval 时的默认值
+	defaultMinTests    = 5               // 未配置 min_tests 时的默认值
+	defaultFailureRate = 0.5             // 未配置 failure_rate 时的默认值
+	defaultMinSpeed    = 3.0             // 未配置 bad_line_min_speed 时判定失败的下载速率
+	ipv4PrefixBits     = 24
+	ipv6PrefixBits     = 48
+)
+
+// Group 一个网段或 ASN 内出口 IP 的检测汇总
+type Group struct {
+	Kind        string  `json:"kind"`
+	Key         string  `json:"key"`          // 如 198.51.100.0/24、2001:db8:1::/48、AS4134
+	Name        string  `json:"name"`         // ASN 的组织名称
+	IPs         int     `json:"ips"`          // 检测过的出口 IP 数
+	FailingIPs  int     `json:"failing_ips"`  // 至少失败过一次的出口 IP 数
+	BadIPs      int     `json:"bad_ips"`      // bad_ips 中未过期的出口 IP 数
+	Tests       int     `json:"tests"`        // 检测次数
+	Failures    int     `json:"failures"`     // 失败次数
+	FailureRate float64 `json:"failure_rate"` // 失败次数 / 检测次数
+	Suspect     bool    `json:"suspect"`
+}
+
+// Report 一次分析的结果
+type Report struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Window      string    `json:"window"`
+	MinTests    int       `json:"min_tests"`
+	FailureRate float64   `json:"failure_rate"` // 可疑阈值
+	ASNEnabled  bool      `json:"asn_enabled"`
+	Groups      []Group   `json:"groups"` // 可疑分组在前，其余按失败率降序
+}
+
+// Analyzer 定期按网段和 ASN 汇总出口 IP 的检测结果，失败率达到阈值的分组视为可疑
+type Analyzer struct {
+	DB          database.Store
+	Window      time.Duration
+	Interval    time.Duration
+	MinTests    int
+	FailureRate float64
+	MinSpeed    float64
+	BadIPTTL    time.Duration
+
+	asn      *ASNDB
+	mutex    sync.RWMutex
+	report   Report
+	suspects map[string]Group // 分组 key 到可疑分组
+}
+
+// NewAnalyzer 创建分组分析器，配置了 asn_database 时打开 ASN 数据库
+func NewAnalyzer(db database.Store, config *config.Config) (*Analyzer, error) {
+	cfg := config.IPGroups
+	a := &Analyzer{
+		DB:          db,
+		Window:      cfg.Window,
+		Interval:    cfg.Interval,
+		MinTests:    cfg.MinTests,
+		FailureRate: cfg.FailureRate,
+		MinSpeed:    config.Checker.BadLineMinSpeed,
+		BadIPTTL:    config.BadIPExpiry(),
+		suspects:    make(map[string]Group),
+	}
+	if a.Window <= 0 {
+		a.Window = defaultWindow
+	}
+	if a.Interval <= 0 {
+		a.Interval = defaultInterval
+	}
+	if a.MinTests <= 0 {
+		a.MinTests = defaultMinTests
+	}
+	if a.FailureRate <= 0 {
+		a.FailureRate = defaultFailureRate
+	}
+	if a.MinSpeed <= 0 {
+		a.MinSpeed = defaultMinSpeed
+	}
+	if cfg.ASNDatabase != "" {
+		asn, err := OpenASNDB(cfg.ASNDatabase)
+		if err != nil {
+			return nil, err
+		}
+		a.asn = asn
+	}
+	return a, nil
+}
+
+// Close 关闭 ASN 数据库
+func (a *Analyzer) Close() error {
+	if a.asn == nil {
+		return nil
+	}
+	return a.asn.Close()
+}
+
+// Run 启动时分析一次，之后每隔 Interval 分析一次，ctx 取消时退出
+func (a *Analyzer) Run(ctx context.Context) {
+	for {
+		if err := a.Analyze(time.Now()); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"Error": err,
+			}).Error("【出口 IP 分组】分析出错")
+		}
+		select {
+		case <-time.After(a.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Analyze 统计 now 之前 Window 内的检测结果，更新分组报告和可疑分组
+func (a *Analyzer) Analyze(now time.Time) error {
+	stats, err := a.DB.OutboundIPStats(now.Add(-a.Window), a.MinSpeed)
+	if err != nil {
+		return err
+	}
+	badIPs, err := a.DB.BadIPEntries(database.ProjectFilter{}, a.BadIPTTL)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]*Group)
+	add := func(kind, key, name string, fn func(g *Group)) {
+		g, ok := groups[key]
+		if !ok {
+			g = &Group{Kind: kind, Key: key, Name: name}
+			groups[key] = g
+		}
+		fn(g)
+	}
+	for _, stat := range stats {
+		for _, k := range a.keys(stat.OutboundIP) {
+			add(k.kind, k.key, k.name, func(g *Group) {
+				g.IPs++
+				g.Tests += stat.Tests
+				g.Failures += stat.Failures
+				if stat.Failures > 0 {
+					g.FailingIPs++
+				}
+			})
+		}
+	}
+	for _, entry := range badIPs {
+		if entry.Expired {
+			continue
+		}
+		for _, k := range a.keys(entry.OutboundIP) {
+			add(k.kind, k.key, k.name, func(g *Group) {
+				g.BadIPs++
+			})
+		}
+	}
+
+	report := Report{
+		GeneratedAt: now,
+		Window:      a.Window.String(),
+		MinTests:    a.MinTests,
+		FailureRate: a.FailureRate,
+		ASNEnabled:  a.asn != nil,
+		Groups:      make([]Group, 0, len(groups)),
+	}
+	suspects := make(map[string]Group)
+	for _, g := range groups {
+		if g.Tests > 0 {
+			g.FailureRate = float64(g.Failures) / float64(g.Tests)
+		}
+		g.Suspect = g.Tests >= a.MinTests && g.FailureRate >= a.FailureRate
+		if g.Suspect {
+			suspects[g.Key] = *g
+		}
+		report.Groups = append(report.Groups, *g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		gi, gj := report.Groups[i], report.Groups[j]
+		if gi.Suspect != gj.Suspect {
+			return gi.Suspect
+		}
+		if gi.FailureRate != gj.FailureRate {
+			return gi.FailureRate > gj.FailureRate
+		}
+		if gi.Tests != gj.Tests {
+			return gi.Tests > gj.Tests
+		}
+		return gi.Key < gj.Key
+	})
+
+	a.mutex.Lock()
+	previous := a.suspects
+	a.report = report
+	a.suspects = suspects
+	a.mutex.Unlock()
+
+	for key, g := range suspects {
+		if _, ok := previous[key]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"Group":       key,
+				"Name":        g.Name,
+				"Tests":       g.Tests,
+				"FailureRate": fmt.Sprintf("%.2f", g.FailureRate),
+			}).Warn("【出口 IP 分组】分组失败率超过阈值，标记为可疑")
+		}
+	}
+	for key := range previous {
+		if _, ok := suspects[key]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"Group": key,
+			}).Info("【出口 IP 分组】分组恢复正常")
+		}
+	}
+	return nil
+}
+
+// Report 返回最近一次分析的结果
+func (a *Analyzer) Report() Report {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.report
+}
+
+// Suspect 返回出口 IP 所在的可疑分组，不在任何可疑分组中时返回 false
+func (a *Analyzer) Suspect(ip string) (Group, bool) {
+	keys := a.keys(ip)
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, k := range keys {
+		if g, ok := a.suspects[k.key]; ok {
+			return g, true
+		}
+	}
+	return Group{}, false
+}
+
+type groupKey struct {
+	kind, key, name string
+}
+
+// keys 返回出口 IP 所属的网段分组，以及配置了 ASN 数据库时所属的 ASN 分组
+func (a *Analyzer) keys(ip string) []groupKey {
+	var keys []groupKey
+	if prefix, ok := Prefix(ip); ok {
+		keys = append(keys, groupKey{kind: KindPrefix, key: prefix.String()})
+	}
+	if a.asn != nil {
+		if asn, ok := a.asn.Lookup(ip); ok {
+			keys = append(keys, groupKey{kind: KindASN, key: fmt.Sprintf("AS%d", asn.Number), name: asn.Organization})
+		}
+	}
+	return keys
+}
+
+// Prefix 返回 IP 所在的 /24（IPv4）或 /48（IPv6）网段
+func Prefix(ip string) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	bits := ipv4PrefixBits
+	if addr.Is6() {
+		bits = ipv6PrefixBits
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return prefix, true
+}
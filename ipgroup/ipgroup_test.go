@@ -0,0 +1,164 @@
+package ipgroup
+
+import (
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+)
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeStore 只实现分组分析用到的查询，其他方法调用时 panic
+type fakeStore struct {
+	database.Store
+	stats  []database.OutboundIPStat
+	badIPs []database.BadIPEntry
+
+	since time.Time // OutboundIPStats 收到的起始时间
+}
+
+func (f *fakeStore) OutboundIPStats(since time.Time, minSpeed float64) ([]database.OutboundIPStat, error) {
+	f.since = since
+	return f.stats, nil
+}
+
+func (f *fakeStore) BadIPEntries(filter database.ProjectFilter, ttl time.Duration) ([]database.BadIPEntry, error) {
+	return f.badIPs, nil
+}
+
+// newTestAnalyzer 创建阈值为 5 次检测、失败率 0.5 的分析器
+func newTestAnalyzer(t *testing.T, store *fakeStore) *Analyzer {
+	t.Helper()
+	a, err := NewAnalyzer(store, &config.Config{IPGroups: config.IPGroupsCFG{Window: time.Hour, MinTests: 5, FailureRate: 0.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAnalyzeSuspectThreshold(t *testing.T) {
+	tests := []struct {
+		name    string
+		stats   []database.OutboundIPStat
+		suspect bool
+	}{
+		{"above_rate", []database.OutboundIPStat{{OutboundIP: "198.51.100.1", Tests: 5, Failures: 3}}, true},
+		{"at_rate", []database.OutboundIPStat{{OutboundIP: "198.51.100.1", Tests: 6, Failures: 3}}, true},
+		{"below_rate", []database.OutboundIPStat{{OutboundIP: "198.51.100.1", Tests: 7, Failures: 3}}, false},
+		// 检测次数不足时不判定
+		{"below_min_tests", []database.OutboundIPStat{{OutboundIP: "198.51.100.1", Tests: 4, Failures: 4}}, false},
+		// 同一网段的多个出口 IP 合并计算
+		{"merged_ips", []database.OutboundIPStat{
+			{OutboundIP: "198.51.100.1", Tests: 3, Failures: 3},
+			{OutboundIP: "198.51.100.2", Tests: 3, Failures: 0},
+		}, true},
+		{"ipv6", []database.OutboundIPStat{
+			{OutboundIP: "2001:db8:1:1::1", Tests: 3, Failures: 2},
+			{OutboundIP: "2001:db8:1:2::1", Tests: 2, Failures: 1},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAnalyzer(t, &fakeStore{stats: tt.stats})
+			if err := a.Analyze(testNow); err != nil {
+				t.Fatal(err)
+			}
+			groups := a.Report().Groups
+			if len(groups) != 1 {
+				t.Fatalf("分组为 %+v，期望 1 个", groups)
+			}
+			if groups[0].Suspect != tt.suspect {
+				t.Fatalf("分组 %+v 的可疑状态为 %v，期望 %v", groups[0], groups[0].Suspect, tt.suspect)
+			}
+			if _, ok := a.Suspect(tt.stats[0].OutboundIP); ok != tt.suspect {
+				t.Fatalf("Suspect(%s) 为 %v，期望 %v", tt.stats[0].OutboundIP, ok, tt.suspect)
+			}
+		})
+	}
+}
+
+func TestAnalyzeReport(t *testing.T) {
+	store := &fakeStore{
+		stats: []database.OutboundIPStat{
+			{OutboundIP: "198.51.100.1", Tests: 4, Failures: 4},
+			{OutboundIP: "198.51.100.2", Tests: 2, Failures: 0},
+			{OutboundIP: "203.0.113.1", Tests: 10, Failures: 2},
+			{OutboundIP: "192.0.2.1", Tests: 2, Failures: 2},
+		},
+		badIPs: []database.BadIPEntry{
+			{OutboundIP: "198.51.100.1"},
+			{OutboundIP: "198.51.100.3"},
+			{OutboundIP: "198.51.100.4", Expired: true},
+		},
+	}
+	a := newTestAnalyzer(t, store)
+	if err := a.Analyze(testNow); err != nil {
+		t.Fatal(err)
+	}
+	if want := testNow.Add(-time.Hour); !store.since.Equal(want) {
+		t.Fatalf("统计起始时间为 %s，期望 %s", store.since, want)
+	}
+
+	report := a.Report()
+	want := []Group{
+		{Kind: KindPrefix, Key: "198.51.100.0/24", IPs: 2, FailingIPs: 1, BadIPs: 2, Tests: 6, Failures: 4, FailureRate: 4.0 / 6, Suspect: true},
+		// 失败率最高但检测次数不足，排在可疑分组之后
+		{Kind: KindPrefix, Key: "192.0.2.0/24", IPs: 1, FailingIPs: 1, Tests: 2, Failures: 2, FailureRate: 1},
+		{Kind: KindPrefix, Key: "203.0.113.0/24", IPs: 1, FailingIPs: 1, Tests: 10, Failures: 2, FailureRate: 0.2},
+	}
+	if len(report.Groups) != len(want) {
+		t.Fatalf("分组为 %+v，期望 %+v", report.Groups, want)
+	}
+	for i := range want {
+		if report.Groups[i] != want[i] {
+			t.Errorf("第 %d 个分组为 %+v，期望 %+v", i+1, report.Groups[i], want[i])
+		}
+	}
+	if report.GeneratedAt != testNow || report.ASNEnabled {
+		t.Fatalf("报告为 %+v", report)
+	}
+
+	// 可疑分组内的其他出口 IP 同样被判定为可疑
+	if g, ok := a.Suspect("198.51.100.200"); !ok || g.Key != "198.51.100.0/24" {
+		t.Fatalf("Suspect(198.51.100.200) = %+v, %v", g, ok)
+	}
+	for _, ip := range []string{"203.0.113.1", "192.0.2.1", "invalid"} {
+		if _, ok := a.Suspect(ip); ok {
+			t.Errorf("%s 不应被判定为可疑", ip)
+		}
+	}
+
+	// 失败率下降后恢复正常
+	store.stats = []database.OutboundIPStat{{OutboundIP: "198.51.100.1", Tests: 20, Failures: 4}}
+	if err := a.Analyze(testNow.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Suspect("198.51.100.1"); ok {
+		t.Fatal("失败率下降后仍被判定为可疑")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"198.51.100.7", "198.51.100.0/24"},
+		{" 198.51.100.7 ", "198.51.100.0/24"},
+		{"::ffff:198.51.100.7", "198.51.100.0/24"},
+		{"2001:db8:1:2::1", "2001:db8:1::/48"},
+		{"invalid", ""},
+	}
+	for _, tt := range tests {
+		prefix, ok := Prefix(tt.ip)
+		got := ""
+		if ok {
+			got = prefix.String()
+		}
+		if got != tt.want {
+			t.Errorf("Prefix(%q) = %q，期望 %q", tt.ip, got, tt.want)
+		}
+	}
+}
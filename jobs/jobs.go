@@ -0,0 +1,399 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"monitoring_system/database"
+	"monitoring_system/events"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 任务状态
+const (
+	StatusQueued    = "queued"    // 等待执行
+	StatusRunning   = "running"   // 执行中
+	StatusSucceeded = "succeeded" // 已完成
+	StatusFailed    = "failed"    // 执行出错
+	StatusCanceled  = "canceled"  // 已取消
+)
+
+const (
+	defaultQueueSize = 32              // 等待执行的任务数上限
+	finishedTTL      = time.Hour       // 已结束的任务保留时间
+	maxFinished      = 200             // 最多保留的已结束任务数
+	maxSteps         = 100             // 每个任务最多保留的进度记录数
+	cancelWait       = 5 * time.Second // 取消任务时等待 Runner 结束的最长时间
+)
+
+var (
+	// ErrInvalidRequest 检测请求无效，如城市不存在、TradeID 或探测类型不可用
+	ErrInvalidRequest = errors.New("无效的检测请求")
+	// ErrQueueFull 等待执行的任务已达上限
+	ErrQueueFull = errors.New("检测任务队列已满，请稍后再试")
+	// ErrNotFound 任务不存在或已过期
+	ErrNotFound = errors.New("检测任务不存在或已过期")
+	// ErrFinished 任务已结束，不能取消
+	ErrFinished = errors.New("检测任务已结束")
+)
+
+// Request 按需检测的请求
+type Request struct {
+	CityID  int      `json:"city_id"`
+	TradeID int      `json:"trade_id,omitempty"` // 为 0 时使用城市所属项目的第一个 TradeID
+	Types   []string `json:"types,omitempty"`    // 为空时执行全部已配置的探测器
+}
+
+// Step 任务的一条进度记录
+type Step struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Outcome 任务的检测结果
+type Outcome struct {
+	NodeResults  []database.NodeTestResult `json:"node_results"`  // 执行了 socks5 和 download 时每条线路的汇总结果
+	ProbeResults []database.ProbeResult    `json:"probe_results"` // 每个探测器的结果
+}
+
+// Job 按需检测任务，只保存在内存中，重启后丢失
+type Job struct {
+	ID          string     `json:"id"`
+	Request                // 补全默认值后的请求
+	CityName    string     `json:"city_name"`
+	RequestedBy string     `json:"requested_by"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Steps       []Step     `json:"steps"`
+	Outcome                // 结束后的检测结果
+	Error       string     `json:"error,omitempty"`
+}
+
+// Finished 任务是否已结束
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCanceled
+}
+
+// Runner 执行检测
+type Runner interface {
+	// Resolve 校验请求并补全默认的 TradeID 和探测类型，请求无效时返回包装了 ErrInvalidRequest 的错误
+	Resolve(req Request) (Request, string, error)
+	// Run 执行检测，progress 用于报告进度
+	Run(ctx context.Context, req Request, progress func(message string)) (Outcome, error)
+}
+
+// Manager 管理按需检测任务：排队、执行、查询进度和取消
+type Manager struct {
+	runner  Runner
+	workers int
+	queue   chan *entry
+	now     func() time.Time // 当前时间，测试时可替换
+
+	mutex sync.Mutex
+	jobs  map[string]*entry
+}
+
+// entry 任务及其运行状态，job 由 mutex 保护
+type entry struct {
+	job     Job
+	cancel  context.CancelFunc // 执行中的任务的取消函数
+	changed chan struct{}      // 任务更新时关闭并替换，用于通知 Watch
+}
+
+// NewManager 创建任务管理器，workers 为同时执行的任务数
+func NewManager(runner Runner, workers int) *Manager {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &Manager{
+		runner:  runner,
+		workers: workers,
+		queue:   make(chan *entry, defaultQueueSize),
+		now:     time.Now,
+		jobs:    make(map[string]*entry),
+	}
+}
+
+// Run 启动执行任务的协程，直到 ctx 取消
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case e := <-m.queue:
+					// 服务退出时 select 可能随机选中队列，不再开始新任务，由 cancelQueued 结束
+					if ctx.Err() != nil {
+						return
+					}
+					m.execute(ctx, e)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	m.cancelQueued()
+}
+
+// Submit 校验请求并加入队列，返回任务快照
+func (m *Manager) Submit(req Request, requestedBy string) (Job, error) {
+	req, cityName, err := m.runner.Resolve(req)
+	if err != nil {
+		return Job{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	now := m.now().UTC()
+	e := &entry{
+		job: Job{
+			ID:          id,
+			Request:     req,
+			CityName:    cityName,
+			RequestedBy: requestedBy,
+			Status:      StatusQueued,
+			CreatedAt:   now,
+			Steps:       []Step{{Time: now, Message: "已加入队列"}},
+		},
+		changed: make(chan struct{}),
+	}
+
+	m.mutex.Lock()
+	m.purge(now)
+	select {
+	case m.queue <- e:
+	default:
+		m.mutex.Unlock()
+		return Job{}, ErrQueueFull
+	}
+	m.jobs[id] = e
+	job := e.snapshot()
+	m.mutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"JobID":       id,
+		"CityID":      req.CityID,
+		"TradeID":     req.TradeID,
+		"Types":       req.Types,
+		"RequestedBy": requestedBy,
+	}).Info("【按需检测】任务已加入队列")
+	events.Publish(events.TypeProbeJob, events.SourceProbeJob, job)
+	return job, nil
+}
+
+// Get 返回任务快照
+func (m *Manager) Get(id string) (Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return e.snapshot(), nil
+}
+
+// List 返回最近的任务，cityID 不为 0 时只返回该城市的任务，按创建时间倒序
+func (m *Manager) List(cityID, limit int) []Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.purge(m.now())
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, e := range m.jobs {
+		if cityID == 0 || e.job.CityID == cityID {
+			jobs = append(jobs, e.snapshot())
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+// Watch 返回任务快照和任务下次更新时关闭的通道
+func (m *Manager) Watch(id string) (Job, <-chan struct{}, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.jobs[id]
+	if !ok {
+		return Job{}, nil, ErrNotFound
+	}
+	return e.snapshot(), e.changed, nil
+}
+
+// Cancel 取消等待中或执行中的任务
+func (m *Manager) Cancel(id, canceledBy string) (Job, error) {
+	m.mutex.Lock()
+	e, ok := m.jobs[id]
+	if !ok {
+		m.mutex.Unlock()
+		return Job{}, ErrNotFound
+	}
+	if e.job.Finished() {
+		m.mutex.Unlock()
+		return Job{}, ErrFinished
+	}
+	message := "已被 " + canceledBy + " 取消"
+	if e.job.Status == StatusQueued {
+		// 尚未开始的任务直接结束，出队时跳过
+		m.finishLocked(e, StatusCanceled, message)
+		job := e.snapshot()
+		m.mutex.Unlock()
+		events.Publish(events.TypeProbeJob, events.SourceProbeJob, job)
+		return job, nil
+	}
+	e.cancel()
+	e.job.Error = message
+	m.mutex.Unlock()
+
+	// 等待 Runner 响应取消，超时后返回执行中的快照
+	timeout := time.After(cancelWait)
+	for {
+		job, changed, err := m.Watch(id)
+		if err != nil || job.Finished() {
+			return job, err
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return job, nil
+		}
+	}
+}
+
+// execute 执行一个任务
+func (m *Manager) execute(ctx context.Context, e *entry) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.mutex.Lock()
+	if e.job.Status != StatusQueued {
+		m.mutex.Unlock()
+		return
+	}
+	now := m.now().UTC()
+	e.job.Status = StatusRunning
+	e.job.StartedAt = &now
+	e.cancel = cancel
+	m.addStepLocked(e, "开始执行")
+	job := e.snapshot()
+	m.mutex.Unlock()
+	events.Publish(events.TypeProbeJob, events.SourceProbeJob, job)
+
+	outcome, err := m.runner.Run(ctx, job.Request, func(message string) {
+		m.mutex.Lock()
+		m.addStepLocked(e, message)
+		m.mutex.Unlock()
+	})
+
+	m.mutex.Lock()
+	e.job.Outcome = outcome
+	switch {
+	case ctx.Err() != nil:
+		message := e.job.Error
+		if message == "" {
+			message = "服务退出，任务中断"
+		}
+		m.finishLocked(e, StatusCanceled, message)
+	case err != nil:
+		e.job.Error = err.Error()
+		m.finishLocked(e, StatusFailed, "执行出错: "+err.Error())
+	default:
+		m.finishLocked(e, StatusSucceeded, "已完成")
+	}
+	job = e.snapshot()
+	m.mutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"JobID":   job.ID,
+		"CityID":  job.CityID,
+		"TradeID": job.TradeID,
+		"Status":  job.Status,
+		"Error":   job.Error,
+	}).Info("【按需检测】任务已结束")
+	events.Publish(events.TypeProbeJob, events.SourceProbeJob, job)
+}
+
+// cancelQueued 服务退出时结束所有未开始的任务
+func (m *Manager) cancelQueued() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, e := range m.jobs {
+		if e.job.Status == StatusQueued {
+			m.finishLocked(e, StatusCanceled, "服务退出，任务未执行")
+		}
+	}
+}
+
+// addStepLocked 追加进度记录并通知 Watch，调用方需持有 mutex
+func (m *Manager) addStepLocked(e *entry, message string) {
+	e.job.Steps = append(e.job.Steps, Step{Time: m.now().UTC(), Message: message})
+	if len(e.job.Steps) > maxSteps {
+		e.job.Steps = e.job.Steps[len(e.job.Steps)-maxSteps:]
+	}
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// finishLocked 结束任务，调用方需持有 mutex
+func (m *Manager) finishLocked(e *entry, status, message string) {
+	now := m.now().UTC()
+	e.job.Status = status
+	e.job.FinishedAt = &now
+	if status == StatusCanceled && e.job.Error == "" {
+		e.job.Error = message
+	}
+	m.addStepLocked(e, message)
+}
+
+// purge 清理过期的已结束任务，已结束的任务超过 maxFinished 时清理最早的，调用方需持有 mutex
+func (m *Manager) purge(now time.Time) {
+	var finished []*entry
+	for id, e := range m.jobs {
+		if !e.job.Finished() {
+			continue
+		}
+		if now.Sub(*e.job.FinishedAt) > finishedTTL {
+			delete(m.jobs, id)
+			continue
+		}
+		finished = append(finished, e)
+	}
+	if len(finished) <= maxFinished {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].job.FinishedAt.Before(*finished[j].job.FinishedAt) })
+	for _, e := range finished[:len(finished)-maxFinished] {
+		delete(m.jobs, e.job.ID)
+	}
+}
+
+// snapshot 复制任务，避免调用方读取时与执行中的任务并发修改，调用方需持有 mutex
+func (e *entry) snapshot() Job {
+	job := e.job
+	job.Steps = append([]Step(nil), e.job.Steps...)
+	job.Types = append([]string(nil), e.job.Types...)
+	return job
+}
+
+// newID 生成任务 ID
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
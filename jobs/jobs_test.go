@@ -0,0 +1,364 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"monitoring_system/database"
+)
+
+const testTradeID = 1001
+
+var errProxy = errors.New("代理连接失败")
+
+// stubRunner Resolve 补全默认 TradeID，Run 调用 run，run 为 nil 时直接成功
+type stubRunner struct {
+	resolveErr error
+	run        func(ctx context.Context, req Request, progress func(message string)) (Outcome, error)
+
+	mutex sync.Mutex
+	runs  int // Run 的调用次数
+}
+
+func (r *stubRunner) Resolve(req Request) (Request, string, error) {
+	if r.resolveErr != nil {
+		return req, "", r.resolveErr
+	}
+	if req.TradeID == 0 {
+		req.TradeID = testTradeID
+	}
+	return req, "南京市电信", nil
+}
+
+func (r *stubRunner) Run(ctx context.Context, req Request, progress func(message string)) (Outcome, error) {
+	r.mutex.Lock()
+	r.runs++
+	r.mutex.Unlock()
+	if r.run == nil {
+		return Outcome{}, nil
+	}
+	return r.run(ctx, req, progress)
+}
+
+func (r *stubRunner) runCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.runs
+}
+
+// testClock 手动推进的时钟，执行任务的协程同时读取
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.mutex.Unlock()
+}
+
+// newTestManager 创建使用 testClock 的任务管理器，start 为 true 时启动执行协程，测试结束时停止
+func newTestManager(t *testing.T, runner Runner, start bool) (*Manager, *testClock) {
+	t.Helper()
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewManager(runner, 1)
+	m.now = clock.Now
+	if start {
+		startManager(t, m)
+	}
+	return m, clock
+}
+
+// startManager 启动执行协程，返回停止并等待其退出的函数，测试结束时也会调用
+func startManager(t *testing.T, m *Manager) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitStatus 等待任务进入 status
+func waitStatus(t *testing.T, m *Manager, id, status string) Job {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		job, changed, err := m.Watch(id)
+		if err != nil {
+			t.Fatalf("查询任务出错: %v", err)
+		}
+		if job.Status == status {
+			return job
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("任务状态为 %s，等待 %s 超时", job.Status, status)
+		}
+	}
+}
+
+// stepMessages 返回任务的进度信息
+func stepMessages(job Job) []string {
+	messages := make([]string, 0, len(job.Steps))
+	for _, step := range job.Steps {
+		messages = append(messages, step.Message)
+	}
+	return messages
+}
+
+func TestManagerJobLifecycle(t *testing.T) {
+	outcome := Outcome{ProbeResults: []database.ProbeResult{{ProbeType: "download", NodeID: 101}}}
+	tests := []struct {
+		name    string
+		run     func(ctx context.Context, req Request, progress func(message string)) (Outcome, error)
+		status  string
+		error   string
+		steps   []string
+		outcome Outcome
+	}{
+		{"succeeded", func(ctx context.Context, req Request, progress func(message string)) (Outcome, error) {
+			progress("下载测试")
+			return outcome, nil
+		}, StatusSucceeded, "", []string{"已加入队列", "开始执行", "下载测试", "已完成"}, outcome},
+		{"failed", func(ctx context.Context, req Request, progress func(message string)) (Outcome, error) {
+			return Outcome{}, errProxy
+		}, StatusFailed, errProxy.Error(), []string{"已加入队列", "开始执行", "执行出错: " + errProxy.Error()}, Outcome{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestManager(t, &stubRunner{run: tt.run}, true)
+			job, err := m.Submit(Request{CityID: 101}, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Status != StatusQueued || job.TradeID != testTradeID || job.CityName != "南京市电信" || job.RequestedBy != "alice" {
+				t.Fatalf("提交后任务为 %+v", job)
+			}
+
+			job = waitStatus(t, m, job.ID, tt.status)
+			if job.Error != tt.error || job.StartedAt == nil || job.FinishedAt == nil {
+				t.Fatalf("任务为 %+v", job)
+			}
+			if got := fmt.Sprint(stepMessages(job)); got != fmt.Sprint(tt.steps) {
+				t.Fatalf("进度为 %s，期望 %v", got, tt.steps)
+			}
+			if fmt.Sprint(job.Outcome) != fmt.Sprint(tt.outcome) {
+				t.Fatalf("检测结果为 %+v，期望 %+v", job.Outcome, tt.outcome)
+			}
+			if _, err := m.Cancel(job.ID, "alice"); !errors.Is(err, ErrFinished) {
+				t.Fatalf("取消已结束的任务，错误为 %v，期望 ErrFinished", err)
+			}
+		})
+	}
+}
+
+func TestManagerCancelRunning(t *testing.T) {
+	started := make(chan struct{})
+	runner := &stubRunner{run: func(ctx context.Context, req Request, progress func(message string)) (Outcome, error) {
+		close(started)
+		<-ctx.Done()
+		return Outcome{}, ctx.Err()
+	}}
+	m, _ := newTestManager(t, runner, true)
+	job, err := m.Submit(Request{CityID: 101}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	waitStatus(t, m, job.ID, StatusRunning)
+
+	// Cancel 等待 Runner 响应取消后返回已结束的任务
+	job, err = m.Cancel(job.ID, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != StatusCanceled || job.Error != "已被 bob 取消" {
+		t.Fatalf("取消后任务为 %+v", job)
+	}
+	if _, err := m.Cancel(job.ID, "bob"); !errors.Is(err, ErrFinished) {
+		t.Fatalf("重复取消的错误为 %v，期望 ErrFinished", err)
+	}
+}
+
+func TestManagerCancelQueued(t *testing.T) {
+	runner := &stubRunner{}
+	m, _ := newTestManager(t, runner, false)
+	canceled, err := m.Submit(Request{CityID: 101}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := m.Submit(Request{CityID: 102}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 取消时通知 Watch
+	_, changed, err := m.Watch(canceled.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := m.Cancel(canceled.ID, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != StatusCanceled || job.StartedAt != nil || job.Error != "已被 bob 取消" {
+		t.Fatalf("取消后任务为 %+v", job)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatal("取消后 Watch 的通道未关闭")
+	}
+	if _, err := m.Cancel("unknown", "bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("取消不存在的任务，错误为 %v，期望 ErrNotFound", err)
+	}
+
+	// 已取消的任务出队时跳过，之后的任务正常执行
+	startManager(t, m)
+	waitStatus(t, m, pending.ID, StatusSucceeded)
+	if runs := runner.runCount(); runs != 1 {
+		t.Fatalf("Run 调用 %d 次，期望 1 次", runs)
+	}
+}
+
+func TestManagerShutdown(t *testing.T) {
+	runner := &stubRunner{run: func(ctx context.Context, req Request, progress func(message string)) (Outcome, error) {
+		<-ctx.Done()
+		return Outcome{}, ctx.Err()
+	}}
+	m, _ := newTestManager(t, runner, false)
+	stop := startManager(t, m)
+	running, err := m.Submit(Request{CityID: 101}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, m, running.ID, StatusRunning)
+	queued, err := m.Submit(Request{CityID: 102}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务退出时中断执行中的任务，结束未开始的任务
+	stop()
+	for _, tt := range []struct {
+		id    string
+		error string
+	}{
+		{running.ID, "服务退出，任务中断"},
+		{queued.ID, "服务退出，任务未执行"},
+	} {
+		job, err := m.Get(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != StatusCanceled || job.Error != tt.error {
+			t.Fatalf("服务退出后任务为 %+v，期望错误 %q", job, tt.error)
+		}
+	}
+}
+
+func TestManagerSubmitErrors(t *testing.T) {
+	invalid := fmt.Errorf("%w: 城市 999 不存在", ErrInvalidRequest)
+	m, _ := newTestManager(t, &stubRunner{resolveErr: invalid}, false)
+	if _, err := m.Submit(Request{CityID: 999}, "alice"); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("错误为 %v，期望 ErrInvalidRequest", err)
+	}
+	if jobs := m.List(0, 0); len(jobs) != 0 {
+		t.Fatalf("无效请求加入了任务列表: %+v", jobs)
+	}
+
+	// 不启动执行协程，等待执行的任务达到上限后拒绝
+	m, _ = newTestManager(t, &stubRunner{}, false)
+	for i := 0; i < defaultQueueSize; i++ {
+		if _, err := m.Submit(Request{CityID: 101}, "alice"); err != nil {
+			t.Fatalf("第 %d 个任务提交出错: %v", i+1, err)
+		}
+	}
+	if _, err := m.Submit(Request{CityID: 101}, "alice"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("错误为 %v，期望 ErrQueueFull", err)
+	}
+	if jobs := m.List(0, 0); len(jobs) != defaultQueueSize {
+		t.Fatalf("任务 %d 个，期望 %d 个", len(jobs), defaultQueueSize)
+	}
+}
+
+func TestManagerFinishedTTL(t *testing.T) {
+	m, clock := newTestManager(t, &stubRunner{}, true)
+	first, err := m.Submit(Request{CityID: 101}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, m, first.ID, StatusSucceeded)
+	clock.Advance(30 * time.Minute)
+	second, err := m.Submit(Request{CityID: 102}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, m, second.ID, StatusSucceeded)
+
+	// 结束后恰好 finishedTTL 时仍保留，超过后清理
+	clock.Advance(30 * time.Minute)
+	if jobs := m.List(0, 0); len(jobs) != 2 {
+		t.Fatalf("任务 %d 个，期望 2 个", len(jobs))
+	}
+	clock.Advance(time.Second)
+	jobs := m.List(0, 0)
+	if len(jobs) != 1 || jobs[0].ID != second.ID {
+		t.Fatalf("清理后任务为 %+v，期望只剩 %s", jobs, second.ID)
+	}
+	if _, err := m.Get(first.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("过期任务的错误为 %v，期望 ErrNotFound", err)
+	}
+}
+
+func TestManagerMaxFinished(t *testing.T) {
+	m, clock := newTestManager(t, &stubRunner{}, true)
+	var ids []string
+	for i := 0; i < maxFinished+1; i++ {
+		job, err := m.Submit(Request{CityID: 101 + i}, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitStatus(t, m, job.ID, StatusSucceeded)
+		ids = append(ids, job.ID)
+		clock.Advance(time.Second)
+	}
+
+	// 超过上限时清理最早结束的任务
+	jobs := m.List(0, 0)
+	if len(jobs) != maxFinished {
+		t.Fatalf("任务 %d 个，期望 %d 个", len(jobs), maxFinished)
+	}
+	if _, err := m.Get(ids[0]); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("最早的任务的错误为 %v，期望 ErrNotFound", err)
+	}
+	if jobs[0].ID != ids[len(ids)-1] || jobs[len(jobs)-1].ID != ids[1] {
+		t.Fatalf("任务未按创建时间倒序排列")
+	}
+	if jobs := m.List(101+maxFinished, 0); len(jobs) != 1 || jobs[0].ID != ids[maxFinished] {
+		t.Fatalf("按城市筛选的任务为 %+v", jobs)
+	}
+}
@@ -2,16 +2,27 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
+	"context"
 	"fmt"
+	"monitoring_system/alert"
+	"monitoring_system/auth"
 	"monitoring_system/checker"
+	"monitoring_system/cmd"
+	"monitoring_system/config"
 	"monitoring_system/database"
 	"monitoring_system/http_requests"
+	"monitoring_system/ipgroup"
+	"monitoring_system/jobs"
+	"monitoring_system/probe"
+	"monitoring_system/retention"
+	"monitoring_system/scheduler"
 	"monitoring_system/tcp"
 	"monitoring_system/webserver"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -20,17 +31,33 @@ import (
 // 最大并发数
 const maxConcurrency = 5
 
+// 收到退出信号后等待进行中的检测结束的最长时间
+const shutdownTimeout = 30 * time.Second
+
 // 定义一个互斥锁
 var dbMutex sync.Mutex
 
-// 定义一个全局的 map 来存储 curl 出现 exit 28 和 18 的 randomCityID 和对应的 outboundIP
-var curlExitErrorMap = make(map[int]map[string]struct{})
-var curlExitErrorMutex sync.Mutex
-
 func main() {
-	// 打开 SQLite 数据库
-	db := database.InitDatabase()
-	defer func(db *sql.DB) {
+	// 收到 SIGINT/SIGTERM 时取消根 context，各检测线程随之退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// mockapi 等子命令单独运行，不启动监控服务
+	if runSubcommand(ctx) {
+		return
+	}
+
+	// 读取配置文件
+	config, err := config.ReadConfig()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("读取配置文件出错")
+	}
+
+	// 按 database.db_type 打开数据库，检测线程、主循环和网页服务器共用同一个连接池
+	db := database.InitDatabase(config.DatabaseCFG)
+	defer func(db database.Store) {
 		err := db.Close()
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
@@ -39,13 +66,8 @@ func main() {
 		}
 	}(db)
 
-	// 读取配置文件
-	config, err := http_requests.ReadConfig()
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"Error": err,
-		}).Fatal("读取配置文件出错")
-	}
+	// 上游接口客户端，超时和重试策略见 config.yaml 中的 api 配置
+	api := http_requests.NewClient(config.API, config.BaseAPIAddr, config.Throttle)
 
 	connectOut := config.ConnectOut
 	connectBase := config.ConnectBaseURL
@@ -69,7 +91,7 @@ func main() {
 	}
 
 	// 检查数据库中是否已经存在省份和城市信息
-	dataExists, err := database.CheckDataExists(db)
+	dataExists, err := db.CheckDataExists()
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"Error": err,
@@ -90,41 +112,198 @@ func main() {
 
 		if input == "y" {
 			// 用户选择更新，重新拉取省份和城市数据并写入
-			updateDatabase(db, config)
+			updateDatabase(ctx, db, api, config.ProjectList())
+		} else {
+			// 旧库中的城市没有项目标记，归入第一个项目；新增的项目单独拉取城市数据
+			if err := db.TagUntaggedCities(config.ProjectList()[0]); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"Error": err,
+				}).Fatal("标记城市所属项目时出错")
+			}
+			missing := projectsWithoutCities(db, config.ProjectList())
+			if len(missing) > 0 {
+				updateDatabase(ctx, db, api, missing)
+			}
 		}
 	} else {
 		// 数据库没有数据，直接初始化查询并写入
-		updateDatabase(db, config)
+		updateDatabase(ctx, db, api, config.ProjectList())
 	}
 
 	// 定义检测间隔时间，修改为 3 秒
 	interval := 3 * time.Second
 
-	// 启动 Web 服务器
-	go webserver.StartWebServer(config.WebServerPort)
+	// 复查队列保存在数据库中，上次运行时未复查完的城市重启后继续复查
+	if cities, ips, err := db.RecheckQueueSize(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Error("【复查队列】查询复查队列出错")
+	} else if cities > 0 {
+		logrus.WithFields(logrus.Fields{
+			"Cities":      cities,
+			"OutboundIPs": ips,
+		}).Warn("【复查队列】从数据库恢复等待复查的城市")
+	}
+
+	// 创建城市调度器，所有 TradeID 共享，优先检测最久未检测、最近失败和等待复查的城市
+	sched := scheduler.NewScheduler(db, config)
+
+	// 按网段和 ASN 汇总失败的出口 IP，检测前筛查出口 IP 时使用
+	groups, err := ipgroup.NewAnalyzer(db, config)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("创建出口 IP 分组分析器出错")
+	}
+	defer groups.Close()
+	screen := &cmd.IPScreen{DB: db, API: api, Config: config, Groups: groups}
+
+	// 网页服务器的认证，未配置用户和 Token 时不校验身份
+	authenticator, err := auth.New(config.Auth)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("读取认证配置出错")
+	}
+	if authenticator == nil {
+		logrus.Warn("【认证】未配置 auth.users 和 auth.tokens，网页服务器不校验身份")
+	}
+	accessLog, accessLogFile, err := auth.NewAccessLog(config.Auth.AccessLog)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("打开访问日志出错")
+	}
+	defer accessLogFile.Close()
+
+	// 根据配置创建探测器
+	probeEnv := probe.Env{
+		TargetAddr:  targetAddr,
+		DownloadURL: cmd.DownloadURLSource(db, config),
+	}
+	probers, err := probe.FromConfig(config.Probes, probeEnv, config.DownloadTestCount)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("创建探测器出错")
+	}
+
+	// 复查与主循环使用相同的探测配置，但探测次数沿用 check_err_test_num
+	checkerProbers, err := checker.NewProbers(config.Probes, probeEnv, config.ErrTestNum)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("创建复查探测器出错")
+	}
 
 	// 信号量通道
 	sem := make(chan struct{}, maxConcurrency)
 
+	// 通过 /api/v1/probes 发起的按需检测，每个 TradeID 同一时间只执行一个任务
+	probeJobs := jobs.NewManager(&probeJobRunner{
+		db:      db,
+		api:     api,
+		config:  config,
+		probers: probers,
+		screen:  screen,
+		sem:     sem,
+	}, len(config.TradeIDs))
+
+	// 启动 Web 服务器
+	var wg sync.WaitGroup
+	webserver.SetStore(db)
+	webserver.SetScheduler(sched)
+	webserver.SetThrottle(api.Throttle)
+	webserver.SetBadIPTTL(config.BadIPExpiry())
+	webserver.SetIPGroups(groups)
+	webserver.SetProjects(config.ProjectList())
+	webserver.SetAuth(authenticator, accessLog)
+	webserver.SetProbeJobs(probeJobs)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		webserver.StartWebServer(ctx, config.WebServerPort)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		probeJobs.Run(ctx)
+	}()
+
+	// 定期汇总超过保留期的检测结果
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		retention.NewJob(db, config).Run(ctx)
+	}()
+
+	// 定期分析出口 IP 分组
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		groups.Run(ctx)
+	}()
+
+	// 线路状态变化和持续检测失败时推送告警，未配置 webhook 时不启动
+	notifier, err := alert.NewNotifier(db, config)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Fatal("创建告警推送出错")
+	}
+	if notifier != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notifier.Run(ctx)
+		}()
+	}
+
 	for _, tradeID := range config.TradeIDs {
+		wg.Add(1)
 		go func(tID int) {
+			defer wg.Done()
 			for {
-				performChecks(db, tID, config, sem, targetAddr)
-				time.Sleep(interval)
+				performChecks(ctx, db, api, tID, config, sem, probers, sched, screen)
+				select {
+				case <-time.After(interval):
+				case <-ctx.Done():
+					return
+				}
 			}
 		}(tradeID)
 	}
-	// 创建检查器实例
-	mapChecker := checker.NewChecker(db, config, curlExitErrorMap, &curlExitErrorMutex)
+	// 创建检查器实例，所有检测线程共享同一个任务队列
+	mapChecker := checker.NewChecker(db, config, api, checkerProbers, screen)
 
-	// 启动检查器协程
+	// 每个 watchTradeID 启动一个检查器协程
+	for _, watchTradeID := range config.WatchTradeID {
+		wg.Add(1)
+		go func(wID int) {
+			defer wg.Done()
+			mapChecker.Run(ctx, wID)
+		}(watchTradeID)
+	}
+
+	// 等待退出信号
+	<-ctx.Done()
+	// 恢复默认的信号处理，再次收到信号时直接退出
+	stop()
+	logrus.Warn("收到退出信号，等待进行中的检测结束...")
+
+	// 进行中的检测会随 ctx 中止，超过 shutdownTimeout 仍未结束时直接退出，
+	// 不执行 defer 中的关闭操作，避免检测线程仍在写入时关闭数据库
+	done := make(chan struct{})
 	go func() {
-		for {
-			logrus.Warn("\n【Checker】启动成功...")
-			mapChecker.Check()
-			time.Sleep(5 * time.Second) // 每 5 秒检查一次
-		}
+		wg.Wait()
+		close(done)
 	}()
-	// 防止 main 函数退出
-	select {}
+	select {
+	case <-done:
+		logrus.Warn("所有检测已结束，关闭数据库")
+	case <-time.After(shutdownTimeout):
+		logrus.Error("等待检测结束超时，强制退出")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,311 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType Prometheus 文本格式的 Content-Type
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// 指标类型
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DurationBuckets 探测耗时直方图的默认分桶（秒）
+var DurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Label 一个标签
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample 一个带标签的取值，用于抓取时才计算的指标
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+// collector 可以输出为文本格式的指标
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry 指标注册表，按注册顺序输出
+type Registry struct {
+	mutex      sync.Mutex
+	names      map[string]struct{}
+	collectors []collector
+}
+
+// Default 默认注册表，各包的指标都注册在这里，由网页服务器的 /metrics 输出
+var Default = NewRegistry()
+
+// NewRegistry 创建注册表
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+// register 注册指标，重名时 panic，指标都在包初始化时注册，重名属于编码错误
+func (r *Registry) register(name string, c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic(fmt.Sprintf("指标重复注册: %s", name))
+	}
+	r.names[name] = struct{}{}
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText 按文本格式输出所有已注册的指标
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mutex.Unlock()
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// desc 指标的名称、说明和标签名
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key 将标签值拼接为 map 的键
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("指标 %s 需要 %d 个标签值，实际 %d 个", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// pairs 将标签值与标签名配对
+func (d desc) pairs(values []string) []Label {
+	labels := make([]Label, len(values))
+	for i, v := range values {
+		labels[i] = Label{Name: d.labels[i], Value: v}
+	}
+	return labels
+}
+
+// CounterVec 按标签区分的计数器
+type CounterVec struct {
+	desc
+	mutex  sync.Mutex
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec 创建计数器并注册到 Default
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, labels: labels}, values: make(map[string]*labeledValue)}
+	Default.register(name, c)
+	return c
+}
+
+// Inc 计数加一
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add 计数加 v，v 不能为负数
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("计数器 %s 不能减少", c.name))
+	}
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lv, ok := c.values[key]
+	if !ok {
+		lv = &labeledValue{labels: append([]string(nil), labelValues...)}
+		c.values[key] = lv
+	}
+	lv.value += v
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.mutex.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, lv := range c.values {
+		samples = append(samples, Sample{Labels: c.pairs(lv.labels), Value: lv.value})
+	}
+	c.mutex.Unlock()
+	return WriteFamily(w, c.name, c.help, TypeCounter, samples)
+}
+
+// HistogramVec 按标签区分的直方图
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // 与 buckets 一一对应，非累计
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec 创建直方图并注册到 Default，buckets 为各分桶的上限，需升序
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("直方图 %s 的分桶需升序", name))
+	}
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	Default.register(name, h)
+	return h
+}
+
+// Observe 记录一次观测值
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	h.mutex.Lock()
+	values := make([]histogramValue, 0, len(h.values))
+	for _, hv := range h.values {
+		copied := *hv
+		copied.counts = append([]uint64(nil), hv.counts...)
+		values = append(values, copied)
+	}
+	h.mutex.Unlock()
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labels, "\xff") < strings.Join(values[j].labels, "\xff")
+	})
+
+	if err := writeHeader(w, h.name, h.help, TypeHistogram); err != nil {
+		return err
+	}
+	for _, hv := range values {
+		labels := h.pairs(hv.labels)
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hv.counts[i]
+			le := append(append([]Label(nil), labels...), Label{Name: "le", Value: formatFloat(upper)})
+			if err := writeSample(w, h.name+"_bucket", le, float64(cumulative)); err != nil {
+				return err
+			}
+		}
+		inf := append(append([]Label(nil), labels...), Label{Name: "le", Value: "+Inf"})
+		if err := writeSample(w, h.name+"_bucket", inf, float64(hv.count)); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_sum", labels, hv.sum); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_count", labels, float64(hv.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFamily 输出一组同名指标，samples 按标签排序后输出
+func WriteFamily(w io.Writer, name, help, metricType string, samples []Sample) error {
+	if err := writeHeader(w, name, help, metricType); err != nil {
+		return err
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return labelString(samples[i].Labels) < labelString(samples[j].Labels)
+	})
+	for _, s := range samples {
+		if err := writeSample(w, name, s.Labels, s.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, metricType)
+	return err
+}
+
+func writeSample(w io.Writer, name string, labels []Label, value float64) error {
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, labelString(labels), formatFloat(value))
+	return err
+}
+
+// labelString 输出 {a="1",b="2"} 形式的标签，没有标签时为空
+func labelString(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
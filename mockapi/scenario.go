@@ -0,0 +1,105 @@
+package mockapi
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"monitoring_system/http_requests"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 故障类型
+const (
+	FaultError = "error" // 返回 code 不为 1000 的响应
+	FaultEmpty = "empty" // 返回 code 1000 但 data 为空
+	FaultSlow  = "slow"  // 延迟 delay 后正常响应
+	FaultHTTP  = "http"  // 返回 status 指定的 HTTP 状态码
+)
+
+// Scenario 模拟上游的数据和故障注入配置
+type Scenario struct {
+	Provinces []http_requests.Province `yaml:"provinces"`
+	Nodes     []NodeSpec               `yaml:"nodes"`
+	Lines     []LineSpec               `yaml:"lines"`
+	Faults    []Fault                  `yaml:"faults"`
+}
+
+// NodeSpec 城市节点，project_id 和 line_id 为 0 时在所有项目中返回
+type NodeSpec struct {
+	ID        int    `yaml:"id"`
+	Name      string `yaml:"name"`
+	LineType  string `yaml:"line_type"`
+	Max       int    `yaml:"max"`
+	AreaID    int    `yaml:"area_id"`
+	ProjectID int    `yaml:"project_id"`
+	LineID    int    `yaml:"line_id"`
+}
+
+// LineSpec trade ID 对应的线路，更换 IP 时按顺序轮换 outbound_ips
+type LineSpec struct {
+	TradeID      int      `yaml:"trade_id"`
+	SSPass       string   `yaml:"ss_pass"`
+	EndpointAddr string   `yaml:"endpoint_addr"` // SOCKS5 代理地址
+	OutboundIPs  []string `yaml:"outbound_ips"`
+	NodeID       int      `yaml:"node_id"` // 初始节点，为 0 时使用第一个节点
+}
+
+// Fault 故障注入规则
+type Fault struct {
+	Endpoint    string        `yaml:"endpoint"`    // 接口名称，为空时作用于所有接口
+	Type        string        `yaml:"type"`        // error、empty、slow、http
+	Code        int           `yaml:"code"`        // error 返回的 code，默认 500
+	Msg         string        `yaml:"msg"`         // error 返回的消息
+	Status      int           `yaml:"status"`      // http 返回的状态码，默认 502
+	Delay       time.Duration `yaml:"delay"`       // slow 的延迟时间
+	Probability float64       `yaml:"probability"` // 触发概率，0 表示每次都触发
+	Times       int           `yaml:"times"`       // 最多触发次数，0 表示不限
+	TradeID     int           `yaml:"trade_id"`    // 只对该 trade ID 生效，0 表示不限
+}
+
+// LoadScenario 读取场景文件
+func LoadScenario(path string) (*Scenario, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取场景文件出错: %w", err)
+	}
+	var scenario Scenario
+	if err := yaml.Unmarshal(file, &scenario); err != nil {
+		return nil, fmt.Errorf("解析场景文件出错: %w", err)
+	}
+	for i, fault := range scenario.Faults {
+		switch fault.Type {
+		case FaultError, FaultEmpty, FaultSlow, FaultHTTP:
+		default:
+			return nil, fmt.Errorf("第 %d 条故障规则的类型无效: %s", i+1, fault.Type)
+		}
+	}
+	return &scenario, nil
+}
+
+// DefaultScenario 未指定场景文件时使用的数据：两个省份、四个城市，tradeIDs 各一条线路
+func DefaultScenario(endpointAddr string, tradeIDs ...int) *Scenario {
+	scenario := &Scenario{
+		Provinces: []http_requests.Province{
+			{ID: 1, Name: "江苏省"},
+			{ID: 2, Name: "浙江省"},
+		},
+		Nodes: []NodeSpec{
+			{ID: 101, Name: "南京市电信", LineType: "电信", Max: 100, AreaID: 1},
+			{ID: 102, Name: "苏州市联通", LineType: "联通", Max: 100, AreaID: 1},
+			{ID: 201, Name: "杭州市电信", LineType: "电信", Max: 100, AreaID: 2},
+			{ID: 202, Name: "宁波市移动", LineType: "移动", Max: 100, AreaID: 2},
+		},
+	}
+	for i, tradeID := range tradeIDs {
+		scenario.Lines = append(scenario.Lines, LineSpec{
+			TradeID:      tradeID,
+			SSPass:       "mock",
+			EndpointAddr: endpointAddr,
+			OutboundIPs:  []string{fmt.Sprintf("198.51.100.%d", i*2+1), fmt.Sprintf("198.51.100.%d", i*2+2)},
+		})
+	}
+	return scenario
+}
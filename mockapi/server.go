@@ -0,0 +1,341 @@
+package mockapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"monitoring_system/http_requests"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/rand"
+)
+
+// 线路的 node_name 带一个前缀字符，与上游一致，检测时会去掉首字符再与城市名匹配
+const nodeNamePrefix = "*"
+
+// lineState 线路当前的节点和出口 IP
+type lineState struct {
+	spec   LineSpec
+	nodeID int
+	ipIdx  int
+}
+
+// Server 模拟上游接口，实现 http.Handler，可直接用于 httptest.NewServer
+type Server struct {
+	scenario *Scenario
+	mux      *http.ServeMux
+
+	mutex  sync.Mutex
+	lines  []*lineState
+	fired  []int          // 每条故障规则已触发的次数
+	calls  map[string]int // 每个接口的调用次数
+	random *rand.Rand
+}
+
+// NewServer 根据场景创建模拟上游
+func NewServer(scenario *Scenario) *Server {
+	s := &Server{
+		scenario: scenario,
+		mux:      http.NewServeMux(),
+		fired:    make([]int, len(scenario.Faults)),
+		calls:    make(map[string]int),
+		random:   rand.New(rand.NewSource(uint64(time.Now().UnixNano()))),
+	}
+	for _, spec := range scenario.Lines {
+		state := &lineState{spec: spec, nodeID: spec.NodeID}
+		if state.nodeID == 0 && len(scenario.Nodes) > 0 {
+			state.nodeID = scenario.Nodes[0].ID
+		}
+		s.lines = append(s.lines, state)
+	}
+
+	s.handle(http_requests.EndpointGetProvinces, s.getProvinces)
+	s.handle(http_requests.EndpointGetNodes, s.getNodes)
+	s.handle(http_requests.EndpointChangeNode, s.changeNode)
+	s.handle(http_requests.EndpointChangeLineIPAddr, s.changeLineIPAddr)
+	s.handle(http_requests.EndpointGetLine, s.getLine)
+	return s
+}
+
+// ServeHTTP 实现 http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Calls 返回接口被调用的次数，包括注入了故障的调用
+func (s *Server) Calls(endpoint string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[endpoint]
+}
+
+// Line 返回 tradeID 对应线路的当前状态
+func (s *Server) Line(tradeID int) (http_requests.Line, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, state := range s.lines {
+		if state.spec.TradeID == tradeID {
+			return s.line(i, state), true
+		}
+	}
+	return http_requests.Line{}, false
+}
+
+// response 上游接口的通用响应格式
+type response struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data"`
+}
+
+// handle 注册接口，处理前按场景注入故障，命中 error、empty、http 规则时不修改线路状态
+func (s *Server) handle(endpoint string, handler func(r *http.Request) response) {
+	s.mux.HandleFunc("/api/outApi/"+endpoint, func(w http.ResponseWriter, r *http.Request) {
+		tradeID, err := requestTradeID(endpoint, r)
+		if err != nil {
+			writeResponse(w, endpoint, failure(fmt.Sprintf("参数错误: %v", err)))
+			return
+		}
+		fault, delay := s.fault(endpoint, tradeID)
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if fault == nil {
+			writeResponse(w, endpoint, handler(r))
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"Endpoint": endpoint,
+			"TradeID":  tradeID,
+			"Fault":    fault.Type,
+		}).Info("【MockAPI】注入故障")
+		switch fault.Type {
+		case FaultHTTP:
+			status := fault.Status
+			if status == 0 {
+				status = http.StatusBadGateway
+			}
+			http.Error(w, http.StatusText(status), status)
+		case FaultError:
+			resp := response{Code: fault.Code, Msg: fault.Msg}
+			if resp.Code == 0 {
+				resp.Code = 500
+			}
+			if resp.Msg == "" {
+				resp.Msg = "模拟故障"
+			}
+			writeResponse(w, endpoint, resp)
+		case FaultEmpty:
+			writeResponse(w, endpoint, success("success", []struct{}{}))
+		}
+	})
+}
+
+// writeResponse 写入 JSON 响应
+func writeResponse(w http.ResponseWriter, endpoint string, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logrus.WithFields(logrus.Fields{"Endpoint": endpoint, "Error": err}).Error("【MockAPI】写入响应出错")
+	}
+}
+
+// requestTradeID 取出请求中的 trade ID 用于匹配故障规则：changeNode 读取请求体中的 trade_id，
+// changeLineIpAddr 读取 line_id，其余接口返回 0。读取后的请求体会还原，供后续处理
+func requestTradeID(endpoint string, r *http.Request) (int, error) {
+	switch endpoint {
+	case http_requests.EndpointChangeLineIPAddr:
+		return strconv.Atoi(r.URL.Query().Get("line_id"))
+	case http_requests.EndpointChangeNode:
+	default:
+		return 0, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return 0, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var payload struct {
+		TradeID int `json:"trade_id"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return 0, err
+	}
+	return payload.TradeID, nil
+}
+
+// fault 记录一次调用，返回命中的故障规则和需要延迟的时间。
+// slow 规则可以与其他规则叠加，其余规则只取第一条命中的
+func (s *Server) fault(endpoint string, tradeID int) (*Fault, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls[endpoint]++
+
+	var hit *Fault
+	var delay time.Duration
+	for i := range s.scenario.Faults {
+		fault := &s.scenario.Faults[i]
+		if fault.Endpoint != "" && fault.Endpoint != endpoint {
+			continue
+		}
+		if fault.TradeID != 0 && fault.TradeID != tradeID {
+			continue
+		}
+		if fault.Type != FaultSlow && hit != nil {
+			continue
+		}
+		if fault.Times > 0 && s.fired[i] >= fault.Times {
+			continue
+		}
+		if fault.Probability > 0 && s.random.Float64() >= fault.Probability {
+			continue
+		}
+		s.fired[i]++
+		if fault.Type == FaultSlow {
+			delay += fault.Delay
+		} else {
+			hit = fault
+		}
+	}
+	return hit, delay
+}
+
+// success 返回成功响应
+func success(msg string, data interface{}) response {
+	return response{Code: http_requests.CodeSuccess, Msg: msg, Data: data}
+}
+
+// failure 返回失败响应，code 与上游参数错误时一致
+func failure(msg string) response {
+	return response{Code: 400, Msg: msg}
+}
+
+func (s *Server) getProvinces(r *http.Request) response {
+	provinces := s.scenario.Provinces
+	if provinces == nil {
+		provinces = []http_requests.Province{}
+	}
+	return success("success", provinces)
+}
+
+func (s *Server) getNodes(r *http.Request) response {
+	query := r.URL.Query()
+	provinceID, _ := strconv.Atoi(query.Get("province_id"))
+	projectID, _ := strconv.Atoi(query.Get("project_id"))
+	lineID, _ := strconv.Atoi(query.Get("line_id"))
+
+	nodes := []http_requests.Node{}
+	for _, spec := range s.scenario.Nodes {
+		if spec.AreaID != provinceID {
+			continue
+		}
+		if spec.ProjectID != 0 && spec.ProjectID != projectID {
+			continue
+		}
+		if spec.LineID != 0 && spec.LineID != lineID {
+			continue
+		}
+		nodes = append(nodes, http_requests.Node{
+			ID:       spec.ID,
+			Name:     spec.Name,
+			LineType: spec.LineType,
+			Max:      spec.Max,
+			AreaID:   spec.AreaID,
+		})
+	}
+	return success("success", nodes)
+}
+
+func (s *Server) changeNode(r *http.Request) response {
+	var payload struct {
+		NodeID  int `json:"node_id"`
+		TradeID int `json:"trade_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return failure(fmt.Sprintf("参数错误: %v", err))
+	}
+	if _, ok := s.node(payload.NodeID); !ok {
+		return failure(fmt.Sprintf("节点 %d 不存在", payload.NodeID))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, state := range s.lines {
+		if state.spec.TradeID == payload.TradeID {
+			state.nodeID = payload.NodeID
+			// 切换节点后出口 IP 随之变化
+			state.ipIdx++
+			return success("节点变更成功.", nil)
+		}
+	}
+	return failure(fmt.Sprintf("trade ID %d 不存在", payload.TradeID))
+}
+
+func (s *Server) changeLineIPAddr(r *http.Request) response {
+	lineID, err := strconv.Atoi(r.URL.Query().Get("line_id"))
+	if err != nil {
+		return failure("参数错误: line_id")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, state := range s.lines {
+		// 调用方传入的 line_id 为 trade ID，也兼容线路自身的 ID
+		if state.spec.TradeID == lineID || i+1 == lineID {
+			state.ipIdx++
+			return success("变更成功.", nil)
+		}
+	}
+	return failure(fmt.Sprintf("线路 %d 不存在", lineID))
+}
+
+func (s *Server) getLine(r *http.Request) response {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines := make([]http_requests.Line, 0, len(s.lines))
+	for i, state := range s.lines {
+		lines = append(lines, s.line(i, state))
+	}
+	return success("success", lines)
+}
+
+// node 按 ID 查找城市节点
+func (s *Server) node(id int) (NodeSpec, bool) {
+	for _, spec := range s.scenario.Nodes {
+		if spec.ID == id {
+			return spec, true
+		}
+	}
+	return NodeSpec{}, false
+}
+
+// line 将线路状态转换为上游接口返回的格式，调用方需持有锁
+func (s *Server) line(i int, state *lineState) http_requests.Line {
+	line := http_requests.Line{
+		ID:           i + 1,
+		TradeName:    fmt.Sprintf("mock-%d", state.spec.TradeID),
+		SSUser:       strconv.Itoa(state.spec.TradeID),
+		SSPass:       state.spec.SSPass,
+		EndpointAddr: state.spec.EndpointAddr,
+		GroupName:    "mock",
+		ProjectName:  "mock",
+	}
+	if len(state.spec.OutboundIPs) > 0 {
+		line.OutboundIP = state.spec.OutboundIPs[state.ipIdx%len(state.spec.OutboundIPs)]
+	}
+	if node, ok := s.node(state.nodeID); ok {
+		line.NodeName = nodeNamePrefix + node.Name
+		line.LineType = node.LineType
+	}
+	return line
+}
@@ -0,0 +1,162 @@
+package mockapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+)
+
+const (
+	testTradeID      = 1001
+	testEndpointAddr = "127.0.0.1:1080"
+)
+
+// testRetry 测试使用的重试策略，缩短退避时间
+var testRetry = config.RetryPolicy{
+	MaxAttempts:    ptr(3),
+	InitialBackoff: ptr(20 * time.Millisecond),
+	MaxBackoff:     ptr(100 * time.Millisecond),
+	Multiplier:     ptr(2.0),
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// startClient 启动模拟上游，返回连接它的客户端，单次请求超时 200ms
+func startClient(t *testing.T, scenario *Scenario) (*http_requests.Client, *Server) {
+	t.Helper()
+	mock := NewServer(scenario)
+	upstream := httptest.NewServer(mock)
+	t.Cleanup(upstream.Close)
+	cfg := config.APICFG{Timeout: 200 * time.Millisecond, Retry: testRetry}
+	return http_requests.NewClient(cfg, upstream.URL, config.ThrottleCFG{Settle: time.Millisecond}), mock
+}
+
+func TestClientRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		fault    Fault
+		calls    int           // 期望的请求次数
+		minWait  time.Duration // 期望的最少退避时间
+		wantCode int           // 期望最终返回的 HTTP 状态码，0 表示成功
+	}{
+		{"5xx_recovers", Fault{Type: FaultHTTP, Status: http.StatusBadGateway, Times: 2}, 3, 20 * time.Millisecond, 0},
+		{"5xx_exhausted", Fault{Type: FaultHTTP, Status: http.StatusServiceUnavailable}, 3, 20 * time.Millisecond, http.StatusServiceUnavailable},
+		{"429_retried", Fault{Type: FaultHTTP, Status: http.StatusTooManyRequests, Times: 1}, 2, 10 * time.Millisecond, 0},
+		{"4xx_not_retried", Fault{Type: FaultHTTP, Status: http.StatusNotFound}, 1, 0, http.StatusNotFound},
+		{"timeout", Fault{Type: FaultSlow, Delay: time.Second, Times: 1}, 2, 10 * time.Millisecond, 0},
+		{"error_code", Fault{Type: FaultError, Code: 500, Times: 1}, 2, 10 * time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fault.Endpoint = http_requests.EndpointGetProvinces
+			scenario := DefaultScenario(testEndpointAddr)
+			scenario.Faults = []Fault{tt.fault}
+			api, mock := startClient(t, scenario)
+
+			start := time.Now()
+			provinces, err := api.GetProvinces(context.Background())
+			elapsed := time.Since(start)
+
+			if calls := mock.Calls(http_requests.EndpointGetProvinces); calls != tt.calls {
+				t.Fatalf("请求 %d 次，期望 %d 次", calls, tt.calls)
+			}
+			// 退避带 20% 的随机抖动
+			if elapsed < tt.minWait*8/10 {
+				t.Fatalf("耗时 %s，期望退避不少于 %s", elapsed, tt.minWait)
+			}
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("重试后仍出错: %v", err)
+				}
+				if len(provinces) != 2 || provinces[0].Name != "江苏省" {
+					t.Fatalf("省份为 %+v", provinces)
+				}
+				return
+			}
+			var statusErr *http_requests.StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.wantCode {
+				t.Fatalf("错误为 %v，期望 HTTP 状态码 %d", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestClientRetriesEmptyLines(t *testing.T) {
+	scenario := DefaultScenario(testEndpointAddr, testTradeID)
+	scenario.Faults = []Fault{{Endpoint: http_requests.EndpointGetLine, Type: FaultEmpty, Times: 1}}
+	api, mock := startClient(t, scenario)
+
+	// data 为空时解析失败，同样重试
+	lines, err := api.GetLines(context.Background())
+	if err != nil {
+		t.Fatalf("重试后仍出错: %v", err)
+	}
+	if len(lines) != 1 || mock.Calls(http_requests.EndpointGetLine) != 2 {
+		t.Fatalf("线路为 %+v，请求 %d 次", lines, mock.Calls(http_requests.EndpointGetLine))
+	}
+}
+
+func TestChangeNodeGetLines(t *testing.T) {
+	api, mock := startClient(t, DefaultScenario(testEndpointAddr, testTradeID))
+	ctx := context.Background()
+
+	nodes, err := api.GetNodes(ctx, 1, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].ID != 201 || nodes[0].AreaID != 2 || nodes[0].LineType != "电信" {
+		t.Fatalf("城市为 %+v", nodes)
+	}
+
+	if err := api.ChangeNode(ctx, 201, testTradeID); err != nil {
+		t.Fatalf("变更节点出错: %v", err)
+	}
+	lines, err := api.GetLines(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := http_requests.Line{
+		ID:           1,
+		TradeName:    "mock-1001",
+		SSUser:       "1001",
+		SSPass:       "mock",
+		EndpointAddr: testEndpointAddr,
+		OutboundIP:   "198.51.100.2",
+		LineType:     "电信",
+		GroupName:    "mock",
+		NodeName:     nodeNamePrefix + "杭州市电信",
+		ProjectName:  "mock",
+	}
+	if len(lines) != 1 || lines[0] != want {
+		t.Fatalf("线路为 %+v，期望 %+v", lines, want)
+	}
+
+	// 更换 IP 后出口轮换，节点不变
+	if err := api.ChangeLineIP(ctx, testTradeID); err != nil {
+		t.Fatalf("更换 IP 出错: %v", err)
+	}
+	if lines, err = api.GetLines(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lines[0].OutboundIP != "198.51.100.1" || lines[0].NodeName != want.NodeName {
+		t.Fatalf("更换 IP 后线路为 %+v", lines[0])
+	}
+	if line, _ := mock.Line(testTradeID); line != lines[0] {
+		t.Fatalf("接口返回 %+v，模拟上游状态为 %+v", lines[0], line)
+	}
+
+	// 节点不存在时返回上游的错误码
+	err = api.ChangeNode(ctx, 999, testTradeID)
+	var apiErr *http_requests.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 400 || apiErr.Endpoint != http_requests.EndpointChangeNode {
+		t.Fatalf("错误为 %v，期望 changeNode 返回 code 400", err)
+	}
+}
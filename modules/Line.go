@@ -1,8 +1,7 @@
 package modules
 
 import (
-	"database/sql"
-	"errors"
+	"monitoring_system/database"
 )
 
 // BadLine bad_line 表
@@ -10,28 +9,9 @@ type BadLine struct {
 	RandomCityID int `json:"randomCityID" db:"randomCityID"`
 }
 
-// GetRandomCityID 随机获取一个id
-func (l BadLine) GetRandomCityID(db *sql.DB) (int, error) {
-	var randomCityID int
-	if err := db.QueryRow("SELECT randomCityID FROM bad_line ORDER BY RANDOM() LIMIT 1").Scan(&randomCityID); err != nil {
-		return 0, err
-	}
-	return randomCityID, nil
-}
-
-func (l BadLine) GetCityIDbyID(db *sql.DB, id int) (int, error) {
-	var cityID int
-	if err := db.QueryRow("SELECT randomCityID FROM bad_line WHERE randomCityID=?", id).Scan(&cityID); err != nil {
-		return 0, err
-	}
-	return cityID, nil
-}
-
-func (l BadLine) CheckIsNotExistsAndInsert(db *sql.DB, id int) {
-	_, err := l.GetCityIDbyID(db, id)
-	if err != nil && errors.Is(err, sql.ErrNoRows) {
-		_, _ = db.Exec("INSERT INTO bad_line (randomCityID) VALUES (?)", id)
-	}
+// GetRandomCityIDs 按随机顺序获取 filter 范围内的全部 id
+func (l BadLine) GetRandomCityIDs(store database.Store, filter database.ProjectFilter) ([]int, error) {
+	return store.BadLineCityIDs(filter)
 }
 
 // GoodLine good_line 表
@@ -39,30 +19,12 @@ type GoodLine struct {
 	NodeID int `json:"node_id" db:"node_id"`
 }
 
-// GetRandomCityID 随机获取一个id
-func (l GoodLine) GetRandomCityID(db *sql.DB) (int, error) {
-	var randomCityID int
-	if err := db.QueryRow("SELECT node_id FROM good_line ORDER BY RANDOM() LIMIT 1").Scan(&randomCityID); err != nil {
-		return 0, err
-	}
-	return randomCityID, nil
-}
-
-func (l GoodLine) GetCityIDbyID(db *sql.DB, id int) (int, error) {
-	var cityID int
-	if err := db.QueryRow("SELECT node_id FROM good_line WHERE node_id=?", id).Scan(&cityID); err != nil {
-		return 0, err
-	}
-	return cityID, nil
-}
-
-func (l GoodLine) CheckIsNotExistsAndInsert(db *sql.DB, id int) {
-	_, err := l.GetCityIDbyID(db, id)
-	if err != nil && errors.Is(err, sql.ErrNoRows) {
-		_, _ = db.Exec("INSERT INTO good_line (node_id) VALUES (?)", id)
-	}
+// GetRandomCityIDs 按随机顺序获取 filter 范围内的全部 id
+func (l GoodLine) GetRandomCityIDs(store database.Store, filter database.ProjectFilter) ([]int, error) {
+	return store.GoodLineCityIDs(filter, true)
 }
 
-func (l GoodLine) DeleteById(db *sql.DB, id int) {
-	_, _ = db.Exec("DELETE FROM good_line WHERE id=?", id)
+// CheckIsNotExistsAndInsert id 不在 good_line 表中时插入
+func (l GoodLine) CheckIsNotExistsAndInsert(store database.Store, id int, audit database.LineAudit) {
+	_ = store.InsertIntoGoodLine(id, audit)
 }
@@ -0,0 +1,82 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+	"monitoring_system/socks5"
+)
+
+func init() {
+	Register(TypeDNS, newDNSProber)
+}
+
+// defaultResolver 未配置时使用的解析服务器
+const defaultResolver = "223.5.5.5:53"
+
+// defaultDomain 未配置时解析的域名
+const defaultDomain = "www.baidu.com"
+
+// DNSProber 通过代理以 TCP 方式向解析服务器查询域名
+type DNSProber struct {
+	Count    int
+	Resolver string
+	Domain   string
+	Timeout  time.Duration
+}
+
+func newDNSProber(cfg config.ProbeCFG, env Env) (Prober, error) {
+	p := &DNSProber{
+		Count:    countOr(cfg, 3),
+		Resolver: cfg.Target,
+		Domain:   cfg.Domain,
+		Timeout:  timeoutOr(cfg, defaultTimeout),
+	}
+	if p.Resolver == "" {
+		p.Resolver = defaultResolver
+	}
+	if p.Domain == "" {
+		p.Domain = defaultDomain
+	}
+	return p, nil
+}
+
+// Name 返回探测类型
+func (p *DNSProber) Name() string {
+	return TypeDNS
+}
+
+// Probe 执行 DNS 解析探测
+func (p *DNSProber) Probe(ctx context.Context, line http_requests.Line) *Result {
+	return runAttempts(ctx, TypeDNS, p.Count, func(ctx context.Context) Attempt {
+		ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+
+		// A 和 AAAA 查询可能并发拨号，只记录第一次拨号的耗时
+		var timing socks5.Timing
+		var timingOnce sync.Once
+		resolver := &net.Resolver{
+			PreferGo: true,
+			// 返回的连接不是 PacketConn，解析器会使用 TCP 报文格式
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, t, err := socks5.DialTimed(ctx, line.SSUser, line.SSPass, line.EndpointAddr, p.Resolver)
+				timingOnce.Do(func() { timing = t })
+				return conn, err
+			},
+		}
+
+		start := time.Now()
+		addrs, err := resolver.LookupHost(ctx, p.Domain)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("域名 %s 没有解析结果", p.Domain)
+		}
+		// LookupHost 返回后仍可能有未结束的拨号，读取 timing 前先占用 timingOnce
+		timingOnce.Do(func() {})
+		return Attempt{Duration: time.Since(start), Timing: timing, Err: err}
+	})
+}
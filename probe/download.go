@@ -0,0 +1,66 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+	"monitoring_system/socks5"
+)
+
+func init() {
+	Register(TypeDownload, newDownloadProber)
+}
+
+// DownloadProber 通过代理下载文件，统计平均下载速率
+type DownloadProber struct {
+	Count     int
+	URL       string
+	URLSource func() (string, error) // 未配置 URL 时从该函数获取下载地址
+	Timeout   time.Duration
+}
+
+func newDownloadProber(cfg config.ProbeCFG, env Env) (Prober, error) {
+	return &DownloadProber{
+		Count:     countOr(cfg, 3),
+		URL:       cfg.URL,
+		URLSource: env.DownloadURL,
+		Timeout:   timeoutOr(cfg, socks5.DefaultDownloadTimeout),
+	}, nil
+}
+
+// Name 返回探测类型
+func (p *DownloadProber) Name() string {
+	return TypeDownload
+}
+
+// downloadURL 获取下载地址
+func (p *DownloadProber) downloadURL() (string, error) {
+	if p.URL != "" {
+		return p.URL, nil
+	}
+	if p.URLSource == nil {
+		return "", errors.New("未配置下载地址")
+	}
+	return p.URLSource()
+}
+
+// Probe 执行下载测试
+func (p *DownloadProber) Probe(ctx context.Context, line http_requests.Line) *Result {
+	url, err := p.downloadURL()
+	if err != nil {
+		return &Result{ProbeType: TypeDownload, ResponseTime: -1, Err: err}
+	}
+	return runAttempts(ctx, TypeDownload, p.Count, func(ctx context.Context) Attempt {
+		start := time.Now()
+		speed, timing, err := socks5.Download(ctx, url, line.SSUser, line.SSPass, line.EndpointAddr, p.Timeout)
+		attempt := Attempt{Duration: time.Since(start), Timing: timing, Speed: speed, Err: err}
+		var dlErr *socks5.DownloadError
+		if errors.As(err, &dlErr) {
+			attempt.ExitCode = dlErr.ExitCode()
+		}
+		return attempt
+	})
+}
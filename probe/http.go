@@ -0,0 +1,93 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+	"monitoring_system/socks5"
+)
+
+func init() {
+	Register(TypeHTTP, newHTTPProber)
+}
+
+// HTTPProber 通过代理发送 HTTP GET 请求，状态码小于 400 视为成功
+type HTTPProber struct {
+	Count   int
+	URL     string
+	Timeout time.Duration
+}
+
+func newHTTPProber(cfg config.ProbeCFG, env Env) (Prober, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("http 探测未配置 url")
+	}
+	return &HTTPProber{
+		Count:   countOr(cfg, 3),
+		URL:     cfg.URL,
+		Timeout: timeoutOr(cfg, defaultTimeout),
+	}, nil
+}
+
+// Name 返回探测类型
+func (p *HTTPProber) Name() string {
+	return TypeHTTP
+}
+
+// Probe 执行 HTTP GET 探测
+func (p *HTTPProber) Probe(ctx context.Context, line http_requests.Line) *Result {
+	return runAttempts(ctx, TypeHTTP, p.Count, func(ctx context.Context) Attempt {
+		ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+
+		var timing socks5.Timing
+		var tunnelReady time.Time
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, t, err := socks5.DialTimed(ctx, line.SSUser, line.SSPass, line.EndpointAddr, addr)
+				if err != nil {
+					return nil, err
+				}
+				timing = t
+				tunnelReady = time.Now()
+				return conn, nil
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}
+		defer transport.CloseIdleConnections()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+		if err != nil {
+			return Attempt{Err: err}
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotFirstResponseByte: func() {
+				if !tunnelReady.IsZero() {
+					timing.FirstByte = time.Since(tunnelReady)
+				}
+			},
+		}))
+
+		start := time.Now()
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			return Attempt{Duration: time.Since(start), Timing: timing, Err: err}
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		attempt := Attempt{Duration: time.Since(start), Timing: timing, Err: err}
+		if err == nil && resp.StatusCode >= http.StatusBadRequest {
+			attempt.Err = fmt.Errorf("HTTP 状态码异常: %d", resp.StatusCode)
+		}
+		return attempt
+	})
+}
@@ -0,0 +1,294 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/http_requests"
+	"monitoring_system/metrics"
+	"monitoring_system/socks5"
+)
+
+// 内置探测类型
+const (
+	TypeSOCKS5   = "socks5"
+	TypeDownload = "download"
+	TypeHTTP     = "http"
+	TypeTLS      = "tls"
+	TypeDNS      = "dns"
+	TypeUDP      = "udp"
+)
+
+// defaultTimeout 未配置超时时间时单次探测的超时时间
+const defaultTimeout = 10 * time.Second
+
+// 单次探测的耗时和失败分类
+var (
+	probeDuration = metrics.NewHistogramVec("monitoring_probe_duration_seconds",
+		"单次探测耗时（秒），包含失败的探测。标签 probe_type: 探测类型，如 socks5、download；result: success 或 failure",
+		metrics.DurationBuckets, "probe_type", "result")
+	probeErrors = metrics.NewCounterVec("monitoring_probe_errors_total",
+		"单次探测失败次数。标签 probe_type: 探测类型；code: 与 curl 对应的退出码 18（传输中断）、28（超时）、97（SOCKS5 握手失败），其余错误为 other",
+		"probe_type", "code")
+)
+
+// Prober 探测器接口，对一条线路执行一种类型的探测
+type Prober interface {
+	// Name 返回探测类型，结果按该类型入库
+	Name() string
+	// Probe 对线路执行探测，失败信息记录在 Result.Err 中
+	Probe(ctx context.Context, line http_requests.Line) *Result
+}
+
+// Attempt 单次探测的明细
+type Attempt struct {
+	Duration time.Duration
+	Timing   socks5.Timing
+	Speed    float64 // 下载速率（Mbps），仅下载类探测有值
+	ExitCode int     // 下载失败时与 curl 对应的退出码
+	Err      error
+}
+
+// Result 一个探测器对一条线路的探测结果
+type Result struct {
+	ProbeType    string
+	SuccessRate  float64       // 成功率，百分比
+	ResponseTime int64         // 成功请求的平均耗时（毫秒），全部失败时为 -1
+	DownloadRate float64       // 平均下载速率（Mbps），失败的次数按 0 计入
+	Timing       socks5.Timing // 成功请求的各阶段平均耗时
+	Attempts     []Attempt
+	Err          error // 全部失败或无法执行时的错误
+}
+
+// NeedsRecheck 判断失败的下载是否需要复查，即退出码为 18、28、97
+func (a Attempt) NeedsRecheck() bool {
+	return a.Err != nil && socks5.IsRecheckCode(a.ExitCode)
+}
+
+// FirstFailure 返回第一次失败的探测，没有失败时返回 false
+func (r *Result) FirstFailure() (Attempt, bool) {
+	for _, a := range r.Attempts {
+		if a.Err != nil {
+			return a, true
+		}
+	}
+	return Attempt{}, false
+}
+
+// RecheckFailure 返回第一次需要复查的失败，没有时返回 false
+func (r *Result) RecheckFailure() (Attempt, bool) {
+	for _, a := range r.Attempts {
+		if a.NeedsRecheck() {
+			return a, true
+		}
+	}
+	return Attempt{}, false
+}
+
+// Record 将探测结果转换为数据库记录
+func (r *Result) Record(line http_requests.Line, cityID, tradeID int) database.ProbeResult {
+	record := database.ProbeResult{
+		ProbeType:    r.ProbeType,
+		NodeID:       cityID,
+		NodeName:     line.NodeName,
+		OutboundIP:   line.OutboundIP,
+		TradeID:      tradeID,
+		SuccessRate:  r.SuccessRate,
+		ResponseTime: r.ResponseTime,
+		DownloadRate: r.DownloadRate,
+		PhaseTimes: database.PhaseTimes{
+			Connect:      r.Timing.Connect.Milliseconds(),
+			Handshake:    r.Timing.Handshake.Milliseconds(),
+			ConnectReply: r.Timing.ConnectReply.Milliseconds(),
+			FirstByte:    r.Timing.FirstByte.Milliseconds(),
+		},
+	}
+	for _, attempt := range r.Attempts {
+		if attempt.ExitCode != 0 {
+			record.ExitCode = attempt.ExitCode
+		}
+	}
+	if r.Err != nil {
+		record.Error = r.Err.Error()
+	}
+	return record
+}
+
+// Env 探测器运行所需的外部信息
+type Env struct {
+	TargetAddr  string                 // SOCKS5 探测 CONNECT 的目标地址
+	DownloadURL func() (string, error) // 下载地址来源，配置中未指定 url 时使用
+}
+
+// Factory 根据配置创建探测器
+type Factory func(cfg config.ProbeCFG, env Env) (Prober, error)
+
+var (
+	registry      = make(map[string]Factory)
+	registryMutex sync.RWMutex
+)
+
+// Register 注册一种探测类型，重复注册会覆盖之前的实现
+func Register(probeType string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[probeType] = factory
+}
+
+// Types 返回已注册的探测类型
+func Types() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	types := make([]string, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New 根据单个配置创建探测器
+func New(cfg config.ProbeCFG, env Env) (Prober, error) {
+	registryMutex.RLock()
+	factory, ok := registry[cfg.Type]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("未知的探测类型: %s", cfg.Type)
+	}
+	return factory(cfg, env)
+}
+
+// FromConfig 根据配置创建探测器列表，SOCKS5 和下载测试是判定线路好坏的依据，未配置时自动补上
+func FromConfig(cfgs []config.ProbeCFG, env Env, downloadCount int) ([]Prober, error) {
+	var probers []Prober
+	hasSOCKS5, hasDownload := false, false
+	for _, cfg := range cfgs {
+		prober, err := New(cfg, env)
+		if err != nil {
+			return nil, err
+		}
+		switch cfg.Type {
+		case TypeSOCKS5:
+			hasSOCKS5 = true
+		case TypeDownload:
+			hasDownload = true
+		}
+		probers = append(probers, prober)
+	}
+	if !hasSOCKS5 {
+		prober, err := New(config.ProbeCFG{Type: TypeSOCKS5}, env)
+		if err != nil {
+			return nil, err
+		}
+		probers = append([]Prober{prober}, probers...)
+	}
+	if !hasDownload {
+		prober, err := New(config.ProbeCFG{Type: TypeDownload, Count: downloadCount}, env)
+		if err != nil {
+			return nil, err
+		}
+		probers = append(probers, prober)
+	}
+	return probers, nil
+}
+
+// Find 从探测器列表中查找指定类型的探测器
+func Find(probers []Prober, probeType string) Prober {
+	for _, prober := range probers {
+		if prober.Name() == probeType {
+			return prober
+		}
+	}
+	return nil
+}
+
+// runAttempts 执行 count 次探测并汇总结果
+func runAttempts(ctx context.Context, probeType string, count int, attempt func(ctx context.Context) Attempt) *Result {
+	result := &Result{ProbeType: probeType, ResponseTime: -1}
+	if count <= 0 {
+		count = 1
+	}
+
+	var totalDuration time.Duration
+	var totalTiming socks5.Timing
+	var totalSpeed float64
+	var lastErr error
+	successCount := 0
+	for i := 0; i < count; i++ {
+		if ctx.Err() != nil {
+			lastErr = ctx.Err()
+			break
+		}
+		start := time.Now()
+		a := attempt(ctx)
+		observeAttempt(probeType, a, time.Since(start))
+		result.Attempts = append(result.Attempts, a)
+		totalSpeed += a.Speed
+		if a.Err != nil {
+			lastErr = a.Err
+			continue
+		}
+		totalDuration += a.Duration
+		totalTiming.Connect += a.Timing.Connect
+		totalTiming.Handshake += a.Timing.Handshake
+		totalTiming.ConnectReply += a.Timing.ConnectReply
+		totalTiming.FirstByte += a.Timing.FirstByte
+		successCount++
+	}
+
+	result.DownloadRate = totalSpeed / float64(count)
+	result.SuccessRate = float64(successCount) / float64(count) * 100
+	if successCount == 0 {
+		result.Err = fmt.Errorf("%s 探测全部失败: %v", probeType, lastErr)
+		return result
+	}
+	n := time.Duration(successCount)
+	result.ResponseTime = (totalDuration / n).Milliseconds()
+	result.Timing = socks5.Timing{
+		Connect:      totalTiming.Connect / n,
+		Handshake:    totalTiming.Handshake / n,
+		ConnectReply: totalTiming.ConnectReply / n,
+		FirstByte:    totalTiming.FirstByte / n,
+	}
+	return result
+}
+
+// observeAttempt 记录单次探测的耗时和失败分类，服务退出导致的失败不计入
+func observeAttempt(probeType string, a Attempt, elapsed time.Duration) {
+	if a.Err == nil {
+		probeDuration.Observe(elapsed.Seconds(), probeType, "success")
+		return
+	}
+	if errors.Is(a.Err, context.Canceled) {
+		return
+	}
+	probeDuration.Observe(elapsed.Seconds(), probeType, "failure")
+	code := "other"
+	if a.NeedsRecheck() {
+		code = strconv.Itoa(a.ExitCode)
+	}
+	probeErrors.Inc(probeType, code)
+}
+
+// timeoutOr 返回配置的超时时间，未配置时返回默认值
+func timeoutOr(cfg config.ProbeCFG, def time.Duration) time.Duration {
+	if cfg.Timeout > 0 {
+		return cfg.Timeout
+	}
+	return def
+}
+
+// countOr 返回配置的探测次数，未配置时返回默认值
+func countOr(cfg config.ProbeCFG, def int) int {
+	if cfg.Count > 0 {
+		return cfg.Count
+	}
+	return def
+}
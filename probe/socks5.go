@@ -0,0 +1,64 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+	"monitoring_system/socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Register(TypeSOCKS5, newSOCKS5Prober)
+}
+
+// SOCKS5Prober 通过代理 CONNECT 到目标地址，统计成功率和各阶段耗时
+type SOCKS5Prober struct {
+	Count      int
+	TargetAddr string
+	Timeout    time.Duration
+}
+
+func newSOCKS5Prober(cfg config.ProbeCFG, env Env) (Prober, error) {
+	target := cfg.Target
+	if target == "" {
+		target = env.TargetAddr
+	}
+	if target == "" {
+		return nil, fmt.Errorf("socks5 探测未配置目标地址")
+	}
+	return &SOCKS5Prober{
+		Count:      countOr(cfg, 10),
+		TargetAddr: target,
+		Timeout:    timeoutOr(cfg, defaultTimeout),
+	}, nil
+}
+
+// Name 返回探测类型
+func (p *SOCKS5Prober) Name() string {
+	return TypeSOCKS5
+}
+
+// Probe 执行 SOCKS5 测试
+func (p *SOCKS5Prober) Probe(ctx context.Context, line http_requests.Line) *Result {
+	return runAttempts(ctx, TypeSOCKS5, p.Count, func(ctx context.Context) Attempt {
+		ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		conn, timing, err := socks5.DialTimed(ctx, line.SSUser, line.SSPass, line.EndpointAddr, p.TargetAddr)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"NodeName": line.NodeName,
+				"error":    err,
+			}).Error(" SOCKS5代理测试失败")
+			return Attempt{Duration: time.Since(start), Err: err}
+		}
+		conn.Close()
+		return Attempt{Duration: time.Since(start), Timing: timing}
+	})
+}
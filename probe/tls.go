@@ -0,0 +1,63 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+	"monitoring_system/socks5"
+)
+
+func init() {
+	Register(TypeTLS, newTLSProber)
+}
+
+// TLSProber 通过代理连接目标地址并完成 TLS 握手
+type TLSProber struct {
+	Count   int
+	Target  string
+	Timeout time.Duration
+}
+
+func newTLSProber(cfg config.ProbeCFG, env Env) (Prober, error) {
+	if cfg.Target == "" {
+		return nil, fmt.Errorf("tls 探测未配置 target")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Target); err != nil {
+		return nil, fmt.Errorf("tls 探测 target 格式错误: %v", err)
+	}
+	return &TLSProber{
+		Count:   countOr(cfg, 3),
+		Target:  cfg.Target,
+		Timeout: timeoutOr(cfg, defaultTimeout),
+	}, nil
+}
+
+// Name 返回探测类型
+func (p *TLSProber) Name() string {
+	return TypeTLS
+}
+
+// Probe 执行 TLS 握手探测
+func (p *TLSProber) Probe(ctx context.Context, line http_requests.Line) *Result {
+	host, _, _ := net.SplitHostPort(p.Target)
+	return runAttempts(ctx, TypeTLS, p.Count, func(ctx context.Context) Attempt {
+		ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		conn, timing, err := socks5.DialTimed(ctx, line.SSUser, line.SSPass, line.EndpointAddr, p.Target)
+		if err != nil {
+			return Attempt{Duration: time.Since(start), Err: err}
+		}
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		err = tlsConn.HandshakeContext(ctx)
+		return Attempt{Duration: time.Since(start), Timing: timing, Err: err}
+	})
+}
@@ -0,0 +1,80 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/http_requests"
+	"monitoring_system/socks5"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func init() {
+	Register(TypeUDP, newUDPProber)
+}
+
+// UDPProber 通过代理的 UDP ASSOCIATE 向目标发送 DNS 查询，收到任意响应即视为成功
+type UDPProber struct {
+	Count   int
+	Target  string
+	Payload []byte
+	Timeout time.Duration
+}
+
+func newUDPProber(cfg config.ProbeCFG, env Env) (Prober, error) {
+	target := cfg.Target
+	if target == "" {
+		target = defaultResolver
+	}
+	domain := cfg.Domain
+	if domain == "" {
+		domain = defaultDomain
+	}
+	payload, err := buildDNSQuery(domain)
+	if err != nil {
+		return nil, fmt.Errorf("udp 探测构造查询报文失败: %v", err)
+	}
+	return &UDPProber{
+		Count:   countOr(cfg, 3),
+		Target:  target,
+		Payload: payload,
+		Timeout: timeoutOr(cfg, defaultTimeout),
+	}, nil
+}
+
+// buildDNSQuery 构造查询 domain A 记录的 DNS 报文
+func buildDNSQuery(domain string) ([]byte, error) {
+	name, err := dnsmessage.NewName(domain + ".")
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return msg.Pack()
+}
+
+// Name 返回探测类型
+func (p *UDPProber) Name() string {
+	return TypeUDP
+}
+
+// Probe 执行 UDP 探测
+func (p *UDPProber) Probe(ctx context.Context, line http_requests.Line) *Result {
+	return runAttempts(ctx, TypeUDP, p.Count, func(ctx context.Context) Attempt {
+		ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		_, timing, err := socks5.UDPExchange(ctx, line.SSUser, line.SSPass, line.EndpointAddr, p.Target, p.Payload)
+		return Attempt{Duration: time.Since(start), Timing: timing, Err: err}
+	})
+}
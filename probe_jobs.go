@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"monitoring_system/cmd"
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/events"
+	"monitoring_system/http_requests"
+	"monitoring_system/jobs"
+	"monitoring_system/probe"
+)
+
+// tradeLocks 同一个 TradeID 同一时间只能切换到一个城市，周期检测和按需检测共用
+var tradeLocks = &tradeLockSet{locks: make(map[int]chan struct{})}
+
+// tradeLockSet 按 TradeID 加锁，等待时可随 ctx 取消
+type tradeLockSet struct {
+	mutex sync.Mutex
+	locks map[int]chan struct{} // 容量为 1 的通道，有值表示已加锁
+}
+
+// get 返回 tradeID 的锁
+func (t *tradeLockSet) get(tradeID int) chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lock, ok := t.locks[tradeID]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		t.locks[tradeID] = lock
+	}
+	return lock
+}
+
+// tryLock 尝试加锁，已被占用时返回 false
+func (t *tradeLockSet) tryLock(tradeID int) (func(), bool) {
+	lock := t.get(tradeID)
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, true
+	default:
+		return nil, false
+	}
+}
+
+// lock 加锁，ctx 取消时返回错误
+func (t *tradeLockSet) lock(ctx context.Context, tradeID int) (func(), error) {
+	lock := t.get(tradeID)
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// probeJobRunner 执行通过 /api/v1/probes 发起的按需检测，使用与周期检测相同的流程和探测器
+type probeJobRunner struct {
+	db      database.Store
+	api     *http_requests.Client
+	config  *config.Config
+	probers []probe.Prober
+	screen  *cmd.IPScreen
+	sem     chan struct{} // 与周期检测共用的并发限制
+}
+
+// Resolve 实现 jobs.Runner：城市必须存在；未指定 TradeID 时选择城市所属项目的第一个 TradeID，
+// 指定时必须是 config.yaml 中的 TradeIDs 且与城市属于同一项目；未指定探测类型时执行全部已配置的探测器
+func (r *probeJobRunner) Resolve(req jobs.Request) (jobs.Request, string, error) {
+	city, err := r.db.GetCity(req.CityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return req, "", fmt.Errorf("%w: 城市 %d 不存在", jobs.ErrInvalidRequest, req.CityID)
+	}
+	if err != nil {
+		return req, "", err
+	}
+	projectID, lineID, err := r.db.GetCityProject(req.CityID)
+	if err != nil {
+		return req, "", err
+	}
+
+	if req.TradeID == 0 {
+		for _, tradeID := range r.config.TradeIDs {
+			if database.ProjectFilterFor(r.config, tradeID).Match(projectID, lineID) {
+				req.TradeID = tradeID
+				break
+			}
+		}
+		if req.TradeID == 0 {
+			return req, "", fmt.Errorf("%w: 没有可用于城市 %d 的 TradeID", jobs.ErrInvalidRequest, req.CityID)
+		}
+	} else {
+		found := false
+		for _, tradeID := range r.config.TradeIDs {
+			found = found || tradeID == req.TradeID
+		}
+		if !found {
+			return req, "", fmt.Errorf("%w: TradeID %d 不在配置的 TradeIDs 中", jobs.ErrInvalidRequest, req.TradeID)
+		}
+		if !database.ProjectFilterFor(r.config, req.TradeID).Match(projectID, lineID) {
+			return req, "", fmt.Errorf("%w: 城市 %d 不属于 TradeID %d 的项目", jobs.ErrInvalidRequest, req.CityID, req.TradeID)
+		}
+	}
+
+	if len(req.Types) == 0 {
+		for _, prober := range r.probers {
+			req.Types = append(req.Types, prober.Name())
+		}
+		return req, city.Name, nil
+	}
+	seen := make(map[string]bool)
+	var types []string
+	for _, probeType := range req.Types {
+		if seen[probeType] {
+			continue
+		}
+		if r.prober(probeType) == nil {
+			return req, "", fmt.Errorf("%w: 未配置探测类型 %q", jobs.ErrInvalidRequest, probeType)
+		}
+		seen[probeType] = true
+		types = append(types, probeType)
+	}
+	req.Types = types
+	return req, city.Name, nil
+}
+
+// Run 实现 jobs.Runner，等待并发名额和 TradeID 空闲后按请求的探测类型检测城市
+func (r *probeJobRunner) Run(ctx context.Context, req jobs.Request, progress func(message string)) (jobs.Outcome, error) {
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		progress("等待检测并发名额")
+		select {
+		case r.sem <- struct{}{}:
+		case <-ctx.Done():
+			return jobs.Outcome{}, ctx.Err()
+		}
+	}
+	defer func() { <-r.sem }()
+
+	unlock, ok := tradeLocks.tryLock(req.TradeID)
+	if !ok {
+		progress(fmt.Sprintf("TradeID %d 正在检测其他城市，等待其完成", req.TradeID))
+		var err error
+		unlock, err = tradeLocks.lock(ctx, req.TradeID)
+		if err != nil {
+			return jobs.Outcome{}, err
+		}
+	}
+	defer unlock()
+
+	// 按请求中的顺序执行探测器
+	probers := make([]probe.Prober, 0, len(req.Types))
+	for _, probeType := range req.Types {
+		probers = append(probers, r.prober(probeType))
+	}
+	return checkCity(ctx, r.db, r.api, req.TradeID, req.CityID, r.config, probers, r.screen, events.SourceProbeJob, progress)
+}
+
+// prober 返回指定类型的探测器，未配置时返回 nil
+func (r *probeJobRunner) prober(probeType string) probe.Prober {
+	for _, prober := range r.probers {
+		if prober.Name() == probeType {
+			return prober
+		}
+	}
+	return nil
+}
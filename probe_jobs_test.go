@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/http_requests"
+	"monitoring_system/jobs"
+	"monitoring_system/probe"
+)
+
+// namedProber 只有名称的探测器，Resolve 只用到 Name
+type namedProber string
+
+func (p namedProber) Name() string {
+	return string(p)
+}
+
+func (p namedProber) Probe(ctx context.Context, line http_requests.Line) *probe.Result {
+	return nil
+}
+
+// newTestResolver 创建两个项目的 probeJobRunner：城市 101 和 TradeID 1001 属于 a，城市 201 和 TradeID 1002 属于 b
+func newTestResolver(t *testing.T) *probeJobRunner {
+	t.Helper()
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveProvinces([]http_requests.Province{{ID: 1, Name: "江苏省"}, {ID: 2, Name: "浙江省"}}); err != nil {
+		t.Fatal(err)
+	}
+	projects := []config.ProjectCFG{
+		{Name: "a", ProjectID: 592, LineID: 22, TradeIDs: []int{1001}},
+		{Name: "b", ProjectID: 600, LineID: 30, TradeIDs: []int{1002}},
+	}
+	if err := db.SaveNodes([]http_requests.Node{{ID: 101, Name: "南京市电信", AreaID: 1}}, projects[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveNodes([]http_requests.Node{{ID: 201, Name: "杭州市电信", AreaID: 2}}, projects[1]); err != nil {
+		t.Fatal(err)
+	}
+	return &probeJobRunner{
+		db:      db,
+		config:  &config.Config{TradeIDs: []int{1001, 1002}, WatchTradeID: []int{1003}, Projects: projects},
+		probers: []probe.Prober{namedProber(probe.TypeSOCKS5), namedProber(probe.TypeDownload), namedProber(probe.TypeDNS)},
+	}
+}
+
+func TestProbeJobResolve(t *testing.T) {
+	r := newTestResolver(t)
+	tests := []struct {
+		name     string
+		req      jobs.Request
+		want     jobs.Request // 补全默认值后的请求
+		cityName string
+		error    string // 不为空时期望返回 ErrInvalidRequest，且错误信息包含该内容
+	}{
+		{"defaults", jobs.Request{CityID: 101},
+			jobs.Request{CityID: 101, TradeID: 1001, Types: []string{probe.TypeSOCKS5, probe.TypeDownload, probe.TypeDNS}}, "南京市电信", ""},
+		// 未指定 TradeID 时选择城市所属项目的 TradeID
+		{"default_trade_id_by_project", jobs.Request{CityID: 201, Types: []string{probe.TypeDNS}},
+			jobs.Request{CityID: 201, TradeID: 1002, Types: []string{probe.TypeDNS}}, "杭州市电信", ""},
+		{"dedup_types", jobs.Request{CityID: 101, TradeID: 1001, Types: []string{probe.TypeDNS, probe.TypeSOCKS5, probe.TypeDNS}},
+			jobs.Request{CityID: 101, TradeID: 1001, Types: []string{probe.TypeDNS, probe.TypeSOCKS5}}, "南京市电信", ""},
+		{"unknown_city", jobs.Request{CityID: 999}, jobs.Request{}, "", "城市 999 不存在"},
+		// watchTradeID 不在 TradeIDs 中，不能用于按需检测
+		{"trade_id_not_configured", jobs.Request{CityID: 101, TradeID: 1003}, jobs.Request{}, "", "TradeID 1003 不在配置的 TradeIDs 中"},
+		{"city_outside_project", jobs.Request{CityID: 201, TradeID: 1001}, jobs.Request{}, "", "城市 201 不属于 TradeID 1001 的项目"},
+		{"unknown_probe_type", jobs.Request{CityID: 101, Types: []string{probe.TypeSOCKS5, probe.TypeTLS}}, jobs.Request{}, "", `未配置探测类型 "tls"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, cityName, err := r.Resolve(tt.req)
+			if tt.error != "" {
+				if !errors.Is(err, jobs.ErrInvalidRequest) || !strings.Contains(err.Error(), tt.error) {
+					t.Fatalf("错误为 %v，期望 ErrInvalidRequest: %s", err, tt.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(req, tt.want) || cityName != tt.cityName {
+				t.Fatalf("Resolve() = %+v, %q，期望 %+v, %q", req, cityName, tt.want, tt.cityName)
+			}
+		})
+	}
+}
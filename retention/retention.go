@@ -0,0 +1,118 @@
+package retention
+
+import (
+	"context"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRawDays    = 7         // 未配置 raw_days 时的默认值
+	defaultHourlyDays = 90        // 未配置 hourly_days 时的默认值
+	defaultInterval   = time.Hour // 未配置 interval 时的默认值
+	day               = 24 * time.Hour
+)
+
+// Job 定期将超过保留期的检测结果汇总为按小时和按天的统计，避免结果表无限增长，
+// 同时清理超过 TTL 未再命中的 bad_ips 记录
+type Job struct {
+	DB         database.Store
+	RawDays    int
+	HourlyDays int
+	Interval   time.Duration
+	BadIPTTL   time.Duration
+}
+
+// NewJob 创建汇总任务
+func NewJob(db database.Store, config *config.Config) *Job {
+	j := &Job{
+		DB:         db,
+		RawDays:    config.Retention.RawDays,
+		HourlyDays: config.Retention.HourlyDays,
+		Interval:   config.Retention.Interval,
+		BadIPTTL:   config.BadIPExpiry(),
+	}
+	if j.RawDays <= 0 {
+		j.RawDays = defaultRawDays
+	}
+	if j.HourlyDays <= 0 {
+		j.HourlyDays = defaultHourlyDays
+	}
+	// 按小时统计必须比原始结果保留得久，否则刚汇总的小时区间会立即被合并
+	if j.HourlyDays <= j.RawDays {
+		j.HourlyDays = j.RawDays + 1
+	}
+	if j.Interval <= 0 {
+		j.Interval = defaultInterval
+	}
+	return j
+}
+
+// Run 启动时执行一次汇总，之后每隔 Interval 执行一次，ctx 取消时退出
+func (j *Job) Run(ctx context.Context) {
+	for {
+		j.RunOnce(time.Now())
+		select {
+		case <-time.After(j.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunOnce 按 now 计算截止时间并执行一次汇总，然后清理过期的 bad_ips。
+// 截止时间按 UTC 小时和天对齐，每个区间只汇总一次
+func (j *Job) RunOnce(now time.Time) {
+	j.rollup(now)
+	j.purgeBadIPs()
+}
+
+// purgeBadIPs 清理超过 BadIPTTL 未再命中的 bad_ips 记录
+func (j *Job) purgeBadIPs() {
+	if j.BadIPTTL <= 0 {
+		return
+	}
+	purged, err := j.DB.PurgeExpiredBadIPs(j.BadIPTTL)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+		}).Error("【数据保留】清理过期的 bad_ips 出错")
+		return
+	}
+	if purged > 0 {
+		logrus.WithFields(logrus.Fields{
+			"Purged": purged,
+			"TTL":    j.BadIPTTL,
+		}).Info("【数据保留】已清理过期的 bad_ips")
+	}
+}
+
+// rollup 汇总超过保留期的检测结果
+func (j *Job) rollup(now time.Time) {
+	rawBefore := now.Add(-time.Duration(j.RawDays) * day).Truncate(time.Hour)
+	hourlyBefore := now.Add(-time.Duration(j.HourlyDays) * day).Truncate(day)
+
+	start := time.Now()
+	stats, err := j.DB.RollupTestResults(rawBefore, hourlyBefore)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"RawBefore":    rawBefore.Format("2006-01-02 15:04:05"),
+			"HourlyBefore": hourlyBefore.Format("2006-01-02 15:04:05"),
+			"Error":        err,
+		}).Error("【数据保留】汇总检测结果出错")
+		return
+	}
+	if stats.RawRows == 0 && stats.ProbeRows == 0 && stats.HourlyRows == 0 {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"RawRows":    stats.RawRows,
+		"ProbeRows":  stats.ProbeRows,
+		"HourlyRows": stats.HourlyRows,
+		"Elapsed":    time.Since(start).Round(time.Millisecond),
+	}).Info("【数据保留】已汇总过期的检测结果")
+}
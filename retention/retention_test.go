@@ -0,0 +1,117 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/http_requests"
+)
+
+// rollupStore 记录 RollupTestResults 和 PurgeExpiredBadIPs 收到的参数，其他方法调用时 panic
+type rollupStore struct {
+	database.Store
+	rawBefore, hourlyBefore time.Time
+	purgeTTL                time.Duration
+}
+
+func (s *rollupStore) RollupTestResults(rawBefore, hourlyBefore time.Time) (database.RollupStats, error) {
+	s.rawBefore, s.hourlyBefore = rawBefore, hourlyBefore
+	return database.RollupStats{}, nil
+}
+
+func (s *rollupStore) PurgeExpiredBadIPs(ttl time.Duration) (int, error) {
+	s.purgeTTL = ttl
+	return 0, nil
+}
+
+func TestRunOnceCutoffs(t *testing.T) {
+	now := time.Date(2024, 5, 20, 13, 45, 30, 0, time.UTC)
+	tests := []struct {
+		name         string
+		cfg          config.RetentionCFG
+		rawBefore    time.Time
+		hourlyBefore time.Time
+	}{
+		{"defaults", config.RetentionCFG{},
+			time.Date(2024, 5, 13, 13, 0, 0, 0, time.UTC), time.Date(2024, 2, 20, 0, 0, 0, 0, time.UTC)},
+		{"configured", config.RetentionCFG{RawDays: 1, HourlyDays: 30},
+			time.Date(2024, 5, 19, 13, 0, 0, 0, time.UTC), time.Date(2024, 4, 20, 0, 0, 0, 0, time.UTC)},
+		// 按小时统计的保留期不长于原始结果时顺延一天
+		{"hourly_not_longer_than_raw", config.RetentionCFG{RawDays: 10, HourlyDays: 5},
+			time.Date(2024, 5, 10, 13, 0, 0, 0, time.UTC), time.Date(2024, 5, 9, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollupStore{}
+			NewJob(store, &config.Config{Retention: tt.cfg}).RunOnce(now)
+			if !store.rawBefore.Equal(tt.rawBefore) || !store.hourlyBefore.Equal(tt.hourlyBefore) {
+				t.Fatalf("截止时间为 %s、%s，期望 %s、%s", store.rawBefore, store.hourlyBefore, tt.rawBefore, tt.hourlyBefore)
+			}
+			if store.purgeTTL != config.DefaultBadIPTTL {
+				t.Fatalf("清理 bad_ips 的 TTL 为 %s，期望 %s", store.purgeTTL, config.DefaultBadIPTTL)
+			}
+		})
+	}
+}
+
+// totalSamples 返回城市在 [from, to) 内的检测次数，以及非空区间是否都来自汇总数据
+func totalSamples(t *testing.T, db database.Store, from, to time.Time, step time.Duration) (int64, bool) {
+	t.Helper()
+	buckets, err := db.CityHistory(101, from, to, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples int64
+	aggregated := true
+	for _, b := range buckets {
+		samples += b.Samples
+		if b.Samples > 0 && !b.Aggregated {
+			aggregated = false
+		}
+	}
+	return samples, aggregated
+}
+
+func TestRunOnceStore(t *testing.T) {
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveProvinces([]http_requests.Province{{ID: 1, Name: "江苏省"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveNodes([]http_requests.Node{{ID: 101, Name: "南京市电信", AreaID: 1}}, config.ProjectCFG{ProjectID: 592, LineID: 22}); err != nil {
+		t.Fatal(err)
+	}
+	// SaveNodeTestResult 使用当前时间，通过推后 RunOnce 的时间让结果超过保留期
+	now := time.Now()
+	for _, rt := range []int64{100, 300} {
+		if err := db.SaveNodeTestResult(database.NodeTestResult{NodeName: "南京市电信", NodeID: 101, SuccessRate: 100, AvgResponseTime: rt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := NewJob(db, &config.Config{})
+	from, to := now.Add(-2*day), now.Add(2*day)
+
+	// 保留期内不汇总
+	job.RunOnce(now.Add(time.Duration(job.RawDays-1) * day))
+	if samples, aggregated := totalSamples(t, db, from, to, time.Hour); samples != 2 || aggregated {
+		t.Fatalf("保留期内检测次数为 %d，汇总为 %v，期望 2 次原始结果", samples, aggregated)
+	}
+
+	job.RunOnce(now.Add(time.Duration(job.RawDays)*day + 2*time.Hour))
+	if samples, aggregated := totalSamples(t, db, from, to, time.Hour); samples != 2 || !aggregated {
+		t.Fatalf("按小时汇总后检测次数为 %d，汇总为 %v，期望 2 次汇总结果", samples, aggregated)
+	}
+
+	job.RunOnce(now.Add(time.Duration(job.HourlyDays+1) * day))
+	if samples, aggregated := totalSamples(t, db, from, to, day); samples != 2 || !aggregated {
+		t.Fatalf("按天汇总后检测次数为 %d，汇总为 %v，期望 2 次汇总结果", samples, aggregated)
+	}
+}
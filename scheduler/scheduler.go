@@ -0,0 +1,225 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+
+	"golang.org/x/exp/rand"
+)
+
+const (
+	defaultMaxStaleness  = 6 * time.Hour    // 未配置 max_staleness 时的默认值
+	defaultFailureWindow = time.Hour        // 未配置 failure_window 时的默认值
+	defaultMinSpeed      = 3.0              // 未配置 bad_line_min_speed 时判定失败的下载速率
+	refreshInterval      = time.Minute      // 从数据库重新加载检测时间的间隔
+	minRetestInterval    = 10 * time.Minute // 刚检测过的城市不参与失败加权，避免反复选中同一城市
+)
+
+// 优先级权重，分值越高越先检测
+const (
+	neverTestedScore = 100.0 // 从未检测过的城市
+	maxStaleScore    = 10.0  // 陈旧度分值上限，保证从未检测过的城市始终优先
+	failureBonus     = 1.0   // 最近检测失败的城市
+	exitErrorBonus   = 2.0   // 复查队列中的城市
+)
+
+// CityState 城市在调度队列中的状态
+type CityState struct {
+	CityID        int       `json:"city_id"`
+	Name          string    `json:"name"`
+	LastTested    time.Time `json:"last_tested"` // 从未检测过时为零值
+	Age           string    `json:"age"`
+	RecentFailure bool      `json:"recent_failure"`
+	ExitError     bool      `json:"exit_error"`
+	Score         float64   `json:"score"`
+}
+
+// Scheduler 按覆盖情况选择下一个检测的城市：
+// 越久没检测的城市分值越高，最近失败和复查队列中的城市额外加分
+type Scheduler struct {
+	DB            database.Store
+	MaxStaleness  time.Duration
+	FailureWindow time.Duration
+	MinSpeed      float64
+	now           func() time.Time // 当前时间，测试时可替换
+
+	mutex    sync.Mutex
+	cities   []database.CityLastTest
+	failures map[int]time.Time // 城市 ID 到最近一次失败时间
+	picked   map[int]time.Time // 已分配但结果可能尚未入库的城市
+	loadedAt time.Time
+}
+
+// NewScheduler 创建城市调度器
+func NewScheduler(db database.Store, config *config.Config) *Scheduler {
+	s := &Scheduler{
+		DB:            db,
+		MaxStaleness:  config.Scheduler.MaxStaleness,
+		FailureWindow: config.Scheduler.FailureWindow,
+		MinSpeed:      config.Checker.BadLineMinSpeed,
+		now:           time.Now,
+		picked:        make(map[int]time.Time),
+	}
+	if s.MaxStaleness <= 0 {
+		s.MaxStaleness = defaultMaxStaleness
+	}
+	if s.FailureWindow <= 0 {
+		s.FailureWindow = defaultFailureWindow
+	}
+	if s.MinSpeed <= 0 {
+		s.MinSpeed = defaultMinSpeed
+	}
+	return s
+}
+
+// Next 返回 filter 范围内当前优先级最高的城市 ID，并记为已分配
+func (s *Scheduler) Next(filter database.ProjectFilter) (int, error) {
+	exitErrors, err := s.exitErrorCities()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.refresh(); err != nil {
+		return 0, err
+	}
+	now := s.now()
+	states := s.states(now, exitErrors, filter)
+	if len(states) == 0 {
+		return 0, errors.New("数据库中没有城市信息")
+	}
+
+	// 分值相同的城市随机选择
+	best := states[0].Score
+	n := 1
+	for n < len(states) && states[n].Score == best {
+		n++
+	}
+	cityID := states[rand.Intn(n)].CityID
+	s.picked[cityID] = now
+	return cityID, nil
+}
+
+// Queue 返回 filter 范围内按优先级排序的前 limit 个城市，limit <= 0 时返回全部
+func (s *Scheduler) Queue(limit int, filter database.ProjectFilter) ([]CityState, error) {
+	exitErrors, err := s.exitErrorCities()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	states := s.states(s.now(), exitErrors, filter)
+	if limit > 0 && len(states) > limit {
+		states = states[:limit]
+	}
+	return states, nil
+}
+
+// refresh 超过刷新间隔时从数据库重新加载各城市的检测时间和失败记录
+func (s *Scheduler) refresh() error {
+	now := s.now()
+	if now.Sub(s.loadedAt) < refreshInterval {
+		return nil
+	}
+	cities, err := s.DB.GetCityLastTestTimes()
+	if err != nil {
+		return fmt.Errorf("查询城市检测时间出错: %w", err)
+	}
+	failures, err := s.DB.GetRecentFailureTimes(now.Add(-s.FailureWindow), s.MinSpeed)
+	if err != nil {
+		return fmt.Errorf("查询失败记录出错: %w", err)
+	}
+	s.cities = cities
+	s.failures = failures
+	s.loadedAt = now
+
+	// 结果已入库的城市不再需要记录分配时间
+	for _, city := range cities {
+		if pickedAt, ok := s.picked[city.CityID]; ok && !city.LastTestTime.Before(pickedAt) {
+			delete(s.picked, city.CityID)
+		}
+	}
+	return nil
+}
+
+// states 计算 filter 范围内城市的分值并按分值降序排列
+func (s *Scheduler) states(now time.Time, exitErrors map[int]bool, filter database.ProjectFilter) []CityState {
+	states := make([]CityState, 0, len(s.cities))
+	for _, city := range s.cities {
+		if !filter.Match(city.ProjectID, city.LineID) {
+			continue
+		}
+		state := CityState{CityID: city.CityID, Name: city.Name, LastTested: city.LastTestTime}
+		if pickedAt, ok := s.picked[city.CityID]; ok && pickedAt.After(state.LastTested) {
+			state.LastTested = pickedAt
+		}
+
+		if state.LastTested.IsZero() {
+			state.Score = neverTestedScore
+		} else {
+			age := now.Sub(state.LastTested)
+			state.Score = math.Min(float64(age)/float64(s.MaxStaleness), maxStaleScore)
+			if failedAt, ok := s.failures[city.CityID]; ok && !failedAt.Before(city.LastTestTime) {
+				state.RecentFailure = true
+			}
+			state.ExitError = exitErrors[city.CityID]
+			if age >= minRetestInterval {
+				if state.RecentFailure {
+					state.Score += failureBonus
+				}
+				if state.ExitError {
+					state.Score += exitErrorBonus
+				}
+			}
+		}
+		state.Age = FormatAge(state.LastTested, now)
+		states = append(states, state)
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		return states[i].Score > states[j].Score
+	})
+	return states
+}
+
+// exitErrorCities 返回复查队列中等待复查的城市 ID
+func (s *Scheduler) exitErrorCities() (map[int]bool, error) {
+	entries, err := s.DB.RecheckQueue()
+	if err != nil {
+		return nil, fmt.Errorf("查询复查队列出错: %w", err)
+	}
+	cities := make(map[int]bool, len(entries))
+	for _, entry := range entries {
+		cities[entry.CityID] = true
+	}
+	return cities, nil
+}
+
+// FormatAge 将距上次检测的时间格式化为便于阅读的字符串
+func FormatAge(lastTested, now time.Time) string {
+	if lastTested.IsZero() {
+		return "从未检测"
+	}
+	age := now.Sub(lastTested)
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%d秒前", int(age.Seconds()))
+	case age < time.Hour:
+		return fmt.Sprintf("%d分钟前", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%d小时%d分钟前", int(age.Hours()), int(age.Minutes())%60)
+	default:
+		return fmt.Sprintf("%d天前", int(age.Hours()/24))
+	}
+}
@@ -0,0 +1,201 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"monitoring_system/config"
+	"monitoring_system/database"
+)
+
+const (
+	testProjectID = 592
+	testLineID    = 22
+)
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeStore 只实现调度器用到的查询，其他方法调用时 panic
+type fakeStore struct {
+	database.Store
+	cities   []database.CityLastTest
+	failures map[int]time.Time
+	queue    []database.RecheckEntry
+
+	failuresSince time.Time // GetRecentFailureTimes 收到的起始时间
+	loads         int       // GetCityLastTestTimes 的调用次数
+}
+
+func (f *fakeStore) GetCityLastTestTimes() ([]database.CityLastTest, error) {
+	f.loads++
+	return f.cities, nil
+}
+
+func (f *fakeStore) GetRecentFailureTimes(since time.Time, minSpeed float64) (map[int]time.Time, error) {
+	f.failuresSince = since
+	return f.failures, nil
+}
+
+func (f *fakeStore) RecheckQueue() ([]database.RecheckEntry, error) {
+	return f.queue, nil
+}
+
+// city 返回距 testNow 已 age 未检测的城市，age 为 0 时表示从未检测
+func city(id int, age time.Duration) database.CityLastTest {
+	c := database.CityLastTest{CityID: id, Name: "城市", ProjectID: testProjectID, LineID: testLineID}
+	if age > 0 {
+		c.LastTestTime = testNow.Add(-age)
+	}
+	return c
+}
+
+// newTestScheduler 创建使用 fakeStore 的调度器，时钟固定为 *now
+func newTestScheduler(store *fakeStore, now *time.Time) *Scheduler {
+	s := NewScheduler(store, &config.Config{Scheduler: config.SchedulerCFG{MaxStaleness: 6 * time.Hour, FailureWindow: time.Hour}})
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestSchedulerScore(t *testing.T) {
+	tests := []struct {
+		name          string
+		age           time.Duration // 距上次检测的时间，0 表示从未检测
+		failedAgo     time.Duration // 距最近一次失败的时间，0 表示没有失败
+		exitError     bool
+		score         float64
+		recentFailure bool
+	}{
+		{"never_tested", 0, 0, false, neverTestedScore, false},
+		{"never_tested_in_queue", 0, 0, true, neverTestedScore, false},
+		{"stale_half", 3 * time.Hour, 0, false, 0.5, false},
+		{"stale_full", 6 * time.Hour, 0, false, 1, false},
+		{"stale_capped", 100 * 24 * time.Hour, 0, false, maxStaleScore, false},
+		{"recent_failure", 3 * time.Hour, 3 * time.Hour, false, 0.5 + failureBonus, true},
+		// 失败早于最后一次检测，说明之后已经检测成功
+		{"failure_before_last_test", 30 * time.Minute, 40 * time.Minute, false, 0.5 / 6, false},
+		{"exit_error", 3 * time.Hour, 0, true, 0.5 + exitErrorBonus, false},
+		{"failure_and_exit_error", 3 * time.Hour, 3 * time.Hour, true, 0.5 + failureBonus + exitErrorBonus, true},
+		// 刚检测过的城市不加分
+		{"within_min_retest", 6 * time.Minute, 6 * time.Minute, true, 1.0 / 60, true},
+		{"at_min_retest", minRetestInterval, minRetestInterval, true, 1.0/36 + failureBonus + exitErrorBonus, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{cities: []database.CityLastTest{city(101, tt.age)}}
+			if tt.failedAgo > 0 {
+				store.failures = map[int]time.Time{101: testNow.Add(-tt.failedAgo)}
+			}
+			if tt.exitError {
+				store.queue = []database.RecheckEntry{{CityID: 101}}
+			}
+			now := testNow
+			states, err := newTestScheduler(store, &now).Queue(0, database.ProjectFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(states) != 1 {
+				t.Fatalf("队列为 %+v", states)
+			}
+			state := states[0]
+			if diff := state.Score - tt.score; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("分值为 %v，期望 %v", state.Score, tt.score)
+			}
+			if state.RecentFailure != tt.recentFailure {
+				t.Errorf("RecentFailure 为 %v，期望 %v", state.RecentFailure, tt.recentFailure)
+			}
+			if tt.age > 0 && state.ExitError != tt.exitError {
+				t.Errorf("ExitError 为 %v，期望 %v", state.ExitError, tt.exitError)
+			}
+		})
+	}
+}
+
+func TestSchedulerNextOrder(t *testing.T) {
+	store := &fakeStore{
+		cities: []database.CityLastTest{
+			city(101, 3*time.Hour),      // 0.5
+			city(102, 0),                // 从未检测
+			city(103, 2*time.Hour),      // 0.33 + 失败加分
+			city(104, 5*time.Hour),      // 0.83 + 复查加分
+			city(105, 100*24*time.Hour), // 上限 10
+			city(106, 5*time.Minute),    // 刚检测过，复查不加分
+			{CityID: 201, ProjectID: 1, LineID: 1, LastTestTime: testNow.Add(-24 * time.Hour)}, // 其他项目
+		},
+		failures: map[int]time.Time{103: testNow.Add(-time.Hour)},
+		queue:    []database.RecheckEntry{{CityID: 104}, {CityID: 106}},
+	}
+	now := testNow
+	s := newTestScheduler(store, &now)
+	filter := database.ProjectFilter{ProjectID: testProjectID, LineID: testLineID}
+
+	// 选中的城市记为刚检测过，依次排到队尾
+	want := []int{102, 105, 104, 103, 101, 106}
+	for i, cityID := range want {
+		got, err := s.Next(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != cityID {
+			t.Fatalf("第 %d 次选中城市 %d，期望 %d", i+1, got, cityID)
+		}
+		now = now.Add(time.Second)
+	}
+	if store.loads != 1 {
+		t.Fatalf("加载检测时间 %d 次，刷新间隔内期望 1 次", store.loads)
+	}
+	if want := testNow.Add(-time.Hour); !store.failuresSince.Equal(want) {
+		t.Fatalf("查询失败记录的起始时间为 %s，期望 %s", store.failuresSince, want)
+	}
+
+	// 不限项目时其他项目的城市同样参与排序
+	if got, err := s.Next(database.ProjectFilter{}); err != nil || got != 201 {
+		t.Fatalf("Next() = %d, %v，期望 201", got, err)
+	}
+}
+
+func TestSchedulerPickedClearedAfterResult(t *testing.T) {
+	store := &fakeStore{cities: []database.CityLastTest{city(101, 3*time.Hour), city(102, 2*time.Hour)}}
+	now := testNow
+	s := newTestScheduler(store, &now)
+
+	if got, _ := s.Next(database.ProjectFilter{}); got != 101 {
+		t.Fatalf("选中城市 %d，期望 101", got)
+	}
+	// 结果入库后重新加载，分配记录被清除
+	now = now.Add(refreshInterval)
+	store.cities = []database.CityLastTest{{CityID: 101, LastTestTime: now}, city(102, 2*time.Hour)}
+	if _, err := s.Queue(0, database.ProjectFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.picked[101]; ok || store.loads != 2 {
+		t.Fatalf("分配记录为 %v，加载 %d 次", s.picked, store.loads)
+	}
+}
+
+func TestSchedulerNoCities(t *testing.T) {
+	now := testNow
+	s := newTestScheduler(&fakeStore{cities: []database.CityLastTest{city(101, time.Hour)}}, &now)
+	if _, err := s.Next(database.ProjectFilter{ProjectID: 1}); err == nil {
+		t.Fatal("筛选范围内没有城市时应返回错误")
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	tests := []struct {
+		age  time.Duration
+		want string
+	}{
+		{30 * time.Second, "30秒前"},
+		{5 * time.Minute, "5分钟前"},
+		{2*time.Hour + 3*time.Minute, "2小时3分钟前"},
+		{50 * time.Hour, "2天前"},
+	}
+	for _, tt := range tests {
+		if got := FormatAge(testNow.Add(-tt.age), testNow); got != tt.want {
+			t.Errorf("FormatAge(%s) = %q，期望 %q", tt.age, got, tt.want)
+		}
+	}
+	if got := FormatAge(time.Time{}, testNow); got != "从未检测" {
+		t.Errorf("零值格式化为 %q", got)
+	}
+}
@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// 下载错误码，与 curl 的退出码保持一致，方便沿用原有的复查判定逻辑
+const (
+	ExitCouldntConnect = 7  // 无法连接到代理
+	ExitPartialFile    = 18 // 传输中断，只收到部分数据
+	ExitTimeout        = 28 // 下载超时
+	ExitProxyHandshake = 97 // SOCKS5 握手或认证失败
+	ExitOther          = 1  // 其他错误
+)
+
+// DefaultDownloadTimeout 单次下载的最长时间，与原 curl 的 -m 120 保持一致
+const DefaultDownloadTimeout = 120 * time.Second
+
+// DownloadError 下载失败时返回的错误，Code 对应 curl 的退出码
+type DownloadError struct {
+	Code int
+	Err  error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("下载失败(退出码 %d): %v", e.Code, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode 返回与 curl 对应的退出码
+func (e *DownloadError) ExitCode() int {
+	return e.Code
+}
+
+// IsRecheckCode 判断退出码是否需要写入复查队列等待复查
+func IsRecheckCode(code int) bool {
+	return code == ExitPartialFile || code == ExitTimeout || code == ExitProxyHandshake
+}
+
+// Download 通过 SOCKS5 代理下载 url 并丢弃内容，返回下载速率（Mbps）和各阶段耗时。
+// 与 curl 一样不检查 HTTP 状态码，非 2xx 响应也按成功计算速率
+func Download(ctx context.Context, url, user, pass, endpointAddr string, timeout time.Duration) (float64, Timing, error) {
+	if timeout <= 0 {
+		timeout = DefaultDownloadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// 拨号在 http.Transport 的协程中执行，ctx 超时后 Do 返回时拨号可能仍在进行，状态需加锁访问
+	state := &dialState{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, t, forward, err := dialTimed(ctx, user, pass, endpointAddr, network, addr)
+			state.dialed(t, forward.connected(), err)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, Timing{}, &DownloadError{Code: ExitOther, Err: err}
+	}
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: state.firstByte,
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	start := time.Now()
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		timing, connectErr, handshakeErr := state.result()
+		return 0, timing, classifyDownloadError(ctx, err, connectErr, handshakeErr)
+	}
+	timing, _, _ := state.result()
+	defer resp.Body.Close()
+
+	// 不检查状态码，下载地址失效时表现为速率过低，由 good_line/bad_line 的判定处理
+	written, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start).Seconds()
+	if err != nil {
+		dlErr := classifyDownloadError(ctx, err, nil, nil)
+		if dlErr.Code == ExitOther && written > 0 {
+			// 已经收到部分数据后连接中断，按传输不完整处理
+			dlErr.Code = ExitPartialFile
+		}
+		return 0, timing, dlErr
+	}
+	if resp.ContentLength > 0 && written < resp.ContentLength {
+		return 0, timing, &DownloadError{Code: ExitPartialFile, Err: fmt.Errorf("仅收到 %d/%d 字节", written, resp.ContentLength)}
+	}
+	if elapsed <= 0 {
+		return 0, timing, nil
+	}
+
+	// 与 curl 的 speed_download 一致：总字节数除以总耗时，再换算为 Mbps
+	speed := float64(written) / elapsed
+	return speed * 8 / (1024 * 1024), timing, nil
+}
+
+// dialState 记录拨号的各阶段耗时和失败原因
+type dialState struct {
+	mutex        sync.Mutex
+	timing       Timing
+	tunnelReady  time.Time // 隧道建立完成的时间，用于计算首字节耗时
+	connectErr   error     // 连接代理失败
+	handshakeErr error     // 已连接代理，握手或认证失败
+}
+
+// dialed 记录一次拨号的结果，connected 表示是否已连接到代理
+func (s *dialState) dialed(t Timing, connected bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case err == nil:
+		s.timing = t
+		s.tunnelReady = time.Now()
+	case connected:
+		s.handshakeErr = err
+	default:
+		s.connectErr = err
+	}
+}
+
+// firstByte 收到响应的第一个字节时记录首字节耗时
+func (s *dialState) firstByte() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.tunnelReady.IsZero() {
+		s.timing.FirstByte = time.Since(s.tunnelReady)
+	}
+}
+
+// result 返回各阶段耗时和拨号失败的原因
+func (s *dialState) result() (Timing, error, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.timing, s.connectErr, s.handshakeErr
+}
+
+// classifyDownloadError 将下载过程中的错误映射为 curl 风格的退出码
+func classifyDownloadError(ctx context.Context, err, connectErr, handshakeErr error) *DownloadError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &DownloadError{Code: ExitTimeout, Err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &DownloadError{Code: ExitTimeout, Err: err}
+	}
+	if handshakeErr != nil {
+		return &DownloadError{Code: ExitProxyHandshake, Err: handshakeErr}
+	}
+	if connectErr != nil {
+		return &DownloadError{Code: ExitCouldntConnect, Err: connectErr}
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return &DownloadError{Code: ExitPartialFile, Err: err}
+	}
+	return &DownloadError{Code: ExitOther, Err: err}
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"monitoring_system/fakesocks"
+)
+
+// startProxy 启动假 SOCKS5 代理，测试结束时关闭
+func startProxy(t *testing.T, imp fakesocks.Impairments) string {
+	t.Helper()
+	proxy := fakesocks.NewServer(fakesocks.Config{Impairments: imp})
+	if err := proxy.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	return proxy.Addr()
+}
+
+// closedAddr 返回一个没有监听的本地地址
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func newDownloadServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(make([]byte, 256*1024)))
+	})
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		// 声明 1000 字节，只发送 10 字节后关闭连接
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n0123456789")
+		buf.Flush()
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, string(make([]byte, 64*1024)), http.StatusNotFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownload(t *testing.T) {
+	server := newDownloadServer(t)
+	proxy := startProxy(t, fakesocks.Impairments{})
+
+	speed, timing, err := Download(context.Background(), server.URL+"/file", "1001", "pass", proxy, time.Second)
+	if err != nil {
+		t.Fatalf("下载出错: %v", err)
+	}
+	if speed <= 0 {
+		t.Fatalf("下载速率为 %f", speed)
+	}
+	if timing.Connect <= 0 || timing.FirstByte <= 0 {
+		t.Fatalf("各阶段耗时为 %+v", timing)
+	}
+}
+
+func TestDownloadExitCodes(t *testing.T) {
+	server := newDownloadServer(t)
+	tests := []struct {
+		name     string
+		path     string
+		endpoint string
+		want     int
+	}{
+		{"partial_file", "/short", startProxy(t, fakesocks.Impairments{}), ExitPartialFile},
+		{"reset_after", "/file", startProxy(t, fakesocks.Impairments{ResetAfter: 4096}), ExitPartialFile},
+		{"timeout", "/slow", startProxy(t, fakesocks.Impairments{}), ExitTimeout},
+		// 超时发生在代理握手期间
+		{"handshake_timeout", "/file", startProxy(t, fakesocks.Impairments{Latency: time.Second}), ExitTimeout},
+		{"auth_fail", "/file", startProxy(t, fakesocks.Impairments{AuthFail: true}), ExitProxyHandshake},
+		{"refuse_connect", "/file", startProxy(t, fakesocks.Impairments{RefuseConnect: true}), ExitProxyHandshake},
+		{"proxy_refused", "/file", closedAddr(t), ExitCouldntConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			speed, _, err := Download(context.Background(), server.URL+tt.path, "1001", "pass", tt.endpoint, 300*time.Millisecond)
+			var dlErr *DownloadError
+			if !errors.As(err, &dlErr) {
+				t.Fatalf("错误为 %v，期望 DownloadError", err)
+			}
+			if dlErr.ExitCode() != tt.want {
+				t.Fatalf("退出码为 %d，期望 %d: %v", dlErr.ExitCode(), tt.want, err)
+			}
+			if speed != 0 {
+				t.Fatalf("下载失败时速率为 %f", speed)
+			}
+			if IsRecheckCode(tt.want) != (tt.want != ExitCouldntConnect) {
+				t.Fatalf("退出码 %d 的复查判定错误", tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadIgnoresStatusCode(t *testing.T) {
+	server := newDownloadServer(t)
+	proxy := startProxy(t, fakesocks.Impairments{})
+
+	// 与不带 -f 的 curl 一致，非 2xx 响应的响应体同样计入下载速率
+	speed, _, err := Download(context.Background(), server.URL+"/missing", "1001", "pass", proxy, time.Second)
+	if err != nil {
+		t.Fatalf("404 响应返回错误: %v", err)
+	}
+	if speed <= 0 {
+		t.Fatalf("404 响应的下载速率为 %f", speed)
+	}
+}
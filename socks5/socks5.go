@@ -1,71 +1,91 @@
 package socks5
 
 import (
-	"fmt"
+	"context"
+	"net"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"golang.org/x/net/proxy"
 )
 
-// TestSOCKS5 对指定的 SOCKS5 代理进行测试
-func TestSOCKS5(user, pass, endpointAddr, targetAddr, nodeName, outboundIP string, testCount int) (float64, int64, error) {
-	totalTime := int64(0)
-	successCount := 0
+// Timing 单次 SOCKS5 连接各阶段耗时
+type Timing struct {
+	Connect      time.Duration // 与代理端点建立 TCP 连接
+	Handshake    time.Duration // 方法协商与用户名密码认证
+	ConnectReply time.Duration // 发送 CONNECT 到收到代理响应
+	FirstByte    time.Duration // 隧道建立后到收到下载首字节，仅下载测试有值
+}
 
-	for i := 0; i < testCount; i++ {
-		start := time.Now()
-		dialer, err := proxy.SOCKS5("tcp", endpointAddr, &proxy.Auth{User: user, Password: pass}, proxy.Direct)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"user":         user,
-				"endpointAddr": endpointAddr,
-				"testIndex":    i,
-				"error":        err,
-			}).Error("创建 SOCKS5 拨号器失败")
-			continue
-		}
+// Total 返回建立隧道的总耗时
+func (t Timing) Total() time.Duration {
+	return t.Connect + t.Handshake + t.ConnectReply
+}
 
-		conn, err := dialer.Dial("tcp", targetAddr)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				// "user":         user,
-				// "endpointAddr": endpointAddr,
-				// "targetAddr":   targetAddr,
-				// "testIndex":    i,
-				"error": err,
-			}).Error(" SOCKS5代理测试失败")
-			continue
-		}
-		conn.Close()
+// tracingConn 记录最后一次写入的时间，握手最后一次写入即为 CONNECT 请求
+type tracingConn struct {
+	net.Conn
+	lastWrite time.Time
+}
 
-		elapsed := time.Since(start).Milliseconds()
-		totalTime += elapsed
-		successCount++
-	}
+func (c *tracingConn) Write(b []byte) (int, error) {
+	c.lastWrite = time.Now()
+	return c.Conn.Write(b)
+}
 
-	if successCount == 0 {
-		errMsg := fmt.Sprintf("所有测试请求均失败，连接信息: %s，账号: %s，密码: %s", endpointAddr, user, pass)
-		logrus.WithFields(logrus.Fields{
-			"user":         user,
-			"endpointAddr": endpointAddr,
-			"targetAddr":   targetAddr,
-		}).Error(errMsg)
-		return 0, 0, fmt.Errorf(errMsg)
+// tracingDialer 作为 SOCKS5 的前置拨号器，记录到代理端点的 TCP 连接耗时
+type tracingDialer struct {
+	start       time.Time
+	connectedAt time.Time
+	conn        *tracingConn
+}
+
+func (d *tracingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	d.start = time.Now()
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
 	}
+	d.connectedAt = time.Now()
+	d.conn = &tracingConn{Conn: conn}
+	return d.conn, nil
+}
 
-	successRate := float64(successCount) / float64(testCount) * 100
-	avgResponseTime := totalTime / int64(successCount)
+func (d *tracingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
 
-	logrus.WithFields(logrus.Fields{
-		// "user":            user,
-		// "endpointAddr":    endpointAddr,
-		// "targetAddr":      targetAddr,
-		// "successRate":     successRate,
-		// "avgResponseTime": avgResponseTime,
-		// "NodeName":        nodeName,
-		// "OutboundIP":      outboundIP,
-	}).Info("【SOCKS5代理测试成功】")
+// connected 判断到代理端点的 TCP 连接是否已建立
+func (d *tracingDialer) connected() bool {
+	return d.conn != nil
+}
+
+// timing 根据记录的时间点计算各阶段耗时
+func (d *tracingDialer) timing(done time.Time) Timing {
+	t := Timing{Connect: d.connectedAt.Sub(d.start)}
+	if d.conn != nil && !d.conn.lastWrite.IsZero() {
+		t.Handshake = d.conn.lastWrite.Sub(d.connectedAt)
+		t.ConnectReply = done.Sub(d.conn.lastWrite)
+	}
+	return t
+}
+
+// dialTimed 通过 SOCKS5 代理连接 targetAddr，并返回各阶段耗时
+func dialTimed(ctx context.Context, user, pass, endpointAddr, network, targetAddr string) (net.Conn, Timing, *tracingDialer, error) {
+	forward := &tracingDialer{}
+	dialer, err := proxy.SOCKS5("tcp", endpointAddr, &proxy.Auth{User: user, Password: pass}, forward)
+	if err != nil {
+		return nil, Timing{}, forward, err
+	}
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, targetAddr)
+	if err != nil {
+		return nil, Timing{}, forward, err
+	}
+	return conn, forward.timing(time.Now()), forward, nil
+}
 
-	return successRate, avgResponseTime, nil
+// DialTimed 通过 SOCKS5 代理连接 targetAddr，并返回 TCP 连接、认证、CONNECT 各阶段耗时
+func DialTimed(ctx context.Context, user, pass, endpointAddr, targetAddr string) (net.Conn, Timing, error) {
+	conn, timing, _, err := dialTimed(ctx, user, pass, endpointAddr, "tcp", targetAddr)
+	return conn, timing, err
 }
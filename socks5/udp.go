@@ -0,0 +1,202 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 协议常量
+const (
+	socksVersion        = 0x05
+	authNone            = 0x00
+	authUsernamePass    = 0x02
+	authNoAcceptable    = 0xff
+	cmdUDPAssociate     = 0x03
+	atypIPv4            = 0x01
+	atypDomain          = 0x03
+	atypIPv6            = 0x04
+	authUsernamePassVer = 0x01
+)
+
+// appendAddr 按 SOCKS5 的地址格式编码 host:port
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("无效的端口: %s", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, atypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, atypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("域名过长: %s", host)
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readAddr 从 r 中读取 SOCKS5 格式的地址
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("未知的地址类型: %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// UDPExchange 通过 SOCKS5 UDP ASSOCIATE 向 targetAddr 发送一个数据报并等待响应
+func UDPExchange(ctx context.Context, user, pass, endpointAddr, targetAddr string, payload []byte) ([]byte, Timing, error) {
+	var timing Timing
+	var dialer net.Dialer
+	start := time.Now()
+	ctrl, err := dialer.DialContext(ctx, "tcp", endpointAddr)
+	if err != nil {
+		return nil, timing, err
+	}
+	defer ctrl.Close()
+	timing.Connect = time.Since(start)
+	if deadline, ok := ctx.Deadline(); ok {
+		ctrl.SetDeadline(deadline)
+	}
+
+	// 协商认证方式
+	handshakeStart := time.Now()
+	if _, err := ctrl.Write([]byte{socksVersion, 2, authNone, authUsernamePass}); err != nil {
+		return nil, timing, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(ctrl, reply[:]); err != nil {
+		return nil, timing, err
+	}
+	if reply[0] != socksVersion || reply[1] == authNoAcceptable {
+		return nil, timing, errors.New("代理不接受任何认证方式")
+	}
+	if reply[1] == authUsernamePass {
+		req := []byte{authUsernamePassVer, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := ctrl.Write(req); err != nil {
+			return nil, timing, err
+		}
+		if _, err := io.ReadFull(ctrl, reply[:]); err != nil {
+			return nil, timing, err
+		}
+		if reply[1] != 0x00 {
+			return nil, timing, errors.New("用户名密码认证失败")
+		}
+	}
+	timing.Handshake = time.Since(handshakeStart)
+
+	// 请求 UDP 转发
+	associateStart := time.Now()
+	req, _ := appendAddr([]byte{socksVersion, cmdUDPAssociate, 0x00}, "0.0.0.0:0")
+	if _, err := ctrl.Write(req); err != nil {
+		return nil, timing, err
+	}
+	var head [3]byte
+	if _, err := io.ReadFull(ctrl, head[:]); err != nil {
+		return nil, timing, err
+	}
+	if head[1] != 0x00 {
+		return nil, timing, fmt.Errorf("UDP ASSOCIATE 被拒绝，响应码: %d", head[1])
+	}
+	relayAddr, err := readAddr(ctrl)
+	if err != nil {
+		return nil, timing, err
+	}
+	timing.ConnectReply = time.Since(associateStart)
+
+	// 代理返回未指定地址时，使用代理端点的主机
+	relayHost, relayPort, _ := net.SplitHostPort(relayAddr)
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		endpointHost, _, _ := net.SplitHostPort(endpointAddr)
+		relayAddr = net.JoinHostPort(endpointHost, relayPort)
+	}
+
+	relay, err := dialer.DialContext(ctx, "udp", relayAddr)
+	if err != nil {
+		return nil, timing, err
+	}
+	defer relay.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		relay.SetDeadline(deadline)
+	}
+
+	packet, err := appendAddr([]byte{0x00, 0x00, 0x00}, targetAddr)
+	if err != nil {
+		return nil, timing, err
+	}
+	packet = append(packet, payload...)
+	sendAt := time.Now()
+	if _, err := relay.Write(packet); err != nil {
+		return nil, timing, err
+	}
+
+	buf := make([]byte, 64*1024)
+	n, err := relay.Read(buf)
+	if err != nil {
+		return nil, timing, err
+	}
+	timing.FirstByte = time.Since(sendAt)
+
+	// 去掉 UDP 转发头：RSV(2) FRAG(1) + 地址
+	if n < 3 {
+		return nil, timing, errors.New("UDP 响应过短")
+	}
+	body := bytes.NewReader(buf[3:n])
+	if _, err := readAddr(body); err != nil {
+		return nil, timing, err
+	}
+	data, _ := io.ReadAll(body)
+	return data, timing, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"monitoring_system/auth"
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/fakesocks"
+	"monitoring_system/mockapi"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 子命令关闭服务时等待进行中请求的最长时间
+const subcommandShutdownTimeout = 5 * time.Second
+
+// subcommands 可用的子命令，不带子命令时启动监控服务
+var subcommands = map[string]func(ctx context.Context, args []string) error{
+	"mockapi":      runMockAPI,
+	"fakesocks":    runFakeSOCKS,
+	"migrate":      runMigrate,
+	"webhook":      runWebhookReceiver,
+	"hashpassword": runHashPassword,
+}
+
+// runSubcommand 执行 os.Args 中的子命令，没有子命令时返回 false
+func runSubcommand(ctx context.Context) bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	run, ok := subcommands[os.Args[1]]
+	if !ok {
+		return false
+	}
+	if err := run(ctx, os.Args[2:]); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Subcommand": os.Args[1],
+			"Error":      err,
+		}).Fatal("子命令执行失败")
+	}
+	return true
+}
+
+// runMockAPI 启动模拟上游接口，用于离线开发和联调
+func runMockAPI(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("mockapi", flag.ContinueOnError)
+	addr := flags.String("addr", ":18080", "监听地址")
+	scenarioPath := flags.String("scenario", "", "场景文件，为空时使用内置场景")
+	endpoint := flags.String("endpoint", "127.0.0.1:1080", "内置场景中线路的 SOCKS5 地址")
+	socksAddr := flags.String("socks", "", "同时启动假 SOCKS5 代理的监听地址，用户名密码取自场景中的线路")
+	redirect := flags.String("redirect", "", "假 SOCKS5 代理将所有 CONNECT 改为连接该地址")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var scenario *mockapi.Scenario
+	if *scenarioPath != "" {
+		var err error
+		if scenario, err = mockapi.LoadScenario(*scenarioPath); err != nil {
+			return err
+		}
+	} else {
+		scenario = mockapi.DefaultScenario(*endpoint, configTradeIDs()...)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"Addr":      *addr,
+		"Provinces": len(scenario.Provinces),
+		"Nodes":     len(scenario.Nodes),
+		"Lines":     len(scenario.Lines),
+		"Faults":    len(scenario.Faults),
+	}).Info("【MockAPI】模拟上游接口已启动")
+
+	if *socksAddr != "" {
+		users := make(map[string]string, len(scenario.Lines))
+		for _, line := range scenario.Lines {
+			users[strconv.Itoa(line.TradeID)] = line.SSPass
+		}
+		proxy := fakesocks.NewServer(fakesocks.Config{Users: users, Redirect: *redirect})
+		if err := proxy.Listen(*socksAddr); err != nil {
+			return err
+		}
+		defer proxy.Close()
+		logrus.WithFields(logrus.Fields{"Addr": proxy.Addr()}).Info("【FakeSOCKS5】假 SOCKS5 代理已启动")
+	}
+	return serve(ctx, &http.Server{Addr: *addr, Handler: mockapi.NewServer(scenario)})
+}
+
+// runFakeSOCKS 启动假 SOCKS5 代理，可注入延迟、限速、中途重置、认证失败和拒绝 CONNECT
+func runFakeSOCKS(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("fakesocks", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:1080", "监听地址")
+	configPath := flags.String("config", "", "配置文件，可按用户名设置异常；指定后忽略下列异常参数")
+	users := flags.String("users", "", "允许的用户名密码，格式 user:pass,user:pass，为空时接受任意用户")
+	redirect := flags.String("redirect", "", "将所有 CONNECT 改为连接该地址")
+	latency := flags.Duration("latency", 0, "每次握手响应前的延迟")
+	bandwidth := flags.Int64("bandwidth", 0, "下行带宽上限，字节/秒")
+	resetAfter := flags.Int64("reset-after", 0, "下行传输该字节数后重置连接")
+	authFail := flags.Bool("auth-fail", false, "认证总是失败")
+	refuse := flags.Bool("refuse", false, "CONNECT 总是返回连接被拒绝")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var config fakesocks.Config
+	if *configPath != "" {
+		var err error
+		if config, err = fakesocks.LoadConfig(*configPath); err != nil {
+			return err
+		}
+	} else {
+		config = fakesocks.Config{
+			Redirect: *redirect,
+			Impairments: fakesocks.Impairments{
+				Latency:       *latency,
+				Bandwidth:     *bandwidth,
+				ResetAfter:    *resetAfter,
+				AuthFail:      *authFail,
+				RefuseConnect: *refuse,
+			},
+		}
+		if *users != "" {
+			config.Users = make(map[string]string)
+			for _, pair := range strings.Split(*users, ",") {
+				user, pass, ok := strings.Cut(pair, ":")
+				if !ok {
+					return fmt.Errorf("无效的用户名密码: %s", pair)
+				}
+				config.Users[user] = pass
+			}
+		}
+	}
+
+	proxy := fakesocks.NewServer(config)
+	logrus.WithFields(logrus.Fields{
+		"Addr":        *addr,
+		"Users":       len(config.Users),
+		"Impairments": fmt.Sprintf("%+v", config.Impairments),
+	}).Info("【FakeSOCKS5】假 SOCKS5 代理已启动")
+	return proxy.Run(ctx, *addr)
+}
+
+// runMigrate 查看或执行数据库迁移：migrate status | migrate up [-to 版本号]
+func runMigrate(ctx context.Context, args []string) error {
+	action := "status"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	target := flags.Int("to", 0, "迁移到指定版本，0 表示最新版本")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := database.Open(config.DatabaseCFG)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch action {
+	case "status":
+		statuses, err := db.MigrationStatuses()
+		if err != nil {
+			return err
+		}
+		current, latest, err := db.CheckSchema()
+		fmt.Printf("数据库类型: %s，当前版本: %d，最新版本: %d\n", db.DBType(), current, latest)
+		for _, status := range statuses {
+			state := "未执行"
+			if status.Applied {
+				state = "已执行 " + status.AppliedAt
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return err
+	case "up":
+		applied, err := db.Migrate(*target)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("没有需要执行的迁移")
+		}
+		for _, m := range applied {
+			fmt.Printf("已执行 %04d_%s\n", m.Version, m.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("未知的操作: %s，可用操作为 status、up", action)
+	}
+}
+
+// runWebhookReceiver 启动本地 webhook 接收端，打印收到的告警，用于调试告警配置
+func runWebhookReceiver(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("webhook", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:18090", "监听地址")
+	fail := flags.Int("fail", 0, "前 N 个请求返回 500，用于验证重试")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var mutex sync.Mutex
+	received := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		received++
+		n := received
+		mutex.Unlock()
+
+		fields := logrus.Fields{"N": n, "Path": r.URL.Path, "Query": r.URL.RawQuery}
+		if n <= *fail {
+			logrus.WithFields(fields).Warn("【Webhook】模拟推送失败")
+			http.Error(w, "模拟推送失败", http.StatusInternalServerError)
+			return
+		}
+		logrus.WithFields(fields).Info("【Webhook】收到告警: ", string(body))
+		// 同时满足钉钉、企业微信（errcode）和飞书（code）的成功响应
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok","code":0,"msg":"success"}`))
+	})
+
+	logrus.WithFields(logrus.Fields{"Addr": *addr, "Fail": *fail}).Info("【Webhook】本地接收端已启动")
+	return serve(ctx, &http.Server{Addr: *addr, Handler: handler})
+}
+
+// runHashPassword 生成密码的 bcrypt 哈希，填入 config.yaml 的 auth.users[].password_hash。
+// 未指定 -password 时从标准输入读取一行，避免密码留在 shell 历史中
+func runHashPassword(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("hashpassword", flag.ContinueOnError)
+	password := flags.String("password", "", "要生成哈希的密码，为空时从标准输入读取")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("读取密码出错: %w", err)
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	if *password == "" {
+		return fmt.Errorf("密码不能为空")
+	}
+	hash, err := auth.HashPassword(*password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+// configTradeIDs 读取 config.yaml 中的 TradeIDs 和 watchTradeID，配置文件不存在时返回空
+func configTradeIDs() []int {
+	if _, err := os.Stat("config.yaml"); err != nil {
+		return nil
+	}
+	config, err := config.ReadConfig()
+	if err != nil {
+		return nil
+	}
+	return append(append([]int{}, config.TradeIDs...), config.WatchTradeID...)
+}
+
+// serve 运行 HTTP 服务直到 ctx 取消
+func serve(ctx context.Context, server *http.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), subcommandShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("关闭服务出错: %w", err)
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
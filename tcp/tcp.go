@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"os/exec"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -27,43 +27,34 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return f.TextFormatter.Format(entry)
 }
 
-// GetLocalIP 通过执行 curl 命令访问 ip.sb 获取本地服务器 IP 地址
+// GetLocalIP 通过访问 ip.sb 获取本地服务器 IP 地址
 func GetLocalIP() (string, error) {
-	// 构建 curl 命令
-	cmd := exec.Command("curl", "http://ip.sb")
-
-	// 获取命令的输出管道
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-		}).Error("获取 curl 命令输出管道出错")
-		return "", fmt.Errorf("获取 curl 命令输出管道出错: %w", err)
+	client := &http.Client{
+		Timeout: 10 * time.Second, // 设置超时时间为 10 秒
 	}
-
-	// 启动命令
-	if err := cmd.Start(); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-		}).Error("启动 curl 命令出错")
-		return "", fmt.Errorf("启动 curl 命令出错: %w", err)
+	req, err := http.NewRequest("GET", "http://ip.sb", nil)
+	if err != nil {
+		return "", fmt.Errorf("创建请求出错: %w", err)
 	}
+	// ip.sb 根据 User-Agent 决定返回纯文本还是网页
+	req.Header.Set("User-Agent", "curl/8.0")
 
-	// 读取命令输出
-	body, err := io.ReadAll(stdout)
+	resp, err := client.Do(req)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
-		}).Error("读取 curl 命令输出出错")
-		return "", fmt.Errorf("读取 curl 命令输出出错: %w", err)
+		}).Error("请求 ip.sb 出错")
+		return "", fmt.Errorf("请求 ip.sb 出错: %w", err)
 	}
+	defer resp.Body.Close()
 
-	// 等待命令执行完成
-	if err := cmd.Wait(); err != nil {
+	// 读取响应内容
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
-		}).Error("执行 curl 命令出错")
-		return "", fmt.Errorf("执行 curl 命令出错: %w", err)
+		}).Error("读取 ip.sb 响应出错")
+		return "", fmt.Errorf("读取 ip.sb 响应出错: %w", err)
 	}
 
 	ip := strings.TrimSpace(string(body))
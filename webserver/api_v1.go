@@ -0,0 +1,672 @@
+package webserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"monitoring_system/auth"
+	"monitoring_system/database"
+)
+
+const maxAPIBodySize = 1 << 20
+
+// 未填写 reason 时写入 line_events 的原因
+const (
+	defaultAPIAddReason    = "通过 API 添加"
+	defaultAPIRemoveReason = "通过 API 删除"
+)
+
+// APIError /api/v1 出错时的响应
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// lineRequest 添加 good_line、bad_line、bad_ips 记录的请求体
+type lineRequest struct {
+	CityID     int    `json:"city_id"`
+	OutboundIP string `json:"outbound_ip"` // bad_line、bad_ips 必填
+	Note       string `json:"note"`
+	Reason     string `json:"reason"` // 写入 line_events 的原因
+}
+
+// noteRequest 修改备注的请求体
+type noteRequest struct {
+	Note *string `json:"note"`
+}
+
+// downloadURLRequest 添加或修改下载地址的请求体，修改时只更新填写的字段
+type downloadURLRequest struct {
+	URL     string  `json:"url"`
+	Enabled *bool   `json:"enabled"`
+	Note    *string `json:"note"`
+}
+
+// handleAPIV1 处理 /api/v1/ 下的请求，管理 good_line、bad_line、bad_ips、下载地址、按需检测和复查队列：
+//
+//	GET/POST          /api/v1/good_line        PATCH/DELETE /api/v1/good_line/{city_id}
+//	GET/POST          /api/v1/bad_line         PATCH/DELETE /api/v1/bad_line/{outbound_ip}
+//	GET/POST          /api/v1/bad_ips          PATCH/DELETE /api/v1/bad_ips/{outbound_ip}?city_id=
+//	GET/POST          /api/v1/download_urls    PATCH/DELETE /api/v1/download_urls/{id}
+//	GET/POST          /api/v1/probes           GET/DELETE   /api/v1/probes/{id}    GET /api/v1/probes/{id}/events
+//	GET               /api/v1/recheck_queue    GET/PATCH/DELETE /api/v1/recheck_queue/{city_id}?outbound_ip=
+//
+// 请求体和响应均为 JSON，出错时返回 {"error": "..."}
+func handleAPIV1(w http.ResponseWriter, r *http.Request) {
+	resource, key, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+	key, action, _ := strings.Cut(key, "/")
+	if action != "" && (resource != "probes" || action != "events") {
+		writeAPIError(w, http.StatusNotFound, "接口不存在: "+r.URL.Path)
+		return
+	}
+
+	var handlers map[string]http.HandlerFunc
+	switch resource {
+	case "good_line":
+		handlers = map[string]http.HandlerFunc{http.MethodGet: listGoodLine, http.MethodPost: addGoodLine}
+		if key != "" {
+			handlers = map[string]http.HandlerFunc{http.MethodPatch: annotateGoodLine, http.MethodDelete: removeGoodLine}
+		}
+	case "bad_line":
+		handlers = map[string]http.HandlerFunc{http.MethodGet: listBadLine, http.MethodPost: addBadLine}
+		if key != "" {
+			handlers = map[string]http.HandlerFunc{http.MethodPatch: annotateBadLine, http.MethodDelete: removeBadLine}
+		}
+	case "bad_ips":
+		handlers = map[string]http.HandlerFunc{http.MethodGet: listBadIPs, http.MethodPost: addBadIP}
+		if key != "" {
+			handlers = map[string]http.HandlerFunc{http.MethodPatch: annotateBadIP, http.MethodDelete: removeBadIP}
+		}
+	case "download_urls":
+		handlers = map[string]http.HandlerFunc{http.MethodGet: listDownloadURLs, http.MethodPost: addDownloadURL}
+		if key != "" {
+			handlers = map[string]http.HandlerFunc{http.MethodPatch: updateDownloadURLByID, http.MethodDelete: removeDownloadURL}
+		}
+	case "probes":
+		handlers = map[string]http.HandlerFunc{http.MethodGet: listProbeJobs, http.MethodPost: submitProbeJob}
+		if key != "" {
+			handlers = map[string]http.HandlerFunc{http.MethodGet: getProbeJob, http.MethodDelete: cancelProbeJob}
+		}
+		if action != "" {
+			handlers = map[string]http.HandlerFunc{http.MethodGet: streamProbeJob}
+		}
+	case "recheck_queue":
+		handlers = map[string]http.HandlerFunc{http.MethodGet: listRecheckQueue}
+		if key != "" {
+			handlers = map[string]http.HandlerFunc{http.MethodGet: getRecheckEntry, http.MethodPatch: prioritizeRecheck, http.MethodDelete: removeRecheck}
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, "接口不存在: "+r.URL.Path)
+		return
+	}
+
+	handler, ok := handlers[r.Method]
+	if !ok {
+		var allowed []string
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete} {
+			if _, ok := handlers[method]; ok {
+				allowed = append(allowed, method)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("不支持 %s 方法，可用 %s", r.Method, strings.Join(allowed, "、")))
+		return
+	}
+	handler(w, r)
+}
+
+// apiKey 返回路径中资源名之后的部分，如 /api/v1/bad_line/1.2.3.4 中的 1.2.3.4
+func apiKey(r *http.Request) string {
+	_, key, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+	return key
+}
+
+// listGoodLine GET /api/v1/good_line
+func listGoodLine(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries, err := store.GoodLineEntries(filter)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []database.GoodLineEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// addGoodLine POST /api/v1/good_line，将城市加入 good_line
+func addGoodLine(w http.ResponseWriter, r *http.Request) {
+	var req lineRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	city, ok := lookupCity(w, req.CityID)
+	if !ok {
+		return
+	}
+	exists, err := store.CheckNodeIDExistsInGoodLine(req.CityID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if exists {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("城市 %d 已在 good_line 中", req.CityID))
+		return
+	}
+
+	if err := store.InsertIntoGoodLine(req.CityID, apiAudit(r, req.Reason, defaultAPIAddReason)); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Note != "" {
+		if err := store.SetGoodLineNote(req.CityID, req.Note); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, database.GoodLineEntry{CityID: city.ID, CityName: city.Name, Note: req.Note})
+}
+
+// annotateGoodLine PATCH /api/v1/good_line/{city_id}，修改备注
+func annotateGoodLine(w http.ResponseWriter, r *http.Request) {
+	cityID, ok := parseAPICityID(w, apiKey(r))
+	if !ok {
+		return
+	}
+	note, ok := decodeNote(w, r)
+	if !ok {
+		return
+	}
+	err := store.SetGoodLineNote(cityID, note)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("城市 %d 不在 good_line 中", cityID))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	city, _ := store.GetCity(cityID)
+	writeJSON(w, http.StatusOK, database.GoodLineEntry{CityID: cityID, CityName: city.Name, Note: note})
+}
+
+// removeGoodLine DELETE /api/v1/good_line/{city_id}?reason=，将城市移出 good_line
+func removeGoodLine(w http.ResponseWriter, r *http.Request) {
+	cityID, ok := parseAPICityID(w, apiKey(r))
+	if !ok {
+		return
+	}
+	exists, err := store.CheckNodeIDExistsInGoodLine(cityID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !exists {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("城市 %d 不在 good_line 中", cityID))
+		return
+	}
+	if err := store.DeleteFromGoodLine(cityID, apiAudit(r, r.URL.Query().Get("reason"), defaultAPIRemoveReason)); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listBadLine GET /api/v1/bad_line
+func listBadLine(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries, err := store.BadLineEntries(filter)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []database.BadLineEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// addBadLine POST /api/v1/bad_line，将出口 IP 加入 bad_line
+func addBadLine(w http.ResponseWriter, r *http.Request) {
+	var req lineRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	ip, ok := parseAPIIP(w, req.OutboundIP)
+	if !ok {
+		return
+	}
+	if _, ok := lookupCity(w, req.CityID); !ok {
+		return
+	}
+	exists, err := store.CheckNodeIDExistsInBadLine(ip)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if exists {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("出口 IP %s 已在 bad_line 中", ip))
+		return
+	}
+
+	if err := store.InsertIntoBadLine(ip, req.CityID, apiAudit(r, req.Reason, defaultAPIAddReason)); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Note != "" {
+		if err := store.SetBadLineNote(ip, req.Note); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, database.BadLineEntry{OutboundIP: ip, CityID: req.CityID, Note: req.Note})
+}
+
+// annotateBadLine PATCH /api/v1/bad_line/{outbound_ip}，修改备注
+func annotateBadLine(w http.ResponseWriter, r *http.Request) {
+	ip, ok := parseAPIIP(w, apiKey(r))
+	if !ok {
+		return
+	}
+	note, ok := decodeNote(w, r)
+	if !ok {
+		return
+	}
+	err := store.SetBadLineNote(ip, note)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("出口 IP %s 不在 bad_line 中", ip))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	entries, err := store.BadLineEntries(database.ProjectFilter{})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, entry := range entries {
+		if entry.OutboundIP == ip {
+			writeJSON(w, http.StatusOK, entry)
+			return
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Sprintf("出口 IP %s 不在 bad_line 中", ip))
+}
+
+// removeBadLine DELETE /api/v1/bad_line/{outbound_ip}?reason=，将出口 IP 移出 bad_line
+func removeBadLine(w http.ResponseWriter, r *http.Request) {
+	ip, ok := parseAPIIP(w, apiKey(r))
+	if !ok {
+		return
+	}
+	exists, err := store.CheckNodeIDExistsInBadLine(ip)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !exists {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("出口 IP %s 不在 bad_line 中", ip))
+		return
+	}
+	if err := store.DeleteFromBadLine(ip, apiAudit(r, r.URL.Query().Get("reason"), defaultAPIRemoveReason)); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listBadIPs GET /api/v1/bad_ips，包括已过期但尚未清理的记录
+func listBadIPs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries, err := store.BadIPEntries(filter, badIPTTL)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []database.BadIPEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// addBadIP POST /api/v1/bad_ips，记录一次出口 IP 命中，已有未过期的记录时累加命中次数
+func addBadIP(w http.ResponseWriter, r *http.Request) {
+	var req lineRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	ip, ok := parseAPIIP(w, req.OutboundIP)
+	if !ok {
+		return
+	}
+	if _, ok := lookupCity(w, req.CityID); !ok {
+		return
+	}
+
+	if err := store.InsertIntoBadIPs(ip, req.CityID, badIPTTL, apiAudit(r, req.Reason, defaultAPIAddReason)); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Note != "" {
+		if err := store.SetBadIPNote(ip, req.CityID, req.Note); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	entries, err := badIPEntries(ip, req.CityID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		writeAPIError(w, http.StatusInternalServerError, "写入 bad_ips 后未找到记录")
+		return
+	}
+	writeJSON(w, http.StatusCreated, entries[0])
+}
+
+// annotateBadIP PATCH /api/v1/bad_ips/{outbound_ip}?city_id=，修改备注，未指定 city_id 时修改该出口 IP 的全部记录
+func annotateBadIP(w http.ResponseWriter, r *http.Request) {
+	ip, cityID, ok := parseBadIPKey(w, r)
+	if !ok {
+		return
+	}
+	note, ok := decodeNote(w, r)
+	if !ok {
+		return
+	}
+	err := store.SetBadIPNote(ip, cityID, note)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("出口 IP %s 不在 bad_ips 中", ip))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	entries, err := badIPEntries(ip, cityID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// removeBadIP DELETE /api/v1/bad_ips/{outbound_ip}?city_id=&reason=，未指定 city_id 时删除该出口 IP 的全部记录
+func removeBadIP(w http.ResponseWriter, r *http.Request) {
+	ip, cityID, ok := parseBadIPKey(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := store.DeleteFromBadIPs(ip, cityID, apiAudit(r, r.URL.Query().Get("reason"), defaultAPIRemoveReason))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if deleted == 0 {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("出口 IP %s 不在 bad_ips 中", ip))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseBadIPKey 解析 bad_ips 接口路径中的出口 IP 和可选的 city_id 参数
+func parseBadIPKey(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	ip, ok := parseAPIIP(w, apiKey(r))
+	if !ok {
+		return "", 0, false
+	}
+	cityID := 0
+	if v := r.URL.Query().Get("city_id"); v != "" {
+		if cityID, ok = parseAPICityID(w, v); !ok {
+			return "", 0, false
+		}
+	}
+	return ip, cityID, true
+}
+
+// badIPEntries 获取出口 IP 的 bad_ips 记录，cityID 为 0 时返回全部城市的记录
+func badIPEntries(ip string, cityID int) ([]database.BadIPEntry, error) {
+	entries, err := store.BadIPEntries(database.ProjectFilter{}, badIPTTL)
+	if err != nil {
+		return nil, err
+	}
+	matched := []database.BadIPEntry{}
+	for _, entry := range entries {
+		if entry.OutboundIP == ip && (cityID == 0 || entry.CityID == cityID) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+// listDownloadURLs GET /api/v1/download_urls
+func listDownloadURLs(w http.ResponseWriter, r *http.Request) {
+	urls, err := store.DownloadURLs()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if urls == nil {
+		urls = []database.DownloadURL{}
+	}
+	writeJSON(w, http.StatusOK, urls)
+}
+
+// addDownloadURL POST /api/v1/download_urls，新增下载地址，未填写 enabled 时默认启用
+func addDownloadURL(w http.ResponseWriter, r *http.Request) {
+	var req downloadURLRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := validateDownloadURL(req.URL); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+	note := ""
+	if req.Note != nil {
+		note = *req.Note
+	}
+	u, err := store.AddDownloadURL(req.URL, note, enabled)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// updateDownloadURLByID PATCH /api/v1/download_urls/{id}，修改启用状态和备注
+func updateDownloadURLByID(w http.ResponseWriter, r *http.Request) {
+	u, ok := lookupDownloadURL(w, apiKey(r))
+	if !ok {
+		return
+	}
+	var req downloadURLRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.URL != "" {
+		writeAPIError(w, http.StatusBadRequest, "不能修改 url，请删除后重新添加")
+		return
+	}
+	if req.Enabled != nil {
+		u.Enabled = *req.Enabled
+	}
+	if req.Note != nil {
+		u.Note = *req.Note
+	}
+	err := store.UpdateDownloadURL(u.ID, u.Enabled, u.Note)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("下载地址 %d 不存在", u.ID))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+// removeDownloadURL DELETE /api/v1/download_urls/{id}
+func removeDownloadURL(w http.ResponseWriter, r *http.Request) {
+	u, ok := lookupDownloadURL(w, apiKey(r))
+	if !ok {
+		return
+	}
+	err := store.DeleteDownloadURL(u.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookupDownloadURL 解析路径中的下载地址 ID 并查询，出错时写入响应并返回 false
+func lookupDownloadURL(w http.ResponseWriter, key string) (database.DownloadURL, bool) {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil || id <= 0 {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("无效的下载地址 ID: %s", key))
+		return database.DownloadURL{}, false
+	}
+	u, err := store.GetDownloadURLByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("下载地址 %d 不存在", id))
+		return u, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return u, false
+	}
+	return u, true
+}
+
+// validateDownloadURL 校验下载地址，只接受带主机名的 http、https 地址
+func validateDownloadURL(raw string) error {
+	if raw == "" {
+		return fmt.Errorf("url 不能为空")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("无效的 url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url 只支持 http 和 https，实际为 %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("url 缺少主机名: %s", raw)
+	}
+	return nil
+}
+
+// lookupCity 校验城市 ID 存在于 cities 表，城市不存在时返回 404，出错时写入响应并返回 false
+func lookupCity(w http.ResponseWriter, cityID int) (database.CityInfo, bool) {
+	if cityID <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "city_id 必须为正整数")
+		return database.CityInfo{}, false
+	}
+	city, err := store.GetCity(cityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("城市 %d 不存在", cityID))
+		return city, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return city, false
+	}
+	return city, true
+}
+
+// parseAPICityID 解析城市 ID，出错时写入响应并返回 false
+func parseAPICityID(w http.ResponseWriter, v string) (int, bool) {
+	cityID, err := strconv.Atoi(v)
+	if err != nil || cityID <= 0 {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("无效的城市 ID: %s", v))
+		return 0, false
+	}
+	return cityID, true
+}
+
+// parseAPIIP 校验出口 IP，返回规范化后的地址，出错时写入响应并返回 false
+func parseAPIIP(w http.ResponseWriter, v string) (string, bool) {
+	ip := net.ParseIP(v)
+	if ip == nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("无效的出口 IP: %q", v))
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// apiAudit 生成通过 API 修改线路表时写入 line_events 的上下文
+func apiAudit(r *http.Request, reason, defaultReason string) database.LineAudit {
+	if reason == "" {
+		reason = defaultReason
+	}
+	// 启用认证后在原因中记录操作人
+	if principal := principalFrom(r.Context()); principal.Method != auth.MethodNone {
+		reason = fmt.Sprintf("%s（操作人 %s）", reason, principal.Name)
+	}
+	return database.LineAudit{Source: database.SourceAPI, Reason: reason}
+}
+
+// decodeNote 解析修改备注的请求体，note 为必填
+func decodeNote(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req noteRequest
+	if !decodeJSON(w, r, &req) {
+		return "", false
+	}
+	if req.Note == nil {
+		writeAPIError(w, http.StatusBadRequest, "缺少 note")
+		return "", false
+	}
+	return *req.Note, true
+}
+
+// decodeJSON 解析 JSON 请求体，不接受未知字段，出错时写入响应并返回 false
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			writeAPIError(w, http.StatusBadRequest, "请求体为空")
+		} else {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("解析请求体出错: %v", err))
+		}
+		return false
+	}
+	return true
+}
+
+// writeJSON 以 JSON 格式写入响应
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError 写入 {"error": "..."} 格式的错误响应
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, APIError{Error: message})
+}
@@ -0,0 +1,207 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"monitoring_system/database"
+)
+
+// decodeResponse 检查状态码和 Content-Type 后解析 JSON 响应
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, status int, v any) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("状态码为 %d，期望 %d，响应: %s", rec.Code, status, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Content-Type 为 %q", contentType)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("解析响应出错: %v，响应: %s", err, rec.Body.String())
+	}
+}
+
+func TestAPIV1Errors(t *testing.T) {
+	setupStore(t)
+	// 已在 good_line 中的城市，用于 409
+	if rec := serve(t, http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("添加 good_line 的状态码为 %d", rec.Code)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		error  string // 期望错误信息包含的内容
+	}{
+		{"unknown_resource", http.MethodGet, "/api/v1/unknown", "", http.StatusNotFound, "接口不存在"},
+		{"unknown_action", http.MethodGet, "/api/v1/good_line/101/events", "", http.StatusNotFound, "接口不存在"},
+		{"empty_body", http.MethodPost, "/api/v1/good_line", "", http.StatusBadRequest, "请求体为空"},
+		{"invalid_json", http.MethodPost, "/api/v1/good_line", `{"city_id":`, http.StatusBadRequest, "解析请求体出错"},
+		{"unknown_field", http.MethodPost, "/api/v1/good_line", `{"city_id":101,"foo":1}`, http.StatusBadRequest, "解析请求体出错"},
+		{"missing_city_id", http.MethodPost, "/api/v1/good_line", `{}`, http.StatusBadRequest, "city_id 必须为正整数"},
+		{"unknown_city_id", http.MethodPost, "/api/v1/good_line", `{"city_id":999}`, http.StatusNotFound, "城市 999 不存在"},
+		{"duplicate_good_line", http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, http.StatusConflict, "城市 101 已在 good_line 中"},
+		{"non_numeric_city_id", http.MethodPatch, "/api/v1/good_line/abc", `{"note":"x"}`, http.StatusBadRequest, "无效的城市 ID: abc"},
+		{"missing_note", http.MethodPatch, "/api/v1/good_line/101", `{}`, http.StatusBadRequest, "缺少 note"},
+		{"annotate_missing_good_line", http.MethodPatch, "/api/v1/good_line/102", `{"note":"x"}`, http.StatusNotFound, "城市 102 不在 good_line 中"},
+		{"remove_missing_good_line", http.MethodDelete, "/api/v1/good_line/102", "", http.StatusNotFound, "城市 102 不在 good_line 中"},
+		{"invalid_outbound_ip", http.MethodPost, "/api/v1/bad_line", `{"city_id":101,"outbound_ip":"1.2.3"}`, http.StatusBadRequest, "无效的出口 IP"},
+		{"bad_line_unknown_city", http.MethodPost, "/api/v1/bad_line", `{"city_id":999,"outbound_ip":"1.2.3.4"}`, http.StatusNotFound, "城市 999 不存在"},
+		{"remove_missing_bad_line", http.MethodDelete, "/api/v1/bad_line/1.2.3.4", "", http.StatusNotFound, "不在 bad_line 中"},
+		{"bad_ips_invalid_city_param", http.MethodDelete, "/api/v1/bad_ips/1.2.3.4?city_id=x", "", http.StatusBadRequest, "无效的城市 ID: x"},
+		{"remove_missing_bad_ip", http.MethodDelete, "/api/v1/bad_ips/1.2.3.4", "", http.StatusNotFound, "不在 bad_ips 中"},
+		{"download_url_bad_scheme", http.MethodPost, "/api/v1/download_urls", `{"url":"ftp://example.com/file"}`, http.StatusBadRequest, "只支持 http 和 https"},
+		{"download_url_missing_host", http.MethodPost, "/api/v1/download_urls", `{"url":"http:///file"}`, http.StatusBadRequest, "缺少主机名"},
+		{"download_url_empty", http.MethodPost, "/api/v1/download_urls", `{"note":"x"}`, http.StatusBadRequest, "url 不能为空"},
+		{"download_url_non_numeric_id", http.MethodDelete, "/api/v1/download_urls/abc", "", http.StatusBadRequest, "无效的下载地址 ID: abc"},
+		{"download_url_unknown_id", http.MethodDelete, "/api/v1/download_urls/42", "", http.StatusNotFound, "下载地址 42 不存在"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp APIError
+			decodeResponse(t, serve(t, tt.method, tt.target, tt.body, nil), tt.status, &resp)
+			if !strings.Contains(resp.Error, tt.error) {
+				t.Fatalf("错误信息为 %q，期望包含 %q", resp.Error, tt.error)
+			}
+		})
+	}
+}
+
+func TestAPIV1MethodNotAllowed(t *testing.T) {
+	setupStore(t)
+	tests := []struct {
+		method string
+		target string
+		allow  string
+	}{
+		{http.MethodDelete, "/api/v1/good_line", "GET, POST"},
+		{http.MethodGet, "/api/v1/good_line/101", "PATCH, DELETE"},
+		{http.MethodPut, "/api/v1/download_urls/1", "PATCH, DELETE"},
+		{http.MethodPost, "/api/v1/recheck_queue", "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rec := serve(t, tt.method, tt.target, "", nil)
+			var resp APIError
+			decodeResponse(t, rec, http.StatusMethodNotAllowed, &resp)
+			if allow := rec.Header().Get("Allow"); allow != tt.allow {
+				t.Fatalf("Allow 为 %q，期望 %q", allow, tt.allow)
+			}
+			if !strings.Contains(resp.Error, "不支持 "+tt.method+" 方法") {
+				t.Fatalf("错误信息为 %q", resp.Error)
+			}
+		})
+	}
+}
+
+func TestAPIV1GoodLineRoundTrip(t *testing.T) {
+	db := setupStore(t)
+
+	var added database.GoodLineEntry
+	decodeResponse(t, serve(t, http.MethodPost, "/api/v1/good_line", `{"city_id":101,"note":"主力线路","reason":"人工确认"}`, nil), http.StatusCreated, &added)
+	want := database.GoodLineEntry{CityID: testCityID, CityName: "南京市电信", Note: "主力线路"}
+	if added != want {
+		t.Fatalf("添加后返回 %+v，期望 %+v", added, want)
+	}
+
+	var entries []database.GoodLineEntry
+	decodeResponse(t, serve(t, http.MethodGet, "/api/v1/good_line", "", nil), http.StatusOK, &entries)
+	if len(entries) != 1 || entries[0] != want {
+		t.Fatalf("good_line 为 %+v，期望 [%+v]", entries, want)
+	}
+
+	var annotated database.GoodLineEntry
+	decodeResponse(t, serve(t, http.MethodPatch, "/api/v1/good_line/101", `{"note":"备用线路"}`, nil), http.StatusOK, &annotated)
+	want.Note = "备用线路"
+	if annotated != want {
+		t.Fatalf("修改备注后返回 %+v，期望 %+v", annotated, want)
+	}
+
+	rec := serve(t, http.MethodDelete, "/api/v1/good_line/101?reason=线路下线", "", nil)
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Fatalf("删除的状态码为 %d，响应: %s", rec.Code, rec.Body.String())
+	}
+	decodeResponse(t, serve(t, http.MethodGet, "/api/v1/good_line", "", nil), http.StatusOK, &entries)
+	if len(entries) != 0 {
+		t.Fatalf("删除后 good_line 为 %+v", entries)
+	}
+
+	// 添加和删除都以 api 来源写入 line_events，未认证时原因不带操作人
+	events, err := db.LineEvents(database.LineEventQuery{CityID: testCityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("变更记录为 %+v，期望 2 条", events)
+	}
+	removed, inserted := events[0], events[1]
+	if inserted.Source != database.SourceAPI || inserted.Reason != "人工确认" || inserted.ToState != database.LineStateGoodLine {
+		t.Fatalf("添加的变更记录为 %+v", inserted)
+	}
+	if removed.Source != database.SourceAPI || removed.Reason != "线路下线" || removed.FromState != database.LineStateGoodLine {
+		t.Fatalf("删除的变更记录为 %+v", removed)
+	}
+}
+
+func TestAPIV1BadLineRoundTrip(t *testing.T) {
+	setupStore(t)
+
+	var added database.BadLineEntry
+	decodeResponse(t, serve(t, http.MethodPost, "/api/v1/bad_line", `{"city_id":101,"outbound_ip":"198.51.100.7"}`, nil), http.StatusCreated, &added)
+	want := database.BadLineEntry{OutboundIP: "198.51.100.7", CityID: testCityID}
+	if added != want {
+		t.Fatalf("添加后返回 %+v，期望 %+v", added, want)
+	}
+	var resp APIError
+	decodeResponse(t, serve(t, http.MethodPost, "/api/v1/bad_line", `{"city_id":102,"outbound_ip":"198.51.100.7"}`, nil), http.StatusConflict, &resp)
+
+	var annotated database.BadLineEntry
+	decodeResponse(t, serve(t, http.MethodPatch, "/api/v1/bad_line/198.51.100.7", `{"note":"丢包"}`, nil), http.StatusOK, &annotated)
+	want.Note = "丢包"
+	if annotated != want {
+		t.Fatalf("修改备注后返回 %+v，期望 %+v", annotated, want)
+	}
+	if rec := serve(t, http.MethodDelete, "/api/v1/bad_line/198.51.100.7", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("删除的状态码为 %d，响应: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIV1DownloadURLRoundTrip(t *testing.T) {
+	setupStore(t)
+
+	var added database.DownloadURL
+	decodeResponse(t, serve(t, http.MethodPost, "/api/v1/download_urls", `{"url":"https://example.com/100MB.bin","note":"测速"}`, nil), http.StatusCreated, &added)
+	if added.ID <= 0 || added.URL != "https://example.com/100MB.bin" || !added.Enabled || added.Note != "测速" {
+		t.Fatalf("添加后返回 %+v", added)
+	}
+
+	target := "/api/v1/download_urls/" + strconv.FormatInt(added.ID, 10)
+	var updated database.DownloadURL
+	decodeResponse(t, serve(t, http.MethodPatch, target, `{"enabled":false}`, nil), http.StatusOK, &updated)
+	if updated.ID != added.ID || updated.Enabled || updated.Note != "测速" {
+		t.Fatalf("停用后返回 %+v", updated)
+	}
+	var resp APIError
+	decodeResponse(t, serve(t, http.MethodPatch, target, `{"url":"https://example.com/other"}`, nil), http.StatusBadRequest, &resp)
+
+	var urls []database.DownloadURL
+	decodeResponse(t, serve(t, http.MethodGet, "/api/v1/download_urls", "", nil), http.StatusOK, &urls)
+	if len(urls) != 1 || urls[0].ID != added.ID || urls[0].Enabled {
+		t.Fatalf("下载地址为 %+v", urls)
+	}
+
+	if rec := serve(t, http.MethodDelete, target, "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("删除的状态码为 %d，响应: %s", rec.Code, rec.Body.String())
+	}
+	decodeResponse(t, serve(t, http.MethodGet, "/api/v1/download_urls", "", nil), http.StatusOK, &urls)
+	if len(urls) != 0 {
+		t.Fatalf("删除后下载地址为 %+v", urls)
+	}
+}
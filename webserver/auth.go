@@ -0,0 +1,248 @@
+package webserver
+
+import (
+	"context"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"monitoring_system/auth"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 网页服务器的认证，为 nil 时不校验身份，所有请求按 operator 处理
+var authenticator *auth.Auth
+
+// 访问日志，记录登录失败、被拒绝的请求和所有修改操作
+var accessLog = logrus.StandardLogger()
+
+// SetAuth 设置认证和访问日志，a 为 nil 时不校验身份
+func SetAuth(a *auth.Auth, log *logrus.Logger) {
+	authenticator = a
+	if log != nil {
+		accessLog = log
+	}
+}
+
+// anonymous 未配置认证时的调用方
+var anonymous = auth.Principal{Name: "anonymous", Role: auth.RoleOperator, Method: auth.MethodNone}
+
+type principalKey struct{}
+
+// withPrincipal 在请求的 context 中记录调用方
+func withPrincipal(ctx context.Context, principal *auth.Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFrom 返回请求的调用方，未经过 withAuth 时返回 anonymous
+func principalFrom(ctx context.Context) *auth.Principal {
+	if principal, ok := ctx.Value(principalKey{}).(*auth.Principal); ok {
+		return principal
+	}
+	return &anonymous
+}
+
+// publicPaths 无需登录即可访问的路径
+var publicPaths = map[string]bool{"/login": true, "/logout": true}
+
+// isMutating 判断请求是否会修改数据，/updateline/ 虽然是 GET 请求但会修改下载地址
+func isMutating(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return strings.HasPrefix(r.URL.Path, "/updateline/")
+	}
+	return true
+}
+
+// withAuth 校验请求的身份和角色：修改数据的请求需要 operator，其余需要 viewer。
+// 修改操作无论成功与否都写入访问日志
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal := &anonymous
+		if authenticator != nil {
+			var err error
+			principal, err = authenticator.Authenticate(r)
+			if err != nil {
+				logAccess(r, nil, http.StatusUnauthorized, 0).WithField("Error", err).Warn("【访问日志】认证失败")
+				unauthorized(w, r, err.Error())
+				return
+			}
+			if principal == nil {
+				unauthorized(w, r, "需要登录或提供 API Token")
+				return
+			}
+		}
+
+		mutating := isMutating(r)
+		required := auth.RoleViewer
+		if mutating {
+			required = auth.RoleOperator
+		}
+		if !auth.Allows(principal.Role, required) {
+			logAccess(r, principal, http.StatusForbidden, 0).Warn("【访问日志】权限不足")
+			writeAPIError(w, http.StatusForbidden, "权限不足，需要 "+required+" 角色")
+			return
+		}
+
+		r = r.WithContext(withPrincipal(r.Context(), principal))
+		if !mutating {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		logAccess(r, principal, recorder.status, time.Since(start)).Info("【访问日志】修改操作")
+	})
+}
+
+// unauthorized 未通过认证时，页面请求跳转到登录页，接口请求返回 401
+func unauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	if authenticator.HasUsers() && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="monitoring_system"`)
+	writeAPIError(w, http.StatusUnauthorized, message)
+}
+
+// logAccess 生成访问日志条目，principal 为 nil 表示未通过认证
+func logAccess(r *http.Request, principal *auth.Principal, status int, elapsed time.Duration) *logrus.Entry {
+	fields := logrus.Fields{
+		"Method": r.Method,
+		"Path":   r.URL.RequestURI(),
+		"Status": status,
+		"Remote": clientAddr(r),
+	}
+	if principal != nil {
+		fields["User"] = principal.Name
+		fields["Role"] = principal.Role
+		fields["Auth"] = principal.Method
+	}
+	if elapsed > 0 {
+		fields["Elapsed"] = elapsed.Round(time.Millisecond)
+	}
+	return accessLog.WithFields(fields)
+}
+
+// clientAddr 返回客户端地址，经过反向代理时附上 X-Forwarded-For
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return host + " (X-Forwarded-For: " + forwarded + ")"
+	}
+	return host
+}
+
+// statusRecorder 记录响应状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// loginPage 登录页的数据
+type loginPage struct {
+	Next     string
+	Username string
+	Error    string
+}
+
+// handleLogin 处理 /login，GET 展示登录页，POST 校验用户名密码并创建会话
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if authenticator == nil || !authenticator.HasUsers() {
+		http.Error(w, "未配置网页用户，无需登录", http.StatusNotFound)
+		return
+	}
+	page := loginPage{Next: safeNext(r.FormValue("next"))}
+	switch r.Method {
+	case http.MethodGet:
+		renderLogin(w, http.StatusOK, page)
+	case http.MethodPost:
+		page.Username = r.PostFormValue("username")
+		principal, err := authenticator.Login(page.Username, r.PostFormValue("password"))
+		if err != nil {
+			logAccess(r, nil, http.StatusUnauthorized, 0).WithField("Username", page.Username).Warn("【访问日志】登录失败")
+			page.Error = "用户名或密码错误"
+			renderLogin(w, http.StatusUnauthorized, page)
+			return
+		}
+		id, expires, err := authenticator.Sessions.Create(*principal)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// SameSite=Strict：其他站点发起的请求不携带会话，防止跨站请求调用修改接口
+		http.SetCookie(w, &http.Cookie{
+			Name:     auth.CookieName,
+			Value:    id,
+			Path:     "/",
+			Expires:  expires,
+			HttpOnly: true,
+			Secure:   authenticator.CookieSecure,
+			SameSite: http.SameSiteStrictMode,
+		})
+		logAccess(r, principal, http.StatusFound, 0).Info("【访问日志】登录成功")
+		http.Redirect(w, r, page.Next, http.StatusFound)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "不支持的请求方法", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLogout 处理 POST /logout，删除会话后跳转到登录页
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "不支持的请求方法", http.StatusMethodNotAllowed)
+		return
+	}
+	if authenticator != nil {
+		if cookie, err := r.Cookie(auth.CookieName); err == nil {
+			authenticator.Sessions.Delete(cookie.Value)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: auth.CookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// handleWhoami 处理 /whoami 请求，返回当前调用方
+func handleWhoami(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, principalFrom(r.Context()))
+}
+
+// renderLogin 渲染登录页
+func renderLogin(w http.ResponseWriter, status int, page loginPage) {
+	tmpl, err := template.ParseFiles("webserver/templates/login.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	tmpl.Execute(w, page)
+}
+
+// safeNext 只允许跳转到本站的路径，防止登录后被跳转到其他站点
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,286 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"monitoring_system/auth"
+	"monitoring_system/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	viewerToken   = "viewer-token-0123456789"
+	operatorToken = "operator-token-0123456789"
+	testPassword  = "secret-password"
+)
+
+// setupTestAuth 配置 viewer、operator 两个 Token 和两个网页用户，访问日志以 JSON 格式写入返回的缓冲区
+func setupTestAuth(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	hash, err := auth.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&buf)
+	log.SetFormatter(&logrus.JSONFormatter{})
+	setupAuth(t, config.AuthCFG{
+		Users: []config.UserCFG{
+			{Username: "alice", PasswordHash: hash, Role: auth.RoleOperator},
+			{Username: "bob", PasswordHash: hash, Role: auth.RoleViewer},
+		},
+		Tokens: []config.TokenCFG{
+			{Name: "viewer", Token: viewerToken, Role: auth.RoleViewer},
+			{Name: "operator", Token: operatorToken, Role: auth.RoleOperator},
+		},
+	}, log)
+	return &buf
+}
+
+// bearer 返回携带 API Token 的请求头
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// accessEntries 解析 JSON 格式的访问日志
+func accessEntries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("访问日志 %q 不是 JSON: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWithAuthRoles(t *testing.T) {
+	setupStore(t)
+	setupTestAuth(t)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header http.Header
+		want   int
+	}{
+		{"viewer_get", http.MethodGet, "/api/v1/good_line", "", bearer(viewerToken), http.StatusOK},
+		{"viewer_post", http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, bearer(viewerToken), http.StatusForbidden},
+		{"viewer_put", http.MethodPut, "/api/v1/good_line", `{"city_id":101}`, bearer(viewerToken), http.StatusForbidden},
+		{"viewer_patch", http.MethodPatch, "/api/v1/good_line/101", `{"note":"x"}`, bearer(viewerToken), http.StatusForbidden},
+		{"viewer_delete", http.MethodDelete, "/api/v1/bad_line/198.51.100.1", "", bearer(viewerToken), http.StatusForbidden},
+		// /updateline/ 是 GET 请求，但会修改下载地址
+		{"viewer_updateline", http.MethodGet, "/updateline/http://example.com/file", "", bearer(viewerToken), http.StatusForbidden},
+		{"viewer_x_api_token", http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, http.Header{"X-Api-Token": {viewerToken}}, http.StatusForbidden},
+		{"operator_post", http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, bearer(operatorToken), http.StatusCreated},
+		// 通过认证后由接口校验参数
+		{"operator_updateline", http.MethodGet, "/updateline/ftp:", "", bearer(operatorToken), http.StatusBadRequest},
+		{"operator_delete", http.MethodDelete, "/api/v1/bad_line/198.51.100.1", "", bearer(operatorToken), http.StatusNotFound},
+		{"missing_token", http.MethodGet, "/api/v1/good_line", "", nil, http.StatusUnauthorized},
+		{"bad_token", http.MethodGet, "/api/v1/good_line", "", bearer("wrong-token-0123456789"), http.StatusUnauthorized},
+		{"bad_scheme", http.MethodGet, "/api/v1/good_line", "", http.Header{"Authorization": {"Basic " + operatorToken}}, http.StatusUnauthorized},
+		{"bad_session", http.MethodGet, "/api/v1/good_line", "", http.Header{"Cookie": {auth.CookieName + "=forged"}}, http.StatusUnauthorized},
+		// 接口请求即使接受 HTML 也不跳转
+		{"api_post_html", http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, http.Header{"Accept": {"text/html"}}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, tt.method, tt.target, tt.body, tt.header)
+			if rec.Code != tt.want {
+				t.Fatalf("状态码为 %d，期望 %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			switch tt.want {
+			case http.StatusUnauthorized:
+				if rec.Header().Get("WWW-Authenticate") == "" {
+					t.Fatal("401 响应缺少 WWW-Authenticate")
+				}
+				fallthrough
+			case http.StatusForbidden:
+				var apiErr APIError
+				if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil || apiErr.Error == "" {
+					t.Fatalf("响应不是 JSON 错误: %s", rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestUnauthorizedPageRedirectsToLogin(t *testing.T) {
+	setupStore(t)
+	setupTestAuth(t)
+
+	html := http.Header{"Accept": {"text/html,application/xhtml+xml"}}
+	for _, header := range []http.Header{html, {"Accept": html["Accept"], "Cookie": {auth.CookieName + "=forged"}}} {
+		rec := serve(t, http.MethodGet, "/cities/101?days=7", "", header)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("状态码为 %d，期望跳转到登录页", rec.Code)
+		}
+		if location := rec.Header().Get("Location"); location != "/login?next="+url.QueryEscape("/cities/101?days=7") {
+			t.Fatalf("跳转到 %s", location)
+		}
+	}
+
+	// 只配置 Token 时没有登录页，页面请求同样返回 401
+	setupAuth(t, config.AuthCFG{Tokens: []config.TokenCFG{{Token: viewerToken, Role: auth.RoleViewer}}}, nil)
+	if rec := serve(t, http.MethodGet, "/", "", html); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("状态码为 %d，期望 401", rec.Code)
+	}
+}
+
+func TestNoAuthConfigured(t *testing.T) {
+	setupAuth(t, config.AuthCFG{}, nil)
+	rec := serve(t, http.MethodGet, "/whoami", "", nil)
+	var principal auth.Principal
+	if err := json.Unmarshal(rec.Body.Bytes(), &principal); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || principal.Role != auth.RoleOperator || principal.Method != auth.MethodNone {
+		t.Fatalf("未配置认证时调用方为 %+v", principal)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/cities/101?days=7", "/cities/101?days=7"},
+		{"//evil.example.com/", "/"},
+		{"/\\evil.example.com", "/"},
+		{"https://evil.example.com/", "/"},
+		{"evil.example.com", "/"},
+		{"javascript:alert(1)", "/"},
+	}
+	for _, tt := range tests {
+		if got := safeNext(tt.next); got != tt.want {
+			t.Errorf("safeNext(%q) 为 %q，期望 %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+// login 以表单提交用户名和密码
+func login(t *testing.T, username, password, next string) *http.Response {
+	t.Helper()
+	form := url.Values{"username": {username}, "password": {password}, "next": {next}}
+	rec := serve(t, http.MethodPost, "/login", form.Encode(), http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
+	return rec.Result()
+}
+
+// sessionCookie 返回响应中设置的会话 Cookie
+func sessionCookie(t *testing.T, resp *http.Response) *http.Cookie {
+	t.Helper()
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == auth.CookieName {
+			return cookie
+		}
+	}
+	t.Fatal("响应没有设置会话 Cookie")
+	return nil
+}
+
+func TestLoginLogout(t *testing.T) {
+	setupStore(t)
+	setupTestAuth(t)
+
+	// 登录后跳转到 next，其他站点的地址改为跳转到首页
+	resp := login(t, "bob", testPassword, "//evil.example.com/")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("登录后状态码 %d，跳转到 %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	cookie := sessionCookie(t, resp)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("会话 Cookie 为 %+v", cookie)
+	}
+	if resp := login(t, "bob", testPassword, "/line_events"); resp.Header.Get("Location") != "/line_events" {
+		t.Fatalf("登录后跳转到 %s，期望 /line_events", resp.Header.Get("Location"))
+	}
+
+	withCookie := http.Header{"Cookie": {cookie.String()}}
+	rec := serve(t, http.MethodGet, "/whoami", "", withCookie)
+	var principal auth.Principal
+	if err := json.Unmarshal(rec.Body.Bytes(), &principal); err != nil || principal.Name != "bob" || principal.Method != auth.MethodSession {
+		t.Fatalf("登录后调用方为 %+v, %v", principal, err)
+	}
+	// viewer 的会话同样不能修改数据
+	if rec := serve(t, http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, withCookie); rec.Code != http.StatusForbidden {
+		t.Fatalf("viewer 会话修改数据的状态码为 %d", rec.Code)
+	}
+
+	// 退出后 Cookie 被清除，服务端的会话失效
+	rec = serve(t, http.MethodPost, "/logout", "", withCookie)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("退出登录的状态码为 %d", rec.Code)
+	}
+	if cleared := sessionCookie(t, rec.Result()); cleared.Value != "" || cleared.MaxAge >= 0 {
+		t.Fatalf("退出后的 Cookie 为 %+v", cleared)
+	}
+	if rec := serve(t, http.MethodGet, "/whoami", "", withCookie); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("退出后使用原会话的状态码为 %d，期望 401", rec.Code)
+	}
+
+	// 密码错误和不存在的用户都返回 401，不设置 Cookie
+	for _, username := range []string{"bob", "mallory"} {
+		resp := login(t, username, "wrong-password", "/")
+		if resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) != 0 {
+			t.Fatalf("用户 %s 密码错误时状态码为 %d", username, resp.StatusCode)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	setupStore(t)
+	buf := setupTestAuth(t)
+
+	serve(t, http.MethodGet, "/api/v1/good_line", "", bearer(viewerToken))
+	serve(t, http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, bearer(viewerToken))
+	serve(t, http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, bearer(operatorToken))
+	serve(t, http.MethodPost, "/api/v1/good_line", `{"city_id":101}`, bearer(operatorToken))
+	serve(t, http.MethodGet, "/api/v1/good_line", "", bearer("wrong-token-0123456789"))
+	login(t, "alice", "wrong-password", "/")
+
+	// 只读请求不记录，修改操作无论成功与否都记录
+	want := []struct {
+		msg    string
+		status float64
+		user   string
+	}{
+		{"【访问日志】权限不足", http.StatusForbidden, "viewer"},
+		{"【访问日志】修改操作", http.StatusCreated, "operator"},
+		{"【访问日志】修改操作", http.StatusConflict, "operator"},
+		{"【访问日志】认证失败", http.StatusUnauthorized, ""},
+		{"【访问日志】登录失败", http.StatusUnauthorized, ""},
+	}
+	entries := accessEntries(t, buf)
+	if len(entries) != len(want) {
+		t.Fatalf("访问日志 %d 条，期望 %d 条: %s", len(entries), len(want), buf.String())
+	}
+	for i, w := range want {
+		entry := entries[i]
+		user, _ := entry["User"].(string)
+		if entry["msg"] != w.msg || entry["Status"] != w.status || user != w.user {
+			t.Errorf("第 %d 条访问日志为 %v，期望 %s 状态码 %v 用户 %q", i+1, entry, w.msg, w.status, w.user)
+		}
+		if entry["Method"] != http.MethodPost && entry["Method"] != http.MethodGet {
+			t.Errorf("第 %d 条访问日志缺少请求方法: %v", i+1, entry)
+		}
+	}
+	if entries[1]["Role"] != auth.RoleOperator || entries[1]["Auth"] != auth.MethodToken || entries[1]["Path"] != "/api/v1/good_line" {
+		t.Errorf("修改操作的访问日志为 %v", entries[1])
+	}
+}
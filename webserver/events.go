@@ -0,0 +1,93 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"monitoring_system/events"
+)
+
+const (
+	eventsHeartbeat = 15 * time.Second // 心跳间隔，防止代理因长时间无数据断开连接
+	eventsRetry     = 3000             // 建议浏览器断线后的重连间隔（毫秒）
+	maxEventsRecent = 200
+)
+
+// handleEvents 处理 /events 请求，以 Server-Sent Events 推送事件总线上的事件。
+// 断线重连时浏览器携带 Last-Event-ID，回放之后的事件。新连接可以用 ?recent=N 回放最近 N 条事件
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持流式响应", http.StatusInternalServerError)
+		return
+	}
+
+	var lastID int64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Last-Event-ID 格式错误", http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+	recent := 0
+	if v := r.URL.Query().Get("recent"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "recent 参数格式错误", http.StatusBadRequest)
+			return
+		}
+		recent = min(n, maxEventsRecent)
+	}
+
+	replay, ch, cancel := events.Default.Subscribe(lastID, recent)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+	for _, event := range replay {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent 按 SSE 格式写入一条事件，data 为整条事件的 JSON
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -0,0 +1,179 @@
+package webserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"monitoring_system/database"
+)
+
+const (
+	defaultHistoryRange = 24 * time.Hour
+	minHistoryStep      = time.Minute
+	maxHistoryBuckets   = 2000 // 单次查询最多返回的区间数
+	targetHistoryPoints = 300  // 未指定 step 时按不超过该点数选择区间长度
+)
+
+// historySteps 未指定 step 时可选的区间长度
+var historySteps = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// CityHistoryResponse /api/cities/{id}/history 的响应
+type CityHistoryResponse struct {
+	City    database.CityInfo        `json:"city"`
+	From    time.Time                `json:"from"`
+	To      time.Time                `json:"to"`
+	Step    int64                    `json:"step"` // 区间长度（秒）
+	Buckets []database.HistoryBucket `json:"buckets"`
+}
+
+// handleCityAPI 处理 /api/cities/{id}/history 请求，按区间返回城市下载速率、响应时间和成功率的最小值、平均值、最大值和 P95。
+// 参数 from、to 为 Unix 秒、RFC3339 或 YYYY-MM-DDTHH:MM（东八区），默认最近 24 小时；
+// step 为区间长度，如 5m、1h 或秒数，默认按时间范围自动选择
+func handleCityAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/cities/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	cityID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("无效的城市 ID: %s", parts[0]), http.StatusBadRequest)
+		return
+	}
+	from, to, step, err := parseHistoryRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	city, err := store.GetCity(cityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("城市 %d 不存在", cityID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buckets, err := store.CityHistory(cityID, from, to, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if buckets == nil {
+		buckets = []database.HistoryBucket{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(CityHistoryResponse{
+		City:    city,
+		From:    from,
+		To:      to,
+		Step:    int64(step / time.Second),
+		Buckets: buckets,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseHistoryRange 解析 from、to、step 参数
+func parseHistoryRange(r *http.Request) (from, to time.Time, step time.Duration, err error) {
+	to = time.Now()
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = parseHistoryTime(v); err != nil {
+			return from, to, step, fmt.Errorf("无效的 to: %s", v)
+		}
+	}
+	from = to.Add(-defaultHistoryRange)
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = parseHistoryTime(v); err != nil {
+			return from, to, step, fmt.Errorf("无效的 from: %s", v)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, step, fmt.Errorf("from 必须早于 to")
+	}
+
+	span := to.Sub(from)
+	if v := r.URL.Query().Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil {
+			seconds, convErr := strconv.Atoi(v)
+			if convErr != nil {
+				return from, to, step, fmt.Errorf("无效的 step: %s，请使用 5m、1h 或秒数", v)
+			}
+			step = time.Duration(seconds) * time.Second
+		}
+		if step < minHistoryStep {
+			return from, to, step, fmt.Errorf("step 不能小于 %s", minHistoryStep)
+		}
+		if span/step > maxHistoryBuckets {
+			return from, to, step, fmt.Errorf("时间范围内的区间数超过 %d，请增大 step", maxHistoryBuckets)
+		}
+		return from, to, step.Truncate(time.Second), nil
+	}
+
+	step = historySteps[len(historySteps)-1]
+	for _, candidate := range historySteps {
+		if span/candidate <= targetHistoryPoints {
+			step = candidate
+			break
+		}
+	}
+	if span/step > maxHistoryBuckets {
+		return from, to, step, fmt.Errorf("时间范围过大，区间数超过 %d，请指定更大的 step", maxHistoryBuckets)
+	}
+	return from, to, step, nil
+}
+
+// parseHistoryTime 解析 Unix 秒、RFC3339 或页面输入的东八区时间
+func parseHistoryTime(v string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04", v, displayLocation())
+}
+
+// showCity 处理 /cities/{id} 请求，展示城市的历史检测结果曲线
+func showCity(w http.ResponseWriter, r *http.Request) {
+	idText := strings.Trim(strings.TrimPrefix(r.URL.Path, "/cities/"), "/")
+	cityID, err := strconv.Atoi(idText)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("无效的城市 ID: %s", idText), http.StatusBadRequest)
+		return
+	}
+	city, err := store.GetCity(cityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("城市 %d 不存在", cityID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("webserver/templates/city.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.Execute(w, city)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,104 @@
+package webserver
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"monitoring_system/database"
+	"monitoring_system/metrics"
+)
+
+// 抓取时从数据库和调度器读取的指标，名称、标签见各指标的 HELP
+const (
+	cityDownloadRateHelp     = "城市最近一次检测的平均下载速率（Mbps）。标签 city_id: 城市 ID，province: 省份名称（去掉省、市等后缀），city: 城市名称"
+	citySuccessRateHelp      = "城市最近一次检测的 SOCKS5 成功率（百分比）。标签 city_id、province、city 同 monitoring_city_download_rate_mbps"
+	cityResponseTimeHelp     = "城市最近一次检测的 SOCKS5 平均响应时间（毫秒），全部失败时为 -1。标签 city_id、province、city 同 monitoring_city_download_rate_mbps"
+	provinceDownloadRateHelp = "省份内各城市最近一次检测的平均下载速率的平均值（Mbps）。标签 province: 省份名称"
+	provinceSuccessRateHelp  = "省份内各城市最近一次检测的 SOCKS5 成功率的平均值（百分比）。标签 province: 省份名称"
+	provinceResponseTimeHelp = "省份内各城市最近一次检测的 SOCKS5 平均响应时间的平均值（毫秒），与首页一致，失败城市按 -1 计入。标签 province: 省份名称"
+	lineRowsHelp             = "线路表中的记录数。标签 table: good_line、bad_line，或 bad_ips（只统计未过期的记录）"
+	exitErrorCitiesHelp      = "复查队列中等待复查的城市数（下载出现退出码 18、28、97 的城市）"
+	exitErrorIPsHelp         = "复查队列中等待复查的出口 IP 数"
+)
+
+// handleMetrics 处理 /metrics 请求，按 Prometheus 文本格式输出各城市、省份的最新检测结果，
+// 线路表记录数、复查队列大小，以及各包注册的接口调用和探测指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := writeStoreMetrics(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := metrics.Default.WriteText(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.Write(buf.Bytes())
+}
+
+// writeStoreMetrics 输出从数据库查询的城市、省份检测结果、线路表记录数和复查队列大小
+func writeStoreMetrics(buf *bytes.Buffer) error {
+	cities, err := queryCities("", "", "download_rate", database.ProjectFilter{})
+	if err != nil {
+		return err
+	}
+	var downloadRate, successRate, responseTime []metrics.Sample
+	for _, city := range cities {
+		labels := []metrics.Label{
+			{Name: "city_id", Value: strconv.Itoa(city.CityID)},
+			{Name: "province", Value: removeProvinceSuffix(city.ProvinceName)},
+			{Name: "city", Value: city.Name},
+		}
+		downloadRate = append(downloadRate, metrics.Sample{Labels: labels, Value: city.DownloadRate})
+		successRate = append(successRate, metrics.Sample{Labels: labels, Value: city.AvgSuccessRate})
+		responseTime = append(responseTime, metrics.Sample{Labels: labels, Value: float64(city.AvgResponseTime)})
+	}
+	metrics.WriteFamily(buf, "monitoring_city_download_rate_mbps", cityDownloadRateHelp, metrics.TypeGauge, downloadRate)
+	metrics.WriteFamily(buf, "monitoring_city_success_rate_percent", citySuccessRateHelp, metrics.TypeGauge, successRate)
+	metrics.WriteFamily(buf, "monitoring_city_response_time_ms", cityResponseTimeHelp, metrics.TypeGauge, responseTime)
+
+	downloadRate, successRate, responseTime = nil, nil, nil
+	for _, province := range calculateProvinceAverages(cities) {
+		labels := []metrics.Label{{Name: "province", Value: province.Name}}
+		downloadRate = append(downloadRate, metrics.Sample{Labels: labels, Value: province.AvgDownloadRate})
+		successRate = append(successRate, metrics.Sample{Labels: labels, Value: province.AvgSuccessRate})
+		responseTime = append(responseTime, metrics.Sample{Labels: labels, Value: float64(province.AvgResponseTime)})
+	}
+	metrics.WriteFamily(buf, "monitoring_province_download_rate_mbps", provinceDownloadRateHelp, metrics.TypeGauge, downloadRate)
+	metrics.WriteFamily(buf, "monitoring_province_success_rate_percent", provinceSuccessRateHelp, metrics.TypeGauge, successRate)
+	metrics.WriteFamily(buf, "monitoring_province_response_time_ms", provinceResponseTimeHelp, metrics.TypeGauge, responseTime)
+
+	goodLine, err := store.GoodLineCityIDs(database.ProjectFilter{}, false)
+	if err != nil {
+		return err
+	}
+	badLine, err := store.BadLineEntries(database.ProjectFilter{})
+	if err != nil {
+		return err
+	}
+	badIPs, err := store.BadIPEntries(database.ProjectFilter{}, badIPTTL)
+	if err != nil {
+		return err
+	}
+	activeBadIPs := 0
+	for _, entry := range badIPs {
+		if !entry.Expired {
+			activeBadIPs++
+		}
+	}
+	metrics.WriteFamily(buf, "monitoring_line_rows", lineRowsHelp, metrics.TypeGauge, []metrics.Sample{
+		{Labels: []metrics.Label{{Name: "table", Value: "good_line"}}, Value: float64(len(goodLine))},
+		{Labels: []metrics.Label{{Name: "table", Value: "bad_line"}}, Value: float64(len(badLine))},
+		{Labels: []metrics.Label{{Name: "table", Value: "bad_ips"}}, Value: float64(activeBadIPs)},
+	})
+
+	recheckCities, recheckIPs, err := store.RecheckQueueSize()
+	if err != nil {
+		return err
+	}
+	metrics.WriteFamily(buf, "monitoring_exit_error_cities", exitErrorCitiesHelp, metrics.TypeGauge, []metrics.Sample{{Value: float64(recheckCities)}})
+	return metrics.WriteFamily(buf, "monitoring_exit_error_ips", exitErrorIPsHelp, metrics.TypeGauge, []metrics.Sample{{Value: float64(recheckIPs)}})
+}
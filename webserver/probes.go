@@ -0,0 +1,214 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"monitoring_system/jobs"
+)
+
+const (
+	defaultProbeJobsLimit = 50
+	maxProbeJobsLimit     = 200
+)
+
+// 按需检测任务管理器，未设置时 /api/v1/probes 返回 503
+var probeJobs *jobs.Manager
+
+// SetProbeJobs 设置按需检测任务管理器，需在 StartWebServer 之前调用
+func SetProbeJobs(m *jobs.Manager) {
+	probeJobs = m
+}
+
+// probeRequest 发起按需检测的请求体
+type probeRequest struct {
+	CityID  int      `json:"city_id"`
+	TradeID int      `json:"trade_id"` // 为 0 时使用城市所属项目的第一个 TradeID
+	Types   []string `json:"types"`    // 为空时执行全部已配置的探测器
+}
+
+// probeJobsAvailable 未设置任务管理器时写入 503 并返回 false
+func probeJobsAvailable(w http.ResponseWriter) bool {
+	if probeJobs == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "未启用按需检测")
+		return false
+	}
+	return true
+}
+
+// probeJobID 返回路径中的任务 ID，如 /api/v1/probes/{id}/events 中的 {id}
+func probeJobID(r *http.Request) string {
+	id, _, _ := strings.Cut(apiKey(r), "/")
+	return id
+}
+
+// listProbeJobs GET /api/v1/probes?city_id=&limit=，按创建时间倒序返回最近的任务
+func listProbeJobs(w http.ResponseWriter, r *http.Request) {
+	if !probeJobsAvailable(w) {
+		return
+	}
+	cityID := 0
+	if v := r.URL.Query().Get("city_id"); v != "" {
+		var ok bool
+		if cityID, ok = parseAPICityID(w, v); !ok {
+			return
+		}
+	}
+	limit := defaultProbeJobsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("无效的 limit: %s", v))
+			return
+		}
+		limit = min(n, maxProbeJobsLimit)
+	}
+	writeJSON(w, http.StatusOK, probeJobs.List(cityID, limit))
+}
+
+// submitProbeJob POST /api/v1/probes，发起按需检测，返回 202 和任务，Location 为任务地址
+func submitProbeJob(w http.ResponseWriter, r *http.Request) {
+	if !probeJobsAvailable(w) {
+		return
+	}
+	var req probeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.CityID <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "city_id 必须为正整数")
+		return
+	}
+	if req.TradeID < 0 {
+		writeAPIError(w, http.StatusBadRequest, "trade_id 不能为负数")
+		return
+	}
+
+	job, err := probeJobs.Submit(jobs.Request{CityID: req.CityID, TradeID: req.TradeID, Types: req.Types}, principalFrom(r.Context()).Name)
+	switch {
+	case errors.Is(err, jobs.ErrInvalidRequest):
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, jobs.ErrQueueFull):
+		w.Header().Set("Retry-After", "30")
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/v1/probes/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// getProbeJob GET /api/v1/probes/{id}，返回任务的状态、进度和结果，用于轮询
+func getProbeJob(w http.ResponseWriter, r *http.Request) {
+	if !probeJobsAvailable(w) {
+		return
+	}
+	job, err := probeJobs.Get(probeJobID(r))
+	if err != nil {
+		writeProbeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// cancelProbeJob DELETE /api/v1/probes/{id}，取消等待中或执行中的任务
+func cancelProbeJob(w http.ResponseWriter, r *http.Request) {
+	if !probeJobsAvailable(w) {
+		return
+	}
+	job, err := probeJobs.Cancel(probeJobID(r), principalFrom(r.Context()).Name)
+	if err != nil {
+		writeProbeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// streamProbeJob GET /api/v1/probes/{id}/events，以 Server-Sent Events 推送任务快照，
+// 每次状态或进度变化推送一条 event: job，任务结束后推送 event: done 并关闭连接
+func streamProbeJob(w http.ResponseWriter, r *http.Request) {
+	if !probeJobsAvailable(w) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "不支持流式响应")
+		return
+	}
+	id := probeJobID(r)
+	job, changed, err := probeJobs.Watch(id)
+	if err != nil {
+		writeProbeJobError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		eventType := "job"
+		if job.Finished() {
+			eventType = "done"
+		}
+		if err := writeJobEvent(w, eventType, job); err != nil {
+			return
+		}
+		flusher.Flush()
+		if job.Finished() {
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-changed:
+				break wait
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if job, changed, err = probeJobs.Watch(id); err != nil {
+			return
+		}
+	}
+}
+
+// writeJobEvent 按 SSE 格式写入任务快照
+func writeJobEvent(w http.ResponseWriter, eventType string, job jobs.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	return err
+}
+
+// writeProbeJobError 按任务错误写入响应
+func writeProbeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, jobs.ErrFinished):
+		writeAPIError(w, http.StatusConflict, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	}
+}
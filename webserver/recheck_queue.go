@@ -0,0 +1,110 @@
+package webserver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"monitoring_system/database"
+)
+
+// recheckPriorityRequest 修改复查优先级的请求体
+type recheckPriorityRequest struct {
+	Priority *int `json:"priority"` // 越大越先复查，默认为 0
+}
+
+// listRecheckQueue GET /api/v1/recheck_queue，按复查顺序返回等待复查的城市及其出口 IP
+func listRecheckQueue(w http.ResponseWriter, r *http.Request) {
+	entries, err := store.RecheckQueue()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []database.RecheckEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// getRecheckEntry GET /api/v1/recheck_queue/{city_id}
+func getRecheckEntry(w http.ResponseWriter, r *http.Request) {
+	entry, ok := lookupRecheckEntry(w, apiKey(r))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// prioritizeRecheck PATCH /api/v1/recheck_queue/{city_id}，修改城市的复查优先级
+func prioritizeRecheck(w http.ResponseWriter, r *http.Request) {
+	entry, ok := lookupRecheckEntry(w, apiKey(r))
+	if !ok {
+		return
+	}
+	var req recheckPriorityRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Priority == nil {
+		writeAPIError(w, http.StatusBadRequest, "缺少 priority")
+		return
+	}
+	err := store.SetRecheckPriority(entry.CityID, *req.Priority)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("城市 %d 不在复查队列中", entry.CityID))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	entry.Priority = *req.Priority
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// removeRecheck DELETE /api/v1/recheck_queue/{city_id}?outbound_ip=，未指定 outbound_ip 时将城市移出复查队列
+func removeRecheck(w http.ResponseWriter, r *http.Request) {
+	cityID, ok := parseAPICityID(w, apiKey(r))
+	if !ok {
+		return
+	}
+	ip := ""
+	if v := r.URL.Query().Get("outbound_ip"); v != "" {
+		if ip, ok = parseAPIIP(w, v); !ok {
+			return
+		}
+	}
+	err := store.RemoveRecheck(cityID, ip)
+	if errors.Is(err, sql.ErrNoRows) {
+		if ip != "" {
+			writeAPIError(w, http.StatusNotFound, fmt.Sprintf("城市 %d 的出口 IP %s 不在复查队列中", cityID, ip))
+		} else {
+			writeAPIError(w, http.StatusNotFound, fmt.Sprintf("城市 %d 不在复查队列中", cityID))
+		}
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookupRecheckEntry 解析路径中的城市 ID 并查询复查队列，出错时写入响应并返回 false
+func lookupRecheckEntry(w http.ResponseWriter, key string) (database.RecheckEntry, bool) {
+	cityID, ok := parseAPICityID(w, key)
+	if !ok {
+		return database.RecheckEntry{}, false
+	}
+	entry, err := store.GetRecheckEntry(cityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("城市 %d 不在复查队列中", cityID))
+		return entry, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return entry, false
+	}
+	return entry, true
+}
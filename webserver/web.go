@@ -1,22 +1,78 @@
 package webserver
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"monitoring_system/config"
 	"monitoring_system/database"
+	"monitoring_system/http_requests"
+	"monitoring_system/ipgroup"
+	"monitoring_system/scheduler"
+)
+
+// 与检测线程共用的存储
+var store database.Store
+
+// 城市调度器，用于展示调度队列
+var citySchedule *scheduler.Scheduler
+
+// 配置的项目列表，页面和接口按项目名称筛选
+var projects []config.ProjectCFG
+
+// 上游接口限流器，用于展示限流与熔断状态
+var apiThrottle *http_requests.Throttle
+
+// 出口 IP 分组分析器，用于展示网段和 ASN 的失败率
+var ipGroups *ipgroup.Analyzer
+
+// bad_ips 的过期时间
+var badIPTTL = config.DefaultBadIPTTL
 
-	_ "github.com/mattn/go-sqlite3"
+const (
+	schedulerQueueSize    = 20              // 页面展示的调度队列长度
+	shutdownTimeout       = 5 * time.Second // 服务退出时等待进行中请求的最长时间
+	defaultLineEventLimit = 100             // 变更记录每页条数
+	maxLineEventLimit     = 1000            // 变更记录单次查询的最大条数
 )
 
-// 全局数据库连接池
-var db *sql.DB
+// SetStore 设置存储，需在 StartWebServer 之前调用
+func SetStore(s database.Store) {
+	store = s
+}
+
+// SetScheduler 设置城市调度器，需在 StartWebServer 之前调用
+func SetScheduler(s *scheduler.Scheduler) {
+	citySchedule = s
+}
+
+// SetProjects 设置可筛选的项目列表，需在 StartWebServer 之前调用
+func SetProjects(p []config.ProjectCFG) {
+	projects = p
+}
+
+// SetIPGroups 设置出口 IP 分组分析器，需在 StartWebServer 之前调用
+func SetIPGroups(a *ipgroup.Analyzer) {
+	ipGroups = a
+}
+
+// SetBadIPTTL 设置 bad_ips 的过期时间，用于计算接口返回的过期时间，需在 StartWebServer 之前调用
+func SetBadIPTTL(ttl time.Duration) {
+	badIPTTL = ttl
+}
+
+// SetThrottle 设置上游接口限流器，需在 StartWebServer 之前调用
+func SetThrottle(t *http_requests.Throttle) {
+	apiThrottle = t
+}
 
 // 去除省份名称后缀
 func removeProvinceSuffix(name string) string {
@@ -63,16 +119,6 @@ func calculateProvinceAverages(cities []CityData) []ProvinceData {
 	}
 	return provinces
 }
-func init() {
-	var err error
-	db, err = sql.Open("sqlite3", "./monitor.db")
-	if err != nil {
-		log.Fatalf("打开数据库出错: %v", err)
-	}
-	// 设置连接池的最大连接数等参数
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(5)
-}
 
 // ProvinceData 省份数据结构体
 type ProvinceData struct {
@@ -85,12 +131,15 @@ type ProvinceData struct {
 
 // CityData 城市数据结构体
 type CityData struct {
+	CityID          int
 	Name            string
 	AvgSuccessRate  float64
 	AvgResponseTime int64
 	LastUpdateTime  string
+	LastTestedAge   string // 距上次检测的时间
 	ProvinceName    string
 	DownloadRate    float64
+	database.PhaseTimes
 }
 
 // CurrentNodeInfo 用于存储当前节点信息
@@ -100,103 +149,84 @@ type CurrentNodeInfo struct {
 	TestTime   string
 }
 
-// 查询城市数据的函数，封装了日期筛选和非筛选的逻辑
-func queryCities(startTimeStr, endTimeStr, sortBy string) ([]CityData, error) {
-	var allCities []CityData
-	var query string
-	var args []interface{}
-	var timeCondition string
-
-	orderBy := ""
-	if sortBy == "download_rate" {
-		orderBy = "latest.download_rate DESC"
-	} else if sortBy == "response_time" {
-		orderBy = "latest.avg_response_time ASC"
+// displayLocation 页面展示和时间筛选使用的时区，数据库中保存的是 UTC 时间
+func displayLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		return time.Local
 	}
+	return loc
+}
 
+// 查询城市数据的函数，封装了日期筛选和非筛选的逻辑
+func queryCities(startTimeStr, endTimeStr, sortBy string, filter database.ProjectFilter) ([]CityData, error) {
+	// 定义东八区时区
+	loc := displayLocation()
+
+	var start, end time.Time
 	if startTimeStr != "" && endTimeStr != "" {
-		// 用户使用了筛选功能
-		startTime, err := time.Parse("2006-01-02T15:04", startTimeStr)
+		// 用户使用了筛选功能，页面输入的是东八区时间
+		var err error
+		start, err = time.ParseInLocation("2006-01-02T15:04", startTimeStr, loc)
 		if err != nil {
 			log.Printf("解析开始时间出错: %v", err)
 			return nil, fmt.Errorf("无效的开始时间格式，请使用 YYYY-MM-DDTHH:MM 格式")
 		}
-		endTime, err := time.Parse("2006-01-02T15:04", endTimeStr)
+		end, err = time.ParseInLocation("2006-01-02T15:04", endTimeStr, loc)
 		if err != nil {
 			log.Printf("解析结束时间出错: %v", err)
 			return nil, fmt.Errorf("无效的结束时间格式，请使用 YYYY-MM-DDTHH:MM 格式")
 		}
-
-		// 将解析后的时间转换为数据库存储的格式
-		formattedStartTime := startTime.Format("2006-01-02 15:04:00")
-		formattedEndTime := endTime.Format("2006-01-02 15:04:00")
-
-		timeCondition = "n.test_time BETWEEN ? AND ?"
-		args = []interface{}{formattedStartTime, formattedEndTime}
-	}
-
-	query = `
-        SELECT p.name, latest.name, latest.success_rate, latest.avg_response_time, latest.test_time, latest.download_rate
-        FROM provinces p
-        JOIN cities c ON p.id = c.area_id
-        JOIN (
-            SELECT c.name, n.success_rate, n.avg_response_time, n.test_time, n.download_rate
-            FROM cities c
-            JOIN node_test_results n ON c.name = n.node_name
-    `
-	if timeCondition != "" {
-		query += " WHERE " + timeCondition
 	}
-	query += `
-            GROUP BY c.name
-            HAVING n.test_time = MAX(n.test_time)
-        ) latest ON c.name = latest.name
-        ORDER BY p.name, ` + orderBy
 
-	rows, err := db.Query(query, args...)
+	results, err := store.LatestCityResults(start, end, sortBy, filter)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	// 定义东八区时区
-	loc, err := time.LoadLocation("Asia/Shanghai")
-	if err != nil {
-		return nil, err
-	}
-	for rows.Next() {
-		var provinceName string
-		var cityName string
-		var successRate float64
-		var avgResponseTime int64
-		var lastUpdateTimeStr string
-		var downloadRate float64
-		err := rows.Scan(&provinceName, &cityName, &successRate, &avgResponseTime, &lastUpdateTimeStr, &downloadRate)
-		if err != nil {
-			return nil, err
-		}
-
-		// 解析时间字符串，并使用东八区时区
-		lastUpdateTime, err := time.ParseInLocation("2006-01-02 15:04:05", lastUpdateTimeStr, loc)
-		if err != nil {
-			return nil, err
-		}
 
+	var allCities []CityData
+	for _, result := range results {
+		lastUpdateTime := result.TestTime.In(loc)
 		allCities = append(allCities, CityData{
-			Name:            cityName,
-			AvgSuccessRate:  successRate,
-			AvgResponseTime: avgResponseTime,
+			CityID:          result.CityID,
+			Name:            result.CityName,
+			AvgSuccessRate:  result.SuccessRate,
+			AvgResponseTime: result.AvgResponseTime,
 			LastUpdateTime:  lastUpdateTime.Format("2006-01-02 15:04:05"),
-			ProvinceName:    provinceName,
-			DownloadRate:    downloadRate,
+			LastTestedAge:   scheduler.FormatAge(lastUpdateTime, time.Now()),
+			ProvinceName:    result.ProvinceName,
+			DownloadRate:    result.DownloadRate,
+			PhaseTimes:      result.PhaseTimes,
 		})
 	}
+	return allCities, nil
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+// parseProjectFilter 根据 project 参数（项目名称）返回筛选条件，未指定时不筛选
+func parseProjectFilter(r *http.Request) (database.ProjectFilter, error) {
+	name := r.URL.Query().Get("project")
+	if name == "" {
+		return database.ProjectFilter{}, nil
+	}
+	for _, project := range projects {
+		if project.Name == name {
+			return database.ProjectFilterOf(project), nil
+		}
 	}
+	return database.ProjectFilter{}, fmt.Errorf("未知的项目: %s", name)
+}
 
-	return allCities, nil
+// queryCurrentNode 查询 filter 范围内最新的节点检测信息
+func queryCurrentNode(filter database.ProjectFilter) (CurrentNodeInfo, error) {
+	result, err := store.LatestNodeResult(filter)
+	if err != nil {
+		return CurrentNodeInfo{}, err
+	}
+	info := CurrentNodeInfo{NodeName: result.NodeName, OutboundIP: result.OutboundIP}
+	if !result.TestTime.IsZero() {
+		info.TestTime = result.TestTime.In(displayLocation()).Format("2006-01-02 15:04:05")
+	}
+	return info, nil
 }
 
 // 处理根路径请求，展示检测数据
@@ -212,7 +242,13 @@ func showTestResults(w http.ResponseWriter, r *http.Request) {
 	startTimeStr := r.URL.Query().Get("start-time")
 	endTimeStr := r.URL.Query().Get("end-time")
 
-	allCities, err := queryCities(startTimeStr, endTimeStr, sortBy)
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	allCities, err := queryCities(startTimeStr, endTimeStr, sortBy, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -233,14 +269,8 @@ func showTestResults(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 查询最新的节点检测信息
-	var currentNode CurrentNodeInfo
-	err = db.QueryRow(`
-        SELECT node_name, outbound_ip, test_time
-        FROM node_test_results
-        ORDER BY test_time DESC
-        LIMIT 1
-    `).Scan(&currentNode.NodeName, &currentNode.OutboundIP, &currentNode.TestTime)
-	if err != nil && err != sql.ErrNoRows {
+	currentNode, err := queryCurrentNode(filter)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -257,10 +287,14 @@ func showTestResults(w http.ResponseWriter, r *http.Request) {
 		Provinces   []ProvinceData
 		CurrentNode CurrentNodeInfo
 		Sort        string
+		Projects    []config.ProjectCFG
+		Project     string
 	}{
 		Provinces:   provinces,
 		CurrentNode: currentNode,
 		Sort:        sortBy,
+		Projects:    projects,
+		Project:     r.URL.Query().Get("project"),
 	}
 
 	// 执行模板并将数据传递给模板
@@ -271,10 +305,14 @@ func showTestResults(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// updateDownloadURL 处理更新下载 URL 的请求
+// updateDownloadURL 处理更新下载 URL 的请求，将其设为唯一的下载地址，管理多个下载地址使用 /api/v1/download_urls
 func updateDownloadURL(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Path[len("/updateline/"):]
-	err := database.SaveDownloadURL(db, url)
+	if err := validateDownloadURL(url); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := store.SaveDownloadURL(url)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -296,7 +334,13 @@ func getLatestData(w http.ResponseWriter, r *http.Request) {
 	startTimeStr := r.URL.Query().Get("start-time")
 	endTimeStr := r.URL.Query().Get("end-time")
 
-	allCities, err := queryCities(startTimeStr, endTimeStr, sortBy)
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	allCities, err := queryCities(startTimeStr, endTimeStr, sortBy, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -306,14 +350,8 @@ func getLatestData(w http.ResponseWriter, r *http.Request) {
 	provinces := calculateProvinceAverages(allCities)
 
 	// 查询最新的节点检测信息
-	var currentNode CurrentNodeInfo
-	err = db.QueryRow(`
-        SELECT node_name, outbound_ip, test_time
-        FROM node_test_results
-        ORDER BY test_time DESC
-        LIMIT 1
-    `).Scan(&currentNode.NodeName, &currentNode.OutboundIP, &currentNode.TestTime)
-	if err != nil && err != sql.ErrNoRows {
+	currentNode, err := queryCurrentNode(filter)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -344,10 +382,7 @@ type CityIDs struct {
 }
 
 // BadLineEntry 用于存储 bad_line 表中的一条记录
-type BadLineEntry struct {
-	OutboundIP string `json:"outbound_ip"`
-	CityID     int    `json:"city_id"`
-}
+type BadLineEntry = database.BadLineEntry
 
 // BadLineIPs 用于存储所有 bad_line 表记录的结构体
 type BadLineIPs struct {
@@ -355,48 +390,18 @@ type BadLineIPs struct {
 }
 
 // queryLines 通用的查询表数据的函数
-func queryLines(tableName string) (interface{}, error) {
+func queryLines(tableName string, filter database.ProjectFilter) (interface{}, error) {
 	if tableName == "good_line" {
-		var cityIDs []int
-		query := fmt.Sprintf("SELECT * FROM %s", tableName)
-		rows, err := db.Query(query)
+		cityIDs, err := store.GoodLineCityIDs(filter, false)
 		if err != nil {
 			return nil, err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var nullCityID sql.NullInt64
-			err := rows.Scan(&nullCityID)
-			if err != nil {
-				return nil, err
-			}
-			if nullCityID.Valid {
-				cityIDs = append(cityIDs, int(nullCityID.Int64))
-			}
-		}
 		return CityIDs{CityID: cityIDs}, nil
 	} else if tableName == "bad_line" {
-		var entries []BadLineEntry
-		query := fmt.Sprintf("SELECT * FROM %s", tableName)
-		rows, err := db.Query(query)
+		entries, err := store.BadLineEntries(filter)
 		if err != nil {
 			return nil, err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var entry BadLineEntry
-			var nullCityID sql.NullInt64
-			err := rows.Scan(&entry.OutboundIP, &nullCityID)
-			if err != nil {
-				return nil, err
-			}
-			if nullCityID.Valid {
-				entry.CityID = int(nullCityID.Int64)
-			}
-			entries = append(entries, entry)
-		}
 		return BadLineIPs{Entries: entries}, nil
 	}
 	return nil, fmt.Errorf("不支持的表名: %s", tableName)
@@ -404,7 +409,12 @@ func queryLines(tableName string) (interface{}, error) {
 
 // handleBadLines 处理 /bad_lines 请求
 func handleBadLines(w http.ResponseWriter, r *http.Request) {
-	result, err := queryLines("bad_line")
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := queryLines("bad_line", filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -419,9 +429,40 @@ func handleBadLines(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// BadIPs 用于返回 bad_ips 表记录的结构体
+type BadIPs struct {
+	Entries []database.BadIPEntry `json:"entries"`
+}
+
+// handleBadIPs 处理 /bad_ips 请求，返回 bad_ips 表中的出口 IP 及其命中时间、次数和过期时间
+func handleBadIPs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := store.BadIPEntries(filter, badIPTTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(BadIPs{Entries: entries})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 // handleGoodLines 处理 /good_lines 请求
 func handleGoodLines(w http.ResponseWriter, r *http.Request) {
-	result, err := queryLines("good_line")
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := queryLines("good_line", filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -436,20 +477,211 @@ func handleGoodLines(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// StartWebServer 启动 Web 服务器
-func StartWebServer(port int) {
-	// 注册路由
-	http.HandleFunc("/", showTestResults)
-	http.HandleFunc("/updateline/", updateDownloadURL)
-	http.HandleFunc("/latest-data", getLatestData)
-	http.HandleFunc("/good_lines", handleGoodLines)
-	http.HandleFunc("/bad_lines", handleBadLines)
+// handleScheduler 处理 /scheduler 请求，返回调度队列中优先级最高的城市
+func handleScheduler(w http.ResponseWriter, r *http.Request) {
+	if citySchedule == nil {
+		http.Error(w, "城市调度器未启用", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseProjectFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	queue, err := citySchedule.Queue(schedulerQueueSize, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(queue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleThrottle 处理 /throttle 请求，返回各 trade ID 变更节点和更换 IP 的限流与熔断状态
+func handleThrottle(w http.ResponseWriter, r *http.Request) {
+	if apiThrottle == nil {
+		http.Error(w, "接口限流未启用", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(apiThrottle.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseLineEventQuery 解析 city_id、before、limit 参数
+func parseLineEventQuery(r *http.Request) (database.LineEventQuery, error) {
+	q := database.LineEventQuery{Limit: defaultLineEventLimit}
+	var err error
+	if v := r.URL.Query().Get("city_id"); v != "" {
+		if q.CityID, err = strconv.Atoi(v); err != nil {
+			return q, fmt.Errorf("无效的 city_id: %s", v)
+		}
+	}
+	if v := r.URL.Query().Get("before"); v != "" {
+		if q.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return q, fmt.Errorf("无效的 before: %s", v)
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("无效的 limit: %s", v)
+		}
+		if q.Limit > maxLineEventLimit {
+			q.Limit = maxLineEventLimit
+		}
+	}
+	return q, nil
+}
+
+// handleLineEventsAPI 处理 /api/line_events 请求，按时间倒序返回 good_line、bad_line、bad_ips 的变更记录
+func handleLineEventsAPI(w http.ResponseWriter, r *http.Request) {
+	q, err := parseLineEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, err := store.LineEvents(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []database.LineEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// LineEventView 变更记录页面中的一行
+type LineEventView struct {
+	database.LineEvent
+	TimeText string
+}
 
+// showLineEvents 处理 /line_events 请求，展示指定城市的变更记录
+func showLineEvents(w http.ResponseWriter, r *http.Request) {
+	q, err := parseLineEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, err := store.LineEvents(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	loc := displayLocation()
+	views := make([]LineEventView, 0, len(events))
+	for _, event := range events {
+		views = append(views, LineEventView{LineEvent: event, TimeText: event.Time.In(loc).Format("2006-01-02 15:04:05")})
+	}
+	// 返回条数达到 limit 时提供下一页链接
+	var nextBefore int64
+	if len(events) == q.Limit {
+		nextBefore = events[len(events)-1].ID
+	}
+
+	tmpl, err := template.ParseFiles("webserver/templates/line_events.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Events     []LineEventView
+		CityID     int
+		NextBefore int64
+	}{
+		Events:     views,
+		CityID:     q.CityID,
+		NextBefore: nextBefore,
+	}
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleIPGroups 处理 /ip_groups 请求，返回按网段和 ASN 汇总的出口 IP 失败率
+func handleIPGroups(w http.ResponseWriter, r *http.Request) {
+	if ipGroups == nil {
+		http.Error(w, "出口 IP 分组分析未启用", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ipGroups.Report())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// newHandler 注册路由，返回经过认证的处理器
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", showTestResults)
+	mux.HandleFunc("/updateline/", updateDownloadURL)
+	mux.HandleFunc("/latest-data", getLatestData)
+	mux.HandleFunc("/good_lines", handleGoodLines)
+	mux.HandleFunc("/bad_lines", handleBadLines)
+	mux.HandleFunc("/bad_ips", handleBadIPs)
+	mux.HandleFunc("/ip_groups", handleIPGroups)
+	mux.HandleFunc("/scheduler", handleScheduler)
+	mux.HandleFunc("/throttle", handleThrottle)
+	mux.HandleFunc("/line_events", showLineEvents)
+	mux.HandleFunc("/api/line_events", handleLineEventsAPI)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/cities/", showCity)
+	mux.HandleFunc("/api/cities/", handleCityAPI)
+	mux.HandleFunc("/api/v1/", handleAPIV1)
+	mux.HandleFunc("/login", handleLogin)
+	mux.HandleFunc("/logout", handleLogout)
+	mux.HandleFunc("/whoami", handleWhoami)
+	return withAuth(mux)
+}
+
+// StartWebServer 启动 Web 服务器，ctx 被取消后停止接受新请求并等待进行中的请求完成
+func StartWebServer(ctx context.Context, port int) {
 	// 启动 Web 服务器，使用传入的端口
 	address := fmt.Sprintf(":%d", port)
+	server := &http.Server{
+		Addr:    address,
+		Handler: newHandler(),
+		// 请求的 context 随 ctx 取消，使 /events 等长连接在关闭时及时结束
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("关闭网页服务器出错: %v", err)
+		}
+	}()
+
 	log.Printf("网页服务器端口： %s", address)
-	err := http.ListenAndServe(address, nil)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
 }
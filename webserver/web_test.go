@@ -0,0 +1,93 @@
+package webserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"monitoring_system/auth"
+	"monitoring_system/config"
+	"monitoring_system/database"
+	"monitoring_system/http_requests"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 测试使用的城市，南京市电信在 cities 表中，未知城市不在
+const (
+	testCityID    = 101
+	unknownCityID = 999
+)
+
+// TestMain 切换到仓库根目录，页面模板按相对路径 webserver/templates 读取
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// setupStore 使用 SQLite 内存库作为网页服务器的存储，写入两个城市，测试结束时恢复
+func setupStore(t *testing.T) database.Store {
+	t.Helper()
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveProvinces([]http_requests.Province{{ID: 1, Name: "江苏省"}}); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []http_requests.Node{
+		{ID: testCityID, Name: "南京市电信", AreaID: 1},
+		{ID: 102, Name: "苏州市联通", AreaID: 1},
+	}
+	project := config.ProjectCFG{Name: "default", ProjectID: config.DefaultProjectID, LineID: config.DefaultLineID}
+	if err := db.SaveNodes(nodes, project); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := store
+	store = db
+	t.Cleanup(func() {
+		store = previous
+		db.Close()
+	})
+	return db
+}
+
+// setupAuth 启用认证和访问日志，测试结束时恢复为不校验身份
+func setupAuth(t *testing.T, cfg config.AuthCFG, log *logrus.Logger) *auth.Auth {
+	t.Helper()
+	a, err := auth.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousAuth, previousLog := authenticator, accessLog
+	SetAuth(a, log)
+	t.Cleanup(func() {
+		authenticator, accessLog = previousAuth, previousLog
+	})
+	return a
+}
+
+// serve 通过 newHandler 处理一个请求，header 为 nil 时不附加请求头
+func serve(t *testing.T, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	newHandler().ServeHTTP(rec, req)
+	return rec
+}